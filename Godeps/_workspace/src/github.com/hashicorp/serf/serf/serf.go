@@ -301,21 +301,15 @@ func Create(conf *Config) (*Serf, error) {
 	// Setup the various broadcast queues, which we use to send our own
 	// custom broadcasts along the gossip channel.
 	serf.broadcasts = &memberlist.TransmitLimitedQueue{
-		NumNodes: func() int {
-			return len(serf.members)
-		},
+		NumNodes:       serf.NumNodes,
 		RetransmitMult: conf.MemberlistConfig.RetransmitMult,
 	}
 	serf.eventBroadcasts = &memberlist.TransmitLimitedQueue{
-		NumNodes: func() int {
-			return len(serf.members)
-		},
+		NumNodes:       serf.NumNodes,
 		RetransmitMult: conf.MemberlistConfig.RetransmitMult,
 	}
 	serf.queryBroadcasts = &memberlist.TransmitLimitedQueue{
-		NumNodes: func() int {
-			return len(serf.members)
-		},
+		NumNodes:       serf.NumNodes,
 		RetransmitMult: conf.MemberlistConfig.RetransmitMult,
 	}
 
@@ -1551,6 +1545,13 @@ func (s *Serf) decodeTags(buf []byte) map[string]string {
 	return tags
 }
 
+// NumNodes returns the number of known members, for the broadcast queues
+func (s *Serf) NumNodes() int {
+	s.memberLock.RLock()
+	defer s.memberLock.RUnlock()
+	return len(s.members)
+}
+
 // Stats is used to provide operator debugging information
 func (s *Serf) Stats() map[string]string {
 	toString := func(v uint64) string {
@@ -91,7 +91,10 @@ START:
 	case streamRemoteClose:
 		fallthrough
 	case streamClosed:
-		if s.recvBuf.Len() == 0 {
+		s.recvLock.Lock()
+		empty := s.recvBuf.Len() == 0
+		s.recvLock.Unlock()
+		if empty {
 			s.stateLock.Unlock()
 			return 0, io.EOF
 		}
@@ -0,0 +1,467 @@
+package cerebrum
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/blacklabeldata/namedtuple"
+	"golang.org/x/net/context"
+)
+
+// ACL default policies. ACLs are disabled if no default policy is set.
+const (
+	ACLPolicyAllow = "allow"
+	ACLPolicyDeny  = "deny"
+)
+
+// Access levels granted by a policy.
+const (
+	AccessDeny  = "deny"
+	AccessRead  = "read"
+	AccessWrite = "write"
+)
+
+// ACLRule grants access to the names starting with Prefix. The rule with the
+// longest matching prefix applies.
+type ACLRule struct {
+	Prefix string
+	Access string
+}
+
+// ACLPolicy lists the access granted by a token. Anything not covered falls
+// back to the default policy.
+type ACLPolicy struct {
+	Catalog  string    `json:",omitempty"`
+	KV       []ACLRule `json:",omitempty"`
+	Events   []ACLRule `json:",omitempty"`
+	Queries  []ACLRule `json:",omitempty"`
+	Operator string    `json:",omitempty"`
+}
+
+// ACLToken is a token replicated through Raft. The ID is the secret presented
+// with requests. Management tokens are granted everything, including
+// managing ACLs and snapshots.
+type ACLToken struct {
+	ID          string
+	Name        string
+	Management  bool
+	Policy      ACLPolicy
+	CreateIndex uint64
+	ModifyIndex uint64
+}
+
+// Authorizer decides what a resolved token may do.
+type Authorizer interface {
+	CatalogRead() bool
+	CatalogWrite() bool
+	KVRead(key string) bool
+	KVWrite(key string) bool
+	EventWrite(name string) bool
+	QueryWrite(name string) bool
+	OperatorRead() bool
+	OperatorWrite() bool
+
+	// Management allows managing ACLs and saving and restoring snapshots.
+	Management() bool
+}
+
+// ACLResolver resolves ACL tokens.
+type ACLResolver interface {
+	ResolveToken(token string) (Authorizer, error)
+}
+
+// policyAuthorizer authorizes by a policy and the default policy.
+type policyAuthorizer struct {
+	policy       ACLPolicy
+	management   bool
+	defaultAllow bool
+}
+
+func (p *policyAuthorizer) allowed(access string, write bool) bool {
+	if p.management {
+		return true
+	}
+	switch access {
+	case AccessWrite:
+		return true
+	case AccessRead:
+		return !write
+	case AccessDeny:
+		return false
+	}
+	return p.defaultAllow
+}
+
+// match returns the access of the rule with the longest prefix of name.
+func match(rules []ACLRule, name string) string {
+	access, longest := "", -1
+	for _, r := range rules {
+		if strings.HasPrefix(name, r.Prefix) && len(r.Prefix) > longest {
+			access, longest = r.Access, len(r.Prefix)
+		}
+	}
+	return access
+}
+
+func (p *policyAuthorizer) CatalogRead() bool  { return p.allowed(p.policy.Catalog, false) }
+func (p *policyAuthorizer) CatalogWrite() bool { return p.allowed(p.policy.Catalog, true) }
+
+func (p *policyAuthorizer) KVRead(key string) bool {
+	return p.allowed(match(p.policy.KV, key), false)
+}
+
+func (p *policyAuthorizer) KVWrite(key string) bool {
+	return p.allowed(match(p.policy.KV, key), true)
+}
+
+func (p *policyAuthorizer) EventWrite(name string) bool {
+	return p.allowed(match(p.policy.Events, name), true)
+}
+
+func (p *policyAuthorizer) QueryWrite(name string) bool {
+	return p.allowed(match(p.policy.Queries, name), true)
+}
+
+func (p *policyAuthorizer) OperatorRead() bool  { return p.allowed(p.policy.Operator, false) }
+func (p *policyAuthorizer) OperatorWrite() bool { return p.allowed(p.policy.Operator, true) }
+func (p *policyAuthorizer) Management() bool    { return p.management }
+
+// aclResolver resolves tokens against the replicated state.
+type aclResolver struct {
+	state         *stateStore
+	masterToken   string
+	defaultPolicy string
+}
+
+// ResolveToken returns the Authorizer of a token. The empty token is the
+// anonymous token, which only has the default policy. Every token is granted
+// everything if ACLs are disabled.
+func (r *aclResolver) ResolveToken(token string) (Authorizer, error) {
+	switch {
+	case r.defaultPolicy == "":
+		return &policyAuthorizer{management: true}, nil
+	case token == "":
+		return &policyAuthorizer{defaultAllow: r.defaultPolicy == ACLPolicyAllow}, nil
+	case r.masterToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(r.masterToken)) == 1:
+		return &policyAuthorizer{management: true}, nil
+	}
+
+	acl := r.state.ACLGet(token)
+	if acl == nil {
+		return nil, ErrACLNotFound
+	}
+	return &policyAuthorizer{
+		policy:       acl.Policy,
+		management:   acl.Management,
+		defaultAllow: r.defaultPolicy == ACLPolicyAllow,
+	}, nil
+}
+
+// authorizeTuple checks that a tuple may be applied. Restores replace the
+// ACLs along with the rest of the state, so they require management just like
+// ACL changes and user tuples.
+func authorizeTuple(a Authorizer, t namedtuple.Tuple) error {
+	var allowed bool
+	switch {
+	case t.Is(nodeStatus):
+		allowed = a.CatalogWrite()
+	case t.Is(kvSet), t.Is(kvDelete):
+		key, err := tupleString(t, "Key")
+		if err != nil {
+			return err
+		}
+		allowed = a.KVWrite(key)
+	default:
+		allowed = a.Management()
+	}
+	if !allowed {
+		return ErrPermissionDenied
+	}
+	return nil
+}
+
+// validatePolicy checks the access levels of a policy.
+func validatePolicy(p *ACLPolicy) error {
+	check := func(access string) error {
+		switch access {
+		case "", AccessDeny, AccessRead, AccessWrite:
+			return nil
+		}
+		return fmt.Errorf("invalid access %q", access)
+	}
+
+	accesses := []string{p.Catalog, p.Operator}
+	for _, rules := range [][]ACLRule{p.KV, p.Events, p.Queries} {
+		for _, r := range rules {
+			accesses = append(accesses, r.Access)
+		}
+	}
+	for _, access := range accesses {
+		if err := check(access); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newACLSet builds an ACLSet tuple.
+func newACLSet(acl *ACLToken) (t namedtuple.Tuple, err error) {
+	if err = validatePolicy(&acl.Policy); err != nil {
+		return
+	}
+	policy, err := json.Marshal(&acl.Policy)
+	if err != nil {
+		return
+	}
+	var management uint8
+	if acl.Management {
+		management = 1
+	}
+
+	builder := namedtuple.NewBuilder(aclSet, make([]byte, len(acl.ID)+len(acl.Name)+len(policy)+32))
+	if _, err = builder.PutString("ID", acl.ID); err != nil {
+		return
+	}
+	if _, err = builder.PutString("Name", acl.Name); err != nil {
+		return
+	}
+	if _, err = builder.PutUint8("Management", management); err != nil {
+		return
+	}
+	if _, err = builder.PutUint8Array("Policy", policy); err != nil {
+		return
+	}
+	return builder.Build()
+}
+
+// newACLDelete builds an ACLDelete tuple.
+func newACLDelete(id string) (t namedtuple.Tuple, err error) {
+	builder := namedtuple.NewBuilder(aclDelete, make([]byte, len(id)+16))
+	if _, err = builder.PutString("ID", id); err != nil {
+		return
+	}
+	return builder.Build()
+}
+
+// generateID returns a random UUID.
+func generateID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x-%x-%x-%x-%x", buf[0:4], buf[4:6], buf[6:8], buf[8:10], buf[10:16]), nil
+}
+
+func (c *cerebrum) ACLSet(acl *ACLToken) (string, error) {
+	return c.aclSet(acl, c.applier.Apply)
+}
+
+func (c *cerebrum) aclSet(acl *ACLToken, apply func(namedtuple.Tuple) error) (string, error) {
+	token := *acl
+	if token.ID == "" {
+		id, err := generateID()
+		if err != nil {
+			return "", err
+		}
+		token.ID = id
+	}
+	tuple, err := newACLSet(&token)
+	if err != nil {
+		return "", err
+	}
+	if err = apply(tuple); err != nil {
+		return "", err
+	}
+	c.audits.Audit(AuditOperator, "acl", "set ACL token %q", token.Name)
+	return token.ID, nil
+}
+
+func (c *cerebrum) ACLDelete(id string) error {
+	return c.aclDelete(id, c.applier.Apply)
+}
+
+// aclDelete deletes a token. Token IDs are secret, so only the name is
+// recorded.
+func (c *cerebrum) aclDelete(id string, apply func(namedtuple.Tuple) error) error {
+	var name string
+	if acl := c.state.ACLGet(id); acl != nil {
+		name = acl.Name
+	}
+	tuple, err := newACLDelete(id)
+	if err != nil {
+		return err
+	}
+	if err = apply(tuple); err != nil {
+		return err
+	}
+	c.audits.Audit(AuditOperator, "acl", "deleted ACL token %q", name)
+	return nil
+}
+
+func (c *cerebrum) ACLList() ([]*ACLToken, error) {
+	return c.state.ACLList(), nil
+}
+
+func (c *cerebrum) ResolveToken(token string) (Authorizer, error) {
+	return c.acl.ResolveToken(token)
+}
+
+func (c *cerebrum) WithToken(token string) Agent {
+	return &tokenAgent{c, token, context.Background()}
+}
+
+// tokenAgent authorizes the Agent operations with an ACL token. Writes
+// continue the trace of the context.
+type tokenAgent struct {
+	c     *cerebrum
+	token string
+	ctx   context.Context
+}
+
+// authorize resolves the token and checks it with the function.
+func (t *tokenAgent) authorize(check func(Authorizer) bool) error {
+	authz, err := t.c.acl.ResolveToken(t.token)
+	if err != nil {
+		return err
+	}
+	if !check(authz) {
+		return ErrPermissionDenied
+	}
+	return nil
+}
+
+// authorizeAction is authorize for actions, which record their denials in
+// the audit log.
+func (t *tokenAgent) authorizeAction(action, subject string, check func(Authorizer) bool) error {
+	err := t.authorize(check)
+	if err == ErrPermissionDenied {
+		t.c.audits.Audit(AuditACLDenied, subject, "%s denied", action)
+	}
+	return err
+}
+
+func (t *tokenAgent) apply(tuple namedtuple.Tuple) error {
+	return t.c.applier.ApplyWithTokenContext(t.ctx, tuple, t.token)
+}
+
+func operatorRead(a Authorizer) bool  { return a.OperatorRead() }
+func operatorWrite(a Authorizer) bool { return a.OperatorWrite() }
+func management(a Authorizer) bool    { return a.Management() }
+
+// Members returns no members unless the token may read the catalog.
+func (t *tokenAgent) Members() []Member {
+	if err := t.authorize(func(a Authorizer) bool { return a.CatalogRead() }); err != nil {
+		return []Member{}
+	}
+	return t.c.Members()
+}
+
+func (t *tokenAgent) Join(addrs []string) (int, error) {
+	if err := t.authorizeAction("join", "operator", operatorWrite); err != nil {
+		return 0, err
+	}
+	return t.c.Join(addrs)
+}
+
+func (t *tokenAgent) Leave() error {
+	if err := t.authorizeAction("leave", "operator", operatorWrite); err != nil {
+		return err
+	}
+	return t.c.Leave()
+}
+
+func (t *tokenAgent) ForceLeave(node string) error {
+	if err := t.authorizeAction("force-leave", node, operatorWrite); err != nil {
+		return err
+	}
+	return t.c.ForceLeave(node)
+}
+
+func (t *tokenAgent) UserEvent(name string, payload []byte) error {
+	if err := t.authorizeAction("user event", name, func(a Authorizer) bool { return a.EventWrite(name) }); err != nil {
+		return err
+	}
+	return t.c.UserEvent(name, payload)
+}
+
+func (t *tokenAgent) Query(name string, payload []byte, timeout time.Duration) (map[string][]byte, error) {
+	if err := t.authorizeAction("query", name, func(a Authorizer) bool { return a.QueryWrite(name) }); err != nil {
+		return nil, err
+	}
+	return t.c.Query(name, payload, timeout)
+}
+
+func (t *tokenAgent) KVGet(key string) (*KVEntry, error) {
+	if err := t.authorize(func(a Authorizer) bool { return a.KVRead(key) }); err != nil {
+		return nil, err
+	}
+	return t.c.KVGet(key)
+}
+
+func (t *tokenAgent) KVPut(key string, value []byte) error {
+	tuple, err := newKVSet(key, value)
+	if err != nil {
+		return err
+	}
+	return t.apply(tuple)
+}
+
+func (t *tokenAgent) KVDelete(key string) error {
+	tuple, err := newKVDelete(key)
+	if err != nil {
+		return err
+	}
+	return t.apply(tuple)
+}
+
+// SnapshotSave requires management since snapshots contain the ACL tokens.
+func (t *tokenAgent) SnapshotSave(w io.Writer) error {
+	if err := t.authorize(management); err != nil {
+		return err
+	}
+	return t.c.SnapshotSave(w)
+}
+
+func (t *tokenAgent) SnapshotRestore(r io.Reader) error {
+	return t.c.snapshotRestore(r, t.apply)
+}
+
+// Info returns nothing unless the token may read operator information.
+func (t *tokenAgent) Info() map[string]map[string]string {
+	if err := t.authorize(operatorRead); err != nil {
+		return map[string]map[string]string{}
+	}
+	return t.c.Info()
+}
+
+func (t *tokenAgent) ACLSet(acl *ACLToken) (string, error) {
+	return t.c.aclSet(acl, t.apply)
+}
+
+func (t *tokenAgent) ACLDelete(id string) error {
+	return t.c.aclDelete(id, t.apply)
+}
+
+func (t *tokenAgent) ACLList() ([]*ACLToken, error) {
+	if err := t.authorize(management); err != nil {
+		return nil, err
+	}
+	return t.c.ACLList()
+}
+
+func (t *tokenAgent) ResolveToken(token string) (Authorizer, error) {
+	return t.c.ResolveToken(token)
+}
+
+func (t *tokenAgent) WithToken(token string) Agent {
+	return &tokenAgent{t.c, token, t.ctx}
+}
+
+func (t *tokenAgent) WithContext(ctx context.Context) Agent {
+	return &tokenAgent{t.c, t.token, ctx}
+}
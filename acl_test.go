@@ -0,0 +1,125 @@
+package cerebrum
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestACL_Authorizer(t *testing.T) {
+	authz := &policyAuthorizer{
+		policy: ACLPolicy{
+			Catalog: AccessRead,
+			KV: []ACLRule{
+				{Prefix: "", Access: AccessRead},
+				{Prefix: "app/", Access: AccessWrite},
+				{Prefix: "app/secret/", Access: AccessDeny},
+			},
+			Events: []ACLRule{{Prefix: "deploy", Access: AccessWrite}},
+		},
+	}
+
+	assert.True(t, authz.CatalogRead())
+	assert.False(t, authz.CatalogWrite())
+
+	// The longest prefix wins
+	assert.True(t, authz.KVRead("other"))
+	assert.False(t, authz.KVWrite("other"))
+	assert.True(t, authz.KVWrite("app/config"))
+	assert.False(t, authz.KVRead("app/secret/password"))
+
+	assert.True(t, authz.EventWrite("deploy-web"))
+	assert.False(t, authz.EventWrite("restart"))
+
+	// Anything else falls back to the default policy
+	assert.False(t, authz.QueryWrite("ping"))
+	assert.False(t, authz.OperatorRead())
+	authz.defaultAllow = true
+	assert.True(t, authz.QueryWrite("ping"))
+	assert.True(t, authz.OperatorWrite())
+	assert.False(t, authz.Management())
+}
+
+func TestACL_ResolveToken(t *testing.T) {
+	state := newStateStore()
+	state.aclSet(1, &ACLToken{ID: "manager", Management: true})
+
+	// Every token is granted everything if ACLs are disabled
+	authz, err := (&aclResolver{state: state}).ResolveToken("unknown")
+	assert.Nil(t, err)
+	assert.True(t, authz.Management())
+
+	r := &aclResolver{state, "master", ACLPolicyDeny}
+	authz, err = r.ResolveToken("")
+	assert.Nil(t, err)
+	assert.False(t, authz.KVRead("key"))
+
+	authz, err = r.ResolveToken("master")
+	assert.Nil(t, err)
+	assert.True(t, authz.Management())
+
+	authz, err = r.ResolveToken("manager")
+	assert.Nil(t, err)
+	assert.True(t, authz.Management())
+
+	_, err = r.ResolveToken("unknown")
+	assert.Equal(t, ErrACLNotFound, err)
+}
+
+func TestACL_AuthorizeTuple(t *testing.T) {
+	authz := &policyAuthorizer{policy: ACLPolicy{
+		KV: []ACLRule{{Prefix: "app/", Access: AccessWrite}},
+	}}
+
+	allowed, err := newKVSet("app/key", nil)
+	assert.Nil(t, err)
+	assert.Nil(t, authorizeTuple(authz, allowed))
+
+	denied, err := newKVDelete("other")
+	assert.Nil(t, err)
+	assert.Equal(t, ErrPermissionDenied, authorizeTuple(authz, denied))
+
+	// ACL changes require management
+	acl, err := newACLSet(&ACLToken{ID: "id"})
+	assert.Nil(t, err)
+	assert.Equal(t, ErrPermissionDenied, authorizeTuple(authz, acl))
+	authz.management = true
+	assert.Nil(t, authorizeTuple(authz, acl))
+
+	_, err = newACLSet(&ACLToken{ID: "id", Policy: ACLPolicy{Catalog: "all"}})
+	assert.NotNil(t, err)
+}
+
+func TestACL_Forward(t *testing.T) {
+	tuple, err := newKVSet("key", []byte("value"))
+	assert.Nil(t, err)
+	data, err := encodeTuple(tuple)
+	assert.Nil(t, err)
+
+	span := SpanContext{"4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7"}
+	forward, err := encodeForward(data, "token", span, requestID{"client", 3})
+	assert.Nil(t, err)
+	envelope, err := decodeTuple(forward)
+	assert.Nil(t, err)
+	assert.True(t, envelope.Is(forwardReq))
+
+	msg, err := decodeForward(envelope)
+	assert.Nil(t, err)
+	assert.Equal(t, "token", msg.token)
+	assert.Equal(t, span, msg.span)
+	assert.Equal(t, requestID{"client", 3}, msg.id)
+	assert.True(t, msg.tuple.Is(kvSet))
+	key, err := tupleString(msg.tuple, "Key")
+	assert.Nil(t, err)
+	assert.Equal(t, "key", key)
+
+	// Anonymous and untraced requests carry an empty token and span
+	forward, err = encodeForward(data, "", SpanContext{}, requestID{})
+	assert.Nil(t, err)
+	envelope, err = decodeTuple(forward)
+	assert.Nil(t, err)
+	msg, err = decodeForward(envelope)
+	assert.Nil(t, err)
+	assert.Equal(t, "", msg.token)
+	assert.False(t, msg.span.Valid())
+}
@@ -0,0 +1,475 @@
+package cerebrum
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"time"
+
+	log "github.com/mgutz/logxi/v1"
+	"golang.org/x/net/context"
+)
+
+// Admin operations understood by the AdminHandler.
+const (
+	AdminRaftListPeers          = "raft-list-peers"
+	AdminRaftRemovePeer         = "raft-remove-peer"
+	AdminRaftTransferLeadership = "raft-transfer-leadership"
+	AdminRaftForcePeers         = "raft-force-peers"
+	AdminRaftCompact            = "raft-compact"
+	AdminMembers                = "members"
+	AdminJoin                   = "join"
+	AdminLeave                  = "leave"
+	AdminForceLeave             = "force-leave"
+	AdminEvent                  = "event"
+	AdminQuery                  = "query"
+	AdminKVGet                  = "kv-get"
+	AdminKVPut                  = "kv-put"
+	AdminKVDelete               = "kv-delete"
+	AdminSnapshotSave           = "snapshot-save"
+	AdminSnapshotRestore        = "snapshot-restore"
+	AdminInfo                   = "info"
+	AdminKeyringInstall         = "keyring-install"
+	AdminKeyringUse             = "keyring-use"
+	AdminKeyringRemove          = "keyring-remove"
+	AdminKeyringList            = "keyring-list"
+	AdminACLSet                 = "acl-set"
+	AdminACLDelete              = "acl-delete"
+	AdminACLList                = "acl-list"
+)
+
+// AdminRequest is sent by an admin client. Each admin stream carries a single
+// request and response.
+type AdminRequest struct {
+	Op      string
+	Addrs   []string      `json:",omitempty"`
+	Name    string        `json:",omitempty"`
+	Key     string        `json:",omitempty"`
+	Payload []byte        `json:",omitempty"`
+	Timeout time.Duration `json:",omitempty"`
+	ACL     *ACLToken     `json:",omitempty"`
+
+	// Token is the ACL token the request is authorized with.
+	Token string `json:",omitempty"`
+}
+
+// AdminResponse is returned for every AdminRequest. Error is empty on success.
+type AdminResponse struct {
+	Error     string                       `json:",omitempty"`
+	Peers     []RaftPeer                   `json:",omitempty"`
+	Members   []Member                     `json:",omitempty"`
+	Joined    int                          `json:",omitempty"`
+	Entry     *KVEntry                     `json:",omitempty"`
+	Responses map[string][]byte            `json:",omitempty"`
+	Payload   []byte                       `json:",omitempty"`
+	Info      map[string]map[string]string `json:",omitempty"`
+	Keyring   *KeyringResponse             `json:",omitempty"`
+	ACLID     string                       `json:",omitempty"`
+	ACLs      []*ACLToken                  `json:",omitempty"`
+
+	Compaction *RaftStoreCompaction `json:",omitempty"`
+}
+
+// AdminHandler serves operator requests received on admin streams and on the
+// local admin listener.
+type AdminHandler struct {
+	operator Operator
+	agent    Agent
+	acl      ACLResolver
+	logger   log.Logger
+}
+
+// NewAdminHandler creates an AdminHandler for the given Operator and Agent.
+// Requests are authorized with their ACL token.
+func NewAdminHandler(o Operator, a Agent, acl ACLResolver, l log.Logger) *AdminHandler {
+	return &AdminHandler{o, a, acl, l}
+}
+
+// Serve handles admin requests on each connection accepted by the listener
+// until the listener is closed.
+func (a *AdminHandler) Serve(c context.Context, l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			select {
+			case <-c.Done():
+			default:
+				a.logger.Warn("admin listener closed", "err", err)
+			}
+			return
+		}
+		go a.Handle(c, conn)
+	}
+}
+
+// Handle decodes a single AdminRequest from the stream and writes the
+// AdminResponse.
+func (a *AdminHandler) Handle(c context.Context, conn net.Conn) {
+	defer conn.Close()
+
+	var req AdminRequest
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		a.logger.Warn("failed to decode admin request", "err", err)
+		return
+	}
+
+	resp := a.serve(&req)
+	if resp.Error != "" {
+		a.logger.Warn("admin request failed", "op", req.Op, "err", resp.Error)
+	} else {
+		a.logger.Info("admin request served", "op", req.Op)
+	}
+	if err := json.NewEncoder(conn).Encode(resp); err != nil {
+		a.logger.Warn("failed to encode admin response", "err", err)
+	}
+}
+
+func (a *AdminHandler) serve(req *AdminRequest) *AdminResponse {
+	var resp AdminResponse
+	err := a.authorize(req)
+	if err == nil {
+		err = a.dispatch(req, &resp)
+	}
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	return &resp
+}
+
+// authorize checks the ACL token of operator requests. Agent requests are
+// authorized by the Agent.
+func (a *AdminHandler) authorize(req *AdminRequest) error {
+	var check func(Authorizer) bool
+	switch req.Op {
+	case AdminRaftListPeers, AdminKeyringList:
+		check = operatorRead
+	case AdminRaftRemovePeer, AdminRaftTransferLeadership, AdminRaftForcePeers, AdminRaftCompact,
+		AdminKeyringInstall, AdminKeyringUse, AdminKeyringRemove:
+		check = operatorWrite
+	default:
+		return nil
+	}
+
+	authz, err := a.acl.ResolveToken(req.Token)
+	if err != nil {
+		return err
+	}
+	if !check(authz) {
+		return ErrPermissionDenied
+	}
+	return nil
+}
+
+func (a *AdminHandler) dispatch(req *AdminRequest, resp *AdminResponse) (err error) {
+	switch req.Op {
+	case AdminRaftListPeers:
+		resp.Peers, err = a.operator.RaftPeers()
+	case AdminRaftRemovePeer:
+		for _, addr := range req.Addrs {
+			if err = a.operator.RemoveRaftPeer(addr); err != nil {
+				break
+			}
+		}
+	case AdminRaftTransferLeadership:
+		err = a.operator.TransferLeadership()
+	case AdminRaftForcePeers:
+		err = a.operator.ForceRaftPeers(req.Addrs)
+	case AdminRaftCompact:
+		resp.Compaction, err = a.operator.CompactRaftStore()
+	case AdminMembers:
+		resp.Members = a.agent.WithToken(req.Token).Members()
+	case AdminJoin:
+		resp.Joined, err = a.agent.WithToken(req.Token).Join(req.Addrs)
+	case AdminLeave:
+		err = a.agent.WithToken(req.Token).Leave()
+	case AdminForceLeave:
+		err = a.agent.WithToken(req.Token).ForceLeave(req.Name)
+	case AdminEvent:
+		err = a.agent.WithToken(req.Token).UserEvent(req.Name, req.Payload)
+	case AdminQuery:
+		resp.Responses, err = a.agent.WithToken(req.Token).Query(req.Name, req.Payload, req.Timeout)
+	case AdminKVGet:
+		resp.Entry, err = a.agent.WithToken(req.Token).KVGet(req.Key)
+	case AdminKVPut:
+		err = a.agent.WithToken(req.Token).KVPut(req.Key, req.Payload)
+	case AdminKVDelete:
+		err = a.agent.WithToken(req.Token).KVDelete(req.Key)
+	case AdminSnapshotSave:
+		var buf bytes.Buffer
+		err = a.agent.WithToken(req.Token).SnapshotSave(&buf)
+		resp.Payload = buf.Bytes()
+	case AdminSnapshotRestore:
+		err = a.agent.WithToken(req.Token).SnapshotRestore(bytes.NewReader(req.Payload))
+	case AdminInfo:
+		resp.Info = a.agent.WithToken(req.Token).Info()
+	case AdminKeyringInstall:
+		resp.Keyring, err = a.operator.InstallKey(req.Key)
+	case AdminKeyringUse:
+		resp.Keyring, err = a.operator.UseKey(req.Key)
+	case AdminKeyringRemove:
+		resp.Keyring, err = a.operator.RemoveKey(req.Key)
+	case AdminKeyringList:
+		resp.Keyring, err = a.operator.ListKeys()
+	case AdminACLSet:
+		if req.ACL == nil {
+			return errors.New("missing ACL")
+		}
+		resp.ACLID, err = a.agent.WithToken(req.Token).ACLSet(req.ACL)
+	case AdminACLDelete:
+		err = a.agent.WithToken(req.Token).ACLDelete(req.Name)
+	case AdminACLList:
+		resp.ACLs, err = a.agent.WithToken(req.Token).ACLList()
+	default:
+		err = ErrUnknownAdminOp
+	}
+	return
+}
+
+// AdminClient calls the admin functions of a node, either over an admin
+// stream or through its local admin listener.
+type AdminClient struct {
+	dial    func() (net.Conn, error)
+	timeout time.Duration
+
+	// Token is sent with requests which do not carry an ACL token.
+	Token string
+}
+
+// NewAdminClient creates an AdminClient which opens admin streams to the node
+// listening on addr.
+func NewAdminClient(d Dialer, addr string, timeout time.Duration) *AdminClient {
+	return &AdminClient{
+		dial: func() (net.Conn, error) {
+			return d.Dial(connAdmin, addr, timeout)
+		},
+		timeout: timeout,
+	}
+}
+
+// NewLocalAdminClient creates an AdminClient for the local admin listener of
+// a node.
+func NewLocalAdminClient(addr string, timeout time.Duration) *AdminClient {
+	return &AdminClient{
+		dial: func() (net.Conn, error) {
+			return net.DialTimeout("tcp", addr, timeout)
+		},
+		timeout: timeout,
+	}
+}
+
+// Call sends the request and waits for the response. A response carrying an
+// error is returned as an error.
+func (a *AdminClient) Call(req *AdminRequest) (*AdminResponse, error) {
+	conn, err := a.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if req.Token == "" {
+		req.Token = a.Token
+	}
+	if a.timeout > 0 {
+		conn.SetDeadline(time.Now().Add(a.timeout))
+	}
+	if err = json.NewEncoder(conn).Encode(req); err != nil {
+		return nil, err
+	}
+
+	var resp AdminResponse
+	if err = json.NewDecoder(conn).Decode(&resp); err != nil {
+		return nil, err
+	}
+	if resp.Error != "" {
+		return &resp, errors.New(resp.Error)
+	}
+	return &resp, nil
+}
+
+// RaftPeers implements the Operator interface.
+func (a *AdminClient) RaftPeers() ([]RaftPeer, error) {
+	resp, err := a.Call(&AdminRequest{Op: AdminRaftListPeers})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Peers, nil
+}
+
+// RemoveRaftPeer implements the Operator interface.
+func (a *AdminClient) RemoveRaftPeer(addr string) error {
+	_, err := a.Call(&AdminRequest{Op: AdminRaftRemovePeer, Addrs: []string{addr}})
+	return err
+}
+
+// TransferLeadership implements the Operator interface.
+func (a *AdminClient) TransferLeadership() error {
+	_, err := a.Call(&AdminRequest{Op: AdminRaftTransferLeadership})
+	return err
+}
+
+// ForceRaftPeers implements the Operator interface.
+func (a *AdminClient) ForceRaftPeers(addrs []string) error {
+	_, err := a.Call(&AdminRequest{Op: AdminRaftForcePeers, Addrs: addrs})
+	return err
+}
+
+// CompactRaftStore implements the Operator interface.
+func (a *AdminClient) CompactRaftStore() (*RaftStoreCompaction, error) {
+	resp, err := a.Call(&AdminRequest{Op: AdminRaftCompact})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Compaction, nil
+}
+
+// InstallKey implements the Operator interface.
+func (a *AdminClient) InstallKey(key string) (*KeyringResponse, error) {
+	return a.keyring(&AdminRequest{Op: AdminKeyringInstall, Key: key})
+}
+
+// UseKey implements the Operator interface.
+func (a *AdminClient) UseKey(key string) (*KeyringResponse, error) {
+	return a.keyring(&AdminRequest{Op: AdminKeyringUse, Key: key})
+}
+
+// RemoveKey implements the Operator interface.
+func (a *AdminClient) RemoveKey(key string) (*KeyringResponse, error) {
+	return a.keyring(&AdminRequest{Op: AdminKeyringRemove, Key: key})
+}
+
+// ListKeys implements the Operator interface.
+func (a *AdminClient) ListKeys() (*KeyringResponse, error) {
+	return a.keyring(&AdminRequest{Op: AdminKeyringList})
+}
+
+// keyring returns the keyring response even if some members failed, so the
+// caller can report them.
+func (a *AdminClient) keyring(req *AdminRequest) (*KeyringResponse, error) {
+	resp, err := a.Call(req)
+	if resp == nil {
+		return nil, err
+	}
+	return resp.Keyring, err
+}
+
+// ACLSet calls Agent.ACLSet on the node.
+func (a *AdminClient) ACLSet(acl *ACLToken) (string, error) {
+	resp, err := a.Call(&AdminRequest{Op: AdminACLSet, ACL: acl})
+	if err != nil {
+		return "", err
+	}
+	return resp.ACLID, nil
+}
+
+// ACLDelete calls Agent.ACLDelete on the node.
+func (a *AdminClient) ACLDelete(id string) error {
+	_, err := a.Call(&AdminRequest{Op: AdminACLDelete, Name: id})
+	return err
+}
+
+// ACLList calls Agent.ACLList on the node.
+func (a *AdminClient) ACLList() ([]*ACLToken, error) {
+	resp, err := a.Call(&AdminRequest{Op: AdminACLList})
+	if err != nil {
+		return nil, err
+	}
+	return resp.ACLs, nil
+}
+
+// Members calls Agent.Members on the node.
+func (a *AdminClient) Members() ([]Member, error) {
+	resp, err := a.Call(&AdminRequest{Op: AdminMembers})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Members, nil
+}
+
+// Join calls Agent.Join on the node.
+func (a *AdminClient) Join(addrs []string) (int, error) {
+	resp, err := a.Call(&AdminRequest{Op: AdminJoin, Addrs: addrs})
+	if err != nil {
+		return 0, err
+	}
+	return resp.Joined, nil
+}
+
+// Leave calls Agent.Leave on the node.
+func (a *AdminClient) Leave() error {
+	_, err := a.Call(&AdminRequest{Op: AdminLeave})
+	return err
+}
+
+// ForceLeave calls Agent.ForceLeave on the node.
+func (a *AdminClient) ForceLeave(node string) error {
+	_, err := a.Call(&AdminRequest{Op: AdminForceLeave, Name: node})
+	return err
+}
+
+// UserEvent calls Agent.UserEvent on the node.
+func (a *AdminClient) UserEvent(name string, payload []byte) error {
+	_, err := a.Call(&AdminRequest{Op: AdminEvent, Name: name, Payload: payload})
+	return err
+}
+
+// Query calls Agent.Query on the node.
+func (a *AdminClient) Query(name string, payload []byte, timeout time.Duration) (map[string][]byte, error) {
+	resp, err := a.Call(&AdminRequest{Op: AdminQuery, Name: name, Payload: payload, Timeout: timeout})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Responses, nil
+}
+
+// KVGet calls Agent.KVGet on the node.
+func (a *AdminClient) KVGet(key string) (*KVEntry, error) {
+	resp, err := a.Call(&AdminRequest{Op: AdminKVGet, Key: key})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Entry, nil
+}
+
+// KVPut calls Agent.KVPut on the node.
+func (a *AdminClient) KVPut(key string, value []byte) error {
+	_, err := a.Call(&AdminRequest{Op: AdminKVPut, Key: key, Payload: value})
+	return err
+}
+
+// KVDelete calls Agent.KVDelete on the node.
+func (a *AdminClient) KVDelete(key string) error {
+	_, err := a.Call(&AdminRequest{Op: AdminKVDelete, Key: key})
+	return err
+}
+
+// SnapshotSave calls Agent.SnapshotSave on the node.
+func (a *AdminClient) SnapshotSave(w io.Writer) error {
+	resp, err := a.Call(&AdminRequest{Op: AdminSnapshotSave})
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(resp.Payload)
+	return err
+}
+
+// SnapshotRestore calls Agent.SnapshotRestore on the node.
+func (a *AdminClient) SnapshotRestore(r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	_, err = a.Call(&AdminRequest{Op: AdminSnapshotRestore, Payload: data})
+	return err
+}
+
+// Info calls Agent.Info on the node.
+func (a *AdminClient) Info() (map[string]map[string]string, error) {
+	resp, err := a.Call(&AdminRequest{Op: AdminInfo})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Info, nil
+}
@@ -0,0 +1,142 @@
+package cerebrum
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	log "github.com/mgutz/logxi/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"golang.org/x/net/context"
+)
+
+func serveAdmin(t *testing.T, o Operator, req *AdminRequest) *AdminResponse {
+	client, server := net.Pipe()
+	handler := NewAdminHandler(o, nil, &aclResolver{}, &log.NullLogger{})
+	go handler.Handle(context.Background(), server)
+
+	err := json.NewEncoder(client).Encode(req)
+	assert.Nil(t, err)
+
+	var resp AdminResponse
+	err = json.NewDecoder(client).Decode(&resp)
+	assert.Nil(t, err)
+	client.Close()
+	return &resp
+}
+
+func TestAdminHandler_ListPeers(t *testing.T) {
+	peers := []RaftPeer{
+		{Node: "node-1", Address: "127.0.0.1:9000", Leader: true, Voter: true},
+		{Node: "node-2", Address: "127.0.0.2:9000", Voter: true},
+	}
+	operator := &MockOperator{peers: peers}
+	operator.On("RaftPeers").Return(peers, nil)
+
+	resp := serveAdmin(t, operator, &AdminRequest{Op: AdminRaftListPeers})
+	operator.AssertCalled(t, "RaftPeers")
+	assert.Equal(t, "", resp.Error)
+	assert.Equal(t, peers, resp.Peers)
+}
+
+func TestAdminHandler_RemovePeer(t *testing.T) {
+	operator := &MockOperator{}
+	operator.On("RemoveRaftPeer", "127.0.0.2:9000").Return(nil)
+
+	resp := serveAdmin(t, operator, &AdminRequest{Op: AdminRaftRemovePeer, Addrs: []string{"127.0.0.2:9000"}})
+	operator.AssertCalled(t, "RemoveRaftPeer", "127.0.0.2:9000")
+	assert.Equal(t, "", resp.Error)
+}
+
+func TestAdminHandler_ForcePeersError(t *testing.T) {
+	addrs := []string{"127.0.0.1:9000"}
+	operator := &MockOperator{err: errors.New("node is the leader")}
+	operator.On("ForceRaftPeers", addrs).Return(operator.err)
+
+	resp := serveAdmin(t, operator, &AdminRequest{Op: AdminRaftForcePeers, Addrs: addrs})
+	operator.AssertCalled(t, "ForceRaftPeers", addrs)
+	assert.Equal(t, "node is the leader", resp.Error)
+}
+
+func TestAdminHandler_UnknownOp(t *testing.T) {
+	resp := serveAdmin(t, &MockOperator{}, &AdminRequest{Op: "unknown"})
+	assert.Equal(t, ErrUnknownAdminOp.Error(), resp.Error)
+}
+
+func TestAdminHandler_ListKeys(t *testing.T) {
+	keyring := &KeyringResponse{NumNodes: 2, NumResp: 2, Keys: map[string]int{"a2V5": 2}}
+	operator := &MockOperator{keyring: keyring}
+	operator.On("ListKeys").Return(keyring, nil)
+
+	resp := serveAdmin(t, operator, &AdminRequest{Op: AdminKeyringList})
+	operator.AssertCalled(t, "ListKeys")
+	assert.Equal(t, "", resp.Error)
+	assert.Equal(t, keyring, resp.Keyring)
+}
+
+func TestAdminHandler_RaftCompact(t *testing.T) {
+	compaction := &RaftStoreCompaction{SizeBefore: 4096, SizeAfter: 1024, Duration: time.Second}
+	operator := &MockOperator{compaction: compaction}
+	operator.On("CompactRaftStore").Return(compaction, nil)
+
+	resp := serveAdmin(t, operator, &AdminRequest{Op: AdminRaftCompact})
+	operator.AssertCalled(t, "CompactRaftStore")
+	assert.Equal(t, "", resp.Error)
+	assert.Equal(t, compaction, resp.Compaction)
+}
+
+type MockOperator struct {
+	mock.Mock
+	peers      []RaftPeer
+	keyring    *KeyringResponse
+	compaction *RaftStoreCompaction
+	err        error
+}
+
+func (m *MockOperator) RaftPeers() ([]RaftPeer, error) {
+	m.Called()
+	return m.peers, m.err
+}
+
+func (m *MockOperator) RemoveRaftPeer(addr string) error {
+	m.Called(addr)
+	return m.err
+}
+
+func (m *MockOperator) TransferLeadership() error {
+	m.Called()
+	return m.err
+}
+
+func (m *MockOperator) ForceRaftPeers(addrs []string) error {
+	m.Called(addrs)
+	return m.err
+}
+
+func (m *MockOperator) InstallKey(key string) (*KeyringResponse, error) {
+	m.Called(key)
+	return m.keyring, m.err
+}
+
+func (m *MockOperator) UseKey(key string) (*KeyringResponse, error) {
+	m.Called(key)
+	return m.keyring, m.err
+}
+
+func (m *MockOperator) RemoveKey(key string) (*KeyringResponse, error) {
+	m.Called(key)
+	return m.keyring, m.err
+}
+
+func (m *MockOperator) ListKeys() (*KeyringResponse, error) {
+	m.Called()
+	return m.keyring, m.err
+}
+
+func (m *MockOperator) CompactRaftStore() (*RaftStoreCompaction, error) {
+	m.Called()
+	return m.compaction, m.err
+}
@@ -0,0 +1,402 @@
+package cerebrum
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/blacklabeldata/namedtuple"
+	"github.com/hashicorp/raft"
+	"github.com/hashicorp/serf/serf"
+	"golang.org/x/net/context"
+)
+
+// Agent exposes the cluster operations of a running node.
+type Agent interface {
+
+	// Members lists the members of the gossip pool.
+	Members() []Member
+
+	// Join joins the gossip pool through the given addresses and returns the
+	// number of nodes contacted.
+	Join(addrs []string) (int, error)
+
+	// Leave gracefully leaves the cluster and stops the node.
+	Leave() error
+
+	// ForceLeave forces a failed member into the left state.
+	ForceLeave(node string) error
+
+	// UserEvent broadcasts a user event to the cluster.
+	UserEvent(name string, payload []byte) error
+
+	// Query sends a query to the cluster and collects the responses by node
+	// until the timeout expires.
+	Query(name string, payload []byte, timeout time.Duration) (map[string][]byte, error)
+
+	// KVGet reads a key from the local state. It returns nil if the key does
+	// not exist.
+	KVGet(key string) (*KVEntry, error)
+
+	// KVPut writes a key through Raft.
+	KVPut(key string, value []byte) error
+
+	// KVDelete removes a key through Raft.
+	KVDelete(key string) error
+
+	// SnapshotSave writes a snapshot of the replicated state.
+	SnapshotSave(w io.Writer) error
+
+	// SnapshotRestore replaces the replicated state with a snapshot written
+	// by SnapshotSave.
+	SnapshotRestore(r io.Reader) error
+
+	// Info returns diagnostic information grouped by subsystem.
+	Info() map[string]map[string]string
+
+	// ACLSet creates or updates an ACL token through Raft and returns its
+	// ID. An ID is generated if it is empty.
+	ACLSet(acl *ACLToken) (string, error)
+
+	// ACLDelete removes an ACL token through Raft.
+	ACLDelete(id string) error
+
+	// ACLList lists the ACL tokens.
+	ACLList() ([]*ACLToken, error)
+
+	// ResolveToken returns the Authorizer for an ACL token.
+	ResolveToken(token string) (Authorizer, error)
+
+	// WithToken returns an Agent whose operations are authorized by the ACL
+	// token. Writes carry the token when forwarded to the leader. The
+	// operations of the Agent itself are not authorized.
+	WithToken(token string) Agent
+
+	// WithContext returns an Agent whose writes continue the trace of the
+	// context, see ContextWithSpan.
+	WithContext(ctx context.Context) Agent
+}
+
+// Member is a member of the gossip pool.
+type Member struct {
+	Name   string
+	Addr   string
+	Port   uint16
+	Status string
+	Tags   map[string]string
+}
+
+func (c *cerebrum) Members() []Member {
+	serfMembers := c.serf.Members()
+	members := make([]Member, 0, len(serfMembers))
+	for _, m := range serfMembers {
+		members = append(members, Member{
+			Name:   m.Name,
+			Addr:   m.Addr.String(),
+			Port:   m.Port,
+			Status: m.Status.String(),
+			Tags:   m.Tags,
+		})
+	}
+	return members
+}
+
+func (c *cerebrum) Join(addrs []string) (int, error) {
+	c.logger.Info("Joining cluster", "nodes", addrs)
+	return c.serf.Join(addrs, true)
+}
+
+func (c *cerebrum) Leave() error {
+	if err := c.serf.Leave(); err != nil {
+		return err
+	}
+	go c.Stop()
+	return nil
+}
+
+func (c *cerebrum) ForceLeave(node string) error {
+	if err := c.serf.RemoveFailedNode(node); err != nil {
+		return err
+	}
+	c.audits.Audit(AuditOperator, node, "forced member to leave")
+	return nil
+}
+
+func (c *cerebrum) UserEvent(name string, payload []byte) error {
+	return c.serf.UserEvent(name, payload, false)
+}
+
+func (c *cerebrum) Query(name string, payload []byte, timeout time.Duration) (map[string][]byte, error) {
+	params := c.serf.DefaultQueryParams()
+	if timeout > 0 {
+		params.Timeout = timeout
+	}
+	resp, err := c.serf.Query(name, payload, params)
+	if err != nil {
+		return nil, err
+	}
+
+	responses := make(map[string][]byte)
+	for r := range resp.ResponseCh() {
+		responses[r.From] = r.Payload
+	}
+	return responses, nil
+}
+
+func (c *cerebrum) KVGet(key string) (*KVEntry, error) {
+	return c.state.KVGet(key), nil
+}
+
+func (c *cerebrum) KVPut(key string, value []byte) error {
+	tuple, err := newKVSet(key, value)
+	if err != nil {
+		return err
+	}
+	return c.applier.Apply(tuple)
+}
+
+func (c *cerebrum) KVDelete(key string) error {
+	tuple, err := newKVDelete(key)
+	if err != nil {
+		return err
+	}
+	return c.applier.Apply(tuple)
+}
+
+func (c *cerebrum) WithContext(ctx context.Context) Agent {
+	return &contextAgent{c, ctx}
+}
+
+// contextAgent applies the writes of the node within the trace of the
+// context.
+type contextAgent struct {
+	*cerebrum
+	ctx context.Context
+}
+
+func (a *contextAgent) apply(tuple namedtuple.Tuple) error {
+	return a.applier.ApplyContext(a.ctx, tuple)
+}
+
+func (a *contextAgent) KVPut(key string, value []byte) error {
+	tuple, err := newKVSet(key, value)
+	if err != nil {
+		return err
+	}
+	return a.apply(tuple)
+}
+
+func (a *contextAgent) KVDelete(key string) error {
+	tuple, err := newKVDelete(key)
+	if err != nil {
+		return err
+	}
+	return a.apply(tuple)
+}
+
+func (a *contextAgent) SnapshotRestore(r io.Reader) error {
+	return a.snapshotRestore(r, a.apply)
+}
+
+func (a *contextAgent) ACLSet(acl *ACLToken) (string, error) {
+	return a.aclSet(acl, a.apply)
+}
+
+func (a *contextAgent) ACLDelete(id string) error {
+	return a.aclDelete(id, a.apply)
+}
+
+func (a *contextAgent) WithToken(token string) Agent {
+	return &tokenAgent{a.cerebrum, token, a.ctx}
+}
+
+func (a *contextAgent) WithContext(ctx context.Context) Agent {
+	return &contextAgent{a.cerebrum, ctx}
+}
+
+// SnapshotSave has Raft take a snapshot, so the FSM is never snapshotted
+// during an apply, and copies the newest snapshot. A snapshot which is still
+// current is copied as is, as Raft would name a second one at the same index
+// and millisecond alike.
+func (c *cerebrum) SnapshotSave(w io.Writer) error {
+	snaps, err := c.raftSnapshots.List()
+	if err != nil {
+		return err
+	}
+	if len(snaps) == 0 || snaps[0].Index < c.raft.AppliedIndex() {
+		if err := c.raft.Snapshot().Error(); err != nil && err != raft.ErrNothingNewToSnapshot {
+			return err
+		}
+		if snaps, err = c.raftSnapshots.List(); err != nil {
+			return err
+		}
+	}
+	if len(snaps) == 0 {
+		return ErrNoSnapshot
+	}
+	_, r, err := c.raftSnapshots.Open(snaps[0].ID)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	_, err = io.Copy(w, r)
+	return err
+}
+
+func (c *cerebrum) SnapshotRestore(r io.Reader) error {
+	return c.snapshotRestore(r, c.applier.Apply)
+}
+
+// snapshotRestore replicates a restore. The restore replaces the audit log,
+// so it is recorded afterwards.
+func (c *cerebrum) snapshotRestore(r io.Reader, apply func(namedtuple.Tuple) error) error {
+	if err := replicateRestore(r, apply); err != nil {
+		return err
+	}
+	c.audits.Audit(AuditOperator, "snapshot", "restored a snapshot")
+	return nil
+}
+
+func (c *cerebrum) Info() map[string]map[string]string {
+	return map[string]map[string]string{
+		"agent": map[string]string{
+			"id":          c.config.NodeID,
+			"name":        c.config.NodeName,
+			"dc":          c.config.DataCenter,
+			"leader":      c.raft.Leader(),
+			"state_index": fmt.Sprintf("%d", c.state.Index()),
+		},
+		"raft":    c.raftStats(),
+		"serf":    c.serfStats(),
+		"streams": c.streamStats.Stats(),
+		"pool":    c.pool.Stats(),
+	}
+}
+
+// raftStats describes Raft. The Stats of the vendored Raft and Serf read
+// state owned by their run loops, so the stats are gathered from their safe
+// accessors instead.
+func (c *cerebrum) raftStats() map[string]string {
+	stats := map[string]string{
+		"state":         c.raft.State().String(),
+		"applied_term":  strconv.FormatUint(c.fsm.appliedTerm(), 10),
+		"last_index":    strconv.FormatUint(c.raft.LastIndex(), 10),
+		"applied_index": strconv.FormatUint(c.raft.AppliedIndex(), 10),
+		"last_contact":  "never",
+	}
+	if peers, err := c.raftPeers.Peers(); err == nil {
+		stats["num_peers"] = strconv.Itoa(len(raft.ExcludePeer(peers, c.raftTransport.LocalAddr())))
+	}
+	if c.raft.State() == raft.Leader {
+		stats["last_contact"] = "0"
+	} else if last := c.raft.LastContact(); !last.IsZero() {
+		stats["last_contact"] = time.Since(last).String()
+	}
+	return stats
+}
+
+// serfStats describes Serf from its locked list of members.
+func (c *cerebrum) serfStats() map[string]string {
+	var failed, left int
+	members := c.serf.Members()
+	for _, m := range members {
+		switch m.Status {
+		case serf.StatusFailed:
+			failed++
+		case serf.StatusLeft:
+			left++
+		}
+	}
+	return map[string]string{
+		"members":   strconv.Itoa(len(members)),
+		"failed":    strconv.Itoa(failed),
+		"left":      strconv.Itoa(left),
+		"encrypted": strconv.FormatBool(c.serf.EncryptionEnabled()),
+	}
+}
+
+// newKVSet builds a KVSet tuple.
+func newKVSet(key string, value []byte) (t namedtuple.Tuple, err error) {
+	builder := namedtuple.NewBuilder(kvSet, make([]byte, len(key)+len(value)+32))
+	if _, err = builder.PutString("Key", key); err != nil {
+		return
+	}
+	if _, err = builder.PutUint8Array("Value", value); err != nil {
+		return
+	}
+	return builder.Build()
+}
+
+// newKVDelete builds a KVDelete tuple.
+func newKVDelete(key string) (t namedtuple.Tuple, err error) {
+	builder := namedtuple.NewBuilder(kvDelete, make([]byte, len(key)+16))
+	if _, err = builder.PutString("Key", key); err != nil {
+		return
+	}
+	return builder.Build()
+}
+
+// restoreChunkSize is the size of the chunks a restore is replicated in.
+// Each chunk is a Raft entry, which followers forward to the leader in a
+// frame of at most maxForwardSize.
+const restoreChunkSize = maxForwardSize - 64<<10
+
+// replicateRestore validates a snapshot written by SnapshotSave and applies
+// it in Restore chunks. The FSM restores the snapshot with the last chunk.
+func replicateRestore(r io.Reader, apply func(namedtuple.Tuple) error) error {
+	// Validate the cerebrum state before replicating anything; the user FSM
+	// state following it is streamed
+	var head bytes.Buffer
+	var snap stateSnapshot
+	if err := json.NewDecoder(io.TeeReader(r, &head)).Decode(&snap); err != nil {
+		return fmt.Errorf("invalid snapshot: %v", err)
+	}
+	r = io.MultiReader(&head, r)
+
+	id := randomID(16)
+	buf := make([]byte, restoreChunkSize)
+	for offset := uint64(0); ; {
+		n, err := io.ReadFull(r, buf)
+		last := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !last {
+			return err
+		}
+		tuple, err := newRestoreChunk(id, offset, buf[:n], last)
+		if err != nil {
+			return err
+		}
+		if err = apply(tuple); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+		offset += uint64(n)
+	}
+}
+
+// newRestoreChunk builds a Restore tuple holding the chunk of a snapshot at
+// the offset.
+func newRestoreChunk(id string, offset uint64, data []byte, last bool) (t namedtuple.Tuple, err error) {
+	var end uint8
+	if last {
+		end = 1
+	}
+	builder := namedtuple.NewBuilder(stateRestore, make([]byte, len(data)+len(id)+32))
+	if _, err = builder.PutUint8Array("Data", data); err != nil {
+		return
+	}
+	if _, err = builder.PutString("ID", id); err != nil {
+		return
+	}
+	if _, err = builder.PutUint64("Offset", offset); err != nil {
+		return
+	}
+	if _, err = builder.PutUint8("Last", end); err != nil {
+		return
+	}
+	return builder.Build()
+}
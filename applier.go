@@ -1,13 +1,13 @@
 package cerebrum
 
 import (
-	"bytes"
 	"time"
 
 	"github.com/hashicorp/raft"
 	log "github.com/mgutz/logxi/v1"
 
 	"github.com/blacklabeldata/namedtuple"
+	"golang.org/x/net/context"
 )
 
 // Applier applies tuples to the Raft log if the node is the leader, otherwise
@@ -15,8 +15,19 @@ import (
 type Applier interface {
 
 	// Apply performs the Raft or forward operation depending on the node's
-	// leader status.
+	// leader status. The tuple is applied with the privileges of the node.
 	Apply(namedtuple.Tuple) error
+
+	// ApplyWithToken authorizes the tuple with the ACL token before applying
+	// it. Forwarded tuples carry the token so the leader authorizes them
+	// again.
+	ApplyWithToken(namedtuple.Tuple, string) error
+
+	// ApplyContext and ApplyWithTokenContext are Apply and ApplyWithToken
+	// within the trace of the context. The span is carried to the leader and
+	// into the FSM.
+	ApplyContext(context.Context, namedtuple.Tuple) error
+	ApplyWithTokenContext(context.Context, namedtuple.Tuple, string) error
 }
 
 // RaftApplier covers a few of the raft.Raft methods to make testing easier.
@@ -26,11 +37,21 @@ type RaftApplier interface {
 	Leader() string
 }
 
-func NewApplier(r RaftApplier, f Forwarder, l log.Logger, timeout time.Duration) Applier {
+// NewApplier creates an Applier. The agent token is sent with the tuples the
+// node forwards on its own behalf. Denied tuples are recorded with the
+// Auditor unless it is nil, which is called by the caller of Apply and must
+// not block. Applies are traced with the Tracer unless it is
+// nil.
+func NewApplier(r RaftApplier, f Forwarder, acl ACLResolver, agentToken string, a Auditor, t *Tracer, m *Telemetry, l log.Logger, timeout time.Duration) Applier {
 	return &applier{
 		logger:       l,
 		raft:         r,
 		forwarder:    f,
+		acl:          acl,
+		agentToken:   agentToken,
+		auditor:      a,
+		tracer:       t,
+		telemetry:    m,
 		enqueueLimit: timeout,
 	}
 }
@@ -39,19 +60,292 @@ type applier struct {
 	logger       log.Logger
 	raft         RaftApplier
 	forwarder    Forwarder
+	acl          ACLResolver
+	agentToken   string
+	auditor      Auditor
+	tracer       *Tracer
+	telemetry    *Telemetry
 	enqueueLimit time.Duration
 }
 
 func (c *applier) Apply(tuple namedtuple.Tuple) error {
-	var buf bytes.Buffer
-	tuple.WriteTo(&buf)
-	data := buf.Bytes()
+	return c.ApplyContext(context.Background(), tuple)
+}
+
+func (c *applier) ApplyWithToken(tuple namedtuple.Tuple, token string) error {
+	return c.ApplyWithTokenContext(context.Background(), tuple, token)
+}
+
+func (c *applier) ApplyContext(ctx context.Context, tuple namedtuple.Tuple) error {
+	return c.apply(ctx, tuple, c.agentToken)
+}
+
+func (c *applier) ApplyWithTokenContext(ctx context.Context, tuple namedtuple.Tuple, token string) error {
+	authz, err := c.acl.ResolveToken(token)
+	if err != nil {
+		return err
+	}
+	if err = authorizeTuple(authz, tuple); err != nil {
+		c.telemetry.IncrCounter([]string{"apply", "denied"}, 1)
+		c.logger.Warn("Denied tuple", "type", tuple.Header.Type.Name, "err", err)
+
+		// Denied audit events are not recorded, which would deny again
+		if c.auditor != nil && !tuple.Is(auditEvent) {
+			c.auditor.Audit(AuditACLDenied, tuple.Header.Type.Name, "write denied")
+		}
+		return err
+	}
+	return c.apply(ctx, tuple, token)
+}
+
+func (c *applier) apply(ctx context.Context, tuple namedtuple.Tuple, token string) (err error) {
+	span, _ := c.tracer.StartSpan(ctx, "apply")
+	span.SetAttribute("type", tuple.Header.Type.Name)
+	defer func() { span.Finish(err) }()
+
+	data, err := encodeTuple(tuple)
+	if err != nil {
+		c.logger.Warn("Failed to encode tuple", "err", err)
+		return err
+	}
 
 	if c.raft.State() == raft.Leader {
+		span.SetAttribute("role", "leader")
+		defer c.telemetry.MeasureSince([]string{"apply", "leader"}, time.Now())
+		if id := requestIDFromContext(ctx); id.client != "" {
+			if data, err = encodeOnce(data, id, time.Now()); err != nil {
+				c.logger.Warn("Failed to encode request ID", "err", err)
+				return err
+			}
+		}
+		if span != nil {
+			if data, err = encodeTraced(data, span.Context()); err != nil {
+				c.logger.Warn("Failed to encode traced tuple", "err", err)
+				return err
+			}
+		}
 		future := c.raft.Apply(data, c.enqueueLimit)
-		return future.Error()
+		if err = future.Error(); err == nil {
+			// Tuples which the FSM failed to apply return its error
+			err, _ = future.Response().(error)
+		}
+		if err != nil {
+			c.telemetry.IncrCounter([]string{"apply", "leader", "errors"}, 1)
+		}
+		return err
 	}
 
-	// Handle leader forwarding
-	return c.forwarder.Forward(data)
+	// Handle leader forwarding. Forwards without a client ID get a random
+	// one, which a node forwarding them again after losing the leadership
+	// keeps.
+	span.SetAttribute("role", "follower")
+	defer c.telemetry.MeasureSince([]string{"apply", "forward"}, time.Now())
+	id := requestIDFromContext(ctx)
+	if id.client == "" {
+		id = requestID{client: randomID(16)}
+	}
+	if data, err = encodeForward(data, token, span.Context(), id); err != nil {
+		c.logger.Warn("Failed to encode forwarded tuple", "err", err)
+		return err
+	}
+	if err = c.forwarder.Forward(ctx, data); err != nil {
+		c.telemetry.IncrCounter([]string{"apply", "forward", "errors"}, 1)
+	}
+	return err
+}
+
+// requestID identifies a request so the FSM applies its retries once.
+// Forwards without a client ID have a random one and sequence number zero,
+// for which the FSM only keeps the error of the apply.
+type requestID struct {
+	client string
+	seq    uint64
+}
+
+type requestIDKey struct{}
+
+// ContextWithClientSeq returns a context whose applies carry the ID of a
+// client and the sequence number of its request. The FSM applies each
+// sequence number of a client once, for DedupWindow, and answers retries
+// with the error of the first apply. Clients number their requests from one
+// and wait for each before sending the next; the FSM refuses sequence
+// numbers below the last one applied with ErrStaleSequence.
+func ContextWithClientSeq(ctx context.Context, client string, seq uint64) context.Context {
+	return contextWithRequestID(ctx, requestID{client, seq})
+}
+
+func contextWithRequestID(ctx context.Context, id requestID) context.Context {
+	if id.client == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// requestIDFromContext returns the ID of the request applied within the
+// context. The client ID is empty if it has none.
+func requestIDFromContext(ctx context.Context) requestID {
+	id, _ := ctx.Value(requestIDKey{}).(requestID)
+	return id
+}
+
+// encodeForward wraps an encoded tuple with the ACL token, the span and the
+// ID of the request.
+func encodeForward(data []byte, token string, span SpanContext, id requestID) ([]byte, error) {
+	size := len(data) + len(token) + len(span.TraceID) + len(span.SpanID) + len(id.client) + 72
+	builder := namedtuple.NewBuilder(forwardReq, make([]byte, size))
+	if _, err := builder.PutString("Token", token); err != nil {
+		return nil, err
+	}
+	if _, err := builder.PutString("TraceID", span.TraceID); err != nil {
+		return nil, err
+	}
+	if _, err := builder.PutString("SpanID", span.SpanID); err != nil {
+		return nil, err
+	}
+	if _, err := builder.PutUint8Array("Data", data); err != nil {
+		return nil, err
+	}
+	if _, err := builder.PutString("ID", id.client); err != nil {
+		return nil, err
+	}
+	if _, err := builder.PutUint64("Seq", id.seq); err != nil {
+		return nil, err
+	}
+	tuple, err := builder.Build()
+	if err != nil {
+		return nil, err
+	}
+	return encodeTuple(tuple)
+}
+
+// decodeForward unwraps a forwarded tuple, its ACL token, its span and its
+// request ID. The ID is empty for tuples forwarded by older nodes.
+func decodeForward(t namedtuple.Tuple) (msg forwarded, err error) {
+	if msg.token, err = tupleString(t, "Token"); err != nil {
+		return
+	}
+	if msg.span, err = decodeSpanContext(t); err != nil {
+		return
+	}
+	data, err := tupleBytes(t, "Data")
+	if err != nil {
+		return
+	}
+	if msg.tuple, err = decodeTuple(data); err != nil {
+		return
+	}
+	msg.id.client, _ = tupleString(t, "ID")
+	msg.id.seq, _ = tupleUint64(t, "Seq")
+	return
+}
+
+// encodeForwardAck encodes the acknowledgement of a forward.
+func encodeForwardAck(id string, applyErr error) ([]byte, error) {
+	var msg string
+	if applyErr != nil {
+		msg = applyErr.Error()
+	}
+	builder := namedtuple.NewBuilder(forwardAck, make([]byte, len(id)+len(msg)+32))
+	if _, err := builder.PutString("ID", id); err != nil {
+		return nil, err
+	}
+	if _, err := builder.PutString("Error", msg); err != nil {
+		return nil, err
+	}
+	tuple, err := builder.Build()
+	if err != nil {
+		return nil, err
+	}
+	return encodeTuple(tuple)
+}
+
+// decodeForwardAck returns the ID of an acknowledged forward and the error of
+// its apply.
+func decodeForwardAck(t namedtuple.Tuple) (string, error, error) {
+	id, err := tupleString(t, "ID")
+	if err != nil {
+		return "", nil, err
+	}
+	msg, err := tupleString(t, "Error")
+	if err != nil || msg == "" {
+		return id, nil, err
+	}
+	return id, rpcError(msg), nil
+}
+
+// encodeOnce wraps an encoded tuple with its request ID and the time of the
+// apply.
+func encodeOnce(data []byte, id requestID, now time.Time) ([]byte, error) {
+	builder := namedtuple.NewBuilder(onceReq, make([]byte, len(data)+len(id.client)+48))
+	if _, err := builder.PutString("ID", id.client); err != nil {
+		return nil, err
+	}
+	if _, err := builder.PutUint64("Seq", id.seq); err != nil {
+		return nil, err
+	}
+	if _, err := builder.PutInt64("Time", now.UnixNano()); err != nil {
+		return nil, err
+	}
+	if _, err := builder.PutUint8Array("Data", data); err != nil {
+		return nil, err
+	}
+	tuple, err := builder.Build()
+	if err != nil {
+		return nil, err
+	}
+	return encodeTuple(tuple)
+}
+
+// decodeOnce unwraps an encoded tuple, its request ID and the time of the
+// apply.
+func decodeOnce(t namedtuple.Tuple) (id requestID, at int64, data []byte, err error) {
+	if id.client, err = tupleString(t, "ID"); err != nil {
+		return
+	}
+	if id.seq, err = tupleUint64(t, "Seq"); err != nil {
+		return
+	}
+	if at, err = tupleInt64(t, "Time"); err != nil {
+		return
+	}
+	data, err = tupleBytes(t, "Data")
+	return
+}
+
+// encodeTraced wraps an encoded tuple with the span of the leader's apply.
+func encodeTraced(data []byte, span SpanContext) ([]byte, error) {
+	size := len(data) + len(span.TraceID) + len(span.SpanID) + 32
+	builder := namedtuple.NewBuilder(tracedReq, make([]byte, size))
+	if _, err := builder.PutString("TraceID", span.TraceID); err != nil {
+		return nil, err
+	}
+	if _, err := builder.PutString("SpanID", span.SpanID); err != nil {
+		return nil, err
+	}
+	if _, err := builder.PutUint8Array("Data", data); err != nil {
+		return nil, err
+	}
+	tuple, err := builder.Build()
+	if err != nil {
+		return nil, err
+	}
+	return encodeTuple(tuple)
+}
+
+// decodeTraced unwraps an encoded tuple and its span.
+func decodeTraced(t namedtuple.Tuple) ([]byte, SpanContext, error) {
+	span, err := decodeSpanContext(t)
+	if err != nil {
+		return nil, span, err
+	}
+	data, err := tupleBytes(t, "Data")
+	return data, span, err
+}
+
+func decodeSpanContext(t namedtuple.Tuple) (span SpanContext, err error) {
+	if span.TraceID, err = tupleString(t, "TraceID"); err != nil {
+		return
+	}
+	span.SpanID, err = tupleString(t, "SpanID")
+	return
 }
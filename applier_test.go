@@ -1,7 +1,7 @@
 package cerebrum
 
 import (
-	"bytes"
+	"fmt"
 	"testing"
 	"time"
 
@@ -11,6 +11,7 @@ import (
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"golang.org/x/net/context"
 )
 
 func TestApplier_FollowerState(t *testing.T) {
@@ -30,19 +31,40 @@ func TestApplier_FollowerState(t *testing.T) {
 	tuple, err := builder.Build()
 	assert.Nil(t, err)
 
-	var buf bytes.Buffer
-	tuple.WriteTo(&buf)
-	data := buf.Bytes()
+	data, err := encodeTuple(tuple)
+	assert.Nil(t, err)
 
 	fwdr := &MockForwarder{}
-	fwdr.On("Forward", data).Return()
+	fwdr.On("Forward", mock.Anything).Return()
 	applier := &applier{
-		logger:    &log.NullLogger{},
-		raft:      raftApplier,
-		forwarder: fwdr,
+		logger:     &log.NullLogger{},
+		raft:       raftApplier,
+		forwarder:  fwdr,
+		agentToken: "agent",
 	}
 	err = applier.Apply(tuple)
 	assert.Nil(t, err)
+
+	// Forwarded tuples carry the agent token and an ID
+	envelope, err := decodeTuple(fwdr.Calls[0].Arguments.Get(0).([]byte))
+	assert.Nil(t, err)
+	msg, err := decodeForward(envelope)
+	assert.Nil(t, err)
+	assert.Equal(t, "agent", msg.token)
+	assert.Len(t, msg.id.client, 32)
+	assert.Equal(t, uint64(0), msg.id.seq)
+	forwarded, err := encodeTuple(msg.tuple)
+	assert.Nil(t, err)
+	assert.Equal(t, data, forwarded)
+
+	// Tuples forwarded with a request ID keep it
+	ctx := ContextWithClientSeq(context.Background(), "client", 7)
+	assert.Nil(t, applier.ApplyContext(ctx, tuple))
+	envelope, err = decodeTuple(fwdr.Calls[1].Arguments.Get(0).([]byte))
+	assert.Nil(t, err)
+	msg, err = decodeForward(envelope)
+	assert.Nil(t, err)
+	assert.Equal(t, requestID{"client", 7}, msg.id)
 }
 
 func TestApplier_LeaderState(t *testing.T) {
@@ -60,25 +82,89 @@ func TestApplier_LeaderState(t *testing.T) {
 	tuple, err := builder.Build()
 	assert.Nil(t, err)
 
-	var buf bytes.Buffer
-	tuple.WriteTo(&buf)
-	data := buf.Bytes()
+	data, err := encodeTuple(tuple)
+	assert.Nil(t, err)
 
 	fwdr := &MockForwarder{}
 	future := &MockApplyFuture{}
 	future.On("Error").Return(nil)
+	future.On("Response").Return()
 
 	raftApplier := &MockRaftApplier{state: raft.Leader, future: future}
 	raftApplier.On("State").Return(raft.Leader)
 	raftApplier.On("Apply", data, time.Second).Return(future)
 
-	applier := NewApplier(raftApplier, fwdr, &log.NullLogger{}, time.Second)
+	applier := NewApplier(raftApplier, fwdr, &aclResolver{}, "", nil, nil, nil, &log.NullLogger{}, time.Second)
 	err = applier.Apply(tuple)
 	assert.Nil(t, err)
 	raftApplier.AssertCalled(t, "Apply", data, time.Second)
 	fwdr.AssertNotCalled(t, "Forward")
 }
 
+func TestApplier_LeaderClientSeq(t *testing.T) {
+	tuple, err := newKVSet("key", []byte("value"))
+	assert.Nil(t, err)
+	data, err := encodeTuple(tuple)
+	assert.Nil(t, err)
+
+	future := &MockApplyFuture{response: ErrStaleSequence}
+	future.On("Error").Return(nil)
+	future.On("Response").Return()
+	raftApplier := &MockRaftApplier{state: raft.Leader, future: future}
+	raftApplier.On("State").Return(raft.Leader)
+	raftApplier.On("Apply", mock.Anything, time.Second).Return(future)
+
+	// Tuples are logged with their request ID, and the error of the FSM is
+	// returned
+	applier := NewApplier(raftApplier, &MockForwarder{}, &aclResolver{}, "", nil, nil, nil, &log.NullLogger{}, time.Second)
+	ctx := ContextWithClientSeq(context.Background(), "client", 7)
+	assert.Equal(t, ErrStaleSequence, applier.ApplyContext(ctx, tuple))
+
+	envelope, err := decodeTuple(raftApplier.Calls[1].Arguments.Get(0).([]byte))
+	assert.Nil(t, err)
+	assert.True(t, envelope.Is(onceReq))
+	id, at, logged, err := decodeOnce(envelope)
+	assert.Nil(t, err)
+	assert.Equal(t, requestID{"client", 7}, id)
+	assert.True(t, at > 0)
+	assert.Equal(t, data, logged)
+}
+
+func TestApplier_TokenDenied(t *testing.T) {
+	tuple, err := newKVSet("private/key", []byte("value"))
+	assert.Nil(t, err)
+
+	state := newStateStore()
+	state.aclSet(1, &ACLToken{ID: "token", Policy: ACLPolicy{
+		KV: []ACLRule{{Prefix: "public/", Access: AccessWrite}},
+	}})
+
+	raftApplier := &MockRaftApplier{state: raft.Follower}
+	fwdr := &MockForwarder{}
+	auditor := make(chanAuditor, 1)
+	applier := NewApplier(raftApplier, fwdr, &aclResolver{state, "", ACLPolicyDeny}, "", auditor, nil, nil, &log.NullLogger{}, time.Second)
+
+	assert.Equal(t, ErrPermissionDenied, applier.ApplyWithToken(tuple, "token"))
+	assert.Equal(t, ErrACLNotFound, applier.ApplyWithToken(tuple, "unknown"))
+	raftApplier.AssertNotCalled(t, "State")
+	fwdr.AssertNotCalled(t, "Forward")
+
+	select {
+	case e := <-auditor:
+		assert.Equal(t, AuditACLDenied, e.Kind)
+		assert.Equal(t, "KVSet", e.Subject)
+	case <-time.After(time.Second):
+		t.Fatal("denial not audited")
+	}
+}
+
+// chanAuditor sends the audited events on the channel.
+type chanAuditor chan *AuditEvent
+
+func (c chanAuditor) Audit(kind, subject, format string, args ...interface{}) {
+	c <- &AuditEvent{Kind: kind, Subject: subject, Message: fmt.Sprintf(format, args...)}
+}
+
 type MockRaftApplier struct {
 	mock.Mock
 	future raft.ApplyFuture
@@ -0,0 +1,217 @@
+package cerebrum
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/blacklabeldata/namedtuple"
+	log "github.com/mgutz/logxi/v1"
+	"golang.org/x/net/context"
+)
+
+// AuditLogSize is the number of audit events retained in the FSM. Older
+// events are dropped.
+const AuditLogSize = 1024
+
+// auditQueueSize is the number of events waiting to be recorded by an
+// auditQueue. Further events are dropped.
+const auditQueueSize = 256
+
+// Kinds of audit events.
+const (
+	AuditMemberAlive  = "member-alive"
+	AuditMemberFailed = "member-failed"
+	AuditMemberLeft   = "member-left"
+	AuditMemberReaped = "member-reaped"
+	AuditLeadership   = "leadership"
+	AuditPeerAdded    = "peer-added"
+	AuditPeerRemoved  = "peer-removed"
+	AuditOperator     = "operator"
+	AuditACLDenied    = "acl-denied"
+)
+
+// AuditEvent is a cluster event replicated through Raft. Node is the node
+// which recorded the event and Subject is the member, peer or object it
+// concerns.
+type AuditEvent struct {
+	Index   uint64
+	Time    time.Time
+	Kind    string
+	Node    string
+	Subject string
+	Message string
+}
+
+// Auditor records events in the audit log.
+type Auditor interface {
+	Audit(kind, subject, format string, args ...interface{})
+}
+
+// Audit records an event in the audit log and waits for Raft. Failures are
+// only logged. The node records its events through its auditQueue, which
+// calls Audit in the background.
+func (c *cerebrum) Audit(kind, subject, format string, args ...interface{}) {
+	tuple, err := newAuditEvent(&AuditEvent{
+		Time:    time.Now().UTC(),
+		Kind:    kind,
+		Node:    c.config.NodeName,
+		Subject: subject,
+		Message: fmt.Sprintf(format, args...),
+	})
+	if err == nil {
+		err = c.applier.Apply(tuple)
+	}
+	if err != nil {
+		c.logger.Warn("Failed to record audit event", "kind", kind, "subject", subject, "err", err)
+	}
+}
+
+// auditQueue records events in the background, so the actions they record
+// never wait for Raft. The queue is bounded and a single worker records the events, so events are dropped
+// rather than piling up while the cluster has no leader. Identical events
+// waiting together are recorded once with their count.
+type auditQueue struct {
+	auditor   Auditor
+	events    chan *AuditEvent
+	telemetry *Telemetry
+	logger    log.Logger
+}
+
+func newAuditQueue(a Auditor, size int, m *Telemetry, l log.Logger) *auditQueue {
+	return &auditQueue{
+		auditor:   a,
+		events:    make(chan *AuditEvent, size),
+		telemetry: m,
+		logger:    l,
+	}
+}
+
+// Audit queues the event, or drops it if the queue is full.
+func (q *auditQueue) Audit(kind, subject, format string, args ...interface{}) {
+	e := &AuditEvent{Kind: kind, Subject: subject, Message: fmt.Sprintf(format, args...)}
+	select {
+	case q.events <- e:
+	default:
+		q.telemetry.IncrCounter([]string{"audit", "dropped"}, 1)
+		q.logger.Debug("Dropped audit event", "kind", kind, "subject", subject)
+	}
+}
+
+// run records the queued events until the context is done.
+func (q *auditQueue) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-q.events:
+			for _, e := range q.coalesce(e) {
+				q.auditor.Audit(e.Kind, e.Subject, "%s", e.Message)
+			}
+		}
+	}
+}
+
+// coalesce takes the events waiting behind the first one and merges the
+// identical ones, keeping the order of their first occurrence.
+func (q *auditQueue) coalesce(first *AuditEvent) []*AuditEvent {
+	events := []*AuditEvent{first}
+	counts := map[AuditEvent]int{*first: 1}
+	for n := len(q.events); n > 0; n-- {
+		e := <-q.events
+		if counts[*e] == 0 {
+			events = append(events, e)
+		}
+		counts[*e]++
+	}
+	for _, e := range events {
+		if n := counts[*e]; n > 1 {
+			e.Message = fmt.Sprintf("%s (%d times)", e.Message, n)
+		}
+	}
+	return events
+}
+
+// memberAuditKinds maps the reconciled member statuses to audit events.
+var memberAuditKinds = map[NodeStatus]string{
+	StatusAlive:  AuditMemberAlive,
+	StatusFailed: AuditMemberFailed,
+	StatusLeft:   AuditMemberLeft,
+	StatusReaped: AuditMemberReaped,
+}
+
+// setMemberStatus updates the status of a member in the catalog and records
+// the transition unless the member already had that status.
+func (c *cerebrum) setMemberStatus(details *NodeDetails, status NodeStatus) error {
+	changed := true
+	for _, node := range c.state.Nodes() {
+		if node.Name == details.Name && node.Status == status {
+			changed = false
+		}
+	}
+	if err := c.updateNodeStatus(details, status); err != nil {
+		return err
+	}
+	if changed {
+		c.audits.Audit(memberAuditKinds[status], details.Name, "status changed to %s", status)
+	}
+	return nil
+}
+
+func (s NodeStatus) String() string {
+	switch s {
+	case StatusAlive:
+		return "alive"
+	case StatusFailed:
+		return "failed"
+	case StatusLeft:
+		return "left"
+	case StatusReaped:
+		return "reaped"
+	}
+	return fmt.Sprintf("unknown(%d)", uint8(s))
+}
+
+// newAuditEvent builds an AuditEvent tuple.
+func newAuditEvent(e *AuditEvent) (t namedtuple.Tuple, err error) {
+	size := len(e.Kind) + len(e.Node) + len(e.Subject) + len(e.Message) + 64
+	builder := namedtuple.NewBuilder(auditEvent, make([]byte, size))
+	if _, err = builder.PutInt64("Time", e.Time.UnixNano()); err != nil {
+		return
+	}
+	if _, err = builder.PutString("Kind", e.Kind); err != nil {
+		return
+	}
+	if _, err = builder.PutString("Node", e.Node); err != nil {
+		return
+	}
+	if _, err = builder.PutString("Subject", e.Subject); err != nil {
+		return
+	}
+	if _, err = builder.PutString("Message", e.Message); err != nil {
+		return
+	}
+	return builder.Build()
+}
+
+// decodeAuditEvent reads an AuditEvent tuple.
+func decodeAuditEvent(t namedtuple.Tuple) (*AuditEvent, error) {
+	var e AuditEvent
+	nanos, err := tupleInt64(t, "Time")
+	if err != nil {
+		return nil, err
+	}
+	e.Time = time.Unix(0, nanos).UTC()
+	if e.Kind, err = tupleString(t, "Kind"); err != nil {
+		return nil, err
+	}
+	if e.Node, err = tupleString(t, "Node"); err != nil {
+		return nil, err
+	}
+	if e.Subject, err = tupleString(t, "Subject"); err != nil {
+		return nil, err
+	}
+	if e.Message, err = tupleString(t, "Message"); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
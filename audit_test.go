@@ -0,0 +1,40 @@
+package cerebrum
+
+import (
+	"testing"
+	"time"
+
+	log "github.com/mgutz/logxi/v1"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestAuditQueue(t *testing.T) {
+	auditor := make(chanAuditor)
+	queue := newAuditQueue(auditor, 4, nil, &log.NullLogger{})
+
+	// Events beyond the size of the queue are dropped without blocking
+	for i := 0; i < 3; i++ {
+		queue.Audit(AuditACLDenied, "KVSet", "write denied")
+	}
+	queue.Audit(AuditOperator, "raft", "forced raft peers")
+	queue.Audit(AuditOperator, "raft", "dropped")
+	assert.Len(t, queue.events, 4)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go queue.run(ctx)
+
+	// Identical events are recorded once with their count
+	for _, expected := range []*AuditEvent{
+		{Kind: AuditACLDenied, Subject: "KVSet", Message: "write denied (3 times)"},
+		{Kind: AuditOperator, Subject: "raft", Message: "forced raft peers"},
+	} {
+		select {
+		case e := <-auditor:
+			assert.Equal(t, expected, e)
+		case <-time.After(time.Second):
+			t.Fatal("event not recorded")
+		}
+	}
+}
@@ -0,0 +1,307 @@
+package cerebrum
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/hashicorp/go-msgpack/codec"
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb"
+)
+
+// Buckets of the bolt store, named as by raft-boltdb.
+var (
+	boltLogs = []byte("logs")
+	boltConf = []byte("conf")
+)
+
+// boltCompactBatch is the number of keys copied in each transaction of a
+// compaction.
+const boltCompactBatch = 10000
+
+// boltStore is the RaftStore of BoltRaftStore. It keeps the file format of
+// raft-boltdb, which it replaces as bolt never returns the pages freed by
+// deleted logs to the file system unless the file is compacted.
+type boltStore struct {
+	path string
+
+	// lock is held for writing while the file is compacted, which pauses
+	// the reads and writes of Raft
+	lock sync.RWMutex
+	db   *bolt.DB
+}
+
+// boltStats describes the file of a boltStore.
+type boltStats struct {
+	Size         int64
+	FreePages    int
+	PendingPages int
+}
+
+func openBoltStore(path string) (*boltStore, error) {
+	db, err := openBolt(path)
+	if err != nil {
+		return nil, err
+	}
+	return &boltStore{path: path, db: db}, nil
+}
+
+// openBolt opens a bolt file and creates the buckets of the store.
+func openBolt(path string) (*bolt.DB, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(boltLogs); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(boltConf)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+func (s *boltStore) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.db.Close()
+}
+
+func (s *boltStore) FirstIndex() (uint64, error) {
+	return s.edgeIndex(func(c *bolt.Cursor) ([]byte, []byte) { return c.First() })
+}
+
+func (s *boltStore) LastIndex() (uint64, error) {
+	return s.edgeIndex(func(c *bolt.Cursor) ([]byte, []byte) { return c.Last() })
+}
+
+// edgeIndex returns the index of the log the cursor is moved to, or zero if
+// there are none.
+func (s *boltStore) edgeIndex(move func(*bolt.Cursor) ([]byte, []byte)) (index uint64, err error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	err = s.db.View(func(tx *bolt.Tx) error {
+		if k, _ := move(tx.Bucket(boltLogs).Cursor()); k != nil {
+			index = binary.BigEndian.Uint64(k)
+		}
+		return nil
+	})
+	return
+}
+
+func (s *boltStore) GetLog(index uint64, log *raft.Log) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.db.View(func(tx *bolt.Tx) error {
+		val := tx.Bucket(boltLogs).Get(uint64Bytes(index))
+		if val == nil {
+			return raft.ErrLogNotFound
+		}
+		var handle codec.MsgpackHandle
+		return codec.NewDecoder(bytes.NewReader(val), &handle).Decode(log)
+	})
+}
+
+func (s *boltStore) StoreLog(log *raft.Log) error {
+	return s.StoreLogs([]*raft.Log{log})
+}
+
+func (s *boltStore) StoreLogs(logs []*raft.Log) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltLogs)
+		var handle codec.MsgpackHandle
+		for _, log := range logs {
+			var buf bytes.Buffer
+			if err := codec.NewEncoder(&buf, &handle).Encode(log); err != nil {
+				return err
+			}
+			if err := bucket.Put(uint64Bytes(log.Index), buf.Bytes()); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) DeleteRange(min, max uint64) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.db.Update(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltLogs).Cursor()
+		for k, _ := c.Seek(uint64Bytes(min)); k != nil && binary.BigEndian.Uint64(k) <= max; k, _ = c.Next() {
+			if err := c.Delete(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) Set(key, val []byte) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltConf).Put(key, val)
+	})
+}
+
+// Get returns raftboltdb.ErrKeyNotFound for missing keys, which Raft expects
+// of a new store.
+func (s *boltStore) Get(key []byte) (val []byte, err error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	err = s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(boltConf).Get(key)
+		if v == nil {
+			return raftboltdb.ErrKeyNotFound
+		}
+		val = append([]byte{}, v...)
+		return nil
+	})
+	return
+}
+
+func (s *boltStore) SetUint64(key []byte, val uint64) error {
+	return s.Set(key, uint64Bytes(val))
+}
+
+func (s *boltStore) GetUint64(key []byte) (uint64, error) {
+	val, err := s.Get(key)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(val), nil
+}
+
+// stats describes the file of the store.
+func (s *boltStore) stats() (boltStats, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return boltStats{}, err
+	}
+	db := s.db.Stats()
+	return boltStats{Size: info.Size(), FreePages: db.FreePageN, PendingPages: db.PendingPageN}, nil
+}
+
+// Compact copies the data of the store into a new file and swaps it for the
+// old one, which releases its free pages. Raft waits for the store in the
+// meantime. It returns the sizes of the file before and after.
+func (s *boltStore) Compact() (before, after int64, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return 0, 0, err
+	}
+	before = info.Size()
+
+	tmp := s.path + ".compact"
+	os.Remove(tmp)
+	if err = compactBolt(s.db, tmp); err != nil {
+		os.Remove(tmp)
+		return before, 0, err
+	}
+
+	// The new file is opened before it replaces the old one, so the store
+	// keeps the old file if either fails
+	db, err := openBolt(tmp)
+	if err != nil {
+		os.Remove(tmp)
+		return before, 0, err
+	}
+	if err = os.Rename(tmp, s.path); err != nil {
+		db.Close()
+		os.Remove(tmp)
+		return before, 0, err
+	}
+	s.db.Close()
+	s.db = db
+
+	// Persist the rename
+	if err = syncDir(filepath.Dir(s.path)); err != nil {
+		return before, 0, err
+	}
+
+	if info, err = os.Stat(s.path); err != nil {
+		return before, 0, err
+	}
+	return before, info.Size(), nil
+}
+
+// syncDir flushes the entries of a directory to disk.
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	err = dir.Sync()
+	if closeErr := dir.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// compactBolt copies the buckets of src into a new file at path. Keys are
+// copied in order, so the pages of the new file are filled.
+func compactBolt(src *bolt.DB, path string) error {
+	dst, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return err
+	}
+	err = src.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			return copyBucket(dst, name, b)
+		})
+	})
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// copyBucket copies a bucket without nested buckets in batches.
+func copyBucket(dst *bolt.DB, name []byte, b *bolt.Bucket) error {
+	c := b.Cursor()
+	k, v := c.First()
+	for first := true; first || k != nil; first = false {
+		err := dst.Update(func(tx *bolt.Tx) error {
+			bucket, err := tx.CreateBucketIfNotExists(name)
+			if err != nil {
+				return err
+			}
+			bucket.FillPercent = 1.0
+			for n := 0; k != nil && n < boltCompactBatch; n++ {
+				if err := bucket.Put(k, v); err != nil {
+					return err
+				}
+				k, v = c.Next()
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func uint64Bytes(u uint64) []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, u)
+	return buf
+}
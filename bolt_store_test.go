@@ -0,0 +1,139 @@
+package cerebrum
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb"
+	"github.com/stretchr/testify/assert"
+)
+
+func testBoltStore(t *testing.T) (*boltStore, func()) {
+	dir, err := ioutil.TempDir("", "cerebrum-bolt")
+	assert.Nil(t, err)
+	store, err := openBoltStore(filepath.Join(dir, "raft.db"))
+	assert.Nil(t, err)
+	return store, func() {
+		store.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestBoltStore_Logs(t *testing.T) {
+	store, cleanup := testBoltStore(t)
+	defer cleanup()
+
+	first, err := store.FirstIndex()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), first)
+
+	logs := []*raft.Log{
+		{Index: 1, Term: 1, Type: raft.LogCommand, Data: []byte("a")},
+		{Index: 2, Term: 1, Type: raft.LogCommand, Data: []byte("b")},
+		{Index: 3, Term: 2, Type: raft.LogCommand, Data: []byte("c")},
+	}
+	assert.Nil(t, store.StoreLogs(logs))
+
+	var log raft.Log
+	assert.Nil(t, store.GetLog(2, &log))
+	assert.Equal(t, *logs[1], log)
+	assert.Equal(t, raft.ErrLogNotFound, store.GetLog(4, &log))
+
+	assert.Nil(t, store.DeleteRange(1, 2))
+	first, _ = store.FirstIndex()
+	last, _ := store.LastIndex()
+	assert.Equal(t, uint64(3), first)
+	assert.Equal(t, uint64(3), last)
+}
+
+func TestBoltStore_Stable(t *testing.T) {
+	store, cleanup := testBoltStore(t)
+	defer cleanup()
+
+	_, err := store.Get([]byte("missing"))
+	assert.Equal(t, raftboltdb.ErrKeyNotFound, err)
+
+	assert.Nil(t, store.Set([]byte("key"), []byte("value")))
+	val, err := store.Get([]byte("key"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value"), val)
+
+	assert.Nil(t, store.SetUint64([]byte("term"), 42))
+	term, err := store.GetUint64([]byte("term"))
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(42), term)
+}
+
+func TestBoltStore_Compact(t *testing.T) {
+	store, cleanup := testBoltStore(t)
+	defer cleanup()
+
+	data := make([]byte, 1024)
+	for i := uint64(1); i <= 8000; i++ {
+		assert.Nil(t, store.StoreLog(&raft.Log{Index: i, Term: 1, Data: data}))
+	}
+	assert.Nil(t, store.SetUint64([]byte("term"), 1))
+	assert.Nil(t, store.DeleteRange(1, 7990))
+
+	stats, err := store.stats()
+	assert.Nil(t, err)
+	assert.True(t, stats.FreePages > 0)
+
+	before, after, err := store.Compact()
+	assert.Nil(t, err)
+	assert.Equal(t, stats.Size, before)
+	assert.True(t, after < before/4, "compaction should release the free pages")
+
+	// The remaining logs and keys survive and the store stays writable
+	first, _ := store.FirstIndex()
+	last, _ := store.LastIndex()
+	assert.Equal(t, uint64(7991), first)
+	assert.Equal(t, uint64(8000), last)
+	var log raft.Log
+	assert.Nil(t, store.GetLog(7995, &log))
+	assert.Equal(t, data, log.Data)
+	term, err := store.GetUint64([]byte("term"))
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1), term)
+	assert.Nil(t, store.StoreLog(&raft.Log{Index: 8001, Term: 1}))
+
+	_, err = os.Stat(store.path + ".compact")
+	assert.True(t, os.IsNotExist(err))
+
+	// The compacted file replaced the file of the store
+	assert.Nil(t, store.Close())
+	reopened, err := openBoltStore(store.path)
+	if assert.Nil(t, err) {
+		store.db = reopened.db
+		last, _ = store.LastIndex()
+		assert.Equal(t, uint64(8001), last)
+	}
+}
+
+func TestBoltStore_RaftBoltDBFormat(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cerebrum-bolt")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "raft.db")
+
+	// Files written by raft-boltdb are read by the store
+	old, err := raftboltdb.NewBoltStore(path)
+	assert.Nil(t, err)
+	expected := &raft.Log{Index: 7, Term: 3, Type: raft.LogCommand, Data: []byte("data")}
+	assert.Nil(t, old.StoreLog(expected))
+	assert.Nil(t, old.SetUint64([]byte("term"), 3))
+	old.Close()
+
+	store, err := openBoltStore(path)
+	assert.Nil(t, err)
+	defer store.Close()
+	var log raft.Log
+	assert.Nil(t, store.GetLog(7, &log))
+	assert.Equal(t, *expected, log)
+	term, err := store.GetUint64([]byte("term"))
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(3), term)
+}
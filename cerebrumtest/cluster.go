@@ -0,0 +1,275 @@
+package cerebrumtest
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/blacklabeldata/cerebrum"
+	"github.com/hashicorp/raft"
+)
+
+// DefaultWait is how long the Wait helpers poll before failing the test.
+var DefaultWait = 10 * time.Second
+
+// Node is a node of a test cluster.
+type Node struct {
+	cerebrum.Cerebrum
+
+	Name       string
+	Config     *cerebrum.Config
+	RaftAddr   string
+	GossipAddr string
+}
+
+// Cluster is a cluster of nodes running in the test process. Raft,
+// forwarding and admin streams run over an in-memory Network with Faults
+// between the nodes by name; gossip runs over loopback on free ports and is
+// not affected by partitions or faults. The Raft logs are kept in memory.
+type Cluster struct {
+	t       testing.TB
+	dir     string
+	Network *Network
+	Faults  *Faults
+	Nodes   []*Node
+}
+
+// NewCluster starts n nodes in the data center dc1. The first node
+// bootstraps Raft and the others join it once it leads. Every config is passed to the
+// configure functions before the node is created.
+func NewCluster(t testing.TB, n int, configure ...func(*cerebrum.Config)) *Cluster {
+	dir, err := ioutil.TempDir("", "cerebrumtest")
+	if err != nil {
+		t.Fatalf("failed to create data dir: %v", err)
+	}
+	ca, err := NewCA()
+	if err != nil {
+		t.Fatalf("failed to create CA: %v", err)
+	}
+	c := &Cluster{t: t, dir: dir, Network: NewNetwork(), Faults: NewFaults()}
+
+	for i := 0; i < n; i++ {
+		tlsConfig, err := ca.TLSConfig(cerebrum.RoleServer, "dc1")
+		if err != nil {
+			c.Shutdown()
+			t.Fatalf("failed to issue certificate: %v", err)
+		}
+		port, err := freePort()
+		if err != nil {
+			c.Shutdown()
+			t.Fatalf("failed to find a gossip port: %v", err)
+		}
+
+		// Raft addresses are never bound, they only name the node on the
+		// in-memory network. The Raft port is advertised in the Serf tags.
+		name := fmt.Sprintf("node%d", i+1)
+		raftAddr := "127.0.0.1:" + strconv.Itoa(8300+i)
+		config := cerebrum.DefaultConfig()
+		config.NodeID = name
+		config.NodeName = name
+		config.DataPath = filepath.Join(dir, name)
+		config.Bootstrap = i == 0
+		config.GossipBindAddr = "127.0.0.1"
+		config.GossipBindPort = port
+		config.RaftBindAddr = raftAddr
+		config.Network = c.Faults.Network(name, c.Network.Node(raftAddr))
+		config.RaftStore = cerebrum.InmemRaftStore{}
+		config.TLSConfig = tlsConfig
+		config.LogOutput = ioutil.Discard
+		config.LogLevel = "error"
+		config.ReconcileInterval = time.Second
+		config.RaftConfig = fastRaftConfig()
+		if i > 0 {
+			config.ExistingNodes = []string{c.Nodes[0].GossipAddr}
+		}
+		for _, fn := range configure {
+			fn(config)
+		}
+
+		node, err := cerebrum.New(config)
+		if err != nil {
+			c.Shutdown()
+			t.Fatalf("failed to create %s: %v", name, err)
+		}
+		if err := node.Start(); err != nil {
+			node.Stop()
+			c.Shutdown()
+			t.Fatalf("failed to start %s: %v", name, err)
+		}
+		c.Nodes = append(c.Nodes, &Node{
+			Cerebrum:   node,
+			Name:       name,
+			Config:     config,
+			RaftAddr:   raftAddr,
+			GossipAddr: net.JoinHostPort(config.GossipBindAddr, strconv.Itoa(port)),
+		})
+
+		// The leader only adds the members which join after its election
+		if i == 0 {
+			c.WaitForLeader()
+		}
+	}
+	return c
+}
+
+// fastRaftConfig shortens the Raft timeouts for the in-memory network.
+func fastRaftConfig() *raft.Config {
+	conf := raft.DefaultConfig()
+	conf.HeartbeatTimeout = 100 * time.Millisecond
+	conf.ElectionTimeout = 100 * time.Millisecond
+	conf.LeaderLeaseTimeout = 50 * time.Millisecond
+	conf.CommitTimeout = 5 * time.Millisecond
+	return conf
+}
+
+// freePort returns a loopback port which is free for both TCP and UDP, as
+// memberlist binds both.
+func freePort() (int, error) {
+	for i := 0; i < 10; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return 0, err
+		}
+		port := l.Addr().(*net.TCPAddr).Port
+		p, err := net.ListenPacket("udp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+		l.Close()
+		if err != nil {
+			continue
+		}
+		p.Close()
+		return port, nil
+	}
+	return 0, fmt.Errorf("no free port")
+}
+
+// Shutdown stops the nodes and removes their data.
+func (c *Cluster) Shutdown() {
+	for _, node := range c.Nodes {
+		node.Stop()
+	}
+	os.RemoveAll(c.dir)
+}
+
+// Leader returns the node which is the Raft leader, or nil.
+func (c *Cluster) Leader() *Node {
+	for _, node := range c.Nodes {
+		if isLeader(node) {
+			return node
+		}
+	}
+	return nil
+}
+
+func isLeader(node *Node) bool {
+	return node.Info()["raft"]["state"] == raft.Leader.String()
+}
+
+// WaitForLeader waits until exactly one of the nodes, or of all nodes if
+// none are given, is the leader and the others know it. It returns the
+// leader.
+func (c *Cluster) WaitForLeader(nodes ...*Node) *Node {
+	if len(nodes) == 0 {
+		nodes = c.Nodes
+	}
+	var leader *Node
+	c.WaitFor("a leader", func() bool {
+		leader = nil
+		for _, node := range nodes {
+			if isLeader(node) {
+				if leader != nil {
+					return false
+				}
+				leader = node
+			}
+		}
+		if leader == nil {
+			return false
+		}
+		for _, node := range nodes {
+			if node.Info()["agent"]["leader"] != leader.RaftAddr {
+				return false
+			}
+		}
+		return true
+	})
+	return leader
+}
+
+// WaitForMembers waits until every node sees n alive gossip members.
+func (c *Cluster) WaitForMembers(n int) {
+	c.WaitFor(fmt.Sprintf("%d members", n), func() bool {
+		for _, node := range c.Nodes {
+			alive := 0
+			for _, m := range node.Members() {
+				if m.Status == "alive" {
+					alive++
+				}
+			}
+			if alive != n {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// WaitForPeers waits until the Raft configuration of every node has n
+// peers.
+func (c *Cluster) WaitForPeers(n int) {
+	c.WaitFor(fmt.Sprintf("%d peers", n), func() bool {
+		for _, node := range c.Nodes {
+			if node.Info()["raft"]["num_peers"] != strconv.Itoa(n-1) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// Partition cuts the Raft, forwarding and admin connections between the
+// nodes and the rest of the cluster. Gossip is not affected.
+func (c *Cluster) Partition(nodes ...*Node) {
+	addrs := make([]string, 0, len(nodes))
+	for _, node := range nodes {
+		addrs = append(addrs, node.RaftAddr)
+	}
+	c.Network.Partition(addrs...)
+}
+
+// Heal removes all partitions and faults.
+func (c *Cluster) Heal() {
+	c.Network.Heal()
+	c.Faults.Clear()
+}
+
+// Others returns the nodes except the given ones.
+func (c *Cluster) Others(nodes ...*Node) []*Node {
+	var others []*Node
+	for _, node := range c.Nodes {
+		excluded := false
+		for _, n := range nodes {
+			excluded = excluded || n == node
+		}
+		if !excluded {
+			others = append(others, node)
+		}
+	}
+	return others
+}
+
+// WaitFor polls the condition until it holds or DefaultWait passes, in
+// which case the test fails.
+func (c *Cluster) WaitFor(what string, cond func() bool) {
+	deadline := time.Now().Add(DefaultWait)
+	for !cond() {
+		if time.Now().After(deadline) {
+			c.t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
@@ -0,0 +1,216 @@
+package cerebrumtest
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/blacklabeldata/cerebrum"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestCluster_Partition(t *testing.T) {
+	c := NewCluster(t, 3)
+	defer c.Shutdown()
+
+	c.WaitForMembers(3)
+	c.WaitForPeers(3)
+	leader := c.WaitForLeader()
+
+	// Writes on followers are forwarded to the leader
+	var follower *Node
+	for _, node := range c.Nodes {
+		if node != leader {
+			follower = node
+		}
+	}
+	assert.Nil(t, follower.KVPut("key", []byte("v1")))
+	c.WaitFor("replication", func() bool {
+		for _, node := range c.Nodes {
+			if e, _ := node.KVGet("key"); e == nil || string(e.Value) != "v1" {
+				return false
+			}
+		}
+		return true
+	})
+
+	// The majority elects a new leader without the old one
+	c.Partition(leader)
+	var majority []*Node
+	for _, node := range c.Nodes {
+		if node != leader {
+			majority = append(majority, node)
+		}
+	}
+	newLeader := c.WaitForLeader(majority...)
+	assert.NotEqual(t, leader, newLeader)
+	assert.Nil(t, majority[0].KVPut("key", []byte("v2")))
+	if e, _ := leader.KVGet("key"); assert.NotNil(t, e) {
+		assert.Equal(t, "v1", string(e.Value))
+	}
+
+	// The old leader catches up once the partition heals
+	c.Heal()
+	c.WaitForLeader()
+	c.WaitFor("convergence", func() bool {
+		e, _ := leader.KVGet("key")
+		return e != nil && string(e.Value) == "v2"
+	})
+
+	// The old leader records its step-down once it reaches the new leader
+	c.WaitFor("step-down audit", func() bool {
+		events, _, _ := leader.AuditLog(&cerebrum.QueryOptions{})
+		for _, e := range events {
+			if e.Kind == cerebrum.AuditLeadership && e.Node == leader.Name && e.Message == "leadership lost" {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func TestCluster_ForwardRetry(t *testing.T) {
+	c := NewCluster(t, 3)
+	defer c.Shutdown()
+
+	c.WaitForPeers(3)
+	leader := c.WaitForLeader()
+
+	// Writes forwarded while the leader is cut off are sent again to the
+	// next leader
+	c.Partition(leader)
+	follower := c.Others(leader)[0]
+	assert.Nil(t, follower.KVPut("key", []byte("v1")))
+	assert.NotEqual(t, leader, c.WaitForLeader(c.Others(leader)...))
+	c.WaitFor("replication", func() bool {
+		e, _ := follower.KVGet("key")
+		return e != nil && string(e.Value) == "v1"
+	})
+}
+
+func TestCluster_ClientSeq(t *testing.T) {
+	c := NewCluster(t, 3)
+	defer c.Shutdown()
+
+	c.WaitForPeers(3)
+	leader := c.WaitForLeader()
+	follower := c.Others(leader)[0]
+
+	// A request retried on another node is applied once
+	put := func(node *Node, seq uint64, value string) error {
+		ctx := cerebrum.ContextWithClientSeq(context.Background(), "client", seq)
+		return node.WithContext(ctx).KVPut("key", []byte(value))
+	}
+	assert.Nil(t, put(follower, 1, "v1"))
+	assert.Nil(t, put(leader, 1, "v2"))
+	assert.Nil(t, put(leader, 2, "v3"))
+	assert.Equal(t, cerebrum.ErrStaleSequence, put(follower, 1, "v4"))
+	c.WaitFor("replication", func() bool {
+		e, _ := follower.KVGet("key")
+		return e != nil && string(e.Value) == "v3"
+	})
+}
+
+func TestCluster_LegacyPeerStore(t *testing.T) {
+	// node2 starts from the data directory of an older version, whose peer
+	// store in raft/peers.json was emptied when it left
+	c := NewCluster(t, 2, func(config *cerebrum.Config) {
+		if config.NodeName != "node2" {
+			return
+		}
+		dir := filepath.Join(config.DataPath, cerebrum.RaftStateDir)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, cerebrum.PeersRecoveryFile), []byte("null"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	})
+	defer c.Shutdown()
+	c.WaitForPeers(2)
+
+	// The peer store was moved rather than applied as a recovery file
+	node := c.Nodes[1]
+	_, err := os.Stat(filepath.Join(node.Config.DataPath, cerebrum.RaftStateDir, cerebrum.PeersRecoveryFile+".applied"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(node.Config.DataPath, cerebrum.RaftPeersDir, cerebrum.PeersRecoveryFile))
+	assert.Nil(t, err)
+}
+
+func TestCluster_Snapshot(t *testing.T) {
+	c := NewCluster(t, 3)
+	defer c.Shutdown()
+
+	c.WaitForPeers(3)
+	leader := c.WaitForLeader()
+	follower := c.Others(leader)[0]
+
+	// Snapshots are taken by Raft, also when nothing was applied since the
+	// last one. The values make the snapshot larger than a forwarded frame.
+	assert.Nil(t, leader.KVPut("key", []byte("v1")))
+	large := bytes.Repeat([]byte("v"), 100<<10)
+	for i := 0; i < 20; i++ {
+		assert.Nil(t, leader.KVPut(fmt.Sprintf("large/%d", i), large))
+	}
+	var snap bytes.Buffer
+	assert.Nil(t, leader.SnapshotSave(&snap))
+	var again bytes.Buffer
+	assert.Nil(t, leader.SnapshotSave(&again))
+	assert.True(t, again.Len() > 0)
+	assert.True(t, snap.Len() > 2<<20)
+
+	// Restores are forwarded from followers
+	assert.Nil(t, leader.KVPut("key", []byte("v2")))
+	assert.Nil(t, leader.KVDelete("large/0"))
+	assert.Nil(t, follower.SnapshotRestore(&snap))
+	c.WaitFor("restore", func() bool {
+		e, _ := follower.KVGet("key")
+		return e != nil && string(e.Value) == "v1"
+	})
+	e, err := follower.KVGet("large/0")
+	assert.Nil(t, err)
+	if assert.NotNil(t, e) {
+		assert.Equal(t, large, e.Value)
+	}
+}
+
+func TestCluster_Reload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cerebrumtest-config")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "agent.hcl")
+	write := func(level string) {
+		assert.Nil(t, ioutil.WriteFile(file, []byte(fmt.Sprintf("log_level = %q\n", level)), 0644))
+	}
+
+	// load reads the file as the agent does and keeps the addresses and
+	// runtime settings of the test node
+	load := func(node *cerebrum.Config) *cerebrum.Config {
+		config, err := cerebrum.LoadConfig(file)
+		assert.Nil(t, err)
+		config.NodeID, config.NodeName, config.DataPath = node.NodeID, node.NodeName, node.DataPath
+		config.Bootstrap = node.Bootstrap
+		config.GossipBindAddr, config.GossipBindPort = node.GossipBindAddr, node.GossipBindPort
+		config.RaftBindAddr = node.RaftBindAddr
+		config.Network, config.RaftStore = node.Network, node.RaftStore
+		config.TLSConfig, config.LogOutput = node.TLSConfig, node.LogOutput
+		return config
+	}
+	write("error")
+	c := NewCluster(t, 1, func(config *cerebrum.Config) {
+		*config = *load(config)
+	})
+	defer c.Shutdown()
+	c.WaitForLeader()
+
+	// A node started from a loaded configuration reloads the same files
+	node := c.Nodes[0]
+	write("debug")
+	assert.Nil(t, node.Reload(load(node.Config)))
+	assert.Equal(t, "debug", node.Config.LogLevel)
+	assert.Equal(t, cerebrum.ErrLeadershipTransfer, node.TransferLeadership())
+}
@@ -0,0 +1,353 @@
+package cerebrumtest
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/blacklabeldata/cerebrum"
+)
+
+// ErrReset is returned by connections which were reset by a drop.
+var ErrReset = errors.New("connection reset by fault injection")
+
+// DefaultBlockTimeout is how long writes hang on a blocked link before their
+// connection is reset.
+const DefaultBlockTimeout = time.Second
+
+// Link describes the faults of the traffic from one node to another.
+type Link struct {
+	// Latency and a random Jitter delay every write.
+	Latency time.Duration
+	Jitter  time.Duration
+
+	// DropRate is the probability of a write resetting its connection.
+	DropRate float64
+
+	// Bandwidth caps the bytes per second over all connections of the
+	// link. It is unlimited if zero.
+	Bandwidth int
+
+	// Blocked drops all traffic. Dials fail and writes hang until the link
+	// is unblocked, the connection is closed or its deadline passes. Like a
+	// TCP retransmission timeout, the connection is reset after the
+	// BlockTimeout of the Faults.
+	Blocked bool
+}
+
+// Faults injects faults into the connections between named nodes. The
+// faults of each direction are set separately, so partitions can be
+// asymmetric, and can be changed while the nodes run.
+//
+// Faults are applied by the dialing node, which knows both ends: its writes
+// take the link to the remote node and its reads the link back.
+type Faults struct {
+	// BlockTimeout is how long writes hang on a blocked link before their
+	// connection is reset. It defaults to DefaultBlockTimeout.
+	BlockTimeout time.Duration
+
+	lock    sync.Mutex
+	links   map[direction]Link
+	next    map[direction]time.Time
+	names   map[string]string
+	conns   map[*faultConn]struct{}
+	changed chan struct{}
+}
+
+type direction struct {
+	from, to string
+}
+
+// NewFaults creates a fault injector without faults.
+func NewFaults() *Faults {
+	return &Faults{
+		BlockTimeout: DefaultBlockTimeout,
+		links:        make(map[direction]Link),
+		next:         make(map[direction]time.Time),
+		names:        make(map[string]string),
+		conns:        make(map[*faultConn]struct{}),
+		changed:      make(chan struct{}),
+	}
+}
+
+// Network wraps the network of the named node. The addresses the node
+// listens on are resolved to its name for the other nodes.
+func (f *Faults) Network(name string, n cerebrum.Network) cerebrum.Network {
+	return &faultNetwork{f, name, n}
+}
+
+// Set sets the faults of the traffic from one node to another.
+func (f *Faults) Set(from, to string, l Link) {
+	f.lock.Lock()
+	f.links[direction{from, to}] = l
+	f.notifyLocked()
+	f.lock.Unlock()
+}
+
+// Link returns the faults of the traffic from one node to another.
+func (f *Faults) Link(from, to string) Link {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.links[direction{from, to}]
+}
+
+// Block drops the traffic from one node to another but not back.
+func (f *Faults) Block(from, to string) {
+	f.update(from, to, func(l *Link) { l.Blocked = true })
+}
+
+// Unblock lets the traffic from one node to another through again.
+func (f *Faults) Unblock(from, to string) {
+	f.update(from, to, func(l *Link) { l.Blocked = false })
+}
+
+// Isolate blocks the traffic between the node and all others in both
+// directions.
+func (f *Faults) Isolate(node string, others ...string) {
+	for _, other := range others {
+		f.Block(node, other)
+		f.Block(other, node)
+	}
+}
+
+// Clear removes all faults.
+func (f *Faults) Clear() {
+	f.lock.Lock()
+	f.links = make(map[direction]Link)
+	f.next = make(map[direction]time.Time)
+	f.notifyLocked()
+	f.lock.Unlock()
+}
+
+// Reset closes the open connections between two nodes, in either direction.
+func (f *Faults) Reset(a, b string) {
+	f.lock.Lock()
+	var reset []*faultConn
+	for c := range f.conns {
+		if (c.from == a && c.to == b) || (c.from == b && c.to == a) {
+			reset = append(reset, c)
+		}
+	}
+	f.lock.Unlock()
+
+	for _, c := range reset {
+		c.Close()
+	}
+}
+
+func (f *Faults) update(from, to string, fn func(*Link)) {
+	f.lock.Lock()
+	d := direction{from, to}
+	l := f.links[d]
+	fn(&l)
+	f.links[d] = l
+	f.notifyLocked()
+	f.lock.Unlock()
+}
+
+// notifyLocked wakes up the writes waiting on blocked links.
+func (f *Faults) notifyLocked() {
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+// pass applies the faults of the link to n bytes sent over the connection.
+func (f *Faults) pass(c *faultConn, from, to string, n int, deadline time.Time) error {
+	d := direction{from, to}
+	reset := time.Now().Add(f.BlockTimeout)
+	for {
+		f.lock.Lock()
+		l, changed := f.links[d], f.changed
+		f.lock.Unlock()
+		if !l.Blocked {
+			break
+		}
+		wait := deadline
+		if wait.IsZero() || reset.Before(wait) {
+			wait = reset
+		}
+		if err := c.wait(changed, wait); err != nil {
+			if err == errTimeout && wait == reset {
+				c.Close()
+				return ErrReset
+			}
+			return err
+		}
+	}
+
+	f.lock.Lock()
+	l := f.links[d]
+	if l.DropRate > 0 && rand.Float64() < l.DropRate {
+		f.lock.Unlock()
+		c.Close()
+		return ErrReset
+	}
+	delay := l.Latency
+	if l.Jitter > 0 {
+		delay += time.Duration(rand.Int63n(int64(l.Jitter)))
+	}
+	if l.Bandwidth > 0 {
+		// Pace the link so its writes take their share of the bandwidth
+		now := time.Now()
+		next := f.next[d]
+		if next.Before(now) {
+			next = now
+		}
+		next = next.Add(time.Duration(n) * time.Second / time.Duration(l.Bandwidth))
+		f.next[d] = next
+		if wait := next.Sub(now); wait > delay {
+			delay = wait
+		}
+	}
+	f.lock.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-c.closed:
+		return ErrReset
+	}
+}
+
+func (f *Faults) register(addr, name string) {
+	f.lock.Lock()
+	f.names[addr] = name
+	f.lock.Unlock()
+}
+
+func (f *Faults) name(addr string) (string, bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	name, ok := f.names[addr]
+	return name, ok
+}
+
+// faultNetwork is the network of a node with faults.
+type faultNetwork struct {
+	faults  *Faults
+	node    string
+	network cerebrum.Network
+}
+
+func (n *faultNetwork) Listen(addr string) (net.Listener, error) {
+	l, err := n.network.Listen(addr)
+	if err != nil {
+		return nil, err
+	}
+	n.faults.register(addr, n.node)
+	n.faults.register(l.Addr().String(), n.node)
+	return l, nil
+}
+
+func (n *faultNetwork) Dial(addr string, timeout time.Duration) (net.Conn, error) {
+	to, ok := n.faults.name(addr)
+	if !ok {
+		return n.network.Dial(addr, timeout)
+	}
+	l := n.faults.Link(n.node, to)
+	if l.Blocked {
+		return nil, ErrUnreachable
+	}
+	if l.Latency > 0 {
+		time.Sleep(l.Latency)
+	}
+	conn, err := n.network.Dial(addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &faultConn{Conn: conn, faults: n.faults, from: n.node, to: to, closed: make(chan struct{})}
+	n.faults.lock.Lock()
+	n.faults.conns[c] = struct{}{}
+	n.faults.lock.Unlock()
+	return c, nil
+}
+
+// faultConn applies the faults to the connection from one node to another.
+type faultConn struct {
+	net.Conn
+	faults *Faults
+	from   string
+	to     string
+
+	lock          sync.Mutex
+	readDeadline  time.Time
+	writeDeadline time.Time
+	closed        chan struct{}
+	once          sync.Once
+}
+
+func (c *faultConn) Write(p []byte) (int, error) {
+	c.lock.Lock()
+	deadline := c.writeDeadline
+	c.lock.Unlock()
+	if err := c.faults.pass(c, c.from, c.to, len(p), deadline); err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(p)
+}
+
+func (c *faultConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.lock.Lock()
+		deadline := c.readDeadline
+		c.lock.Unlock()
+		if ferr := c.faults.pass(c, c.to, c.from, n, deadline); ferr != nil {
+			return 0, ferr
+		}
+	}
+	return n, err
+}
+
+func (c *faultConn) Close() error {
+	c.once.Do(func() {
+		close(c.closed)
+		c.faults.lock.Lock()
+		delete(c.faults.conns, c)
+		c.faults.lock.Unlock()
+	})
+	return c.Conn.Close()
+}
+
+func (c *faultConn) SetDeadline(t time.Time) error {
+	c.lock.Lock()
+	c.readDeadline, c.writeDeadline = t, t
+	c.lock.Unlock()
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *faultConn) SetReadDeadline(t time.Time) error {
+	c.lock.Lock()
+	c.readDeadline = t
+	c.lock.Unlock()
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *faultConn) SetWriteDeadline(t time.Time) error {
+	c.lock.Lock()
+	c.writeDeadline = t
+	c.lock.Unlock()
+	return c.Conn.SetWriteDeadline(t)
+}
+
+// wait waits until the faults change, the connection is closed or the
+// deadline passes.
+func (c *faultConn) wait(changed <-chan struct{}, deadline time.Time) error {
+	timer := time.NewTimer(deadline.Sub(time.Now()))
+	defer timer.Stop()
+	select {
+	case <-changed:
+		return nil
+	case <-c.closed:
+		return ErrReset
+	case <-timer.C:
+		return errTimeout
+	}
+}
@@ -0,0 +1,149 @@
+package cerebrumtest
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFaults_Link(t *testing.T) {
+	network := NewNetwork()
+	faults := NewFaults()
+	a := faults.Network("a", network.Node("127.0.0.1:1"))
+	b := faults.Network("b", network.Node("127.0.0.1:2"))
+
+	// b echoes everything back
+	l, err := b.Listen("127.0.0.1:2")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(conn, conn)
+		}
+	}()
+
+	conn, err := a.Dial("127.0.0.1:2", time.Second)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer conn.Close()
+	echo := func() error {
+		if _, err := conn.Write([]byte("ping")); err != nil {
+			return err
+		}
+		_, err := io.ReadFull(conn, make([]byte, 4))
+		return err
+	}
+
+	// Latency applies to each direction
+	faults.Set("a", "b", Link{Latency: 20 * time.Millisecond})
+	faults.Set("b", "a", Link{Latency: 20 * time.Millisecond})
+	start := time.Now()
+	assert.Nil(t, echo())
+	assert.True(t, time.Since(start) >= 40*time.Millisecond)
+
+	// Blocked writes hang until their deadline or the link is unblocked
+	faults.Clear()
+	faults.Block("a", "b")
+	conn.SetWriteDeadline(time.Now().Add(20 * time.Millisecond))
+	_, err = conn.Write([]byte("ping"))
+	if ne, ok := err.(net.Error); assert.True(t, ok) {
+		assert.True(t, ne.Timeout())
+	}
+	conn.SetWriteDeadline(time.Time{})
+	time.AfterFunc(20*time.Millisecond, func() { faults.Unblock("a", "b") })
+	assert.Nil(t, echo())
+
+	// Partitions can be asymmetric
+	faults.Block("b", "a")
+	conn.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	_, err = conn.Write([]byte("ping"))
+	assert.Nil(t, err)
+	_, err = io.ReadFull(conn, make([]byte, 4))
+	assert.Equal(t, errTimeout, err)
+	conn.SetReadDeadline(time.Time{})
+	faults.Block("a", "b")
+	_, err = a.Dial("127.0.0.1:2", time.Second)
+	assert.Equal(t, ErrUnreachable, err)
+	faults.Clear()
+
+	// Bandwidth is shared by the connections of the link
+	faults.Set("a", "b", Link{Bandwidth: 1000})
+	start = time.Now()
+	for i := 0; i < 25; i++ {
+		assert.Nil(t, echo())
+	}
+	assert.True(t, time.Since(start) >= 90*time.Millisecond)
+
+	// Drops reset the connection
+	faults.Set("a", "b", Link{DropRate: 1})
+	assert.Equal(t, ErrReset, echo())
+	faults.Clear()
+	assert.NotNil(t, echo())
+}
+
+func TestFaults_Reset(t *testing.T) {
+	network := NewNetwork()
+	faults := NewFaults()
+	l, err := faults.Network("b", network.Node("127.0.0.1:2")).Listen("127.0.0.1:2")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(conn, conn)
+		}
+	}()
+
+	a := faults.Network("a", network.Node("127.0.0.1:1"))
+	conn, err := a.Dial("127.0.0.1:2", time.Second)
+	if !assert.Nil(t, err) {
+		return
+	}
+	faults.Reset("b", "a")
+	_, err = conn.Read(make([]byte, 1))
+	assert.NotNil(t, err)
+
+	// Writes on blocked links reset their connection after a while
+	conn, err = a.Dial("127.0.0.1:2", time.Second)
+	if !assert.Nil(t, err) {
+		return
+	}
+	faults.BlockTimeout = 20 * time.Millisecond
+	faults.Block("a", "b")
+	_, err = conn.Write([]byte("ping"))
+	assert.Equal(t, ErrReset, err)
+}
+
+func TestFaults_LeaderFlap(t *testing.T) {
+	c := NewCluster(t, 3)
+	defer c.Shutdown()
+	c.WaitForPeers(3)
+	leader := c.WaitForLeader()
+
+	// The followers stop hearing from the leader, although it still hears
+	// from them, and elect another one
+	for _, node := range c.Others(leader) {
+		c.Faults.Block(leader.Name, node.Name)
+	}
+	newLeader := c.WaitForLeader(c.Others(leader)...)
+	assert.NotEqual(t, leader, newLeader)
+
+	c.Heal()
+	c.WaitForLeader()
+	assert.Nil(t, leader.KVPut("key", []byte("value")))
+}
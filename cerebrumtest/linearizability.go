@@ -0,0 +1,248 @@
+package cerebrumtest
+
+import (
+	"math"
+	"sort"
+)
+
+// Unknown is the Return time of operations whose outcome is unknown, e.g.
+// writes which failed with a timeout. They may take effect at any time
+// after their call.
+const Unknown = int64(math.MaxInt64)
+
+// Operation is an operation of a history. Call and Return are the times
+// the operation was invoked and completed.
+type Operation struct {
+	ClientID int
+	Input    interface{}
+	Call     int64
+	Output   interface{}
+	Return   int64
+}
+
+// Model is the sequential specification histories are checked against.
+type Model struct {
+	// Partition splits a history into independent histories, e.g. by key,
+	// which are checked separately. It is optional.
+	Partition func(history []Operation) [][]Operation
+
+	// Init returns the initial state.
+	Init func() interface{}
+
+	// Step reports whether the operation with the input may return the
+	// output in the state, and returns the following state.
+	Step func(state, input, output interface{}) (bool, interface{})
+
+	// Equal compares states. It defaults to ==.
+	Equal func(a, b interface{}) bool
+}
+
+// CheckOperations reports whether the history is linearizable: whether the
+// operations can be ordered in a sequence which is allowed by the model and
+// keeps every operation between its call and return.
+func CheckOperations(model Model, history []Operation) bool {
+	partitions := [][]Operation{history}
+	if model.Partition != nil {
+		partitions = model.Partition(history)
+	}
+	for _, p := range partitions {
+		if !checkSingle(model, p) {
+			return false
+		}
+	}
+	return true
+}
+
+// event is a call or a return in the list of events of a history.
+type event struct {
+	id    int
+	call  bool
+	time  int64
+	value interface{}
+	match *event
+	prev  *event
+	next  *event
+}
+
+// checkSingle searches for a linearization with the algorithm of Wing and
+// Gong, caching the states reached for each set of linearized operations
+// as proposed by Lowe.
+func checkSingle(model Model, history []Operation) bool {
+	equal := model.Equal
+	if equal == nil {
+		equal = func(a, b interface{}) bool { return a == b }
+	}
+
+	events := make([]*event, 0, 2*len(history))
+	for i, op := range history {
+		ret := &event{id: i, time: op.Return, value: op.Output}
+		call := &event{id: i, call: true, time: op.Call, value: op.Input, match: ret}
+		events = append(events, call, ret)
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		if events[i].time != events[j].time {
+			return events[i].time < events[j].time
+		}
+		return events[i].call && !events[j].call
+	})
+	head := &event{}
+	last := head
+	for _, e := range events {
+		e.prev, last.next = last, e
+		last = e
+	}
+
+	type cached struct {
+		linearized bitset
+		state      interface{}
+	}
+	type frame struct {
+		call  *event
+		state interface{}
+	}
+	cache := make(map[uint64][]cached)
+	seen := func(b bitset, state interface{}) bool {
+		for _, c := range cache[b.hash()] {
+			if c.linearized.equals(b) && equal(c.state, state) {
+				return true
+			}
+		}
+		return false
+	}
+
+	linearized := newBitset(len(history))
+	state := model.Init()
+	var calls []frame
+	e := head.next
+	for head.next != nil {
+		if e.call {
+			ok, next := model.Step(state, e.value, e.match.value)
+			if ok {
+				b := linearized.clone().set(e.id)
+				if !seen(b, next) {
+					cache[b.hash()] = append(cache[b.hash()], cached{b, next})
+					calls = append(calls, frame{e, state})
+					state = next
+					linearized.set(e.id)
+					lift(e)
+					e = head.next
+					continue
+				}
+			}
+			e = e.next
+			continue
+		}
+
+		// A return was reached before its call could be linearized, so
+		// undo the last linearized call and try the next one
+		if len(calls) == 0 {
+			return false
+		}
+		top := calls[len(calls)-1]
+		calls = calls[:len(calls)-1]
+		state = top.state
+		linearized.clear(top.call.id)
+		unlift(top.call)
+		e = top.call.next
+	}
+	return true
+}
+
+// lift removes a call and its return from the list.
+func lift(call *event) {
+	call.prev.next = call.next
+	call.next.prev = call.prev
+	ret := call.match
+	ret.prev.next = ret.next
+	if ret.next != nil {
+		ret.next.prev = ret.prev
+	}
+}
+
+// unlift puts a lifted call and its return back.
+func unlift(call *event) {
+	ret := call.match
+	ret.prev.next = ret
+	if ret.next != nil {
+		ret.next.prev = ret
+	}
+	call.prev.next = call
+	call.next.prev = call
+}
+
+type bitset []uint64
+
+func newBitset(n int) bitset {
+	return make(bitset, (n+63)/64)
+}
+
+func (b bitset) clone() bitset {
+	return append(bitset(nil), b...)
+}
+
+func (b bitset) set(i int) bitset {
+	b[i/64] |= 1 << uint(i%64)
+	return b
+}
+
+func (b bitset) clear(i int) bitset {
+	b[i/64] &^= 1 << uint(i%64)
+	return b
+}
+
+func (b bitset) equals(o bitset) bool {
+	for i := range b {
+		if b[i] != o[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// hash is FNV-1a over the words.
+func (b bitset) hash() uint64 {
+	h := uint64(14695981039346656037)
+	for _, w := range b {
+		h ^= w
+		h *= 1099511628211
+	}
+	return h
+}
+
+// KVInput is the input of a KV operation. Get reads the key, Put writes it.
+type KVInput struct {
+	Put   bool
+	Key   string
+	Value string
+}
+
+// KVModel specifies a map of registers. Gets output the string value of the
+// key, empty if it does not exist; the output of Puts is ignored.
+var KVModel = Model{
+	Partition: func(history []Operation) [][]Operation {
+		byKey := make(map[string][]Operation)
+		var keys []string
+		for _, op := range history {
+			key := op.Input.(KVInput).Key
+			if _, ok := byKey[key]; !ok {
+				keys = append(keys, key)
+			}
+			byKey[key] = append(byKey[key], op)
+		}
+		partitions := make([][]Operation, 0, len(keys))
+		for _, key := range keys {
+			partitions = append(partitions, byKey[key])
+		}
+		return partitions
+	},
+	Init: func() interface{} {
+		return ""
+	},
+	Step: func(state, input, output interface{}) (bool, interface{}) {
+		in := input.(KVInput)
+		if in.Put {
+			return true, in.Value
+		}
+		return output.(string) == state.(string), state
+	},
+}
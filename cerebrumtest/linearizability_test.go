@@ -0,0 +1,77 @@
+package cerebrumtest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/blacklabeldata/cerebrum"
+	"github.com/stretchr/testify/assert"
+)
+
+func put(client int, key, value string, call, ret int64) Operation {
+	return Operation{client, KVInput{Put: true, Key: key, Value: value}, call, nil, ret}
+}
+
+func get(client int, key, value string, call, ret int64) Operation {
+	return Operation{client, KVInput{Key: key}, call, value, ret}
+}
+
+func TestLinearizability_Check(t *testing.T) {
+	// Concurrent operations may be ordered either way
+	assert.True(t, CheckOperations(KVModel, []Operation{
+		put(0, "x", "1", 0, 10),
+		get(1, "x", "1", 1, 5),
+		get(2, "x", "", 2, 6),
+		get(1, "x", "1", 11, 12),
+	}))
+
+	// A read after a completed write must see it
+	assert.False(t, CheckOperations(KVModel, []Operation{
+		put(0, "x", "1", 0, 10),
+		get(1, "x", "", 11, 12),
+	}))
+
+	// Reads must not go back in time
+	assert.False(t, CheckOperations(KVModel, []Operation{
+		put(0, "x", "1", 0, 10),
+		get(1, "x", "1", 1, 5),
+		get(2, "x", "", 6, 8),
+	}))
+
+	// Keys are independent
+	assert.False(t, CheckOperations(KVModel, []Operation{
+		put(0, "x", "1", 0, 1),
+		put(0, "y", "1", 2, 3),
+		get(1, "y", "1", 4, 5),
+		get(1, "x", "", 6, 7),
+	}))
+
+	// Failed writes may take effect at any time after their call
+	assert.True(t, CheckOperations(KVModel, []Operation{
+		put(0, "x", "1", 0, Unknown),
+		get(1, "x", "", 1, 2),
+		get(1, "x", "1", 3, 4),
+	}))
+	assert.False(t, CheckOperations(KVModel, []Operation{
+		get(1, "x", "1", 1, 2),
+		put(0, "x", "1", 3, Unknown),
+	}))
+}
+
+func TestLinearizability_Cluster(t *testing.T) {
+	c := NewCluster(t, 3)
+	defer c.Shutdown()
+	c.WaitForPeers(3)
+	c.WaitForLeader()
+
+	history := KVWorkload{
+		Clients:  6,
+		Keys:     3,
+		Duration: 3 * time.Second,
+		Mode:     cerebrum.ReadConsistent,
+		Nemesis:  IsolateLeader(500 * time.Millisecond),
+	}.Run(c)
+
+	assert.True(t, len(history) > 0)
+	assert.True(t, CheckOperations(KVModel, history), "history is not linearizable")
+}
@@ -0,0 +1,232 @@
+package cerebrumtest
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/blacklabeldata/cerebrum"
+)
+
+var (
+	// ErrUnreachable is returned when dialing across a partition.
+	ErrUnreachable = errors.New("address is unreachable")
+
+	// ErrRefused is returned when nothing listens on the address.
+	ErrRefused = errors.New("connection refused")
+
+	errClosed  = errors.New("listener closed")
+	errTimeout = timeoutError{}
+)
+
+// Network is an in-memory network. Each node gets a view of it with Node;
+// connections are net.Pipes and can be cut with Partition.
+type Network struct {
+	lock      sync.Mutex
+	listeners map[string]*listener
+	links     map[*link]struct{}
+	groups    map[string]int
+	group     int
+	port      int
+}
+
+// NewNetwork creates an empty network.
+func NewNetwork() *Network {
+	return &Network{
+		listeners: make(map[string]*listener),
+		links:     make(map[*link]struct{}),
+		groups:    make(map[string]int),
+		port:      40000,
+	}
+}
+
+// Node returns the view of the node listening on addr. Its connections are
+// cut by partitions of addr.
+func (n *Network) Node(addr string) cerebrum.Network {
+	return &nodeNetwork{n, addr}
+}
+
+// Partition moves the addresses into a new partition. They can reach each
+// other but no other address, and their connections to other addresses are
+// closed.
+func (n *Network) Partition(addrs ...string) {
+	n.lock.Lock()
+	n.group++
+	for _, addr := range addrs {
+		n.groups[addr] = n.group
+	}
+	var cut []*link
+	for l := range n.links {
+		if n.groups[l.from] != n.groups[l.to] {
+			cut = append(cut, l)
+		}
+	}
+	n.lock.Unlock()
+
+	for _, l := range cut {
+		l.close()
+	}
+}
+
+// Heal removes all partitions.
+func (n *Network) Heal() {
+	n.lock.Lock()
+	n.groups = make(map[string]int)
+	n.lock.Unlock()
+}
+
+func (n *Network) listen(addr string) (net.Listener, error) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if _, ok := n.listeners[addr]; ok {
+		return nil, errors.New("address already in use: " + addr)
+	}
+	l := &listener{network: n, addr: memAddr(addr), conns: make(chan net.Conn), done: make(chan struct{})}
+	n.listeners[addr] = l
+	return l, nil
+}
+
+func (n *Network) dial(from, to string, timeout time.Duration) (net.Conn, error) {
+	n.lock.Lock()
+	if n.groups[from] != n.groups[to] {
+		n.lock.Unlock()
+		return nil, ErrUnreachable
+	}
+	l, ok := n.listeners[to]
+	if !ok {
+		n.lock.Unlock()
+		return nil, ErrRefused
+	}
+
+	// Every connection gets its own source port, so the remote addresses
+	// seen by the listener are unique.
+	host, _, err := net.SplitHostPort(from)
+	if err != nil {
+		host = from
+	}
+	n.port++
+	local := memAddr(net.JoinHostPort(host, strconv.Itoa(n.port)))
+	client, server := net.Pipe()
+	lk := &link{network: n, from: from, to: to}
+	lk.client = &conn{client, lk, local, memAddr(to)}
+	lk.server = &conn{server, lk, memAddr(to), local}
+	n.links[lk] = struct{}{}
+	n.lock.Unlock()
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case l.conns <- lk.server:
+		return lk.client, nil
+	case <-l.done:
+		lk.close()
+		return nil, ErrRefused
+	case <-expired:
+		lk.close()
+		return nil, errTimeout
+	}
+}
+
+func (n *Network) remove(l *link) {
+	n.lock.Lock()
+	delete(n.links, l)
+	n.lock.Unlock()
+}
+
+// nodeNetwork is the cerebrum.Network of a node.
+type nodeNetwork struct {
+	network *Network
+	addr    string
+}
+
+func (n *nodeNetwork) Listen(addr string) (net.Listener, error) {
+	return n.network.listen(addr)
+}
+
+func (n *nodeNetwork) Dial(addr string, timeout time.Duration) (net.Conn, error) {
+	return n.network.dial(n.addr, addr, timeout)
+}
+
+type listener struct {
+	network *Network
+	addr    memAddr
+	conns   chan net.Conn
+	done    chan struct{}
+	once    sync.Once
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, errClosed
+	}
+}
+
+func (l *listener) Close() error {
+	l.once.Do(func() {
+		l.network.lock.Lock()
+		delete(l.network.listeners, string(l.addr))
+		l.network.lock.Unlock()
+		close(l.done)
+	})
+	return nil
+}
+
+func (l *listener) Addr() net.Addr {
+	return l.addr
+}
+
+// link is a connection between two addresses.
+type link struct {
+	network *Network
+	from    string
+	to      string
+	client  *conn
+	server  *conn
+	once    sync.Once
+}
+
+// close closes both ends, like a reset.
+func (l *link) close() {
+	l.once.Do(func() {
+		l.client.Conn.Close()
+		l.server.Conn.Close()
+		l.network.remove(l)
+	})
+}
+
+// conn is one end of a link with the addresses of the nodes.
+type conn struct {
+	net.Conn
+	link   *link
+	local  net.Addr
+	remote net.Addr
+}
+
+// Close closes this end. The other end reads EOF.
+func (c *conn) Close() error {
+	c.link.network.remove(c.link)
+	return c.Conn.Close()
+}
+
+func (c *conn) LocalAddr() net.Addr  { return c.local }
+func (c *conn) RemoteAddr() net.Addr { return c.remote }
+
+type memAddr string
+
+func (a memAddr) Network() string { return "mem" }
+func (a memAddr) String() string  { return string(a) }
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
@@ -0,0 +1,99 @@
+package cerebrumtest
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/blacklabeldata/cerebrum"
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+type countRequest struct {
+	N int
+}
+
+// rpcService serves the RPC methods of the tests.
+type rpcService struct {
+	name string
+	rpc  *cerebrum.RPC
+}
+
+func (s *rpcService) Name() string { return "rpc" }
+
+func (s *rpcService) Start(ctx *cerebrum.Context) error {
+	s.rpc = ctx.RPC
+	if err := s.rpc.RegisterLeader("leader", func(ctx context.Context, call *cerebrum.RPCCall) (interface{}, error) {
+		return s.name, call.Decode(nil)
+	}); err != nil {
+		return err
+	}
+	if err := s.rpc.Register("count", func(ctx context.Context, call *cerebrum.RPCCall) (interface{}, error) {
+		var req countRequest
+		if err := call.Decode(&req); err != nil {
+			return nil, err
+		}
+		for i := 0; i < req.N; i++ {
+			if err := call.Send(i); err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+	}); err != nil {
+		return err
+	}
+	return s.rpc.Register("sleep", func(ctx context.Context, call *cerebrum.RPCCall) (interface{}, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+}
+
+func (s *rpcService) Stop() {}
+
+func TestRPC_Cluster(t *testing.T) {
+	services := make(map[string]*rpcService)
+	c := NewCluster(t, 3, func(config *cerebrum.Config) {
+		svc := &rpcService{name: config.NodeName}
+		services[config.NodeName] = svc
+		config.Services = append(config.Services, svc)
+	})
+	defer c.Shutdown()
+	c.WaitForPeers(3)
+	leader := c.WaitForLeader()
+	follower := c.Others(leader)[0]
+	rpc := services[follower.Name].rpc
+	ctx := context.Background()
+
+	// Leader methods are refused by followers and retried on the leader
+	var name string
+	assert.Equal(t, raft.ErrNotLeader, rpc.Call(ctx, follower.RaftAddr, "leader", nil, &name))
+	assert.Nil(t, rpc.CallLeader(ctx, "leader", nil, &name))
+	assert.Equal(t, leader.Name, name)
+
+	// Responses can be streamed
+	s, err := rpc.Stream(ctx, leader.RaftAddr, "count", &countRequest{3})
+	if assert.Nil(t, err) {
+		var got []int
+		var i int
+		for err = s.Recv(&i); err == nil; err = s.Recv(&i) {
+			got = append(got, i)
+		}
+		assert.Equal(t, io.EOF, err)
+		assert.Equal(t, []int{0, 1, 2}, got)
+		s.Close()
+	}
+
+	// The deadline of the caller applies to the handler
+	ctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, rpc.Call(ctx, leader.RaftAddr, "sleep", nil, nil))
+	assert.Equal(t, cerebrum.ErrUnknownRPCMethod, rpc.Call(context.Background(), leader.RaftAddr, "missing", nil, nil))
+
+	// Calls for the leader wait for the next one
+	c.Partition(leader)
+	assert.Nil(t, rpc.CallLeader(context.Background(), "leader", nil, &name))
+	assert.NotEqual(t, leader.Name, name)
+	c.Heal()
+}
@@ -0,0 +1,67 @@
+package cerebrumtest
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/blacklabeldata/cerebrum"
+	"github.com/blacklabeldata/yamuxer"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+const streamEcho yamuxer.StreamType = 0x20
+
+// echoService serves streams which echo everything back.
+type echoService struct {
+	ctx *cerebrum.Context
+}
+
+func (s *echoService) Name() string { return "echo" }
+
+func (s *echoService) Start(ctx *cerebrum.Context) error {
+	s.ctx = ctx
+	return ctx.RegisterStream(cerebrum.StreamHandler{
+		Type:    streamEcho,
+		Name:    "echo",
+		Handler: s,
+	})
+}
+
+func (s *echoService) Handle(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	io.Copy(conn, conn)
+}
+
+func (s *echoService) Stop() {}
+
+func TestService_Streams(t *testing.T) {
+	services := make(map[string]*echoService)
+	c := NewCluster(t, 2, func(config *cerebrum.Config) {
+		svc := &echoService{}
+		services[config.NodeName] = svc
+		config.Services = append(config.Services, svc)
+	})
+	defer c.Shutdown()
+	a, b := c.Nodes[0], c.Nodes[1]
+
+	// Services dial each other over the pooled sessions of their node
+	conn, err := services[a.Name].ctx.Dialer.Dial(streamEcho, b.RaftAddr, time.Second)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte("ping"))
+	assert.Nil(t, err)
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(conn, buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "ping", string(buf))
+	assert.Equal(t, "1", b.Info()["streams"]["echo_accepted"])
+
+	// Reserved and registered types are refused
+	assert.Equal(t, cerebrum.ErrStreamTypeReserved, services[a.Name].ctx.RegisterStream(cerebrum.StreamHandler{Type: cerebrum.StreamRaft}))
+	assert.Equal(t, cerebrum.ErrStreamTypeRegistered, services[a.Name].ctx.RegisterStream(cerebrum.StreamHandler{Type: streamEcho}))
+}
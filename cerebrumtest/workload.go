@@ -0,0 +1,188 @@
+package cerebrumtest
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/blacklabeldata/cerebrum"
+)
+
+// History records the operations of concurrent clients.
+type History struct {
+	start time.Time
+	lock  sync.Mutex
+	ops   []Operation
+}
+
+// NewHistory creates an empty history.
+func NewHistory() *History {
+	return &History{start: time.Now()}
+}
+
+// Invoke records the call of an operation. The operation is only added to
+// the history once it completes.
+func (h *History) Invoke(client int, input interface{}) *Operation {
+	return &Operation{ClientID: client, Input: input, Call: h.now()}
+}
+
+// Complete records the return of an operation.
+func (h *History) Complete(op *Operation, output interface{}) {
+	op.Output = output
+	op.Return = h.now()
+	h.add(op)
+}
+
+// Indeterminate records an operation whose outcome is unknown, e.g. a write
+// which failed. It may take effect at any time after its call.
+func (h *History) Indeterminate(op *Operation) {
+	op.Return = Unknown
+	h.add(op)
+}
+
+// Operations returns the recorded operations.
+func (h *History) Operations() []Operation {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return append([]Operation(nil), h.ops...)
+}
+
+func (h *History) now() int64 {
+	return int64(time.Since(h.start))
+}
+
+func (h *History) add(op *Operation) {
+	h.lock.Lock()
+	h.ops = append(h.ops, *op)
+	h.lock.Unlock()
+}
+
+// KVWorkload drives concurrent gets and puts against the nodes of a
+// cluster. Its history can be checked with KVModel.
+type KVWorkload struct {
+	// Clients is the number of concurrent clients. They are spread over the
+	// nodes.
+	Clients int
+
+	// Keys is the number of keys the clients write.
+	Keys int
+
+	// Duration is how long the clients run.
+	Duration time.Duration
+
+	// Mode is the read mode of the gets.
+	Mode cerebrum.ReadMode
+
+	// Backoff is how long a client waits after an error before it tries
+	// the next node. It defaults to 50ms.
+	Backoff time.Duration
+
+	// Nemesis runs concurrently with the clients until stop is closed, e.g.
+	// to inject faults. It must undo them before it returns.
+	Nemesis func(c *Cluster, stop <-chan struct{})
+}
+
+// Run runs the workload and returns its history. Failed gets are left out
+// of the history as they cannot have had an effect; failed puts are
+// indeterminate.
+func (w KVWorkload) Run(c *Cluster) []Operation {
+	history := NewHistory()
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+
+	if w.Nemesis != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.Nemesis(c, stop)
+		}()
+	}
+	for i := 0; i < w.Clients; i++ {
+		wg.Add(1)
+		go func(client int) {
+			defer wg.Done()
+			w.client(c, history, client, stop)
+		}(i)
+	}
+
+	time.Sleep(w.Duration)
+	close(stop)
+	wg.Wait()
+	return history.Operations()
+}
+
+func (w KVWorkload) client(c *Cluster, history *History, client int, stop <-chan struct{}) {
+	random := rand.New(rand.NewSource(int64(client)))
+	node := client % len(c.Nodes)
+	backoff := w.Backoff
+	if backoff <= 0 {
+		backoff = 50 * time.Millisecond
+	}
+	var wait time.Duration
+	for n := 0; ; n++ {
+		select {
+		case <-stop:
+			return
+		case <-time.After(wait):
+		}
+		wait = 0
+
+		key := fmt.Sprintf("key%d", random.Intn(w.Keys))
+		agent := c.Nodes[node]
+		if random.Intn(2) == 0 {
+			value := fmt.Sprintf("%d-%d", client, n)
+			op := history.Invoke(client, KVInput{Put: true, Key: key, Value: value})
+			if err := agent.KVPut(key, []byte(value)); err != nil {
+				// A forwarded put may have been applied by a leader before
+				// the retry which failed
+				history.Indeterminate(op)
+				node = (node + 1) % len(c.Nodes)
+				wait = backoff
+				continue
+			}
+			history.Complete(op, nil)
+			continue
+		}
+
+		op := history.Invoke(client, KVInput{Key: key})
+		entries, _, err := agent.KVRead(key, false, &cerebrum.QueryOptions{Mode: w.Mode})
+		if err != nil {
+			// Consistent reads must be served by the leader
+			node = (node + 1) % len(c.Nodes)
+			wait = backoff
+			continue
+		}
+		value := ""
+		if len(entries) > 0 {
+			value = string(entries[0].Value)
+		}
+		history.Complete(op, value)
+	}
+}
+
+// IsolateLeader returns a nemesis which repeatedly isolates the leader
+// from the other nodes for the interval and then heals the cluster.
+func IsolateLeader(interval time.Duration) func(c *Cluster, stop <-chan struct{}) {
+	return func(c *Cluster, stop <-chan struct{}) {
+		defer c.Heal()
+		for {
+			if leader := c.Leader(); leader != nil {
+				for _, node := range c.Others(leader) {
+					c.Faults.Isolate(leader.Name, node.Name)
+				}
+			}
+			select {
+			case <-stop:
+				return
+			case <-time.After(interval):
+			}
+			c.Heal()
+			select {
+			case <-stop:
+				return
+			case <-time.After(interval):
+			}
+		}
+	}
+}
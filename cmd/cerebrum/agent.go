@@ -0,0 +1,84 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/blacklabeldata/cerebrum"
+	log "github.com/mgutz/logxi/v1"
+)
+
+// configPaths collects the -config flags in order.
+type configPaths []string
+
+func (p *configPaths) String() string {
+	return strings.Join(*p, ",")
+}
+
+func (p *configPaths) Set(value string) error {
+	*p = append(*p, value)
+	return nil
+}
+
+func agentCommand(args []string) int {
+	var paths configPaths
+	flags := flag.NewFlagSet("agent", flag.ContinueOnError)
+	flags.Var(&paths, "config", "JSON or HCL configuration file or directory, may be repeated")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+
+	config, err := cerebrum.LoadConfig(paths...)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading configuration: %v\n", err)
+		return 1
+	}
+	config.LogOutput = log.NewConcurrentWriter(os.Stderr)
+	config.GlobalMetrics = true
+
+	agent, err := cerebrum.New(config)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating agent: %v\n", err)
+		return 1
+	}
+	if err = agent.Start(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error starting agent: %v\n", err)
+		agent.Stop()
+		return 1
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	for {
+		select {
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				reload(agent, paths, config.LogOutput)
+				continue
+			}
+			agent.Stop()
+		case <-agent.Done():
+		}
+		return 0
+	}
+}
+
+// reload reads the configuration files again and applies them to the agent.
+func reload(agent cerebrum.Cerebrum, paths []string, logOutput io.Writer) {
+	config, err := cerebrum.LoadConfig(paths...)
+	if err == nil {
+		config.LogOutput = logOutput
+		config.GlobalMetrics = true
+		err = agent.Reload(config)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reloading configuration: %v\n", err)
+		return
+	}
+	fmt.Fprintln(os.Stderr, "Configuration reloaded")
+}
@@ -0,0 +1,492 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/blacklabeldata/cerebrum"
+)
+
+// DefaultAdminAddr is the admin address used when neither -admin-addr nor
+// CEREBRUM_ADMIN_ADDR is set.
+const DefaultAdminAddr = "127.0.0.1:8400"
+
+// clientFlags creates a flag set with the options shared by all commands
+// talking to a running agent.
+func clientFlags(name string) (*flag.FlagSet, func() *cerebrum.AdminClient) {
+	addr := os.Getenv("CEREBRUM_ADMIN_ADDR")
+	if addr == "" {
+		addr = DefaultAdminAddr
+	}
+
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	adminAddr := flags.String("admin-addr", addr, "address of the agent's admin listener")
+	timeout := flags.Duration("timeout", 30*time.Second, "maximum time to wait for the agent")
+	token := flags.String("token", os.Getenv("CEREBRUM_TOKEN"), "ACL token of the requests")
+	return flags, func() *cerebrum.AdminClient {
+		client := cerebrum.NewLocalAdminClient(*adminAddr, *timeout)
+		client.Token = *token
+		return client
+	}
+}
+
+func fail(err error) int {
+	fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+	return 1
+}
+
+func membersCommand(args []string) int {
+	flags, client := clientFlags("members")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+
+	members, err := client().Members()
+	if err != nil {
+		return fail(err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "Node\tAddress\tStatus\tTags")
+	for _, m := range members {
+		fmt.Fprintf(w, "%s\t%s:%d\t%s\t%s\n", m.Name, m.Addr, m.Port, m.Status, formatTags(m.Tags))
+	}
+	w.Flush()
+	return 0
+}
+
+func formatTags(tags map[string]string) string {
+	pairs := make([]string, 0, len(tags))
+	for k, v := range tags {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func joinCommand(args []string) int {
+	flags, client := clientFlags("join")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+	if flags.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "At least one address to join must be given")
+		return 1
+	}
+
+	n, err := client().Join(flags.Args())
+	if err != nil {
+		return fail(err)
+	}
+	fmt.Printf("Successfully joined cluster by contacting %d nodes.\n", n)
+	return 0
+}
+
+func leaveCommand(args []string) int {
+	flags, client := clientFlags("leave")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+
+	if err := client().Leave(); err != nil {
+		return fail(err)
+	}
+	fmt.Println("Graceful leave complete")
+	return 0
+}
+
+func forceLeaveCommand(args []string) int {
+	flags, client := clientFlags("force-leave")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+	if flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "A single node name must be given")
+		return 1
+	}
+
+	if err := client().ForceLeave(flags.Arg(0)); err != nil {
+		return fail(err)
+	}
+	return 0
+}
+
+func raftCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "Usage: cerebrum raft <list-peers|remove-peer|transfer-leadership|force-peers|compact> [options]")
+		return 1
+	}
+
+	flags, client := clientFlags("raft " + args[0])
+	if err := flags.Parse(args[1:]); err != nil {
+		return 1
+	}
+
+	switch args[0] {
+	case "list-peers":
+		peers, err := client().RaftPeers()
+		if err != nil {
+			return fail(err)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "Node\tID\tAddress\tState\tVoter")
+		for _, p := range peers {
+			state := "follower"
+			if p.Leader {
+				state = "leader"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%v\n", p.Node, p.ID, p.Address, state, p.Voter)
+		}
+		w.Flush()
+	case "remove-peer":
+		if flags.NArg() != 1 {
+			fmt.Fprintln(os.Stderr, "A single peer address must be given")
+			return 1
+		}
+		if err := client().RemoveRaftPeer(flags.Arg(0)); err != nil {
+			return fail(err)
+		}
+		fmt.Printf("Removed peer with address %q\n", flags.Arg(0))
+	case "transfer-leadership":
+		if err := client().TransferLeadership(); err != nil {
+			return fail(err)
+		}
+	case "force-peers":
+		if flags.NArg() == 0 {
+			fmt.Fprintln(os.Stderr, "At least one peer address must be given")
+			return 1
+		}
+		if err := client().ForceRaftPeers(flags.Args()); err != nil {
+			return fail(err)
+		}
+	case "compact":
+		compaction, err := client().CompactRaftStore()
+		if err != nil {
+			return fail(err)
+		}
+		fmt.Printf("Compacted raft store from %d to %d bytes in %v\n",
+			compaction.SizeBefore, compaction.SizeAfter, compaction.Duration)
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown raft command: %s\n", args[0])
+		return 1
+	}
+	return 0
+}
+
+func kvCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "Usage: cerebrum kv <get|put|delete> [options] key [value]")
+		return 1
+	}
+
+	flags, client := clientFlags("kv " + args[0])
+	if err := flags.Parse(args[1:]); err != nil {
+		return 1
+	}
+
+	switch args[0] {
+	case "get":
+		if flags.NArg() != 1 {
+			fmt.Fprintln(os.Stderr, "A single key must be given")
+			return 1
+		}
+		entry, err := client().KVGet(flags.Arg(0))
+		if err != nil {
+			return fail(err)
+		}
+		if entry == nil {
+			fmt.Fprintf(os.Stderr, "Error: no key exists at %q\n", flags.Arg(0))
+			return 1
+		}
+		fmt.Println(string(entry.Value))
+	case "put":
+		if flags.NArg() != 2 {
+			fmt.Fprintln(os.Stderr, "A key and a value must be given")
+			return 1
+		}
+		if err := client().KVPut(flags.Arg(0), []byte(flags.Arg(1))); err != nil {
+			return fail(err)
+		}
+		fmt.Printf("Success! Data written to: %s\n", flags.Arg(0))
+	case "delete":
+		if flags.NArg() != 1 {
+			fmt.Fprintln(os.Stderr, "A single key must be given")
+			return 1
+		}
+		if err := client().KVDelete(flags.Arg(0)); err != nil {
+			return fail(err)
+		}
+		fmt.Printf("Success! Deleted key: %s\n", flags.Arg(0))
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown kv command: %s\n", args[0])
+		return 1
+	}
+	return 0
+}
+
+func eventCommand(args []string) int {
+	flags, client := clientFlags("event")
+	name := flags.String("name", "", "name of the event")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+	if *name == "" || flags.NArg() > 1 {
+		fmt.Fprintln(os.Stderr, "Usage: cerebrum event -name=<name> [payload]")
+		return 1
+	}
+
+	if err := client().UserEvent(*name, []byte(flags.Arg(0))); err != nil {
+		return fail(err)
+	}
+	fmt.Printf("Event '%s' dispatched!\n", *name)
+	return 0
+}
+
+func queryCommand(args []string) int {
+	flags, client := clientFlags("query")
+	name := flags.String("name", "", "name of the query")
+	wait := flags.Duration("wait", 0, "time to wait for responses, defaults to the Serf query timeout")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+	if *name == "" || flags.NArg() > 1 {
+		fmt.Fprintln(os.Stderr, "Usage: cerebrum query -name=<name> [payload]")
+		return 1
+	}
+
+	responses, err := client().Query(*name, []byte(flags.Arg(0)), *wait)
+	if err != nil {
+		return fail(err)
+	}
+
+	nodes := make([]string, 0, len(responses))
+	for node := range responses {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+	for _, node := range nodes {
+		fmt.Printf("%s: %s\n", node, responses[node])
+	}
+	fmt.Printf("Total responses: %d\n", len(responses))
+	return 0
+}
+
+func snapshotCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "Usage: cerebrum snapshot <save|restore> [options] file")
+		return 1
+	}
+
+	flags, client := clientFlags("snapshot " + args[0])
+	if err := flags.Parse(args[1:]); err != nil {
+		return 1
+	}
+	if flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "A single file must be given")
+		return 1
+	}
+	path := flags.Arg(0)
+
+	switch args[0] {
+	case "save":
+		f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+		if err != nil {
+			return fail(err)
+		}
+		if err = client().SnapshotSave(f); err != nil {
+			f.Close()
+			os.Remove(f.Name())
+			return fail(err)
+		}
+		if err = f.Close(); err != nil {
+			os.Remove(f.Name())
+			return fail(err)
+		}
+		if err = os.Rename(f.Name(), path); err != nil {
+			return fail(err)
+		}
+		fmt.Printf("Saved snapshot: %s\n", path)
+	case "restore":
+		f, err := os.Open(path)
+		if err != nil {
+			return fail(err)
+		}
+		defer f.Close()
+		if err = client().SnapshotRestore(f); err != nil {
+			return fail(err)
+		}
+		fmt.Printf("Restored snapshot: %s\n", path)
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown snapshot command: %s\n", args[0])
+		return 1
+	}
+	return 0
+}
+
+func infoCommand(args []string) int {
+	flags, client := clientFlags("info")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+
+	info, err := client().Info()
+	if err != nil {
+		return fail(err)
+	}
+
+	sections := make([]string, 0, len(info))
+	for section := range info {
+		sections = append(sections, section)
+	}
+	sort.Strings(sections)
+	for _, section := range sections {
+		fmt.Printf("%s:\n", section)
+		keys := make([]string, 0, len(info[section]))
+		for key := range info[section] {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fmt.Printf("\t%s = %s\n", key, info[section][key])
+		}
+	}
+	return 0
+}
+
+func keyringCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "Usage: cerebrum keyring <list|install|use|remove> [options] [key]")
+		return 1
+	}
+
+	flags, client := clientFlags("keyring " + args[0])
+	if err := flags.Parse(args[1:]); err != nil {
+		return 1
+	}
+	if args[0] != "list" && flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "A single key must be given")
+		return 1
+	}
+
+	var resp *cerebrum.KeyringResponse
+	var err error
+	switch args[0] {
+	case "list":
+		resp, err = client().ListKeys()
+	case "install":
+		resp, err = client().InstallKey(flags.Arg(0))
+	case "use":
+		resp, err = client().UseKey(flags.Arg(0))
+	case "remove":
+		resp, err = client().RemoveKey(flags.Arg(0))
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown keyring command: %s\n", args[0])
+		return 1
+	}
+
+	if resp != nil {
+		nodes := make([]string, 0, len(resp.Messages))
+		for node := range resp.Messages {
+			nodes = append(nodes, node)
+		}
+		sort.Strings(nodes)
+		for _, node := range nodes {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", node, resp.Messages[node])
+		}
+		if len(resp.Keys) > 0 {
+			w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+			fmt.Fprintln(w, "Key\tNodes")
+			for key, count := range resp.Keys {
+				fmt.Fprintf(w, "%s\t%d/%d\n", key, count, resp.NumNodes)
+			}
+			w.Flush()
+		}
+	}
+	if err != nil {
+		return fail(err)
+	}
+	return 0
+}
+
+func keygenCommand(args []string) int {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return fail(err)
+	}
+	fmt.Println(base64.StdEncoding.EncodeToString(key))
+	return 0
+}
+
+func aclCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "Usage: cerebrum acl <list|create|update|delete> [options] [id]")
+		return 1
+	}
+
+	flags, client := clientFlags("acl " + args[0])
+	name := flags.String("name", "", "name of the token")
+	management := flags.Bool("management", false, "grant the token management privileges")
+	policy := flags.String("policy", "", "file holding the JSON policy of the token")
+	if err := flags.Parse(args[1:]); err != nil {
+		return 1
+	}
+
+	switch args[0] {
+	case "list":
+		acls, err := client().ACLList()
+		if err != nil {
+			return fail(err)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tName\tManagement")
+		for _, acl := range acls {
+			fmt.Fprintf(w, "%s\t%s\t%v\n", acl.ID, acl.Name, acl.Management)
+		}
+		w.Flush()
+	case "create", "update":
+		acl := &cerebrum.ACLToken{Name: *name, Management: *management}
+		if args[0] == "update" {
+			if flags.NArg() != 1 {
+				fmt.Fprintln(os.Stderr, "The ID of the token must be given")
+				return 1
+			}
+			acl.ID = flags.Arg(0)
+		}
+		if *policy != "" {
+			data, err := ioutil.ReadFile(*policy)
+			if err != nil {
+				return fail(err)
+			}
+			if err = json.Unmarshal(data, &acl.Policy); err != nil {
+				return fail(fmt.Errorf("invalid policy: %v", err))
+			}
+		}
+		id, err := client().ACLSet(acl)
+		if err != nil {
+			return fail(err)
+		}
+		fmt.Println(id)
+	case "delete":
+		if flags.NArg() != 1 {
+			fmt.Fprintln(os.Stderr, "The ID of the token must be given")
+			return 1
+		}
+		if err := client().ACLDelete(flags.Arg(0)); err != nil {
+			return fail(err)
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown acl command: %s\n", args[0])
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,67 @@
+// Command cerebrum runs a Cerebrum agent and performs cluster operations
+// against a running agent through its local admin listener.
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// command runs a subcommand with its arguments and returns the exit code.
+type command struct {
+	synopsis string
+	run      func(args []string) int
+}
+
+var commands = map[string]command{
+	"agent":       {"Runs a Cerebrum agent", agentCommand},
+	"members":     {"Lists the members of the cluster", membersCommand},
+	"join":        {"Joins the agent to a cluster", joinCommand},
+	"leave":       {"Gracefully leaves the cluster and stops the agent", leaveCommand},
+	"force-leave": {"Forces a failed member into the left state", forceLeaveCommand},
+	"raft":        {"Inspects and repairs the Raft peer set", raftCommand},
+	"kv":          {"Reads and writes the replicated key/value store", kvCommand},
+	"event":       {"Fires a user event", eventCommand},
+	"query":       {"Sends a query and prints the responses", queryCommand},
+	"snapshot":    {"Saves and restores snapshots of the replicated state", snapshotCommand},
+	"info":        {"Prints diagnostic information about the agent", infoCommand},
+	"keyring":     {"Manages the gossip encryption keys of the cluster", keyringCommand},
+	"keygen":      {"Generates a new gossip encryption key", keygenCommand},
+	"acl":         {"Manages the ACL tokens of the cluster", aclCommand},
+}
+
+func main() {
+	os.Exit(run(os.Args[1:]))
+}
+
+func run(args []string) int {
+	if len(args) == 0 || args[0] == "-h" || args[0] == "-help" || args[0] == "help" {
+		usage()
+		return 1
+	}
+
+	cmd, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command: %s\n\n", args[0])
+		usage()
+		return 1
+	}
+	return cmd.run(args[1:])
+}
+
+func usage() {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintln(os.Stderr, "Usage: cerebrum <command> [options] [args]")
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "Commands:")
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "    %s%s\n", name+strings.Repeat(" ", 16-len(name)), commands[name].synopsis)
+	}
+}
@@ -2,11 +2,28 @@ package cerebrum
 
 import (
 	"crypto/tls"
+	"fmt"
 	"io"
+	"net"
+	"os"
+	"strings"
 	"time"
 
+	"github.com/armon/go-metrics"
 	"github.com/blacklabeldata/serfer"
 	"github.com/hashicorp/raft"
+	log "github.com/mgutz/logxi/v1"
+)
+
+// Default ports and timings used by DefaultConfig.
+const (
+	DefaultGossipPort         = 7946
+	DefaultRaftAddr           = "127.0.0.1:8300"
+	DefaultReconcileInterval  = 60 * time.Second
+	DefaultConnectionDeadline = time.Second
+	DefaultEnqueueTimeout     = 10 * time.Second
+	DefaultPoolSessions       = 1
+	DefaultPoolHealthInterval = 30 * time.Second
 )
 
 type Config struct {
@@ -68,9 +85,24 @@ type Config struct {
 	// GossipAdvertisePort is the advertising port for the Serf server.
 	GossipAdvertisePort int
 
-	// LogOutput is the output for all logs.
+	// LogOutput is the output of the default Logger.
 	LogOutput io.Writer
 
+	// Logger receives the messages of every component, including Raft and
+	// Serf. It defaults to a logxi logger writing to LogOutput.
+	Logger Logger
+
+	// LogLevel is the level of the components, e.g. "debug" or "warn". It
+	// defaults to DefaultLogLevel.
+	LogLevel string
+
+	// LogLevels overrides LogLevel by component, e.g. {"raft": "warn"}.
+	LogLevels map[string]string
+
+	// Tags are additional Serf tags of this node. The id, role and dc tags
+	// are reserved.
+	Tags map[string]string
+
 	// RaftConfig configures the Raft server.
 	RaftConfig *raft.Config
 
@@ -80,23 +112,79 @@ type Config struct {
 	// LogCacheSize is the number of log entries to keep in memory.
 	LogCacheSize int
 
-	// TLSConfig is the config for Raft over TLS
+	// TLSConfig is the config for Raft over TLS. Mutual TLS is required:
+	// servers must present a certificate for server.<dc>.cerebrum. Use
+	// LoadTLSConfig to rotate certificates from files.
 	TLSConfig *tls.Config
 
+	// AuthorizeStream decides which peers may open each stream type. It
+	// defaults to AuthorizeStreamRoles.
+	AuthorizeStream StreamAuthorizer
+
+	// EncryptKey is a base64 encoded 16, 24 or 32 byte key which enables
+	// gossip encryption. It seeds the keyring persisted under DataPath; once
+	// that exists the keyring is used and keys are rotated with the Operator
+	// keyring functions.
+	EncryptKey string
+
+	// ACLDefaultPolicy enables ACLs. It is "allow" or "deny" and applies to
+	// the anonymous token and to anything a token's policy does not cover.
+	// ACLs are disabled if empty.
+	ACLDefaultPolicy string
+
+	// ACLMasterToken is a management token which is not replicated. Servers
+	// also forward their own writes with it, so it must be the same on all
+	// servers if the default policy is "deny".
+	ACLMasterToken string
+
 	// RaftBindAddr is the bind address and port for the Raft TLS server.
 	RaftBindAddr string
 
-	// ReconcileInterval is the interval at which Raft makes sure the FSM has caught up.
+	// ReconcileInterval is the interval at which the leader makes sure the FSM
+	// has caught up and reconciles the registered nodes with the Serf members.
 	ReconcileInterval time.Duration
 
-	// ConnectionDeadline is the maximum the TLS server will wait for connections.
-	// This deadline also applies to the ammount of time to wait for the server to shutdown.
+	// ConnectionDeadline is the maximum the TLS server will wait for the
+	// handshake of an incoming connection.
 	ConnectionDeadline time.Duration
 
+	// Network carries the connections to the Raft addresses of the other
+	// nodes. It defaults to TCP.
+	Network Network
+
+	// RaftStore opens the Raft log and stable store. It defaults to
+	// BoltRaftStore.
+	RaftStore RaftStoreBackend
+
+	// RaftCompactInterval is how often a bolt Raft store is compacted to
+	// return the pages of deleted logs to the file system. It is disabled
+	// if zero; compactions can still be run by operators.
+	RaftCompactInterval time.Duration
+
+	// PoolSessions is the number of multiplexed sessions kept to each other
+	// node. Streams are opened on the session with the fewest. It defaults to
+	// DefaultPoolSessions if zero.
+	PoolSessions int
+
+	// PoolMaxStreams bounds the streams open to other nodes. Dials wait for
+	// a stream to close when it is reached. It is unbounded if zero.
+	PoolMaxStreams int
+
+	// PoolHealthInterval is how often the pooled sessions are pinged.
+	// Sessions which do not answer within the interval are closed. It
+	// defaults to DefaultPoolHealthInterval if zero.
+	PoolHealthInterval time.Duration
+
 	// EnqueueTimeout is the maximum amount of time a Raft submission will wait
 	// before timing out.
 	EnqueueTimeout time.Duration
 
+	// ForwardTimeout bounds the retries of a tuple forwarded to the leader
+	// when the apply has no deadline. Retries wait ForwardBackoff. They
+	// default to DefaultForwardTimeout and DefaultForwardBackoff if zero.
+	ForwardTimeout time.Duration
+	ForwardBackoff time.Duration
+
 	// EstablishLeadership is called when a node becomes the leader of the
 	// Raft cluster. This function can be called multiple times if it returns an
 	// error.
@@ -108,9 +196,246 @@ type Config struct {
 
 	// ConsistentNodeStatus
 
+	// FSM is the user state machine. Tuples which are not handled by
+	// Cerebrum are applied to it.
+	FSM raft.FSM
+
+	// AdminBindAddr is the address of the local admin listener used by the
+	// command line tool. The listener is disabled if empty. It is neither
+	// encrypted nor authenticated, so it must be a loopback address.
+	AdminBindAddr string
+
+	// HTTPBindAddr is the address of the HTTP API. The HTTP service is only
+	// started if it is set.
+	HTTPBindAddr string
+
+	// StatsdAddr and StatsiteAddr are the addresses of statsd and statsite
+	// servers metrics are streamed to.
+	StatsdAddr   string
+	StatsiteAddr string
+
+	// PrometheusMetrics serves the metrics in the Prometheus text format at
+	// the /v1/agent/metrics?format=prometheus HTTP endpoint.
+	PrometheusMetrics bool
+
+	// DisableHostname stops prefixing gauges with the node name.
+	DisableHostname bool
+
+	// GlobalMetrics installs the sinks as the global go-metrics instance,
+	// which carries the metrics of Raft, Serf and the Go runtime. Only one
+	// node in a process may set it.
+	GlobalMetrics bool
+
+	// MetricSinks receive the metrics in addition to the configured sinks,
+	// e.g. a metrics.InmemSink in tests.
+	MetricSinks []metrics.MetricSink
+
+	// TraceFile is a file the spans of the node are appended to as JSON.
+	TraceFile string
+
+	// TraceExporter receives the spans of the node in addition to
+	// TraceFile. Tracing is disabled unless either is set, but the node
+	// still propagates the traces of other nodes.
+	TraceExporter SpanExporter
+
+	// HealthBindAddr is the address of the local listener serving the /live
+	// and /ready health endpoints. The listener is disabled if empty.
+	HealthBindAddr string
+
+	// HealthMaxIndexLag is the number of committed entries the FSM may lag
+	// behind while the node is still ready.
+	HealthMaxIndexLag uint64
+
+	// HealthMaxLastContact is how long a follower may go without contact
+	// from the leader while it is still ready. Zero uses
+	// DefaultHealthMaxLastContact.
+	HealthMaxLastContact time.Duration
+
 	// Services is an array of services running on top of Cerebrum.
 	Services []Service
 
 	// ExistingNodes is an array of nodes already in the cluster.
 	ExistingNodes []string
 }
+
+// DefaultConfig returns a configuration with sensible defaults. NodeID,
+// DataPath and TLSConfig must still be set.
+func DefaultConfig() *Config {
+	hostname, _ := os.Hostname()
+	return &Config{
+		NodeName:             hostname,
+		DataCenter:           "dc1",
+		GossipBindAddr:       "0.0.0.0",
+		GossipBindPort:       DefaultGossipPort,
+		RaftBindAddr:         DefaultRaftAddr,
+		RaftConfig:           raft.DefaultConfig(),
+		SnapshotsRetained:    SnapshotsRetained,
+		LogCacheSize:         raftLogCacheSize,
+		ReconcileInterval:    DefaultReconcileInterval,
+		ConnectionDeadline:   DefaultConnectionDeadline,
+		EnqueueTimeout:       DefaultEnqueueTimeout,
+		ForwardTimeout:       DefaultForwardTimeout,
+		ForwardBackoff:       DefaultForwardBackoff,
+		PoolSessions:         DefaultPoolSessions,
+		PoolHealthInterval:   DefaultPoolHealthInterval,
+		HealthMaxIndexLag:    DefaultHealthMaxIndexLag,
+		HealthMaxLastContact: DefaultHealthMaxLastContact,
+	}
+}
+
+// ConfigError lists every problem found by Config.Validate.
+type ConfigError struct {
+	Errors []error
+}
+
+func (e *ConfigError) Error() string {
+	msgs := make([]string, 0, len(e.Errors))
+	for _, err := range e.Errors {
+		msgs = append(msgs, "\t* "+err.Error())
+	}
+	return "invalid configuration:\n" + strings.Join(msgs, "\n")
+}
+
+// Validate checks the configuration. It returns a *ConfigError listing all
+// problems or nil.
+func (c *Config) Validate() error {
+	var errs []error
+	fail := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	if c.NodeID == "" {
+		fail("NodeID is required")
+	}
+	if c.NodeName == "" {
+		fail("NodeName is required")
+	}
+	if c.DataCenter == "" {
+		fail("DataCenter is required")
+	}
+	if c.DataPath == "" {
+		fail("DataPath is required")
+	}
+	if c.TLSConfig == nil {
+		fail("TLSConfig is required")
+	} else {
+		if len(c.TLSConfig.Certificates) == 0 && c.TLSConfig.GetCertificate == nil {
+			fail("TLSConfig has no certificate")
+		}
+		if c.TLSConfig.ClientAuth != tls.RequireAndVerifyClientCert || c.TLSConfig.ClientCAs == nil {
+			fail("TLSConfig must require and verify client certificates")
+		}
+	}
+	if c.EncryptKey != "" {
+		if _, err := decodeKey(c.EncryptKey); err != nil {
+			fail("invalid EncryptKey: %v", err)
+		}
+	}
+	switch c.ACLDefaultPolicy {
+	case "", ACLPolicyAllow, ACLPolicyDeny:
+	default:
+		fail("invalid ACLDefaultPolicy %q", c.ACLDefaultPolicy)
+	}
+	if c.RaftConfig == nil {
+		fail("RaftConfig is required")
+	} else if err := raft.ValidateConfig(c.RaftConfig); err != nil {
+		fail("RaftConfig: %v", err)
+	}
+
+	if addr, err := net.ResolveTCPAddr("tcp", c.RaftBindAddr); err != nil {
+		fail("invalid RaftBindAddr %q: %v", c.RaftBindAddr, err)
+	} else if addr.IP == nil || addr.IP.IsUnspecified() {
+		fail("RaftBindAddr %q is not advertisable", c.RaftBindAddr)
+	}
+	if c.GossipBindPort < 0 || c.GossipBindPort > 65535 {
+		fail("invalid GossipBindPort %d", c.GossipBindPort)
+	}
+	if c.GossipAdvertisePort < 0 || c.GossipAdvertisePort > 65535 {
+		fail("invalid GossipAdvertisePort %d", c.GossipAdvertisePort)
+	}
+	if c.AdminBindAddr != "" {
+		if host, _, err := net.SplitHostPort(c.AdminBindAddr); err != nil {
+			fail("invalid AdminBindAddr %q: %v", c.AdminBindAddr, err)
+		} else if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			fail("AdminBindAddr %q is not a loopback address", c.AdminBindAddr)
+		}
+	}
+	if c.HTTPBindAddr != "" {
+		if _, _, err := net.SplitHostPort(c.HTTPBindAddr); err != nil {
+			fail("invalid HTTPBindAddr %q: %v", c.HTTPBindAddr, err)
+		}
+	}
+	if c.HealthBindAddr != "" {
+		if _, _, err := net.SplitHostPort(c.HealthBindAddr); err != nil {
+			fail("invalid HealthBindAddr %q: %v", c.HealthBindAddr, err)
+		}
+	}
+	if c.StatsdAddr != "" {
+		if _, _, err := net.SplitHostPort(c.StatsdAddr); err != nil {
+			fail("invalid StatsdAddr %q: %v", c.StatsdAddr, err)
+		}
+	}
+	if c.StatsiteAddr != "" {
+		if _, _, err := net.SplitHostPort(c.StatsiteAddr); err != nil {
+			fail("invalid StatsiteAddr %q: %v", c.StatsiteAddr, err)
+		}
+	}
+
+	if c.LogLevel != "" {
+		if _, ok := log.LevelAtoi[c.LogLevel]; !ok {
+			fail("invalid LogLevel %q", c.LogLevel)
+		}
+	}
+	for name, level := range c.LogLevels {
+		if _, ok := log.LevelAtoi[level]; !ok {
+			fail("invalid LogLevels[%q] %q", name, level)
+		}
+	}
+	for _, tag := range reservedTags {
+		if _, ok := c.Tags[tag]; ok {
+			fail("tag %q is reserved", tag)
+		}
+	}
+
+	if c.SnapshotsRetained < 1 {
+		fail("SnapshotsRetained must be at least 1")
+	}
+	if c.LogCacheSize < 1 {
+		fail("LogCacheSize must be at least 1")
+	}
+	if c.ReconcileInterval <= 0 {
+		fail("ReconcileInterval must be positive")
+	}
+	if c.ConnectionDeadline <= 0 {
+		fail("ConnectionDeadline must be positive")
+	}
+	if c.EnqueueTimeout <= 0 {
+		fail("EnqueueTimeout must be positive")
+	}
+	if c.ForwardTimeout < 0 || c.ForwardTimeout >= DedupWindow {
+		fail("ForwardTimeout must not be negative and must be less than %v", DedupWindow)
+	}
+	if c.ForwardBackoff < 0 {
+		fail("ForwardBackoff must not be negative")
+	}
+	if c.HealthMaxLastContact < 0 {
+		fail("HealthMaxLastContact must not be negative")
+	}
+	if c.RaftCompactInterval < 0 {
+		fail("RaftCompactInterval must not be negative")
+	}
+	if c.PoolSessions < 0 {
+		fail("PoolSessions must not be negative")
+	}
+	if c.PoolMaxStreams < 0 {
+		fail("PoolMaxStreams must not be negative")
+	}
+	if c.PoolHealthInterval < 0 {
+		fail("PoolHealthInterval must not be negative")
+	}
+
+	if len(errs) > 0 {
+		return &ConfigError{errs}
+	}
+	return nil
+}
@@ -0,0 +1,417 @@
+package cerebrum
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/hcl"
+	"github.com/hashicorp/raft"
+)
+
+// ConfigEnvPrefix prefixes the environment variables read by ReadConfigEnv.
+// The name of each variable is the prefix followed by the upper cased file
+// key, e.g. CEREBRUM_NODE_NAME.
+const ConfigEnvPrefix = "CEREBRUM_"
+
+// FileConfig is the part of the configuration which can be read from JSON or
+// HCL files and from the environment. Unset fields are nil so that several
+// sources can be merged. Services, the FSM and the event handlers can only be
+// set in code.
+type FileConfig struct {
+	Bootstrap     *bool    `hcl:"bootstrap"`
+	NodeID        *string  `hcl:"node_id"`
+	NodeName      *string  `hcl:"node_name"`
+	DataCenter    *string  `hcl:"datacenter"`
+	DataPath      *string  `hcl:"data_path"`
+	ExistingNodes []string `hcl:"existing_nodes"`
+
+	GossipBindAddr      *string `hcl:"gossip_bind_addr"`
+	GossipBindPort      *int    `hcl:"gossip_bind_port"`
+	GossipAdvertiseAddr *string `hcl:"gossip_advertise_addr"`
+	GossipAdvertisePort *int    `hcl:"gossip_advertise_port"`
+
+	RaftBindAddr  *string `hcl:"raft_bind_addr"`
+	AdminBindAddr *string `hcl:"admin_bind_addr"`
+	HTTPBindAddr  *string `hcl:"http_bind_addr"`
+
+	HealthBindAddr       *string `hcl:"health_bind_addr"`
+	HealthMaxIndexLag    *uint64 `hcl:"health_max_index_lag"`
+	HealthMaxLastContact *string `hcl:"health_max_last_contact"`
+
+	SnapshotsRetained  *int    `hcl:"snapshots_retained"`
+	LogCacheSize       *int    `hcl:"log_cache_size"`
+	ReconcileInterval  *string `hcl:"reconcile_interval"`
+	ConnectionDeadline *string `hcl:"connection_deadline"`
+	EnqueueTimeout     *string `hcl:"enqueue_timeout"`
+	ForwardTimeout     *string `hcl:"forward_timeout"`
+	ForwardBackoff     *string `hcl:"forward_backoff"`
+
+	PoolSessions       *int    `hcl:"pool_sessions"`
+	PoolMaxStreams     *int    `hcl:"pool_max_streams"`
+	PoolHealthInterval *string `hcl:"pool_health_interval"`
+
+	RaftHeartbeatTimeout   *string `hcl:"raft_heartbeat_timeout"`
+	RaftElectionTimeout    *string `hcl:"raft_election_timeout"`
+	RaftLeaderLeaseTimeout *string `hcl:"raft_leader_lease_timeout"`
+	RaftSnapshotInterval   *string `hcl:"raft_snapshot_interval"`
+	RaftSnapshotThreshold  *uint64 `hcl:"raft_snapshot_threshold"`
+
+	LogLevel  *string           `hcl:"log_level"`
+	LogLevels map[string]string `hcl:"log_levels"`
+	Tags      map[string]string `hcl:"tags"`
+
+	CertFile *string `hcl:"cert_file"`
+	KeyFile  *string `hcl:"key_file"`
+	CAFile   *string `hcl:"ca_file"`
+
+	EncryptKey *string `hcl:"encrypt"`
+
+	ACLDefaultPolicy *string `hcl:"acl_default_policy"`
+	ACLMasterToken   *string `hcl:"acl_master_token"`
+
+	StatsdAddr        *string `hcl:"statsd_addr"`
+	StatsiteAddr      *string `hcl:"statsite_addr"`
+	PrometheusMetrics *bool   `hcl:"prometheus_metrics"`
+	DisableHostname   *bool   `hcl:"disable_hostname"`
+
+	TraceFile *string `hcl:"trace_file"`
+
+	RaftStore           *string `hcl:"raft_store"`
+	RaftCompactInterval *string `hcl:"raft_compact_interval"`
+}
+
+// LoadConfig merges the given files in order and then the environment, and
+// applies the result to DefaultConfig. A directory merges all of its .json
+// and .hcl files in lexical order. The result is not validated since fields
+// like Services are left for code; New validates it.
+func LoadConfig(paths ...string) (*Config, error) {
+	merged := &FileConfig{}
+	for _, path := range paths {
+		files, err := configFiles(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			fc, err := ReadConfigFile(file)
+			if err != nil {
+				return nil, err
+			}
+			merged.Merge(fc)
+		}
+	}
+
+	fc, err := ReadConfigEnv()
+	if err != nil {
+		return nil, err
+	}
+	merged.Merge(fc)
+
+	config := DefaultConfig()
+	if err = merged.Apply(config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// configFiles lists the configuration files at path.
+func configFiles(path string) ([]string, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return []string{path}, nil
+	}
+
+	infos, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, fi := range infos {
+		ext := filepath.Ext(fi.Name())
+		if !fi.IsDir() && (ext == ".json" || ext == ".hcl") {
+			files = append(files, filepath.Join(path, fi.Name()))
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// ReadConfigFile reads a JSON or HCL configuration file.
+func ReadConfigFile(path string) (*FileConfig, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var fc FileConfig
+	if err = hcl.Decode(&fc, string(buf)); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return &fc, nil
+}
+
+// ReadConfigEnv reads the configuration from the environment. Lists are comma
+// separated and maps are comma separated key=value pairs.
+func ReadConfigEnv() (*FileConfig, error) {
+	var fc FileConfig
+	v := reflect.ValueOf(&fc).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := ConfigEnvPrefix + strings.ToUpper(t.Field(i).Tag.Get("hcl"))
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		if err := setEnvField(v.Field(i), value); err != nil {
+			return nil, fmt.Errorf("invalid %s: %v", name, err)
+		}
+	}
+	return &fc, nil
+}
+
+// setEnvField parses value into a FileConfig field.
+func setEnvField(field reflect.Value, value string) error {
+	if field.Kind() == reflect.Slice {
+		var list []string
+		for _, s := range strings.Split(value, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				list = append(list, s)
+			}
+		}
+		field.Set(reflect.ValueOf(list))
+		return nil
+	}
+	if field.Kind() == reflect.Map {
+		m := make(map[string]string)
+		for _, s := range strings.Split(value, ",") {
+			if s = strings.TrimSpace(s); s == "" {
+				continue
+			}
+			kv := strings.SplitN(s, "=", 2)
+			if len(kv) != 2 {
+				return fmt.Errorf("expected key=value, got %q", s)
+			}
+			m[kv[0]] = kv[1]
+		}
+		field.Set(reflect.ValueOf(m))
+		return nil
+	}
+
+	ptr := reflect.New(field.Type().Elem())
+	switch elem := ptr.Elem(); elem.Kind() {
+	case reflect.String:
+		elem.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		elem.SetBool(b)
+	case reflect.Int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		elem.SetInt(int64(n))
+	case reflect.Uint64:
+		n, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		elem.SetUint(n)
+	}
+	field.Set(ptr)
+	return nil
+}
+
+// Merge overrides the fields of f with the fields set in o.
+func (f *FileConfig) Merge(o *FileConfig) {
+	dst := reflect.ValueOf(f).Elem()
+	src := reflect.ValueOf(o).Elem()
+	for i := 0; i < src.NumField(); i++ {
+		if !src.Field(i).IsNil() {
+			dst.Field(i).Set(src.Field(i))
+		}
+	}
+}
+
+// Apply copies the set fields into the Config.
+func (f *FileConfig) Apply(c *Config) (err error) {
+	mergeBool(&c.Bootstrap, f.Bootstrap)
+	mergeString(&c.NodeID, f.NodeID)
+	mergeString(&c.NodeName, f.NodeName)
+	mergeString(&c.DataCenter, f.DataCenter)
+	mergeString(&c.DataPath, f.DataPath)
+	if f.ExistingNodes != nil {
+		c.ExistingNodes = f.ExistingNodes
+	}
+
+	mergeString(&c.GossipBindAddr, f.GossipBindAddr)
+	mergeInt(&c.GossipBindPort, f.GossipBindPort)
+	mergeString(&c.GossipAdvertiseAddr, f.GossipAdvertiseAddr)
+	mergeInt(&c.GossipAdvertisePort, f.GossipAdvertisePort)
+
+	mergeString(&c.RaftBindAddr, f.RaftBindAddr)
+	mergeString(&c.AdminBindAddr, f.AdminBindAddr)
+	mergeString(&c.HTTPBindAddr, f.HTTPBindAddr)
+	mergeString(&c.HealthBindAddr, f.HealthBindAddr)
+	if f.HealthMaxIndexLag != nil {
+		c.HealthMaxIndexLag = *f.HealthMaxIndexLag
+	}
+	mergeString(&c.LogLevel, f.LogLevel)
+	if f.LogLevels != nil {
+		c.LogLevels = f.LogLevels
+	}
+	mergeString(&c.EncryptKey, f.EncryptKey)
+	mergeString(&c.ACLDefaultPolicy, f.ACLDefaultPolicy)
+	mergeString(&c.ACLMasterToken, f.ACLMasterToken)
+	mergeString(&c.StatsdAddr, f.StatsdAddr)
+	mergeString(&c.StatsiteAddr, f.StatsiteAddr)
+	mergeBool(&c.PrometheusMetrics, f.PrometheusMetrics)
+	mergeBool(&c.DisableHostname, f.DisableHostname)
+	mergeString(&c.TraceFile, f.TraceFile)
+	if f.RaftStore != nil {
+		backend, ok := raftStoreBackends[*f.RaftStore]
+		if !ok {
+			return fmt.Errorf("invalid raft_store %q", *f.RaftStore)
+		}
+		c.RaftStore = backend
+	}
+	if f.Tags != nil {
+		c.Tags = f.Tags
+	}
+
+	mergeInt(&c.SnapshotsRetained, f.SnapshotsRetained)
+	mergeInt(&c.LogCacheSize, f.LogCacheSize)
+	if err = mergeDuration(&c.ReconcileInterval, f.ReconcileInterval, "reconcile_interval"); err != nil {
+		return
+	}
+	if err = mergeDuration(&c.ConnectionDeadline, f.ConnectionDeadline, "connection_deadline"); err != nil {
+		return
+	}
+	if err = mergeDuration(&c.EnqueueTimeout, f.EnqueueTimeout, "enqueue_timeout"); err != nil {
+		return
+	}
+	if err = mergeDuration(&c.ForwardTimeout, f.ForwardTimeout, "forward_timeout"); err != nil {
+		return
+	}
+	if err = mergeDuration(&c.ForwardBackoff, f.ForwardBackoff, "forward_backoff"); err != nil {
+		return
+	}
+	if err = mergeDuration(&c.HealthMaxLastContact, f.HealthMaxLastContact, "health_max_last_contact"); err != nil {
+		return
+	}
+	if err = mergeDuration(&c.RaftCompactInterval, f.RaftCompactInterval, "raft_compact_interval"); err != nil {
+		return
+	}
+	mergeInt(&c.PoolSessions, f.PoolSessions)
+	mergeInt(&c.PoolMaxStreams, f.PoolMaxStreams)
+	if err = mergeDuration(&c.PoolHealthInterval, f.PoolHealthInterval, "pool_health_interval"); err != nil {
+		return
+	}
+
+	if f.RaftHeartbeatTimeout != nil || f.RaftElectionTimeout != nil || f.RaftLeaderLeaseTimeout != nil ||
+		f.RaftSnapshotInterval != nil || f.RaftSnapshotThreshold != nil {
+		if c.RaftConfig == nil {
+			c.RaftConfig = raft.DefaultConfig()
+		}
+		if err = mergeDuration(&c.RaftConfig.HeartbeatTimeout, f.RaftHeartbeatTimeout, "raft_heartbeat_timeout"); err != nil {
+			return
+		}
+		if err = mergeDuration(&c.RaftConfig.ElectionTimeout, f.RaftElectionTimeout, "raft_election_timeout"); err != nil {
+			return
+		}
+		if err = mergeDuration(&c.RaftConfig.LeaderLeaseTimeout, f.RaftLeaderLeaseTimeout, "raft_leader_lease_timeout"); err != nil {
+			return
+		}
+		if err = mergeDuration(&c.RaftConfig.SnapshotInterval, f.RaftSnapshotInterval, "raft_snapshot_interval"); err != nil {
+			return
+		}
+		if f.RaftSnapshotThreshold != nil {
+			c.RaftConfig.SnapshotThreshold = *f.RaftSnapshotThreshold
+		}
+	}
+
+	if f.CertFile != nil || f.KeyFile != nil || f.CAFile != nil {
+		var certFile, keyFile, caFile string
+		mergeString(&certFile, f.CertFile)
+		mergeString(&keyFile, f.KeyFile)
+		mergeString(&caFile, f.CAFile)
+		if c.TLSConfig, err = LoadTLSConfig(certFile, keyFile, caFile); err != nil {
+			return
+		}
+	}
+	return nil
+}
+
+func mergeString(dst *string, src *string) {
+	if src != nil {
+		*dst = *src
+	}
+}
+
+func mergeInt(dst *int, src *int) {
+	if src != nil {
+		*dst = *src
+	}
+}
+
+func mergeBool(dst *bool, src *bool) {
+	if src != nil {
+		*dst = *src
+	}
+}
+
+func mergeDuration(dst *time.Duration, src *string, key string) error {
+	if src == nil {
+		return nil
+	}
+	d, err := time.ParseDuration(*src)
+	if err != nil {
+		return fmt.Errorf("invalid %s: %v", key, err)
+	}
+	*dst = d
+	return nil
+}
+
+// LoadTLSConfig creates a mutual TLS configuration. The certificate and key
+// are reloaded when the files change. Peers must present a certificate signed
+// by the CA.
+func LoadTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	if certFile == "" || keyFile == "" || caFile == "" {
+		return nil, fmt.Errorf("cert_file, key_file and ca_file are required")
+	}
+	certs, err := NewCertReloader(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+
+	return &tls.Config{
+		GetCertificate:       certs.GetCertificate,
+		GetClientCertificate: certs.GetClientCertificate,
+		RootCAs:              pool,
+		ClientCAs:            pool,
+		ClientAuth:           tls.RequireAndVerifyClientCert,
+		MinVersion:           tls.VersionTLS12,
+	}, nil
+}
@@ -0,0 +1,161 @@
+package cerebrum
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	log "github.com/mgutz/logxi/v1"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfig_ValidateDefault(t *testing.T) {
+	err := DefaultConfig().Validate()
+	if assert.IsType(t, &ConfigError{}, err) {
+		// NodeID, DataPath and TLSConfig have no defaults
+		assert.Len(t, err.(*ConfigError).Errors, 3)
+	}
+
+	c := DefaultConfig()
+	c.NodeID = "n1"
+	c.DataPath = "/tmp/cerebrum"
+	c.TLSConfig = mutualTLSConfig()
+	assert.Nil(t, c.Validate())
+}
+
+func TestConfig_ValidateZero(t *testing.T) {
+	// Optional fields left zero in a Config literal take their defaults
+	c := &Config{
+		NodeID:             "n1",
+		NodeName:           "node",
+		DataCenter:         "dc1",
+		DataPath:           "/tmp/cerebrum",
+		TLSConfig:          mutualTLSConfig(),
+		RaftConfig:         raft.DefaultConfig(),
+		RaftBindAddr:       DefaultRaftAddr,
+		SnapshotsRetained:  SnapshotsRetained,
+		LogCacheSize:       raftLogCacheSize,
+		ReconcileInterval:  DefaultReconcileInterval,
+		ConnectionDeadline: DefaultConnectionDeadline,
+		EnqueueTimeout:     DefaultEnqueueTimeout,
+	}
+	assert.Nil(t, c.Validate())
+
+	fwdr := NewForwarder(nil, nil, nil, &log.NullLogger{}, c.ForwardTimeout, c.ForwardBackoff).(*forwarder)
+	assert.Equal(t, DefaultForwardTimeout, fwdr.timeout)
+	assert.Equal(t, DefaultForwardBackoff, fwdr.backoff)
+	pool := NewPool(ioutil.Discard, time.Minute, nil)
+	defer pool.Shutdown()
+	pool.SetSessions(c.PoolSessions)
+	pool.SetHealthInterval(c.PoolHealthInterval)
+	assert.Equal(t, DefaultPoolSessions, pool.sessions)
+	assert.Equal(t, DefaultPoolHealthInterval, pool.healthInterval)
+}
+
+func TestConfig_ValidateAll(t *testing.T) {
+	c := DefaultConfig()
+	c.NodeID = "n1"
+	c.DataPath = "/tmp/cerebrum"
+	c.TLSConfig = mutualTLSConfig()
+	c.RaftConfig = nil
+	c.RaftBindAddr = "0.0.0.0:8300"
+	c.LogCacheSize = 0
+	c.ReconcileInterval = 0
+	c.PoolSessions = -1
+	c.ForwardTimeout = DedupWindow
+	c.AdminBindAddr = "0.0.0.0:8400"
+
+	err := c.Validate()
+	if assert.IsType(t, &ConfigError{}, err) {
+		assert.Len(t, err.(*ConfigError).Errors, 7)
+	}
+}
+
+func TestConfig_ValidateAdminBindAddr(t *testing.T) {
+	c := DefaultConfig()
+	c.NodeID = "n1"
+	c.DataPath = "/tmp/cerebrum"
+	c.TLSConfig = mutualTLSConfig()
+	for _, addr := range []string{"127.0.0.1:8400", "[::1]:8400", "localhost:8400"} {
+		c.AdminBindAddr = addr
+		assert.Nil(t, c.Validate(), addr)
+	}
+	for _, addr := range []string{":8400", "10.0.1.5:8400", "admin.example.com:8400"} {
+		c.AdminBindAddr = addr
+		assert.NotNil(t, c.Validate(), addr)
+	}
+}
+
+func TestConfig_Load(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cerebrum-config")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	hclFile := filepath.Join(dir, "a.hcl")
+	assert.Nil(t, ioutil.WriteFile(hclFile, []byte(`
+node_id = "n1"
+data_path = "/tmp/cerebrum"
+existing_nodes = ["10.0.0.1", "10.0.0.2"]
+reconcile_interval = "5s"
+raft_election_timeout = "2s"
+raft_store = "inmem"
+raft_compact_interval = "6h"
+health_max_last_contact = "3s"
+`), 0644))
+	jsonFile := filepath.Join(dir, "b.json")
+	assert.Nil(t, ioutil.WriteFile(jsonFile, []byte(`{"node_id": "n2", "log_cache_size": 64}`), 0644))
+
+	os.Setenv("CEREBRUM_DATACENTER", "east")
+	os.Setenv("CEREBRUM_EXISTING_NODES", "10.0.0.3, 10.0.0.4")
+	defer os.Unsetenv("CEREBRUM_DATACENTER")
+	defer os.Unsetenv("CEREBRUM_EXISTING_NODES")
+
+	c, err := LoadConfig(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, "n2", c.NodeID)
+	assert.Equal(t, "/tmp/cerebrum", c.DataPath)
+	assert.Equal(t, "east", c.DataCenter)
+	assert.Equal(t, []string{"10.0.0.3", "10.0.0.4"}, c.ExistingNodes)
+	assert.Equal(t, 64, c.LogCacheSize)
+	assert.Equal(t, 5*time.Second, c.ReconcileInterval)
+	assert.Equal(t, 2*time.Second, c.RaftConfig.ElectionTimeout)
+	assert.Equal(t, DefaultEnqueueTimeout, c.EnqueueTimeout)
+	assert.Equal(t, InmemRaftStore{}, c.RaftStore)
+	assert.Equal(t, 6*time.Hour, c.RaftCompactInterval)
+	assert.Equal(t, 3*time.Second, c.HealthMaxLastContact)
+}
+
+func TestConfig_LoadInvalidRaftStore(t *testing.T) {
+	f, err := ioutil.TempFile("", "cerebrum-config")
+	assert.Nil(t, err)
+	defer os.Remove(f.Name())
+	f.WriteString(`raft_store = "paper"`)
+	f.Close()
+
+	_, err = LoadConfig(f.Name())
+	assert.NotNil(t, err)
+}
+
+func TestConfig_LoadInvalidDuration(t *testing.T) {
+	f, err := ioutil.TempFile("", "cerebrum-config")
+	assert.Nil(t, err)
+	defer os.Remove(f.Name())
+	f.WriteString(`enqueue_timeout = "soon"`)
+	f.Close()
+
+	_, err = LoadConfig(f.Name())
+	assert.NotNil(t, err)
+}
+
+func mutualTLSConfig() *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{tls.Certificate{}},
+		ClientCAs:    x509.NewCertPool(),
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+}
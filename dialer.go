@@ -23,15 +23,13 @@ type dialer struct {
 	pool *ConnPool
 }
 
+// Dial opens a stream of any type but the reserved UnknownStreamType. The
+// remote node closes streams it has no handler for.
 func (d *dialer) Dial(c yamuxer.StreamType, address string, timeout time.Duration) (net.Conn, error) {
-	switch c {
-	case connRaft:
-		return d.pool.dialRaft(address, timeout)
-	case connForward:
-		return d.pool.dialForwarding(address, timeout)
-	default:
+	if c == yamuxer.UnknownStreamType {
 		return nil, ErrUnknownConnType
 	}
+	return d.pool.dial(address, c, timeout)
 }
 
 func (d *dialer) Shutdown() error {
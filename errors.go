@@ -4,4 +4,40 @@ import "errors"
 
 var ErrNoLeader = errors.New("No cluster leader")
 
+var ErrNotForwardable = errors.New("Tuple type cannot be forwarded")
+
+var ErrInvalidForwardAck = errors.New("Invalid forward acknowledgement")
+
+var ErrStaleSequence = errors.New("Request sequence number was superseded")
+
 var ErrUnknownConnType = errors.New("Unknown connection type")
+
+var ErrStreamTypeReserved = errors.New("Stream type is reserved")
+
+var ErrStreamTypeRegistered = errors.New("Stream type is already registered")
+
+var ErrUnknownRPCMethod = errors.New("Unknown RPC method")
+
+var ErrRPCMethodRegistered = errors.New("RPC method is already registered")
+
+var ErrNoPeers = errors.New("No peers given")
+
+var ErrLeadershipTransfer = errors.New("Leadership transfer is not supported")
+
+var ErrCompactionUnsupported = errors.New("Raft store does not support compaction")
+
+var ErrUnknownAdminOp = errors.New("Unknown admin operation")
+
+var ErrNoSnapshot = errors.New("No snapshot has been taken")
+
+var ErrRestoreInterrupted = errors.New("Restore was interrupted by another restore")
+
+var ErrPermissionDenied = errors.New("Permission denied")
+
+var ErrACLNotFound = errors.New("ACL not found")
+
+var ErrNotReadyForConsistentReads = errors.New("Not ready to serve consistent reads")
+
+var ErrPoolShutdown = errors.New("Connection pool is shut down")
+
+var ErrTooManyStreams = errors.New("Too many open streams")
@@ -14,10 +14,31 @@ import (
 const (
 	connForward yamuxer.StreamType = 0x01
 	connRaft                       = 0x02
+	connAdmin                      = 0x03
+	connRPC                        = 0x04
 )
 
+// maxForwardSize is the largest tuple accepted on a forwarding stream.
+const maxForwardSize = 1 << 20
+
+// isForwardable determines if a forwarded tuple may be applied by the leader.
+func isForwardable(t namedtuple.Tuple) bool {
+	return t.Is(nodeStatus) || t.Is(kvSet) || t.Is(kvDelete) || t.Is(stateRestore) ||
+		t.Is(aclSet) || t.Is(aclDelete) || t.Is(auditEvent)
+}
+
+// forwarded is a tuple received on a forwarding stream with its ACL token,
+// the span of the follower and its request ID.
+type forwarded struct {
+	tuple namedtuple.Tuple
+	token string
+	span  SpanContext
+	id    requestID
+}
+
 type ForwardingHandler struct {
 	applier Applier
+	tracer  *Tracer
 	logger  log.Logger
 }
 
@@ -26,7 +47,7 @@ func (f *ForwardingHandler) Handle(c context.Context, conn net.Conn) {
 	g := grim.ReaperWithContext(c)
 	defer g.Wait()
 
-	messages := make(chan namedtuple.Tuple, 1)
+	messages := make(chan forwarded, 1)
 	g.SpawnFunc(func(ctx context.Context) {
 		defer conn.Close()
 		for {
@@ -36,25 +57,55 @@ func (f *ForwardingHandler) Handle(c context.Context, conn net.Conn) {
 				if !ok {
 					return
 				}
-				if err := f.applier.Apply(msg); err != nil {
-					f.logger.Warn("error applying message")
+				err := ErrNotForwardable
+				if isForwardable(msg.tuple) {
+					span := f.tracer.continueSpan(msg.span, "forward")
+					span.SetAttribute("peer", conn.RemoteAddr().String())
+					actx := contextWithRequestID(ContextWithSpan(ctx, span.Context()), msg.id)
+					err = f.applier.ApplyWithTokenContext(actx, msg.tuple, msg.token)
+					span.Finish(err)
+				}
+				if err != nil {
+					f.logger.Warn("error applying message", "err", err)
+				}
+
+				// Forwards with an ID wait for the result of the apply
+				if msg.id.client != "" {
+					f.ack(conn, msg.id.client, err)
 				}
 			}
 		}
 	})
 	g.SpawnFunc(func(ctx context.Context) {
 		defer close(messages)
-		decoder := namedtuple.NewDecoder(namedtuple.DefaultRegistry, conn)
+		decoder := namedtuple.NewDecoderSize(namedtuple.DefaultRegistry, maxForwardSize, conn)
 		for {
 			tuple, err := decoder.Decode()
 			if err != nil {
 				return
 			}
 
-			if tuple.Is(nodeStatus) {
-				messages <- tuple
+			// Tuples without an envelope are applied with the anonymous token
+			msg := forwarded{tuple: tuple}
+			if tuple.Is(forwardReq) {
+				if msg, err = decodeForward(tuple); err != nil {
+					f.logger.Warn("Failed to decode forwarded tuple", "err", err)
+					continue
+				}
 			}
+			messages <- msg
 		}
 	})
 	return
 }
+
+// ack sends the result of a forward to the follower.
+func (f *ForwardingHandler) ack(conn net.Conn, id string, applyErr error) {
+	data, err := encodeForwardAck(id, applyErr)
+	if err == nil {
+		_, err = conn.Write(data)
+	}
+	if err != nil {
+		f.logger.Warn("Failed to acknowledge forwarded tuple", "err", err)
+	}
+}
@@ -3,44 +3,128 @@ package cerebrum
 import (
 	"time"
 
+	"github.com/blacklabeldata/namedtuple"
 	log "github.com/mgutz/logxi/v1"
+	"golang.org/x/net/context"
 )
 
-// Forwarder forwards data to the cluster leader. If the leader is unknown,
-// an error will be returned. If the leader cannot be contacted, an error
-// returned. If the data cannot be written to the leader, an error will be
-// returned.
+// Defaults of leader forwarding.
+const (
+	DefaultForwardTimeout = 10 * time.Second
+	DefaultForwardBackoff = 50 * time.Millisecond
+)
+
+// forwardDialTimeout bounds each dial of the leader.
+const forwardDialTimeout = 3 * time.Second
+
+// maxForwardAckSize is the largest acknowledgement read from the leader.
+const maxForwardAckSize = 64 << 10
+
+// Forwarder forwards data to the cluster leader and waits for the leader to
+// apply it. While there is no leader, the leader cannot be contacted or it
+// loses the leadership, the data is sent again until the context expires.
+// Contexts without a deadline expire after the forward timeout.
 type Forwarder interface {
-	Forward([]byte) error
+	Forward(context.Context, []byte) error
 }
 
-func NewForwarder(r RaftApplier, d Dialer, l log.Logger) Forwarder {
-	return &forwarder{r, d, l}
+// NewForwarder creates a Forwarder which waits the backoff between attempts.
+func NewForwarder(r RaftApplier, d Dialer, m *Telemetry, l log.Logger, timeout, backoff time.Duration) Forwarder {
+	if timeout <= 0 {
+		timeout = DefaultForwardTimeout
+	}
+	if backoff <= 0 {
+		backoff = DefaultForwardBackoff
+	}
+	return &forwarder{r, d, m, l, timeout, backoff}
 }
 
 type forwarder struct {
-	raft   RaftApplier
-	dialer Dialer
-	logger log.Logger
+	raft      RaftApplier
+	dialer    Dialer
+	telemetry *Telemetry
+	logger    log.Logger
+	timeout   time.Duration
+	backoff   time.Duration
 }
 
 // Forward is used to forward an RPC call to the leader, or fail if no leader
-func (f *forwarder) Forward(buf []byte) error {
+// is elected before the context expires
+func (f *forwarder) Forward(ctx context.Context, buf []byte) error {
+	if _, ok := ctx.Deadline(); !ok && f.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, f.timeout)
+		defer cancel()
+	}
+
+	for {
+		acked, err := f.forward(ctx, buf)
+		if acked && !isLeaderError(err) {
+			return err
+		}
+
+		f.telemetry.IncrCounter([]string{"forward", "retries"}, 1)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(f.backoff):
+		}
+	}
+}
+
+// forward sends the data to the leader once. It reports whether the leader
+// acknowledged the apply, and returns its error.
+func (f *forwarder) forward(ctx context.Context, buf []byte) (bool, error) {
 	leader := f.raft.Leader()
 	if leader == "" {
-		f.logger.Error("No cluster leader")
-		return ErrNoLeader
+		f.telemetry.IncrCounter([]string{"forward", "no_leader"}, 1)
+		f.logger.Warn("No cluster leader")
+		return false, ErrNoLeader
+	}
+
+	timeout := forwardDialTimeout
+	deadline, ok := ctx.Deadline()
+	if ok {
+		if remaining := deadline.Sub(time.Now()); remaining <= 0 {
+			return false, context.DeadlineExceeded
+		} else if remaining < timeout {
+			timeout = remaining
+		}
 	}
 
-	conn, err := f.dialer.Dial(connForward, leader, 3*time.Second)
+	f.telemetry.IncrCounter([]string{"forward", "dials"}, 1)
+	conn, err := f.dialer.Dial(connForward, leader, timeout)
 	if err != nil {
-		f.logger.Error("Failed to dial cluster leader", "leader", leader, "err", err)
-		return err
+		f.telemetry.IncrCounter([]string{"forward", "dial_failures"}, 1)
+		f.logger.Warn("Failed to dial cluster leader", "leader", leader, "err", err)
+		return false, err
 	}
 	defer conn.Close()
+	if ok {
+		conn.SetDeadline(deadline)
+	}
 	if _, err = conn.Write(buf); err != nil {
-		f.logger.Error("Failed to send data to cluster leader", "leader", leader, "err", err)
-		return err
+		f.telemetry.IncrCounter([]string{"forward", "write_failures"}, 1)
+		f.logger.Warn("Failed to send data to cluster leader", "leader", leader, "err", err)
+		return false, err
+	}
+
+	decoder := namedtuple.NewDecoderSize(namedtuple.DefaultRegistry, maxForwardAckSize, conn)
+	tuple, err := decoder.Decode()
+	if err == nil && !tuple.Is(forwardAck) {
+		err = ErrInvalidForwardAck
+	}
+	if err != nil {
+		f.telemetry.IncrCounter([]string{"forward", "ack_failures"}, 1)
+		f.logger.Warn("Failed to read acknowledgement of cluster leader", "leader", leader, "err", err)
+		if ok && !time.Now().Before(deadline) {
+			err = context.DeadlineExceeded
+		}
+		return false, err
+	}
+	_, applyErr, err := decodeForwardAck(tuple)
+	if err != nil {
+		return false, err
 	}
-	return nil
+	return true, applyErr
 }
@@ -2,24 +2,37 @@ package cerebrum
 
 import (
 	"errors"
+	"net"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/blacklabeldata/namedtuple"
+	"github.com/blacklabeldata/yamuxer"
+	"github.com/hashicorp/raft"
 	log "github.com/mgutz/logxi/v1"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"golang.org/x/net/context"
 )
 
+func expiredContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	return ctx
+}
+
 func TestForward_NoLeader(t *testing.T) {
 	applier := &MockRaftApplier{leader: ""}
 	applier.On("Leader").Return(ErrNoLeader)
 	fwdr := &forwarder{
-		raft:   applier,
-		logger: &log.NullLogger{},
+		raft:    applier,
+		logger:  &log.NullLogger{},
+		backoff: time.Hour,
 	}
 
 	var buf []byte
-	err := fwdr.Forward(buf)
+	err := fwdr.Forward(expiredContext(), buf)
 	applier.AssertCalled(t, "Leader")
 	assert.Equal(t, ErrNoLeader, err, "Forward should return ErrNoLeader")
 }
@@ -30,19 +43,21 @@ func TestForward_DialError(t *testing.T) {
 
 	dialError := errors.New("dial error")
 	dialer := &MockDialer{err: dialError}
-	dialer.On("Dial", connForward, "leader", 3*time.Second).Return(nil, dialError)
+	dialer.On("Dial", connForward, "leader", mock.Anything).Return(nil, dialError)
 
 	fwdr := &forwarder{
-		raft:   applier,
-		dialer: dialer,
-		logger: &log.NullLogger{},
+		raft:    applier,
+		dialer:  dialer,
+		logger:  &log.NullLogger{},
+		timeout: 100 * time.Millisecond,
+		backoff: 10 * time.Millisecond,
 	}
 
+	// Dials are retried until the timeout
 	var buf []byte
-	err := fwdr.Forward(buf)
-	applier.AssertCalled(t, "Leader")
-	dialer.AssertCalled(t, "Dial", connForward, "leader", 3*time.Second)
+	err := fwdr.Forward(context.Background(), buf)
 	assert.Equal(t, dialError, err, "Forward should return dial error")
+	assert.True(t, len(dialer.Calls) > 1, "Forward should dial again")
 }
 
 func TestForward_WriteError(t *testing.T) {
@@ -52,6 +67,7 @@ func TestForward_WriteError(t *testing.T) {
 	var buf []byte
 	writeError := errors.New("write failed")
 	conn := &MockConn{err: writeError}
+	conn.On("SetDeadline", mock.Anything).Return(writeError)
 	conn.On("Write", buf).Return(0, writeError)
 	conn.On("Close").Return()
 
@@ -59,37 +75,80 @@ func TestForward_WriteError(t *testing.T) {
 	dialer.On("Dial", connForward, "leader", 3*time.Second).Return(conn, nil)
 
 	fwdr := &forwarder{
-		raft:   applier,
-		dialer: dialer,
-		logger: &log.NullLogger{},
+		raft:    applier,
+		dialer:  dialer,
+		logger:  &log.NullLogger{},
+		backoff: time.Hour,
 	}
 
-	err := fwdr.Forward(buf)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
+	defer cancel()
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	err := fwdr.Forward(ctx, buf)
 	applier.AssertCalled(t, "Leader")
 	dialer.AssertCalled(t, "Dial", connForward, "leader", 3*time.Second)
 	conn.AssertCalled(t, "Write", buf)
 	assert.Equal(t, writeError, err, "Forward should return write error")
 }
 
-func TestForward_Write(t *testing.T) {
-	applier := &MockRaftApplier{leader: "leader"}
-	applier.On("Leader").Return("leader")
+// leaderDialer connects forwards to a fake leader which acknowledges them
+// with the errors in turn.
+type leaderDialer struct {
+	acks  []error
+	dials int32
+}
 
-	var buf []byte
-	conn := &MockConn{}
-	conn.On("Write", buf).Return(0, nil)
-	conn.On("Close").Return()
+func (d *leaderDialer) Dial(t yamuxer.StreamType, addr string, timeout time.Duration) (net.Conn, error) {
+	n := int(atomic.AddInt32(&d.dials, 1)) - 1
+	client, server := net.Pipe()
+	go func() {
+		defer server.Close()
+		tuple, err := namedtuple.NewDecoder(namedtuple.DefaultRegistry, server).Decode()
+		if err != nil {
+			return
+		}
+		msg, err := decodeForward(tuple)
+		if err != nil {
+			return
+		}
+		ack, err := encodeForwardAck(msg.id.client, d.acks[n])
+		if err != nil {
+			return
+		}
+		server.Write(ack)
+	}()
+	return client, nil
+}
 
-	dialer := &MockDialer{err: nil, conn: conn}
-	dialer.On("Dial", connForward, "leader", 3*time.Second).Return(conn, nil)
+func (d *leaderDialer) Shutdown() error {
+	return nil
+}
 
-	fwdr := NewForwarder(applier, dialer, &log.NullLogger{})
-	err := fwdr.Forward(buf)
+func TestForward_Write(t *testing.T) {
+	applier := &MockRaftApplier{leader: "leader"}
+	applier.On("Leader").Return("leader")
 
-	applier.AssertCalled(t, "Leader")
-	dialer.AssertCalled(t, "Dial", connForward, "leader", 3*time.Second)
-	conn.AssertCalled(t, "Write", buf)
-	assert.Equal(t, nil, err, "Forward should return nil")
+	tuple, err := newKVSet("key", []byte("value"))
+	assert.Nil(t, err)
+	data, err := encodeTuple(tuple)
+	assert.Nil(t, err)
+	buf, err := encodeForward(data, "", SpanContext{}, requestID{client: "id"})
+	assert.Nil(t, err)
+
+	// Forwards are sent again to the new leader
+	dialer := &leaderDialer{acks: []error{raft.ErrNotLeader, raft.ErrLeadershipLost, nil}}
+	fwdr := NewForwarder(applier, dialer, nil, &log.NullLogger{}, time.Second, time.Millisecond)
+	assert.Nil(t, fwdr.Forward(context.Background(), buf))
+	assert.Equal(t, int32(3), dialer.dials)
+
+	// Errors of the apply are returned
+	dialer = &leaderDialer{acks: []error{ErrPermissionDenied}}
+	fwdr = NewForwarder(applier, dialer, nil, &log.NullLogger{}, time.Second, time.Millisecond)
+	assert.Equal(t, ErrPermissionDenied, fwdr.Forward(context.Background(), buf))
+	assert.Equal(t, int32(1), dialer.dials)
 }
 
 type MockForwarder struct {
@@ -97,7 +156,7 @@ type MockForwarder struct {
 	err error
 }
 
-func (m *MockForwarder) Forward(buf []byte) error {
+func (m *MockForwarder) Forward(ctx context.Context, buf []byte) error {
 	m.Called(buf)
 	return m.err
 }
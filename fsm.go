@@ -1,9 +1,13 @@
 package cerebrum
 
 import (
+	"bufio"
 	"bytes"
-	"errors"
+	"encoding/json"
 	"io"
+	"io/ioutil"
+	"strconv"
+	"sync/atomic"
 	"time"
 
 	"github.com/blacklabeldata/namedtuple"
@@ -12,44 +16,291 @@ import (
 )
 
 type fsm struct {
+	// term is the term of the last applied log. It is first in the struct
+	// for the alignment of atomic operations.
+	term uint64
+
 	logOutput io.Writer
 	logger    log.Logger
 	path      string
+	state     *stateStore
 	userFSM   raft.FSM
+
+	// tracer continues the traces of the applied tuples
+	tracer    *Tracer
+	telemetry *Telemetry
+}
+
+// appliedTerm returns the term of the last applied log. Unlike the stats of
+// Raft it can be read while Raft runs.
+func (c *fsm) appliedTerm() uint64 {
+	return atomic.LoadUint64(&c.term)
 }
 
 // NewFSM is used to construct a new FSM with a blank state
 func NewFSM(path string, userFSM raft.FSM, logOutput io.Writer) (raft.FSM, error) {
-	fsm := &fsm{
+	return newFSM(path, userFSM, logOutput), nil
+}
+
+func newFSM(path string, userFSM raft.FSM, logOutput io.Writer) *fsm {
+	return &fsm{
 		logOutput: logOutput,
-		logger:    log.NewLogger(logOutput, ""),
+		logger:    log.NewLogger(logOutput, "fsm"),
 		path:      path,
+		state:     newStateStore(),
 		userFSM:   userFSM,
 	}
-	return fsm, nil
 }
 
 func (c *fsm) Apply(log *raft.Log) interface{} {
-	buf := log.Data
-
-	reader := bytes.NewReader(buf)
-	dec := namedtuple.NewDecoder(namedtuple.DefaultRegistry, reader)
-	tup, err := dec.Decode()
+	atomic.StoreUint64(&c.term, log.Term)
+	tup, err := decodeTuple(log.Data)
 	if err != nil {
-		return c.userFSM.Apply(log)
+		defer c.telemetry.MeasureSince([]string{"fsm", "apply", "user"}, time.Now())
+		return c.applyUser(log)
 	}
+	if tup.Is(tracedReq) {
+		return c.applyTraced(log, tup)
+	}
+	if tup.Is(onceReq) {
+		return c.applyOnce(log, tup)
+	}
+	defer c.telemetry.MeasureSince([]string{"fsm", "apply", tup.Header.Type.Name}, time.Now())
 
 	switch {
 	case tup.Is(nodeStatus):
-		return c.applyNodeStatus(tup)
+		return c.applyNodeStatus(log.Index, tup)
+	case tup.Is(kvSet):
+		return c.applyKVSet(log.Index, tup)
+	case tup.Is(kvDelete):
+		return c.applyKVDelete(log.Index, tup)
+	case tup.Is(stateRestore):
+		return c.applyRestore(log.Index, tup)
+	case tup.Is(aclSet):
+		return c.applyACLSet(log.Index, tup)
+	case tup.Is(aclDelete):
+		return c.applyACLDelete(log.Index, tup)
+	case tup.Is(auditEvent):
+		return c.applyAuditEvent(log.Index, tup)
 	default:
-		return c.userFSM.Apply(log)
+		return c.applyUser(log)
+	}
+}
+
+// applyTraced applies the tuple wrapped by the leader within its trace.
+func (c *fsm) applyTraced(log *raft.Log, t namedtuple.Tuple) interface{} {
+	data, sc, err := decodeTraced(t)
+	if err != nil {
+		return err
 	}
+	span := c.tracer.continueSpan(sc, "fsm.apply")
+	span.SetAttribute("index", strconv.FormatUint(log.Index, 10))
+
+	inner := *log
+	inner.Data = data
+	resp := c.Apply(&inner)
+	err, _ = resp.(error)
+	span.Finish(err)
+	return resp
+}
+
+// DuplicateResponse is returned by Apply for a retried request whose first
+// apply returned a value other than an error, bytes or a string, which the FSM
+// cannot keep.
+type DuplicateResponse struct {
+	Client string
+	Seq    uint64
 }
 
-func (f *fsm) applyNodeStatus(t namedtuple.Tuple) error {
-	// TODO: Store node status in persistent storage
-	f.logger.Info("applyNodeStatus")
+// applyOnce applies the tuple of a request unless the client's request was
+// already applied, in which case the response of the first apply is returned.
+func (c *fsm) applyOnce(log *raft.Log, t namedtuple.Tuple) interface{} {
+	id, at, data, err := decodeOnce(t)
+	if err != nil {
+		return err
+	}
+	if last := c.state.clientRequest(id.client, at); last != nil && id.seq <= last.Seq {
+		c.telemetry.IncrCounter([]string{"fsm", "apply", "duplicates"}, 1)
+		if id.seq < last.Seq {
+			return ErrStaleSequence
+		}
+		return last.response()
+	}
+
+	inner := *log
+	inner.Data = data
+	resp := c.Apply(&inner)
+	entry := &clientEntry{Client: id.client, Seq: id.seq, Time: at}
+	if id.seq > 0 {
+		entry.setResponse(resp)
+	} else if err, ok := resp.(error); ok {
+		// Forwards without a client ID are only retried by the forwarding
+		// node, which only reads the error, so only the error is kept
+		entry.Error = err.Error()
+	}
+	c.state.setClientRequest(entry)
+	return resp
+}
+
+// setResponse keeps the response of the first apply of the request.
+func (e *clientEntry) setResponse(resp interface{}) {
+	switch r := resp.(type) {
+	case nil:
+	case error:
+		e.Error = r.Error()
+	case []byte:
+		e.Response, e.ResponseType = append([]byte{}, r...), responseBytes
+	case string:
+		e.Response, e.ResponseType = []byte(r), responseString
+	default:
+		e.ResponseType = responseOther
+	}
+}
+
+// response returns the response of the first apply of the request.
+func (e *clientEntry) response() interface{} {
+	switch {
+	case e.Error != "":
+		return rpcError(e.Error)
+	case e.ResponseType == responseBytes:
+		return append([]byte{}, e.Response...)
+	case e.ResponseType == responseString:
+		return string(e.Response)
+	case e.ResponseType == responseOther:
+		return DuplicateResponse{Client: e.Client, Seq: e.Seq}
+	}
+	return nil
+}
+
+func (c *fsm) applyUser(log *raft.Log) interface{} {
+	if c.userFSM == nil {
+		return nil
+	}
+	return c.userFSM.Apply(log)
+}
+
+func (f *fsm) applyNodeStatus(index uint64, t namedtuple.Tuple) error {
+	var node NodeEntry
+	var status uint8
+	var port int32
+	var err error
+	if node.ID, err = tupleString(t, "ID"); err != nil {
+		return err
+	}
+	if node.Name, err = tupleString(t, "Name"); err != nil {
+		return err
+	}
+	if node.DataCenter, err = tupleString(t, "DataCenter"); err != nil {
+		return err
+	}
+	if status, err = tupleUint8(t, "Status"); err != nil {
+		return err
+	}
+	if node.Addr, err = tupleString(t, "Addr"); err != nil {
+		return err
+	}
+	if port, err = tupleInt32(t, "Port"); err != nil {
+		return err
+	}
+	node.Status = NodeStatus(status)
+	node.Port = int(port)
+
+	f.state.setNode(index, &node)
+	return nil
+}
+
+func (f *fsm) applyKVSet(index uint64, t namedtuple.Tuple) error {
+	key, err := tupleString(t, "Key")
+	if err != nil {
+		return err
+	}
+	value, err := tupleBytes(t, "Value")
+	if err != nil {
+		return err
+	}
+	f.state.kvSet(index, key, value)
+	return nil
+}
+
+func (f *fsm) applyKVDelete(index uint64, t namedtuple.Tuple) error {
+	key, err := tupleString(t, "Key")
+	if err != nil {
+		return err
+	}
+	f.state.kvDelete(index, key)
+	return nil
+}
+
+func (f *fsm) applyACLSet(index uint64, t namedtuple.Tuple) error {
+	var acl ACLToken
+	var management uint8
+	var err error
+	if acl.ID, err = tupleString(t, "ID"); err != nil {
+		return err
+	}
+	if acl.Name, err = tupleString(t, "Name"); err != nil {
+		return err
+	}
+	if management, err = tupleUint8(t, "Management"); err != nil {
+		return err
+	}
+	policy, err := tupleBytes(t, "Policy")
+	if err != nil {
+		return err
+	}
+	if err = json.Unmarshal(policy, &acl.Policy); err != nil {
+		return err
+	}
+	acl.Management = management != 0
+
+	f.state.aclSet(index, &acl)
+	return nil
+}
+
+func (f *fsm) applyACLDelete(index uint64, t namedtuple.Tuple) error {
+	id, err := tupleString(t, "ID")
+	if err != nil {
+		return err
+	}
+	f.state.aclDelete(index, id)
+	return nil
+}
+
+func (f *fsm) applyAuditEvent(index uint64, t namedtuple.Tuple) error {
+	e, err := decodeAuditEvent(t)
+	if err != nil {
+		return err
+	}
+	f.state.auditAppend(index, e)
+	return nil
+}
+
+// applyRestore replaces the state with a snapshot taken by SnapshotSave. A
+// chunked restore is collected until its last chunk; older nodes replicate the
+// whole snapshot in one tuple without an ID.
+func (f *fsm) applyRestore(index uint64, t namedtuple.Tuple) error {
+	data, err := tupleBytes(t, "Data")
+	if err != nil {
+		return err
+	}
+	if id, err := tupleString(t, "ID"); err == nil {
+		offset, err := tupleUint64(t, "Offset")
+		if err != nil {
+			return err
+		}
+		last, err := tupleUint8(t, "Last")
+		if err != nil {
+			return err
+		}
+		if data, err = f.state.restoreChunk(id, offset, data, last != 0); err != nil || data == nil {
+			return err
+		}
+	}
+	if err = f.Restore(ioutil.NopCloser(bytes.NewReader(data))); err != nil {
+		f.logger.Warn("failed to restore snapshot", "err", err)
+		return err
+	}
+	f.state.setIndex(index)
 	return nil
 }
 
@@ -58,23 +309,72 @@ func (c *fsm) Snapshot() (raft.FSMSnapshot, error) {
 		c.logger.Info("snapshot created", "elapsed", time.Now().Sub(start))
 	}(time.Now())
 
-	// TODO: Create snapshot struct.
-
-	return nil, errors.New("Not implemented")
-	// // Create a new snapshot
-	// snap, err := c.state.Snapshot()
-	// if err != nil {
-	// 	return nil, err
-	// }
-	// return &consulSnapshot{snap}, nil
+	snap := &fsmSnapshot{state: c.state.snapshot()}
+	if c.userFSM != nil {
+		user, err := c.userFSM.Snapshot()
+		if err != nil {
+			return nil, err
+		}
+		snap.user = user
+	}
+	return snap, nil
 }
 
+// Restore reads the cerebrum state followed by the user FSM state.
 func (c *fsm) Restore(old io.ReadCloser) error {
 	defer old.Close()
 
-	// TODO: Create file.
-	// TODO: Pipe restore into new file.
-	// TODO: Switch node storage.
+	dec := json.NewDecoder(old)
+	var snap stateSnapshot
+	if err := dec.Decode(&snap); err != nil {
+		return err
+	}
+	c.state.restore(&snap)
+
+	if c.userFSM == nil {
+		return nil
+	}
+
+	// Skip the newline written after the cerebrum state
+	rest := bufio.NewReader(io.MultiReader(dec.Buffered(), old))
+	if b, err := rest.Peek(1); err == nil && b[0] == '\n' {
+		rest.ReadByte()
+	}
+	return c.userFSM.Restore(ioutil.NopCloser(rest))
+}
 
-	return errors.New("Not implemented")
+// fsmSnapshot writes the cerebrum state and then the user FSM state to the
+// same sink.
+type fsmSnapshot struct {
+	state *stateSnapshot
+	user  raft.FSMSnapshot
+}
+
+func (s *fsmSnapshot) Persist(sink raft.SnapshotSink) error {
+	if err := s.state.writeTo(sink); err != nil {
+		sink.Cancel()
+		return err
+	}
+	if s.user != nil {
+		if err := s.user.Persist(&userSink{sink}); err != nil {
+			sink.Cancel()
+			return err
+		}
+	}
+	return sink.Close()
+}
+
+func (s *fsmSnapshot) Release() {
+	if s.user != nil {
+		s.user.Release()
+	}
+}
+
+// userSink keeps the user FSM from closing the shared sink.
+type userSink struct {
+	raft.SnapshotSink
+}
+
+func (u *userSink) Close() error {
+	return nil
 }
@@ -0,0 +1,345 @@
+package cerebrum
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/blacklabeldata/namedtuple"
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/assert"
+)
+
+func kvSetLog(t *testing.T, index uint64, key string, value []byte) *raft.Log {
+	builder := namedtuple.NewBuilder(kvSet, make([]byte, 512))
+	builder.PutString("Key", key)
+	builder.PutUint8Array("Value", value)
+	tuple, err := builder.Build()
+	assert.Nil(t, err)
+
+	data, err := encodeTuple(tuple)
+	assert.Nil(t, err)
+	return &raft.Log{Index: index, Type: raft.LogCommand, Data: data}
+}
+
+func TestFSM_KVSet(t *testing.T) {
+	f := newFSM("", nil, ioutil.Discard)
+
+	assert.Nil(t, f.Apply(kvSetLog(t, 1, "foo", []byte("bar"))))
+	assert.Nil(t, f.Apply(kvSetLog(t, 2, "foo", []byte("baz"))))
+
+	entry := f.state.KVGet("foo")
+	assert.NotNil(t, entry)
+	assert.Equal(t, []byte("baz"), entry.Value)
+	assert.Equal(t, uint64(1), entry.CreateIndex)
+	assert.Equal(t, uint64(2), entry.ModifyIndex)
+	assert.Equal(t, uint64(2), f.state.Index())
+}
+
+func TestFSM_ClientSeq(t *testing.T) {
+	f := newFSM("", nil, ioutil.Discard)
+	onceLog := func(index uint64, id requestID, at time.Time, data []byte) *raft.Log {
+		data, err := encodeOnce(data, id, at)
+		assert.Nil(t, err)
+		return &raft.Log{Index: index, Type: raft.LogCommand, Data: data}
+	}
+	kv := func(value string) []byte {
+		return kvSetLog(t, 0, "foo", []byte(value)).Data
+	}
+
+	// Retries of a request are applied once
+	now := time.Now()
+	assert.Nil(t, f.Apply(onceLog(1, requestID{"a", 1}, now, kv("bar"))))
+	assert.Nil(t, f.Apply(onceLog(2, requestID{"a", 1}, now, kv("baz"))))
+	assert.Equal(t, []byte("bar"), f.state.KVGet("foo").Value)
+	assert.Nil(t, f.Apply(onceLog(3, requestID{"a", 2}, now, kv("baz"))))
+	assert.Equal(t, []byte("baz"), f.state.KVGet("foo").Value)
+	assert.Equal(t, ErrStaleSequence, f.Apply(onceLog(4, requestID{"a", 1}, now, kv("qux"))))
+
+	// Retries return the error of the first apply
+	builder := namedtuple.NewBuilder(aclSet, make([]byte, 128))
+	builder.PutString("ID", "id")
+	builder.PutString("Name", "")
+	builder.PutUint8("Management", 0)
+	builder.PutUint8Array("Policy", []byte("{"))
+	tuple, err := builder.Build()
+	assert.Nil(t, err)
+	invalid, err := encodeTuple(tuple)
+	assert.Nil(t, err)
+	first, ok := f.Apply(onceLog(5, requestID{"b", 1}, now, invalid)).(error)
+	if assert.True(t, ok) {
+		assert.Equal(t, first.Error(), f.Apply(onceLog(6, requestID{"b", 1}, now, kv("qux"))).(error).Error())
+	}
+	assert.Equal(t, []byte("baz"), f.state.KVGet("foo").Value)
+
+	// Requests expire by the times in the log
+	later := now.Add(DedupWindow)
+	assert.Nil(t, f.Apply(onceLog(7, requestID{"a", 1}, later, kv("qux"))))
+	assert.Equal(t, []byte("qux"), f.state.KVGet("foo").Value)
+	assert.Len(t, f.state.snapshot().Clients, 1)
+}
+
+func TestFSM_ClientSeqResponse(t *testing.T) {
+	user := &MockFSM{}
+	f := newFSM("", user, ioutil.Discard)
+	now := time.Now()
+	onceLog := func(index uint64, id requestID) *raft.Log {
+		data, err := encodeOnce([]byte("user command"), id, now)
+		assert.Nil(t, err)
+		return &raft.Log{Index: index, Type: raft.LogCommand, Data: data}
+	}
+
+	// Retries return the response of the user FSM to the first apply
+	assert.Equal(t, "user", f.Apply(onceLog(1, requestID{"a", 1})))
+	assert.Equal(t, "user", f.Apply(onceLog(2, requestID{"a", 1})))
+	assert.Len(t, user.logs, 1)
+
+	// Responses are kept across snapshots
+	snap, err := f.Snapshot()
+	assert.Nil(t, err)
+	var buf bytes.Buffer
+	assert.Nil(t, snap.Persist(&writerSink{&buf}))
+	restored := newFSM("", &MockFSM{}, ioutil.Discard)
+	assert.Nil(t, restored.Restore(ioutil.NopCloser(&buf)))
+	assert.Equal(t, "user", restored.Apply(onceLog(3, requestID{"a", 1})))
+
+	// Responses which cannot be kept are replaced by a marker
+	entry := &clientEntry{Client: "b", Seq: 1}
+	entry.setResponse(struct{}{})
+	assert.Equal(t, DuplicateResponse{Client: "b", Seq: 1}, entry.response())
+	entry = &clientEntry{Client: "b", Seq: 2}
+	entry.setResponse([]byte("bytes"))
+	assert.Equal(t, []byte("bytes"), entry.response())
+
+	// Forwards without a client ID only keep the status of the first apply
+	assert.Equal(t, "user", f.Apply(onceLog(4, requestID{"c", 0})))
+	assert.Nil(t, f.Apply(onceLog(5, requestID{"c", 0})))
+	if last := f.state.clientRequest("c", now.UnixNano()); assert.NotNil(t, last) {
+		assert.Nil(t, last.Response)
+		assert.Equal(t, "", last.ResponseType)
+	}
+	assert.Len(t, user.logs, 2)
+}
+
+func TestFSM_ACL(t *testing.T) {
+	f := newFSM("", nil, ioutil.Discard)
+	policy := ACLPolicy{KV: []ACLRule{{Prefix: "app/", Access: AccessWrite}}}
+
+	tuple, err := newACLSet(&ACLToken{ID: "id", Policy: policy})
+	assert.Nil(t, err)
+	data, err := encodeTuple(tuple)
+	assert.Nil(t, err)
+	assert.Nil(t, f.Apply(&raft.Log{Index: 1, Type: raft.LogCommand, Data: data}))
+
+	acl := f.state.ACLGet("id")
+	if assert.NotNil(t, acl) {
+		assert.Equal(t, "", acl.Name)
+		assert.Equal(t, policy, acl.Policy)
+		assert.Equal(t, uint64(1), acl.CreateIndex)
+	}
+
+	tuple, err = newACLDelete("id")
+	assert.Nil(t, err)
+	data, err = encodeTuple(tuple)
+	assert.Nil(t, err)
+	assert.Nil(t, f.Apply(&raft.Log{Index: 2, Type: raft.LogCommand, Data: data}))
+	assert.Nil(t, f.state.ACLGet("id"))
+}
+
+func TestFSM_AuditEvent(t *testing.T) {
+	f := newFSM("", nil, ioutil.Discard)
+	now := time.Unix(1500000000, 42).UTC()
+
+	for i := uint64(1); i <= AuditLogSize+2; i++ {
+		tuple, err := newAuditEvent(&AuditEvent{Time: now, Kind: AuditMemberFailed, Node: "n1", Subject: "n2", Message: "status changed to failed"})
+		assert.Nil(t, err)
+		data, err := encodeTuple(tuple)
+		assert.Nil(t, err)
+		assert.Nil(t, f.Apply(&raft.Log{Index: i, Type: raft.LogCommand, Data: data}))
+	}
+
+	// The oldest events are dropped
+	events := f.state.AuditEvents(0)
+	assert.Len(t, events, AuditLogSize)
+	assert.Equal(t, uint64(3), events[0].Index)
+	assert.Equal(t, &AuditEvent{
+		Index:   AuditLogSize + 2,
+		Time:    now,
+		Kind:    AuditMemberFailed,
+		Node:    "n1",
+		Subject: "n2",
+		Message: "status changed to failed",
+	}, events[len(events)-1])
+	assert.Len(t, f.state.AuditEvents(AuditLogSize+1), 1)
+
+	// Snapshots retain the audit log
+	snap := f.state.snapshot()
+	restored := newStateStore()
+	restored.restore(snap)
+	assert.Equal(t, events, restored.AuditEvents(0))
+}
+
+func TestFSM_UserApply(t *testing.T) {
+	user := &MockFSM{}
+	f := newFSM("", user, ioutil.Discard)
+
+	log := &raft.Log{Index: 1, Type: raft.LogCommand, Data: []byte("user command")}
+	assert.Equal(t, "user", f.Apply(log))
+	assert.Equal(t, []*raft.Log{log}, user.logs)
+}
+
+func TestFSM_SnapshotRestore(t *testing.T) {
+	f := newFSM("", &MockFSM{state: []byte("user state")}, ioutil.Discard)
+	f.Apply(kvSetLog(t, 1, "foo", []byte("bar")))
+	f.state.setClientRequest(&clientEntry{Client: "a", Seq: 3, Time: 1})
+
+	snap, err := f.Snapshot()
+	assert.Nil(t, err)
+
+	var buf bytes.Buffer
+	err = snap.Persist(&writerSink{&buf})
+	assert.Nil(t, err)
+	snap.Release()
+
+	user := &MockFSM{}
+	restored := newFSM("", user, ioutil.Discard)
+	err = restored.Restore(ioutil.NopCloser(&buf))
+	assert.Nil(t, err)
+
+	entry := restored.state.KVGet("foo")
+	assert.NotNil(t, entry)
+	assert.Equal(t, []byte("bar"), entry.Value)
+	assert.Equal(t, uint64(1), restored.state.Index())
+	assert.Equal(t, []byte("user state"), user.state)
+
+	// Requests of clients are applied once across snapshots
+	if last := restored.state.clientRequest("a", 2); assert.NotNil(t, last) {
+		assert.Equal(t, uint64(3), last.Seq)
+	}
+}
+
+func TestFSM_RestoreChunks(t *testing.T) {
+	large := bytes.Repeat([]byte("user state "), 300000)
+	f := newFSM("", &MockFSM{state: large}, ioutil.Discard)
+	f.Apply(kvSetLog(t, 1, "foo", []byte("bar")))
+
+	snap, err := f.Snapshot()
+	assert.Nil(t, err)
+	var buf bytes.Buffer
+	assert.Nil(t, snap.Persist(&writerSink{&buf}))
+	snap.Release()
+
+	// Snapshots larger than a forwarded frame are replicated in chunks which
+	// fit in one
+	user := &MockFSM{}
+	restored := newFSM("", user, ioutil.Discard)
+	var index uint64
+	err = replicateRestore(&buf, func(tuple namedtuple.Tuple) error {
+		data, err := encodeTuple(tuple)
+		assert.Nil(t, err)
+		frame, err := encodeForward(data, strings.Repeat("t", 64), SpanContext{}, requestID{client: randomID(16), seq: 1})
+		assert.Nil(t, err)
+		assert.True(t, len(frame) <= maxForwardSize)
+
+		index++
+		resp := restored.Apply(&raft.Log{Index: index, Type: raft.LogCommand, Data: data})
+		if resp != nil {
+			return resp.(error)
+		}
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.True(t, index > 3)
+	assert.Equal(t, large, user.state)
+	if entry := restored.state.KVGet("foo"); assert.NotNil(t, entry) {
+		assert.Equal(t, []byte("bar"), entry.Value)
+	}
+	assert.Equal(t, index, restored.state.Index())
+
+	// Invalid snapshots are not replicated
+	err = replicateRestore(strings.NewReader("not a snapshot"), func(namedtuple.Tuple) error {
+		t.Fatal("invalid snapshot replicated")
+		return nil
+	})
+	assert.NotNil(t, err)
+}
+
+func TestFSM_RestoreInterrupted(t *testing.T) {
+	f := newFSM("", nil, ioutil.Discard)
+	chunk := func(index uint64, id string, offset uint64, data string, last bool) interface{} {
+		tuple, err := newRestoreChunk(id, offset, []byte(data), last)
+		assert.Nil(t, err)
+		buf, err := encodeTuple(tuple)
+		assert.Nil(t, err)
+		return f.Apply(&raft.Log{Index: index, Type: raft.LogCommand, Data: buf})
+	}
+	assert.Nil(t, chunk(1, "a", 0, `{"KVs":[{"Key":"a"}]}`, false))
+
+	// Chunks of a pending restore are kept in snapshots
+	restored := newStateStore()
+	restored.restore(f.state.snapshot())
+	assert.Equal(t, &pendingRestore{ID: "a", Data: []byte(`{"KVs":[{"Key":"a"}]}`)}, restored.pending)
+
+	// A second restore replaces the first
+	assert.Nil(t, chunk(2, "b", 0, `{"KVs":[{"Key":"b"}]}`, false))
+	assert.Equal(t, ErrRestoreInterrupted, chunk(3, "a", 21, "\n", true))
+	assert.Nil(t, chunk(4, "b", 21, "\n", true))
+	assert.NotNil(t, f.state.KVGet("b"))
+	assert.Nil(t, f.state.KVGet("a"))
+	assert.Nil(t, f.state.pending)
+}
+
+type MockFSM struct {
+	logs  []*raft.Log
+	state []byte
+}
+
+func (m *MockFSM) Apply(log *raft.Log) interface{} {
+	m.logs = append(m.logs, log)
+	return "user"
+}
+
+func (m *MockFSM) Snapshot() (raft.FSMSnapshot, error) {
+	return &MockFSMSnapshot{m.state}, nil
+}
+
+func (m *MockFSM) Restore(r io.ReadCloser) error {
+	defer r.Close()
+	state, err := ioutil.ReadAll(r)
+	m.state = state
+	return err
+}
+
+type MockFSMSnapshot struct {
+	state []byte
+}
+
+func (m *MockFSMSnapshot) Persist(sink raft.SnapshotSink) error {
+	if _, err := sink.Write(m.state); err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (m *MockFSMSnapshot) Release() {}
+
+// writerSink is a raft.SnapshotSink which writes to an io.Writer.
+type writerSink struct {
+	io.Writer
+}
+
+func (w *writerSink) ID() string {
+	return "test"
+}
+
+func (w *writerSink) Cancel() error {
+	return nil
+}
+
+func (w *writerSink) Close() error {
+	return nil
+}
@@ -0,0 +1,179 @@
+package cerebrum
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/hashicorp/serf/serf"
+	log "github.com/mgutz/logxi/v1"
+	"golang.org/x/net/context"
+)
+
+// DefaultHealthMaxIndexLag is the number of committed entries the FSM may
+// lag behind before the node is not ready.
+const DefaultHealthMaxIndexLag = 64
+
+// DefaultHealthMaxLastContact is how long a follower may go without contact
+// from the leader before it is not ready.
+const DefaultHealthMaxLastContact = 5 * time.Second
+
+// HealthChecker may be implemented by a Service to report failures after it
+// has started.
+type HealthChecker interface {
+	CheckHealth() error
+}
+
+// HealthCheck is the result of a single readiness check. Reason explains why
+// the check is failing.
+type HealthCheck struct {
+	Name    string
+	Healthy bool
+	Reason  string `json:",omitempty"`
+}
+
+// HealthStatus reports whether the node is live and whether it is ready to
+// serve requests.
+type HealthStatus struct {
+	Live   bool
+	Ready  bool
+	Checks []HealthCheck
+}
+
+// Health runs the readiness checks: Serf has joined the cluster, Raft has a
+// known leader which a follower has heard from recently, the FSM is caught up
+// with the last log index and every service has started and is healthy. A
+// follower's last log index may lag the leader's, so it is only ready while
+// the leader keeps replicating to it.
+func (c *cerebrum) Health() *HealthStatus {
+	c.stopLock.Lock()
+	live, joined, started := !c.stopped, c.joined, c.servicesStarted
+	c.stopLock.Unlock()
+
+	return newHealthStatus(live,
+		checkSerf(c.serf.State(), joined),
+		checkLeader(c.raft.Leader(), c.raft.State() == raft.Leader, c.raft.LastContact(), c.healthMaxLastContact()),
+		checkFSM(c.raft.LastIndex(), c.raft.AppliedIndex(), c.config.HealthMaxIndexLag),
+		checkServices(c.services, started))
+}
+
+func newHealthStatus(live bool, checks ...HealthCheck) *HealthStatus {
+	status := &HealthStatus{Live: live, Ready: live, Checks: checks}
+	for _, check := range checks {
+		if !check.Healthy {
+			status.Ready = false
+		}
+	}
+	return status
+}
+
+func healthy(name string) HealthCheck {
+	return HealthCheck{Name: name, Healthy: true}
+}
+
+func unhealthy(name, format string, args ...interface{}) HealthCheck {
+	return HealthCheck{Name: name, Reason: fmt.Sprintf(format, args...)}
+}
+
+func checkSerf(state serf.SerfState, joined bool) HealthCheck {
+	switch {
+	case state != serf.SerfAlive:
+		return unhealthy("serf", "Serf is %s", state)
+	case !joined:
+		return unhealthy("serf", "not joined to the cluster")
+	}
+	return healthy("serf")
+}
+
+// healthMaxLastContact returns HealthMaxLastContact or its default if unset.
+func (c *cerebrum) healthMaxLastContact() time.Duration {
+	if c.config.HealthMaxLastContact > 0 {
+		return c.config.HealthMaxLastContact
+	}
+	return DefaultHealthMaxLastContact
+}
+
+func checkLeader(leader string, isLeader bool, lastContact time.Time, maxAge time.Duration) HealthCheck {
+	switch {
+	case leader == "":
+		return unhealthy("leader", "%v", ErrNoLeader)
+	case isLeader:
+	case lastContact.IsZero():
+		return unhealthy("leader", "no contact with the leader")
+	case time.Since(lastContact) > maxAge:
+		return unhealthy("leader", "no contact with the leader for %v", time.Since(lastContact))
+	}
+	return healthy("leader")
+}
+
+func checkFSM(last, applied, maxLag uint64) HealthCheck {
+	if applied < last && last-applied > maxLag {
+		return unhealthy("fsm", "applied index %d is %d behind the last log index %d",
+			applied, last-applied, last)
+	}
+	return healthy("fsm")
+}
+
+// checkServices checks that the first started services have started and
+// are healthy.
+func checkServices(services []Service, started int) HealthCheck {
+	for i, svc := range services {
+		if i >= started {
+			return unhealthy("services", "service %s is not running", svc.Name())
+		}
+		if hc, ok := svc.(HealthChecker); ok {
+			if err := hc.CheckHealth(); err != nil {
+				return unhealthy("services", "service %s is unhealthy: %v", svc.Name(), err)
+			}
+		}
+	}
+	return healthy("services")
+}
+
+// healthHandler serves /live, which succeeds while the process is up, and
+// /ready, which fails with the failing checks until the node is ready.
+type healthHandler struct {
+	health func() *HealthStatus
+	logger log.Logger
+}
+
+func (h *healthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var ok bool
+	status := h.health()
+	switch r.URL.Path {
+	case "/live":
+		ok = status.Live
+	case "/ready":
+		ok = status.Ready
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		h.logger.Warn("Failed to encode health status", "err", err)
+	}
+}
+
+// serveHealth serves the health endpoints until the context is done.
+func serveHealth(ctx context.Context, l net.Listener, h http.Handler, logger log.Logger) {
+	if err := http.Serve(l, h); err != nil {
+		select {
+		case <-ctx.Done():
+		default:
+			logger.Warn("Health listener closed", "err", err)
+		}
+	}
+}
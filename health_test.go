@@ -0,0 +1,77 @@
+package cerebrum
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/serf/serf"
+	log "github.com/mgutz/logxi/v1"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealth_Checks(t *testing.T) {
+	assert.True(t, checkSerf(serf.SerfAlive, true).Healthy)
+	assert.Equal(t, "not joined to the cluster", checkSerf(serf.SerfAlive, false).Reason)
+	assert.Equal(t, "Serf is left", checkSerf(serf.SerfLeft, true).Reason)
+
+	now := time.Now()
+	assert.True(t, checkLeader("127.0.0.1:8300", false, now, time.Second).Healthy)
+	assert.True(t, checkLeader("127.0.0.1:8300", true, time.Time{}, time.Second).Healthy)
+	assert.Equal(t, ErrNoLeader.Error(), checkLeader("", false, now, time.Second).Reason)
+
+	// A partitioned follower still knows the last leader but has not heard
+	// from it
+	assert.Equal(t, "no contact with the leader", checkLeader("127.0.0.1:8300", false, time.Time{}, time.Second).Reason)
+	assert.False(t, checkLeader("127.0.0.1:8300", false, now.Add(-2*time.Second), time.Second).Healthy)
+
+	assert.True(t, checkFSM(100, 90, 10).Healthy)
+	assert.True(t, checkFSM(100, 100, 0).Healthy)
+	assert.Equal(t, "applied index 89 is 11 behind the last log index 100", checkFSM(100, 89, 10).Reason)
+}
+
+func TestHealth_Services(t *testing.T) {
+	a := &healthService{name: "a"}
+	b := &healthService{name: "b"}
+	services := []Service{a, b}
+
+	assert.True(t, checkServices(nil, 0).Healthy)
+	assert.Equal(t, "service b is not running", checkServices(services, 1).Reason)
+	assert.True(t, checkServices(services, 2).Healthy)
+
+	a.err = errors.New("stalled")
+	assert.Equal(t, "service a is unhealthy: stalled", checkServices(services, 2).Reason)
+}
+
+func TestHealth_Handler(t *testing.T) {
+	status := newHealthStatus(true, healthy("serf"), unhealthy("leader", "%v", ErrNoLeader))
+	assert.False(t, status.Ready)
+	handler := &healthHandler{func() *HealthStatus { return status }, &log.NullLogger{}}
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/live", nil)
+	handler.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("GET", "/ready", nil)
+	handler.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+
+	var body HealthStatus
+	assert.Nil(t, json.NewDecoder(w.Body).Decode(&body))
+	assert.Equal(t, *status, body)
+}
+
+type healthService struct {
+	name string
+	err  error
+}
+
+func (s *healthService) Name() string         { return s.name }
+func (s *healthService) Start(*Context) error { return nil }
+func (s *healthService) Stop()                {}
+func (s *healthService) CheckHealth() error   { return s.err }
@@ -0,0 +1,446 @@
+package cerebrum
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/mgutz/logxi/v1"
+	"golang.org/x/net/context"
+)
+
+// Response headers describing the state a read was served from.
+const (
+	HeaderIndex       = "X-Cerebrum-Index"
+	HeaderKnownLeader = "X-Cerebrum-KnownLeader"
+	HeaderLastContact = "X-Cerebrum-LastContact"
+)
+
+// HeaderToken carries the ACL token of a request. The ?token parameter may be
+// used instead.
+const HeaderToken = "X-Cerebrum-Token"
+
+// HeaderTraceparent carries the W3C trace context of a request. Writes
+// continue the trace.
+const HeaderTraceparent = "Traceparent"
+
+// The HTTP server bounds the time to read a request and to stay idle. Blocking
+// reads hold the response for up to maxQueryWait, so writes get longer.
+const (
+	httpReadTimeout  = 30 * time.Second
+	httpWriteTimeout = maxQueryWait + time.Minute
+	httpIdleTimeout  = 2 * time.Minute
+)
+
+// ErrConflictingReadModes is returned if both stale and consistent reads are
+// requested.
+var ErrConflictingReadModes = errors.New("stale and consistent reads are mutually exclusive")
+
+// HTTPService is a Service exposing the cluster state as a JSON API.
+type HTTPService struct {
+	addr   string
+	logger log.Logger
+	server *http.Server
+}
+
+// NewHTTPService creates an HTTPService listening on addr.
+func NewHTTPService(addr string) *HTTPService {
+	return &HTTPService{addr: addr}
+}
+
+func (s *HTTPService) Name() string {
+	return "http"
+}
+
+func (s *HTTPService) Start(ctx *Context) error {
+	s.logger = ctx.Logger(s.Name())
+	l, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+
+	handler := NewHTTPHandler(ctx.Agent, ctx.Operator, ctx.Reader, s.logger)
+	handler.telemetry = ctx.Telemetry
+	s.server = &http.Server{
+		Handler:      handler,
+		ReadTimeout:  httpReadTimeout,
+		WriteTimeout: httpWriteTimeout,
+		IdleTimeout:  httpIdleTimeout,
+	}
+	go func() {
+		if err := s.server.Serve(l); err != nil && err != http.ErrServerClosed {
+			select {
+			case <-ctx.Context.Done():
+			default:
+				s.logger.Warn("HTTP listener closed", "err", err)
+			}
+		}
+	}()
+	s.logger.Info("HTTP API started", "addr", l.Addr().String())
+	return nil
+}
+
+func (s *HTTPService) Stop() {
+	if s.server != nil {
+		s.server.Close()
+	}
+}
+
+// HTTPHandler serves the /v1 HTTP API.
+type HTTPHandler struct {
+	agent    Agent
+	operator Operator
+	reader   Reader
+	logger   log.Logger
+	mux      *http.ServeMux
+
+	// telemetry serves /v1/agent/metrics if set
+	telemetry *Telemetry
+}
+
+// NewHTTPHandler creates an HTTPHandler for the given Agent, Operator and
+// Reader.
+func NewHTTPHandler(a Agent, o Operator, r Reader, l log.Logger) *HTTPHandler {
+	h := &HTTPHandler{
+		agent:    a,
+		operator: o,
+		reader:   r,
+		logger:   l,
+		mux:      http.NewServeMux(),
+	}
+	h.handle("/v1/status/leader", "GET", h.statusLeader)
+	h.handle("/v1/status/peers", "GET", h.statusPeers)
+	h.handle("/v1/catalog/nodes", "GET", h.catalogNodes)
+	h.handle("/v1/agent/members", "GET", h.agentMembers)
+	h.handle("/v1/agent/metrics", "GET", h.agentMetrics)
+	h.handle("/v1/kv/", "", h.kv)
+	h.handle("/v1/event/fire/", "PUT", h.eventFire)
+	h.handle("/v1/health", "GET", h.health)
+	h.handle("/v1/audit", "GET", h.audit)
+	h.handle("/v1/acl/tokens", "GET", h.aclList)
+	h.handle("/v1/acl/token", "PUT", h.aclSet)
+	h.handle("/v1/acl/token/", "DELETE", h.aclDelete)
+	return h
+}
+
+func (h *HTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+// handle registers an endpoint. The response is encoded as JSON unless the
+// endpoint writes it directly and returns nil. An empty method accepts all
+// methods. Request bodies are limited to maxForwardSize, the largest tuple a
+// follower forwards.
+func (h *HTTPHandler) handle(pattern, method string, fn func(http.ResponseWriter, *http.Request) (interface{}, error)) {
+	h.mux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+		if method != "" && r.Method != method {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, maxForwardSize)
+
+		obj, err := fn(w, r)
+		if err != nil {
+			code := http.StatusInternalServerError
+			if herr, ok := err.(httpError); ok {
+				code = herr.code
+			} else if err == ErrPermissionDenied || err == ErrACLNotFound {
+				code = http.StatusForbidden
+			}
+			h.logger.Warn("HTTP request failed", "method", r.Method, "path", r.URL.Path, "err", err)
+			http.Error(w, err.Error(), code)
+			return
+		}
+		if obj == nil {
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err = json.NewEncoder(w).Encode(obj); err != nil {
+			h.logger.Warn("failed to encode HTTP response", "path", r.URL.Path, "err", err)
+		}
+	})
+}
+
+// httpError is an error with an HTTP status code.
+type httpError struct {
+	code int
+	msg  string
+}
+
+func (e httpError) Error() string {
+	return e.msg
+}
+
+// readBody reads the request body, which handle limits in size.
+func readBody(r *http.Request) ([]byte, error) {
+	data, err := ioutil.ReadAll(r.Body)
+	return data, bodyError(err)
+}
+
+// bodyError reports a request body over the limit with its status code.
+func bodyError(err error) error {
+	if _, ok := err.(*http.MaxBytesError); ok {
+		return httpError{http.StatusRequestEntityTooLarge, err.Error()}
+	}
+	return err
+}
+
+func (h *HTTPHandler) statusLeader(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	return h.reader.Leader(), nil
+}
+
+func (h *HTTPHandler) statusPeers(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	if err := authorizeRequest(h.agent, r, operatorRead); err != nil {
+		return nil, err
+	}
+	peers, err := h.operator.RaftPeers()
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]string, 0, len(peers))
+	for _, p := range peers {
+		addrs = append(addrs, p.Address)
+	}
+	return addrs, nil
+}
+
+func (h *HTTPHandler) catalogNodes(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	q, err := parseQueryOptions(r)
+	if err != nil {
+		return nil, err
+	}
+	nodes, meta, err := h.reader.CatalogNodes(q)
+	if err != nil {
+		return nil, err
+	}
+	setMeta(w, meta)
+	if nodes == nil {
+		nodes = []*NodeEntry{}
+	}
+	return nodes, nil
+}
+
+func (h *HTTPHandler) agentMembers(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	return requestAgent(h.agent, r).Members(), nil
+}
+
+// agentMetrics returns the last interval of the in-memory sink, or all
+// metrics in the Prometheus text format with ?format=prometheus.
+func (h *HTTPHandler) agentMetrics(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	if err := authorizeRequest(h.agent, r, operatorRead); err != nil {
+		return nil, err
+	}
+	if h.telemetry == nil {
+		return nil, httpError{http.StatusNotFound, "metrics are not available"}
+	}
+
+	if r.URL.Query().Get("format") != "prometheus" {
+		return h.telemetry.Summary(), nil
+	}
+	if h.telemetry.Prometheus == nil {
+		return nil, httpError{http.StatusNotFound, "Prometheus metrics are disabled"}
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	_, err := h.telemetry.Prometheus.WriteTo(w)
+	return nil, err
+}
+
+func (h *HTTPHandler) kv(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	key := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+
+	switch r.Method {
+	case "GET":
+		return h.kvGet(w, r, key)
+	case "PUT":
+		if key == "" {
+			return nil, httpError{http.StatusBadRequest, "missing key"}
+		}
+		value, err := readBody(r)
+		if err != nil {
+			return nil, err
+		}
+		if err = requestAgent(h.agent, r).KVPut(key, value); err != nil {
+			return nil, err
+		}
+		return true, nil
+	case "DELETE":
+		if key == "" {
+			return nil, httpError{http.StatusBadRequest, "missing key"}
+		}
+		if err := requestAgent(h.agent, r).KVDelete(key); err != nil {
+			return nil, err
+		}
+		return true, nil
+	}
+	return nil, httpError{http.StatusMethodNotAllowed, "method not allowed"}
+}
+
+func (h *HTTPHandler) kvGet(w http.ResponseWriter, r *http.Request, key string) (interface{}, error) {
+	q, err := parseQueryOptions(r)
+	if err != nil {
+		return nil, err
+	}
+	params := r.URL.Query()
+	_, recurse := params["recurse"]
+	_, raw := params["raw"]
+
+	entries, meta, err := h.reader.KVRead(key, recurse, q)
+	if err != nil {
+		return nil, err
+	}
+	setMeta(w, meta)
+	if len(entries) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return nil, nil
+	}
+
+	// Write the value of a single key as is
+	if raw && !recurse {
+		w.Write(entries[0].Value)
+		return nil, nil
+	}
+	return entries, nil
+}
+
+func (h *HTTPHandler) eventFire(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	name := strings.TrimPrefix(r.URL.Path, "/v1/event/fire/")
+	if name == "" {
+		return nil, httpError{http.StatusBadRequest, "missing event name"}
+	}
+	payload, err := readBody(r)
+	if err != nil {
+		return nil, err
+	}
+	if err = requestAgent(h.agent, r).UserEvent(name, payload); err != nil {
+		return nil, err
+	}
+	return true, nil
+}
+
+func (h *HTTPHandler) health(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	leader := h.reader.Leader()
+	if leader == "" {
+		return nil, httpError{http.StatusServiceUnavailable, ErrNoLeader.Error()}
+	}
+	return map[string]string{"Leader": leader}, nil
+}
+
+func (h *HTTPHandler) audit(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	q, err := parseQueryOptions(r)
+	if err != nil {
+		return nil, err
+	}
+	events, meta, err := h.reader.AuditLog(q)
+	if err != nil {
+		return nil, err
+	}
+	setMeta(w, meta)
+	return events, nil
+}
+
+func (h *HTTPHandler) aclList(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	return requestAgent(h.agent, r).ACLList()
+}
+
+func (h *HTTPHandler) aclSet(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	var acl ACLToken
+	if err := json.NewDecoder(r.Body).Decode(&acl); err != nil {
+		if _, ok := err.(*http.MaxBytesError); ok {
+			return nil, bodyError(err)
+		}
+		return nil, httpError{http.StatusBadRequest, "invalid ACL: " + err.Error()}
+	}
+	id, err := requestAgent(h.agent, r).ACLSet(&acl)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{"ID": id}, nil
+}
+
+func (h *HTTPHandler) aclDelete(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	id := strings.TrimPrefix(r.URL.Path, "/v1/acl/token/")
+	if id == "" {
+		return nil, httpError{http.StatusBadRequest, "missing ACL ID"}
+	}
+	if err := requestAgent(h.agent, r).ACLDelete(id); err != nil {
+		return nil, err
+	}
+	return true, nil
+}
+
+// requestAgent authorizes the Agent with the token of the request and
+// continues its trace.
+func requestAgent(agent Agent, r *http.Request) Agent {
+	agent = agent.WithToken(requestToken(r))
+	if sc, ok := parseTraceparent(r.Header.Get(HeaderTraceparent)); ok {
+		agent = agent.WithContext(ContextWithSpan(context.Background(), sc))
+	}
+	return agent
+}
+
+// authorizeRequest checks the token of the request with the function.
+func authorizeRequest(agent Agent, r *http.Request, check func(Authorizer) bool) error {
+	authz, err := agent.ResolveToken(requestToken(r))
+	if err != nil {
+		return err
+	}
+	if !check(authz) {
+		return ErrPermissionDenied
+	}
+	return nil
+}
+
+// requestToken returns the ACL token of the request.
+func requestToken(r *http.Request) string {
+	if token := r.Header.Get(HeaderToken); token != "" {
+		return token
+	}
+	return r.URL.Query().Get("token")
+}
+
+// parseQueryOptions reads the ?stale, ?consistent, ?index and ?wait
+// parameters and the ACL token.
+func parseQueryOptions(r *http.Request) (*QueryOptions, error) {
+	params := r.URL.Query()
+	q := &QueryOptions{Token: requestToken(r)}
+
+	_, stale := params["stale"]
+	_, consistent := params["consistent"]
+	switch {
+	case stale && consistent:
+		return nil, httpError{http.StatusBadRequest, ErrConflictingReadModes.Error()}
+	case stale:
+		q.Mode = ReadStale
+	case consistent:
+		q.Mode = ReadConsistent
+	}
+
+	if index := params.Get("index"); index != "" {
+		n, err := strconv.ParseUint(index, 10, 64)
+		if err != nil {
+			return nil, httpError{http.StatusBadRequest, "invalid index: " + index}
+		}
+		q.MinIndex = n
+	}
+	if wait := params.Get("wait"); wait != "" {
+		d, err := time.ParseDuration(wait)
+		if err != nil {
+			return nil, httpError{http.StatusBadRequest, "invalid wait: " + wait}
+		}
+		q.MaxWait = d
+	}
+	return q, nil
+}
+
+// setMeta writes the QueryMeta headers.
+func setMeta(w http.ResponseWriter, meta *QueryMeta) {
+	w.Header().Set(HeaderIndex, strconv.FormatUint(meta.Index, 10))
+	w.Header().Set(HeaderKnownLeader, strconv.FormatBool(meta.KnownLeader))
+	w.Header().Set(HeaderLastContact, strconv.FormatInt(int64(meta.LastContact/time.Millisecond), 10))
+}
@@ -0,0 +1,146 @@
+package cerebrum
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/mgutz/logxi/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func serveHTTP(reader Reader, method, url string) *httptest.ResponseRecorder {
+	handler := NewHTTPHandler(nil, &MockOperator{}, reader, &log.NullLogger{})
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest(method, url, nil)
+	handler.ServeHTTP(w, r)
+	return w
+}
+
+func TestHTTP_QueryOptions(t *testing.T) {
+	r, _ := http.NewRequest("GET", "/v1/kv/a?stale&index=42&wait=10s", nil)
+	q, err := parseQueryOptions(r)
+	assert.Nil(t, err)
+	assert.Equal(t, &QueryOptions{Mode: ReadStale, MinIndex: 42, MaxWait: 10 * time.Second}, q)
+
+	r, _ = http.NewRequest("GET", "/v1/kv/a?stale&consistent", nil)
+	_, err = parseQueryOptions(r)
+	assert.NotNil(t, err)
+
+	r, _ = http.NewRequest("GET", "/v1/kv/a?index=abc", nil)
+	_, err = parseQueryOptions(r)
+	assert.NotNil(t, err)
+}
+
+func TestHTTP_KVGet(t *testing.T) {
+	entry := &KVEntry{Key: "a", Value: []byte("b"), CreateIndex: 3, ModifyIndex: 4}
+	reader := &MockReader{}
+	reader.On("KVRead", "a", false, &QueryOptions{Mode: ReadConsistent}).
+		Return([]*KVEntry{entry}, &QueryMeta{Index: 4, KnownLeader: true}, nil)
+
+	w := serveHTTP(reader, "GET", "/v1/kv/a?consistent")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "4", w.Header().Get(HeaderIndex))
+	assert.Equal(t, "true", w.Header().Get(HeaderKnownLeader))
+
+	var entries []*KVEntry
+	assert.Nil(t, json.NewDecoder(w.Body).Decode(&entries))
+	assert.Equal(t, []*KVEntry{entry}, entries)
+}
+
+func TestHTTP_KVGetMissing(t *testing.T) {
+	reader := &MockReader{}
+	reader.On("KVRead", "a", false, &QueryOptions{}).
+		Return([]*KVEntry(nil), &QueryMeta{Index: 4, KnownLeader: true}, nil)
+
+	w := serveHTTP(reader, "GET", "/v1/kv/a")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Equal(t, "4", w.Header().Get(HeaderIndex))
+}
+
+func TestHTTP_KVGetDenied(t *testing.T) {
+	reader := &MockReader{}
+	reader.On("KVRead", "a", false, &QueryOptions{Token: "secret"}).
+		Return([]*KVEntry(nil), (*QueryMeta)(nil), ErrPermissionDenied)
+
+	w := serveHTTP(reader, "GET", "/v1/kv/a?token=secret")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	reader.AssertCalled(t, "KVRead", "a", false, &QueryOptions{Token: "secret"})
+}
+
+func TestHTTP_StatusPeersDenied(t *testing.T) {
+	state := newStateStore()
+	state.aclSet(1, &ACLToken{ID: "operator", Policy: ACLPolicy{Operator: AccessRead}})
+	agent := &cerebrum{acl: &aclResolver{state, "", ACLPolicyDeny}}
+	operator := &MockOperator{peers: []RaftPeer{{Address: "127.0.0.1:9000"}}}
+	operator.On("RaftPeers").Return()
+	handler := NewHTTPHandler(agent, operator, &MockReader{}, &log.NullLogger{})
+
+	// The peers need operator read access, as in the admin stream
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/v1/status/peers", nil)
+	handler.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	operator.AssertNotCalled(t, "RaftPeers")
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("GET", "/v1/status/peers?token=operator", nil)
+	handler.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var addrs []string
+	assert.Nil(t, json.NewDecoder(w.Body).Decode(&addrs))
+	assert.Equal(t, []string{"127.0.0.1:9000"}, addrs)
+}
+
+func TestHTTP_BodyTooLarge(t *testing.T) {
+	handler := NewHTTPHandler(nil, &MockOperator{}, &MockReader{}, &log.NullLogger{})
+
+	// Bodies larger than a forwarded tuple are rejected before they reach
+	// the agent
+	for _, url := range []string{"/v1/kv/a", "/v1/event/fire/deploy", "/v1/acl/token"} {
+		w := httptest.NewRecorder()
+		body := `{"Name": "` + strings.Repeat("a", maxForwardSize) + `"}`
+		r, _ := http.NewRequest("PUT", url, strings.NewReader(body))
+		handler.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code, url)
+	}
+}
+
+func TestHTTP_Health(t *testing.T) {
+	reader := &MockReader{}
+	reader.On("Leader").Return("").Once()
+	w := serveHTTP(reader, "GET", "/v1/health")
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+
+	reader.On("Leader").Return("127.0.0.1:9000").Once()
+	w = serveHTTP(reader, "GET", "/v1/health")
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+type MockReader struct {
+	mock.Mock
+}
+
+func (m *MockReader) Leader() string {
+	args := m.Called()
+	return args.String(0)
+}
+
+func (m *MockReader) CatalogNodes(q *QueryOptions) ([]*NodeEntry, *QueryMeta, error) {
+	args := m.Called(q)
+	return args.Get(0).([]*NodeEntry), args.Get(1).(*QueryMeta), args.Error(2)
+}
+
+func (m *MockReader) AuditLog(q *QueryOptions) ([]*AuditEvent, *QueryMeta, error) {
+	args := m.Called(q)
+	return args.Get(0).([]*AuditEvent), args.Get(1).(*QueryMeta), args.Error(2)
+}
+
+func (m *MockReader) KVRead(key string, recurse bool, q *QueryOptions) ([]*KVEntry, *QueryMeta, error) {
+	args := m.Called(key, recurse, q)
+	return args.Get(0).([]*KVEntry), args.Get(1).(*QueryMeta), args.Error(2)
+}
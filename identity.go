@@ -0,0 +1,198 @@
+package cerebrum
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Certificate roles. A certificate identifies its holder by carrying the DNS
+// name <role>.<datacenter>.cerebrum, e.g. server.dc1.cerebrum.
+const (
+	RoleServer = "server"
+	RoleClient = "client"
+
+	TLSDomain = "cerebrum"
+)
+
+// certCheckInterval is how often a CertReloader looks for changed files.
+const certCheckInterval = time.Second
+
+// ErrNoPeerCertificate is returned if a peer does not present a certificate.
+var ErrNoPeerCertificate = errors.New("peer did not present a certificate")
+
+// CertName returns the DNS name identifying the role in the data center.
+func CertName(role, dc string) string {
+	return role + "." + dc + "." + TLSDomain
+}
+
+// Identity is the verified identity of a peer.
+type Identity struct {
+	Role       string
+	DataCenter string
+}
+
+// identify returns the identity a certificate carries in the data center.
+func identify(cert *x509.Certificate, dc string) (Identity, error) {
+	for _, role := range []string{RoleServer, RoleClient} {
+		if cert.VerifyHostname(CertName(role, dc)) == nil {
+			return Identity{role, dc}, nil
+		}
+	}
+	return Identity{}, fmt.Errorf("certificate is not valid for %s or %s",
+		CertName(RoleServer, dc), CertName(RoleClient, dc))
+}
+
+// CertReloader serves a certificate and key from files. The files are
+// reloaded when either changes, so certificates can be rotated without a
+// restart. The previous certificate is kept if the new files are invalid.
+type CertReloader struct {
+	certFile string
+	keyFile  string
+
+	l       sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+	checked time.Time
+}
+
+// NewCertReloader loads the certificate and key.
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	r := &CertReloader{certFile: certFile, keyFile: keyFile}
+	if _, err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.current(), nil
+}
+
+// GetClientCertificate implements tls.Config.GetClientCertificate.
+func (r *CertReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return r.current(), nil
+}
+
+func (r *CertReloader) current() *tls.Certificate {
+	r.l.Lock()
+	defer r.l.Unlock()
+
+	if time.Since(r.checked) >= certCheckInterval {
+		r.checked = time.Now()
+		if modTime, err := r.lastModified(); err == nil && !modTime.Equal(r.modTime) {
+			r.loadLocked()
+		}
+	}
+	return r.cert
+}
+
+func (r *CertReloader) load() (*tls.Certificate, error) {
+	r.l.Lock()
+	defer r.l.Unlock()
+	return r.cert, r.loadLocked()
+}
+
+func (r *CertReloader) loadLocked() error {
+	modTime, err := r.lastModified()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.cert = &cert
+	r.modTime = modTime
+	r.checked = time.Now()
+	return nil
+}
+
+// lastModified returns the latest modification time of the files.
+func (r *CertReloader) lastModified() (t time.Time, err error) {
+	for _, path := range []string{r.certFile, r.keyFile} {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return t, err
+		}
+		if fi.ModTime().After(t) {
+			t = fi.ModTime()
+		}
+	}
+	return t, nil
+}
+
+// identities tracks the verified identity of each incoming TLS connection by
+// remote address, so stream handlers can authorize the peer. The muxer removes
+// the connections it closes.
+type identities struct {
+	l     sync.Mutex
+	conns map[string]identityEntry
+}
+
+type identityEntry struct {
+	conn net.Conn
+	id   Identity
+}
+
+func newIdentities() *identities {
+	return &identities{conns: make(map[string]identityEntry)}
+}
+
+// add records the identity of the connection.
+func (i *identities) add(conn net.Conn, id Identity) {
+	i.l.Lock()
+	defer i.l.Unlock()
+	i.conns[conn.RemoteAddr().String()] = identityEntry{conn, id}
+}
+
+// remove forgets the identity of a closed connection.
+func (i *identities) remove(conn net.Conn) {
+	i.l.Lock()
+	defer i.l.Unlock()
+	addr := conn.RemoteAddr().String()
+	if e, ok := i.conns[addr]; ok && e.conn == conn {
+		delete(i.conns, addr)
+	}
+}
+
+// get returns the identity of the connection from addr.
+func (i *identities) get(addr net.Addr) (Identity, bool) {
+	i.l.Lock()
+	defer i.l.Unlock()
+	e, ok := i.conns[addr.String()]
+	return e.id, ok
+}
+
+// verifyPeer returns a tls.Config.VerifyConnection function which identifies
+// the client certificate of conn and records it.
+func (c *cerebrum) verifyPeer(conn net.Conn) func(tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return ErrNoPeerCertificate
+		}
+		id, err := identify(cs.PeerCertificates[0], c.config.DataCenter)
+		if err != nil {
+			c.logger.Warn("Rejected peer certificate", "remote", conn.RemoteAddr().String(), "err", err)
+			return err
+		}
+		c.identities.add(conn, id)
+		return nil
+	}
+}
+
+// peerServerName returns the certificate name a server at the Raft address
+// must present. The data center is taken from the Serf tags of the member.
+func (c *cerebrum) peerServerName(addr string) string {
+	dc := c.config.DataCenter
+	if details := c.lookupPeer(addr); details != nil && details.DataCenter != "" {
+		dc = details.DataCenter
+	}
+	return CertName(RoleServer, dc)
+}
@@ -0,0 +1,152 @@
+package cerebrum
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	log "github.com/mgutz/logxi/v1"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+// testCert creates a self signed certificate for the DNS names.
+func testCert(t *testing.T, names ...string) (*x509.Certificate, []byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.Nil(t, err)
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.Nil(t, err)
+	return cert,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+}
+
+func TestIdentity_Identify(t *testing.T) {
+	server, _, _ := testCert(t, CertName(RoleServer, "dc1"))
+	id, err := identify(server, "dc1")
+	assert.Nil(t, err)
+	assert.Equal(t, Identity{RoleServer, "dc1"}, id)
+
+	client, _, _ := testCert(t, CertName(RoleClient, "dc1"))
+	id, err = identify(client, "dc1")
+	assert.Nil(t, err)
+	assert.Equal(t, Identity{RoleClient, "dc1"}, id)
+
+	// A certificate from another data center or without a role is rejected
+	_, err = identify(server, "dc2")
+	assert.NotNil(t, err)
+	other, _, _ := testCert(t, "example.com")
+	_, err = identify(other, "dc1")
+	assert.NotNil(t, err)
+}
+
+func TestIdentity_CertReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cerebrum-certs")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+
+	first, certPEM, keyPEM := testCert(t, "first")
+	assert.Nil(t, ioutil.WriteFile(certFile, certPEM, 0600))
+	assert.Nil(t, ioutil.WriteFile(keyFile, keyPEM, 0600))
+
+	r, err := NewCertReloader(certFile, keyFile)
+	assert.Nil(t, err)
+	cert, err := r.GetCertificate(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, first.Raw, cert.Certificate[0])
+
+	// Rotate the files
+	second, certPEM, keyPEM := testCert(t, "second")
+	assert.Nil(t, ioutil.WriteFile(certFile, certPEM, 0600))
+	assert.Nil(t, ioutil.WriteFile(keyFile, keyPEM, 0600))
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, future, future)
+	r.checked = time.Time{}
+
+	cert, err = r.GetClientCertificate(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, second.Raw, cert.Certificate[0])
+
+	// An invalid key keeps the previous certificate
+	assert.Nil(t, ioutil.WriteFile(keyFile, []byte("invalid"), 0600))
+	future = future.Add(time.Minute)
+	os.Chtimes(keyFile, future, future)
+	r.checked = time.Time{}
+
+	cert, err = r.GetCertificate(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, second.Raw, cert.Certificate[0])
+}
+
+func TestIdentity_RemovedOnClose(t *testing.T) {
+	_, certPEM, keyPEM := testCert(t, CertName(RoleServer, "dc1"))
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	assert.Nil(t, err)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	// The muxer forgets the identities of the connections it closes
+	ids := newIdentities()
+	config := &tls.Config{GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		return &tls.Config{
+			Certificates: []tls.Certificate{pair},
+			ClientAuth:   tls.RequireAnyClientCert,
+			VerifyConnection: func(tls.ConnectionState) error {
+				ids.add(hello.Conn, Identity{RoleServer, "dc1"})
+				return nil
+			},
+		}, nil
+	}}
+	m := newMuxer(context.Background(), l, config, nil, ids.remove, time.Second, ioutil.Discard, &log.NullLogger{})
+	m.Start()
+	defer m.Stop()
+
+	conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{
+		Certificates:       []tls.Certificate{pair},
+		InsecureSkipVerify: true,
+	})
+	assert.Nil(t, err)
+	known := func() bool {
+		_, ok := ids.get(conn.LocalAddr())
+		return ok
+	}
+	waitFor(t, known)
+	conn.Close()
+	waitFor(t, func() bool { return !known() })
+}
+
+// waitFor waits up to a second for the condition.
+func waitFor(t *testing.T, cond func() bool) {
+	for deadline := time.Now().Add(time.Second); !cond(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met")
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package cerebrum
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/hashicorp/serf/serf"
+)
+
+// SerfKeyringFile is the gossip keyring under DataPath. Serf rewrites it
+// whenever keys are installed, used or removed.
+const SerfKeyringFile = "serf/keyring"
+
+// KeyringResponse is the cluster-wide result of a keyring operation.
+type KeyringResponse struct {
+	// Messages holds the error message of each node which failed.
+	Messages map[string]string `json:",omitempty"`
+
+	NumNodes int
+	NumResp  int
+	NumErr   int
+
+	// Keys maps each base64 encoded key to the number of nodes which have
+	// it installed. It is only set by ListKeys.
+	Keys map[string]int `json:",omitempty"`
+}
+
+// InstallKey installs a new gossip key on every member.
+func (c *cerebrum) InstallKey(key string) (*KeyringResponse, error) {
+	r, err := keyringResponse(c.serf.KeyManager().InstallKey(key))
+	c.auditKeyring(err, "installed a gossip key")
+	return r, err
+}
+
+// UseKey makes an installed key the primary gossip key on every member.
+func (c *cerebrum) UseKey(key string) (*KeyringResponse, error) {
+	r, err := keyringResponse(c.serf.KeyManager().UseKey(key))
+	c.auditKeyring(err, "changed the primary gossip key")
+	return r, err
+}
+
+// RemoveKey removes a key which is not the primary key from every member.
+func (c *cerebrum) RemoveKey(key string) (*KeyringResponse, error) {
+	r, err := keyringResponse(c.serf.KeyManager().RemoveKey(key))
+	c.auditKeyring(err, "removed a gossip key")
+	return r, err
+}
+
+// ListKeys lists the gossip keys installed across the cluster.
+func (c *cerebrum) ListKeys() (*KeyringResponse, error) {
+	return keyringResponse(c.serf.KeyManager().ListKeys())
+}
+
+// auditKeyring records a successful keyring change. Keys are never
+// recorded.
+func (c *cerebrum) auditKeyring(err error, msg string) {
+	if err == nil {
+		c.audits.Audit(AuditOperator, "keyring", "%s", msg)
+	}
+}
+
+func keyringResponse(r *serf.KeyResponse, err error) (*KeyringResponse, error) {
+	if r == nil {
+		return nil, err
+	}
+	return &KeyringResponse{
+		Messages: r.Messages,
+		NumNodes: r.NumNodes,
+		NumResp:  r.NumResp,
+		NumErr:   r.NumErr,
+		Keys:     r.Keys,
+	}, err
+}
+
+// decodeKey decodes a base64 gossip key and checks its size.
+func decodeKey(key string) ([]byte, error) {
+	k, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return nil, err
+	}
+	if l := len(k); l != 16 && l != 24 && l != 32 {
+		return nil, fmt.Errorf("key size must be 16, 24 or 32 bytes, not %d", l)
+	}
+	return k, nil
+}
+
+// setupKeyring enables gossip encryption. An existing keyring file takes
+// precedence over EncryptKey since it reflects keys rotated at runtime;
+// otherwise a keyring holding EncryptKey is created. Gossip stays unencrypted
+// if neither exists.
+func (c *cerebrum) setupKeyring(conf *serf.Config) error {
+	path := filepath.Join(c.config.DataPath, SerfKeyringFile)
+	conf.KeyringFile = path
+
+	if _, err := os.Stat(path); err == nil {
+		keyring, err := loadKeyring(path)
+		if err != nil {
+			return err
+		}
+		conf.MemberlistConfig.Keyring = keyring
+		c.logger.Info("Loaded gossip keyring", "path", path, "keys", len(keyring.GetKeys()))
+
+		if c.config.EncryptKey != "" && !hasKey(keyring, c.config.EncryptKey) {
+			c.logger.Warn("EncryptKey is not in the keyring and is ignored", "path", path)
+		}
+		return nil
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	if c.config.EncryptKey == "" {
+		return nil
+	}
+	key, err := decodeKey(c.config.EncryptKey)
+	if err != nil {
+		return err
+	}
+	keyring, err := memberlist.NewKeyring(nil, key)
+	if err != nil {
+		return err
+	}
+	if err := writeKeyring(path, []string{c.config.EncryptKey}); err != nil {
+		return err
+	}
+	conf.MemberlistConfig.Keyring = keyring
+	c.logger.Info("Created gossip keyring", "path", path)
+	return nil
+}
+
+// loadKeyring reads a keyring file written by Serf: a JSON list of base64
+// keys with the primary key first.
+func loadKeyring(path string) (*memberlist.Keyring, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var encoded []string
+	if err := json.Unmarshal(data, &encoded); err != nil {
+		return nil, fmt.Errorf("invalid keyring %s: %v", path, err)
+	}
+	if len(encoded) == 0 {
+		return nil, fmt.Errorf("keyring %s is empty", path)
+	}
+
+	keys := make([][]byte, 0, len(encoded))
+	for _, e := range encoded {
+		key, err := decodeKey(e)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key in keyring %s: %v", path, err)
+		}
+		keys = append(keys, key)
+	}
+	return memberlist.NewKeyring(keys, keys[0])
+}
+
+// writeKeyring writes the base64 keys in the format used by Serf.
+func writeKeyring(path string, keys []string) error {
+	data, err := json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0600)
+}
+
+func hasKey(keyring *memberlist.Keyring, key string) bool {
+	for _, k := range keyring.GetKeys() {
+		if base64.StdEncoding.EncodeToString(k) == key {
+			return true
+		}
+	}
+	return false
+}
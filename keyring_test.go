@@ -0,0 +1,45 @@
+package cerebrum
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyring_LoadWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cerebrum-keyring")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, SerfKeyringFile)
+
+	primary := base64.StdEncoding.EncodeToString(make([]byte, 16))
+	secondary := base64.StdEncoding.EncodeToString(make([]byte, 32))
+	assert.Nil(t, writeKeyring(path, []string{primary, secondary}))
+
+	keyring, err := loadKeyring(path)
+	assert.Nil(t, err)
+	assert.Len(t, keyring.GetKeys(), 2)
+	assert.Equal(t, make([]byte, 16), keyring.GetPrimaryKey())
+	assert.True(t, hasKey(keyring, secondary))
+
+	// Keys of an invalid size are rejected
+	assert.Nil(t, writeKeyring(path, []string{base64.StdEncoding.EncodeToString(make([]byte, 8))}))
+	_, err = loadKeyring(path)
+	assert.NotNil(t, err)
+}
+
+func TestKeyring_ValidateEncryptKey(t *testing.T) {
+	c := DefaultConfig()
+	c.NodeID = "n1"
+	c.DataPath = "/tmp/cerebrum"
+	c.TLSConfig = mutualTLSConfig()
+	c.EncryptKey = base64.StdEncoding.EncodeToString(make([]byte, 32))
+	assert.Nil(t, c.Validate())
+
+	c.EncryptKey = "not base64"
+	assert.NotNil(t, c.Validate())
+}
@@ -2,6 +2,7 @@ package cerebrum
 
 import (
 	"net"
+	"sync/atomic"
 	"time"
 
 	"github.com/hashicorp/raft"
@@ -26,6 +27,22 @@ func (c *cerebrum) setLeader(name string) {
 	c.leader = name
 }
 
+// setConsistentReadReady marks the leader as caught up to serve
+// consistent reads.
+func (c *cerebrum) setConsistentReadReady() {
+	atomic.StoreInt32(&c.readyForConsistentReads, 1)
+}
+
+// resetConsistentReadReady is called on every leadership transition.
+func (c *cerebrum) resetConsistentReadReady() {
+	atomic.StoreInt32(&c.readyForConsistentReads, 0)
+}
+
+// isReadyForConsistentReads reports whether the leader applied its barrier.
+func (c *cerebrum) isReadyForConsistentReads() bool {
+	return atomic.LoadInt32(&c.readyForConsistentReads) == 1
+}
+
 // monitorLeadership is used to monitor if we acquire or lose our role
 // as the leader in the Raft cluster. There is some work the leader is
 // expected to do, so we must react to changes
@@ -35,14 +52,18 @@ func (c *cerebrum) monitorLeadership() {
 	for {
 		select {
 		case isLeader := <-leaderCh:
+			c.resetConsistentReadReady()
 			if isLeader {
 				stopCh = make(chan struct{})
 				go c.leaderLoop(stopCh)
+				c.telemetry.IncrCounter([]string{"leadership", "acquired"}, 1)
 				c.logger.Info("cluster leadership acquired")
 			} else if stopCh != nil {
 				close(stopCh)
 				stopCh = nil
+				c.telemetry.IncrCounter([]string{"leadership", "lost"}, 1)
 				c.logger.Info("cluster leadership lost")
+				c.audits.Audit(AuditLeadership, c.config.NodeName, "leadership lost")
 			}
 		case <-c.context.Done():
 			return
@@ -70,7 +91,7 @@ func (c *cerebrum) leaderLoop(stopCh chan struct{}) {
 RECONCILE:
 	// Setup a reconciliation timer
 	reconcileCh = nil
-	interval := time.After(c.config.ReconcileInterval)
+	interval := time.After(c.reconcileInterval())
 
 	// Apply a raft barrier to ensure our FSM is caught up
 	barrier := c.raft.Barrier(0)
@@ -86,6 +107,20 @@ RECONCILE:
 			goto WAIT
 		}
 		establishedLeader = true
+		c.audits.Audit(AuditLeadership, c.config.NodeName, "leadership acquired")
+
+		// Leadership may have been lost while establishing it
+		select {
+		case <-stopCh:
+		default:
+			c.setConsistentReadReady()
+		}
+	}
+
+	// Reconcile the members whose events were dropped or missed
+	if err := c.reconcile(); err != nil {
+		c.logger.Error("failed to reconcile", "err", err)
+		goto WAIT
 	}
 
 	// Initial reconcile worked, now we can process the channel
@@ -104,6 +139,7 @@ WAIT:
 		case <-interval:
 			goto RECONCILE
 		case member := <-reconcileCh:
+			c.telemetry.SetGauge([]string{"reconcile", "queue"}, float32(len(reconcileCh)))
 			c.reconcileMember(member)
 		}
 	}
@@ -129,6 +165,55 @@ func (c *cerebrum) revokeLeadership() error {
 	return nil
 }
 
+// reconcile brings the registered nodes in line with the Serf members. Members
+// whose status differs are reconciled and nodes Serf no longer knows of are
+// reaped, which catches up with the events the Reconciler dropped.
+func (c *cerebrum) reconcile() error {
+	nodes := make(map[string]*NodeEntry)
+	for _, node := range c.state.Nodes() {
+		nodes[node.Name] = node
+	}
+
+	for _, member := range c.serf.Members() {
+		node := nodes[member.Name]
+		delete(nodes, member.Name)
+
+		details, err := GetNodeDetails(member)
+		if err != nil || details.DataCenter != c.config.DataCenter {
+			continue
+		}
+		if status, ok := memberStatuses[member.Status]; !ok || node != nil && node.Status == status {
+			continue
+		}
+		if err := c.reconcileMember(member); err != nil {
+			return err
+		}
+	}
+
+	for _, node := range nodes {
+		member := serf.Member{Name: node.Name, Addr: net.ParseIP(node.Addr), Status: StatusReap}
+		details := &NodeDetails{
+			ID:         node.ID,
+			Name:       node.Name,
+			DataCenter: node.DataCenter,
+			Addr:       member.Addr,
+			Port:       node.Port,
+		}
+		if err := c.handleReapMember(member, details); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// memberStatuses maps the Serf statuses which are reconciled to the node
+// status they are registered with.
+var memberStatuses = map[serf.MemberStatus]NodeStatus{
+	serf.StatusAlive:  StatusAlive,
+	serf.StatusFailed: StatusFailed,
+	serf.StatusLeft:   StatusLeft,
+}
+
 // reconcileMember is used to do an async reconcile of a single
 // serf member
 func (c *cerebrum) reconcileMember(member serf.Member) (err error) {
@@ -172,14 +257,14 @@ func (c *cerebrum) handleAliveMember(member serf.Member, details *NodeDetails) e
 	}
 
 	c.logger.Info("member joined, marking health alive", "member", member.Name)
-	return c.updateNodeStatus(details, StatusAlive)
+	return c.setMemberStatus(details, StatusAlive)
 }
 
 // handleFailedMember is used to mark the node's status
 // as being critical, along with all checks as unknown.
 func (c *cerebrum) handleFailedMember(member serf.Member, details *NodeDetails) error {
 	c.logger.Info("member failed, marking health critical", "member", member.Name)
-	return c.updateNodeStatus(details, StatusFailed)
+	return c.setMemberStatus(details, StatusFailed)
 }
 
 // handleLeftMember is used to handle members that gracefully
@@ -211,7 +296,7 @@ func (c *cerebrum) handleDeregisterMember(reason NodeStatus, member serf.Member,
 
 	// Deregister the node
 	c.logger.Info("deregistering member", "name", member.Name, "reason", reason)
-	return c.updateNodeStatus(details, reason)
+	return c.setMemberStatus(details, reason)
 }
 
 // joinConsulServer is used to try to join another consul server
@@ -238,7 +323,9 @@ func (c *cerebrum) joinConsulServer(m serf.Member, details *NodeDetails) error {
 	// Attempt to add as a peer
 	var addr net.Addr = &net.TCPAddr{IP: m.Addr, Port: details.Port}
 	future := c.raft.AddPeer(addr.String())
-	if err := future.Error(); err != nil && err != raft.ErrKnownPeer {
+	if err := future.Error(); err == nil {
+		c.audits.Audit(AuditPeerAdded, addr.String(), "added %s as raft peer", m.Name)
+	} else if err != raft.ErrKnownPeer {
 		c.logger.Error("failed to add raft peer", "err", err)
 		return err
 	}
@@ -256,6 +343,7 @@ func (c *cerebrum) removeConsulServer(m serf.Member, port int) error {
 		return err
 	} else if err == nil {
 		c.logger.Info("removed server as peer", "name", m.Name)
+		c.audits.Audit(AuditPeerRemoved, peer.String(), "removed %s as raft peer", m.Name)
 	}
 	return nil
 }
@@ -0,0 +1,286 @@
+package cerebrum
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	stdlog "log"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	log "github.com/mgutz/logxi/v1"
+)
+
+// DefaultLogLevel is the level of the components unless LogLevel or
+// LogLevels is set.
+const DefaultLogLevel = "info"
+
+// Logger receives the messages of every component of a node. Levels are the
+// logxi levels, e.g. log.LevelWarn, and messages are filtered by the level of
+// their component before they reach the Logger. Fields are alternating keys
+// and values and start with the node, datacenter and Raft term.
+type Logger interface {
+	Log(level int, component, msg string, fields []interface{})
+}
+
+// NewLogxiLogger writes the messages with a logxi logger per component. The
+// levels of the LOGXI environment variable are ignored, see LogLevels.
+func NewLogxiLogger(w io.Writer) Logger {
+	return &logxiLogger{w: w, loggers: make(map[string]log.Logger)}
+}
+
+type logxiLogger struct {
+	w       io.Writer
+	lock    sync.Mutex
+	loggers map[string]log.Logger
+}
+
+func (l *logxiLogger) Log(level int, component, msg string, fields []interface{}) {
+	l.lock.Lock()
+	logger, ok := l.loggers[component]
+	if !ok {
+		logger = log.NewLogger(l.w, component)
+		logger.SetLevel(log.LevelAll)
+		l.loggers[component] = logger
+	}
+	l.lock.Unlock()
+	logger.Log(level, msg, fields)
+}
+
+// NewStdLogger writes the messages with a standard library logger in the
+// format of Raft and Serf: "[WARN] component: message key=value".
+func NewStdLogger(l *stdlog.Logger) Logger {
+	return stdLogger{l}
+}
+
+type stdLogger struct {
+	logger *stdlog.Logger
+}
+
+func (l stdLogger) Log(level int, component, msg string, fields []interface{}) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "[%s] %s: %s", levelName(level), component, msg)
+	for i := 0; i < len(fields); i += 2 {
+		var value interface{} = ""
+		if i+1 < len(fields) {
+			value = fields[i+1]
+		}
+		fmt.Fprintf(&buf, " %v=%s", fields[i], quoteValue(value))
+	}
+	l.logger.Output(2, buf.String())
+}
+
+func levelName(level int) string {
+	switch {
+	case level <= log.LevelFatal:
+		return "FATAL"
+	case level <= log.LevelError:
+		return "ERR"
+	case level <= log.LevelWarn:
+		return "WARN"
+	case level <= log.LevelInfo:
+		return "INFO"
+	case level <= log.LevelDebug:
+		return "DEBUG"
+	}
+	return "TRACE"
+}
+
+// quoteValue quotes values which would not parse as a single token.
+func quoteValue(v interface{}) string {
+	s := fmt.Sprint(v)
+	if s == "" || strings.ContainsAny(s, " =\"\t\n") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// parseLevel reads the level names of logxi and of Raft and Serf.
+func parseLevel(name string) (int, bool) {
+	switch name {
+	case "ERROR":
+		return log.LevelError, true
+	case "WARN":
+		return log.LevelWarn, true
+	case "INFO":
+		return log.LevelInfo, true
+	case "DEBUG":
+		return log.LevelDebug, true
+	}
+	level, ok := log.LevelAtoi[name]
+	return level, ok
+}
+
+// logging creates the loggers of the components of a node and updates their
+// levels.
+type logging struct {
+	sink Logger
+	node string
+	dc   string
+	term atomic.Value
+
+	lock    sync.Mutex
+	level   string
+	levels  map[string]string
+	loggers map[string]*componentLogger
+}
+
+func newLogging(c *Config) *logging {
+	sink := c.Logger
+	if sink == nil {
+		sink = NewLogxiLogger(c.LogOutput)
+	}
+	return &logging{
+		sink:    sink,
+		node:    c.NodeName,
+		dc:      c.DataCenter,
+		level:   c.LogLevel,
+		levels:  c.LogLevels,
+		loggers: make(map[string]*componentLogger),
+	}
+}
+
+// Named returns the logger of a component.
+func (l *logging) Named(name string) log.Logger {
+	return l.component(name)
+}
+
+func (l *logging) component(name string) *componentLogger {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if logger, ok := l.loggers[name]; ok {
+		return logger
+	}
+	logger := &componentLogger{name: name, logging: l, level: int32(l.levelOf(name))}
+	l.loggers[name] = logger
+	return logger
+}
+
+// SetLevels updates the levels of the components.
+func (l *logging) SetLevels(level string, levels map[string]string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.level, l.levels = level, levels
+	for name, logger := range l.loggers {
+		logger.SetLevel(l.levelOf(name))
+	}
+}
+
+func (l *logging) levelOf(name string) int {
+	if level, ok := log.LevelAtoi[l.levels[name]]; ok {
+		return level
+	}
+	if level, ok := log.LevelAtoi[l.level]; ok {
+		return level
+	}
+	return log.LevelAtoi[DefaultLogLevel]
+}
+
+// setTerm adds the Raft term returned by the function to the fields once Raft
+// has started.
+func (l *logging) setTerm(term func() uint64) {
+	l.term.Store(term)
+}
+
+func (l *logging) fields() []interface{} {
+	fields := []interface{}{"node", l.node, "dc", l.dc}
+	if term, ok := l.term.Load().(func() uint64); ok {
+		fields = append(fields, "term", strconv.FormatUint(term(), 10))
+	}
+	return fields
+}
+
+// Writer returns the output for the standard library loggers of Raft, Serf,
+// Memberlist and yamux. Their lines are parsed into leveled messages of the
+// component named in the line, or of the given component.
+func (l *logging) Writer(name string) io.Writer {
+	return &logWriter{l, name}
+}
+
+type logWriter struct {
+	logging *logging
+	name    string
+}
+
+// Write parses lines like "2016/01/02 15:04:05 [INFO] raft: message".
+func (w *logWriter) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		level, name, msg := log.LevelInfo, w.name, line
+		if i := strings.Index(line, "["); i >= 0 {
+			if j := strings.Index(line[i:], "] "); j > 0 {
+				if lvl, ok := parseLevel(line[i+1 : i+j]); ok {
+					level, msg = lvl, line[i+j+2:]
+				}
+			}
+		}
+		if i := strings.Index(msg, ": "); i > 0 && !strings.ContainsAny(msg[:i], " [") {
+			name, msg = msg[:i], msg[i+2:]
+		}
+		w.logging.component(name).Log(level, msg, nil)
+	}
+	return len(p), nil
+}
+
+// componentLogger is the logxi logger of a component. It filters the messages
+// by the level of the component and adds the fields of the node.
+type componentLogger struct {
+	name    string
+	logging *logging
+	level   int32
+}
+
+func (c *componentLogger) Trace(msg string, args ...interface{}) {
+	c.Log(log.LevelTrace, msg, args)
+}
+
+func (c *componentLogger) Debug(msg string, args ...interface{}) {
+	c.Log(log.LevelDebug, msg, args)
+}
+
+func (c *componentLogger) Info(msg string, args ...interface{}) {
+	c.Log(log.LevelInfo, msg, args)
+}
+
+func (c *componentLogger) Warn(msg string, args ...interface{}) {
+	c.Log(log.LevelWarn, msg, args)
+}
+
+// Error logs the message and returns the error argument like logxi does, or
+// the message.
+func (c *componentLogger) Error(msg string, args ...interface{}) error {
+	c.Log(log.LevelError, msg, args)
+	if len(args) == 2 {
+		if err, ok := args[1].(error); ok {
+			return err
+		}
+	}
+	return fmt.Errorf("%s", msg)
+}
+
+func (c *componentLogger) Fatal(msg string, args ...interface{}) {
+	c.Log(log.LevelFatal, msg, args)
+	panic("Exit due to fatal error: " + msg)
+}
+
+func (c *componentLogger) Log(level int, msg string, args []interface{}) {
+	if level > c.getLevel() {
+		return
+	}
+	fields := append(c.logging.fields(), args...)
+	c.logging.sink.Log(level, c.name, msg, fields)
+}
+
+func (c *componentLogger) SetLevel(level int) {
+	atomic.StoreInt32(&c.level, int32(level))
+}
+
+func (c *componentLogger) getLevel() int {
+	return int(atomic.LoadInt32(&c.level))
+}
+
+func (c *componentLogger) IsTrace() bool { return c.getLevel() >= log.LevelTrace }
+func (c *componentLogger) IsDebug() bool { return c.getLevel() >= log.LevelDebug }
+func (c *componentLogger) IsInfo() bool  { return c.getLevel() >= log.LevelInfo }
+func (c *componentLogger) IsWarn() bool  { return c.getLevel() >= log.LevelWarn }
@@ -0,0 +1,98 @@
+package cerebrum
+
+import (
+	"bytes"
+	"errors"
+	stdlog "log"
+	"sync"
+	"testing"
+
+	log "github.com/mgutz/logxi/v1"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogger_Levels(t *testing.T) {
+	sink := &captureLogger{}
+	logging := newLogging(&Config{
+		NodeName:   "n1",
+		DataCenter: "dc1",
+		Logger:     sink,
+		LogLevels:  map[string]string{"raft": "warn"},
+	})
+
+	fsm := logging.Named("fsm")
+	raft := logging.Named("raft")
+	assert.True(t, fsm == logging.Named("fsm"))
+	fsm.Debug("hidden")
+	fsm.Info("applied", "index", 1)
+	raft.Info("hidden")
+	raft.Warn("slow")
+	assert.Equal(t, []logEntry{
+		{log.LevelInfo, "fsm", "applied", []interface{}{"node", "n1", "dc", "dc1", "index", 1}},
+		{log.LevelWarn, "raft", "slow", []interface{}{"node", "n1", "dc", "dc1"}},
+	}, sink.take())
+
+	// Levels are updated on reload
+	logging.SetLevels("debug", nil)
+	fsm.Debug("shown")
+	raft.Info("shown")
+	assert.Len(t, sink.take(), 2)
+	assert.True(t, raft.IsDebug())
+
+	err := errors.New("failed")
+	assert.Equal(t, err, fsm.Error("Failed to apply", "err", err))
+	assert.Equal(t, "Failed to apply", fsm.Error("Failed to apply").Error())
+}
+
+func TestLogger_Writer(t *testing.T) {
+	sink := &captureLogger{}
+	logging := newLogging(&Config{NodeName: "n1", Logger: sink, LogLevels: map[string]string{"memberlist": "info"}})
+
+	w := logging.Writer("serf")
+	w.Write([]byte("2016/01/02 15:04:05 [INFO] serf: EventMemberJoin: n2 127.0.0.1\n"))
+	w.Write([]byte("2016/01/02 15:04:05 [DEBUG] memberlist: TCP connection from=127.0.0.1:7946\n"))
+	w.Write([]byte("2016/01/02 15:04:05 [ERR] Failed to send [ack]: eof\n"))
+	w.Write([]byte("unstructured\n"))
+
+	entries := sink.take()
+	if assert.Len(t, entries, 3) {
+		assert.Equal(t, logEntry{log.LevelInfo, "serf", "EventMemberJoin: n2 127.0.0.1", []interface{}{"node", "n1", "dc", ""}}, entries[0])
+		assert.Equal(t, log.LevelError, entries[1].level)
+		assert.Equal(t, "serf", entries[1].component)
+		assert.Equal(t, "Failed to send [ack]: eof", entries[1].msg)
+		assert.Equal(t, "unstructured", entries[2].msg)
+	}
+}
+
+func TestLogger_Std(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewStdLogger(stdlog.New(&buf, "", 0))
+	logger.Log(log.LevelWarn, "forwarder", "Failed to dial", []interface{}{"node", "n1", "err", "connection refused", "term"})
+	assert.Equal(t, "[WARN] forwarder: Failed to dial node=n1 err=\"connection refused\" term=\"\"\n", buf.String())
+}
+
+type logEntry struct {
+	level     int
+	component string
+	msg       string
+	fields    []interface{}
+}
+
+type captureLogger struct {
+	lock    sync.Mutex
+	entries []logEntry
+}
+
+func (c *captureLogger) Log(level int, component, msg string, fields []interface{}) {
+	c.lock.Lock()
+	c.entries = append(c.entries, logEntry{level, component, msg, fields})
+	c.lock.Unlock()
+}
+
+func (c *captureLogger) take() []logEntry {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	entries := c.entries
+	c.entries = nil
+	return entries
+}
@@ -0,0 +1,155 @@
+package cerebrum
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"time"
+
+	"github.com/blacklabeldata/grim"
+	"github.com/blacklabeldata/yamuxer"
+	"github.com/hashicorp/yamux"
+	log "github.com/mgutz/logxi/v1"
+	"golang.org/x/net/context"
+)
+
+// Network carries the connections between the Raft addresses of the nodes.
+// TLS and yamux run on top of it. The default is TCP; the cerebrumtest
+// package provides an in-memory network.
+type Network interface {
+	Listen(addr string) (net.Listener, error)
+	Dial(addr string, timeout time.Duration) (net.Conn, error)
+}
+
+// TCPNetwork is the default Network.
+type TCPNetwork struct{}
+
+func (TCPNetwork) Listen(addr string) (net.Listener, error) {
+	return net.Listen("tcp", addr)
+}
+
+func (TCPNetwork) Dial(addr string, timeout time.Duration) (net.Conn, error) {
+	return net.DialTimeout("tcp", addr, timeout)
+}
+
+// muxer accepts the TLS connections of the other nodes and dispatches their
+// yamux streams by type. Connections and streams are served concurrently.
+type muxer struct {
+	listener   net.Listener
+	tlsConfig  *tls.Config
+	dispatcher yamuxer.Dispatcher
+	closed     func(net.Conn)
+	deadline   time.Duration
+	logOutput  io.Writer
+	logger     log.Logger
+
+	grim   grim.GrimReaper
+	cancel context.CancelFunc
+}
+
+// newMuxer creates a muxer. The TLS handshake of each connection must finish
+// within the deadline. closed, unless nil, is called with each accepted
+// connection once it is closed.
+func newMuxer(c context.Context, l net.Listener, tlsConfig *tls.Config, d yamuxer.Dispatcher, closed func(net.Conn),
+	deadline time.Duration, logOutput io.Writer, logger log.Logger) *muxer {
+	ctx, cancel := context.WithCancel(c)
+	return &muxer{
+		listener:   l,
+		tlsConfig:  tlsConfig,
+		dispatcher: d,
+		closed:     closed,
+		deadline:   deadline,
+		logOutput:  logOutput,
+		logger:     logger,
+		grim:       grim.ReaperWithContext(ctx),
+		cancel:     cancel,
+	}
+}
+
+func (m *muxer) Start() {
+	m.grim.SpawnFunc(m.listen)
+}
+
+// Stop closes the listener and every connection and waits for their streams
+// to be handled.
+func (m *muxer) Stop() {
+	m.cancel()
+	m.listener.Close()
+	m.grim.Wait()
+}
+
+func (m *muxer) listen(ctx context.Context) {
+	for {
+		conn, err := m.listener.Accept()
+		if err != nil {
+			select {
+			case <-ctx.Done():
+				return
+			default:
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(5 * time.Millisecond)
+				continue
+			}
+			m.logger.Error("Failed to accept connection", "err", err)
+			return
+		}
+		m.grim.SpawnFunc(func(ctx context.Context) {
+			m.serve(ctx, conn)
+		})
+	}
+}
+
+// serve runs the TLS handshake and dispatches the streams of the connection
+// until it or the muxer is closed.
+func (m *muxer) serve(ctx context.Context, raw net.Conn) {
+	if m.closed != nil {
+		defer m.closed(raw)
+	}
+	conn := tls.Server(raw, m.tlsConfig)
+	defer conn.Close()
+	if m.deadline > 0 {
+		conn.SetDeadline(time.Now().Add(m.deadline))
+	}
+	if err := conn.Handshake(); err != nil {
+		m.logger.Warn("TLS handshake failed", "remote", raw.RemoteAddr().String(), "err", err)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	conf := yamux.DefaultConfig()
+	conf.LogOutput = m.logOutput
+	session, err := yamux.Server(conn, conf)
+	if err != nil {
+		m.logger.Warn("Failed to start yamux session", "err", err)
+		return
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			session.Close()
+		case <-done:
+		}
+	}()
+
+	g := grim.ReaperWithContext(ctx)
+	defer g.Wait()
+	defer session.Close()
+	for {
+		stream, err := session.Accept()
+		if err != nil {
+			if err != io.EOF && ctx.Err() == nil && !session.IsClosed() {
+				m.logger.Debug("Failed to accept stream", "err", err)
+			}
+			return
+		}
+
+		// The stream type is read by the dispatcher, so a stream which never
+		// sends it must not hold up the others
+		g.SpawnFunc(func(context.Context) {
+			m.dispatcher.Dispatch(g, stream)
+		})
+	}
+}
@@ -0,0 +1,200 @@
+package cerebrum
+
+import (
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// Operator exposes the functions used to inspect and repair the Raft
+// configuration of a running node.
+type Operator interface {
+
+	// RaftPeers lists the known Raft peers along with their leader and voter
+	// status.
+	RaftPeers() ([]RaftPeer, error)
+
+	// RemoveRaftPeer removes the peer with the given address from the Raft
+	// configuration. This must be run on the leader.
+	RemoveRaftPeer(addr string) error
+
+	// TransferLeadership asks the leader to hand leadership to another peer.
+	// The vendored Raft library cannot do so and ErrLeadershipTransfer is
+	// returned.
+	TransferLeadership() error
+
+	// ForceRaftPeers forcibly replaces the local peer set. This is only meant
+	// for outage recovery when quorum has been lost and must not be run on
+	// the leader.
+	ForceRaftPeers(addrs []string) error
+
+	// InstallKey installs a base64 encoded gossip key on every member.
+	InstallKey(key string) (*KeyringResponse, error)
+
+	// UseKey changes the primary gossip key of every member. The key must
+	// already be installed.
+	UseKey(key string) (*KeyringResponse, error)
+
+	// RemoveKey removes a gossip key from every member. The primary key
+	// cannot be removed.
+	RemoveKey(key string) (*KeyringResponse, error)
+
+	// ListKeys lists the gossip keys installed on the members.
+	ListKeys() (*KeyringResponse, error)
+
+	// CompactRaftStore rewrites the Raft log store of the node to release
+	// the space of deleted logs. Raft is paused while it runs.
+	CompactRaftStore() (*RaftStoreCompaction, error)
+}
+
+// RaftPeer describes a single Raft peer.
+type RaftPeer struct {
+	Node    string
+	ID      string
+	Address string
+	Leader  bool
+
+	// Voter is always true as the vendored Raft library has no non-voting
+	// peers
+	Voter bool
+}
+
+// RaftStoreCompaction describes a compaction of the Raft log store.
+type RaftStoreCompaction struct {
+	SizeBefore int64
+	SizeAfter  int64
+	Duration   time.Duration
+}
+
+// RaftPeers lists the peers in the local peer store. The local node is always
+// included.
+func (c *cerebrum) RaftPeers() ([]RaftPeer, error) {
+	addrs, err := c.raftPeers.Peers()
+	if err != nil {
+		return nil, err
+	}
+	local := c.raftTransport.LocalAddr()
+	if !raft.PeerContained(addrs, local) {
+		addrs = append(addrs, local)
+	}
+
+	leader := c.raft.Leader()
+	peers := make([]RaftPeer, 0, len(addrs))
+	for _, addr := range addrs {
+		peer := RaftPeer{
+			Address: addr,
+			Leader:  addr == leader,
+			Voter:   true,
+		}
+		if details := c.lookupPeer(addr); details != nil {
+			peer.Node = details.Name
+			peer.ID = details.ID
+		}
+		peers = append(peers, peer)
+	}
+	return peers, nil
+}
+
+// lookupPeer finds the server details for a Raft address among the Serf
+// members. Only the host is compared for members which do not advertise
+// their Raft port.
+func (c *cerebrum) lookupPeer(addr string) *NodeDetails {
+	if addr == c.raftTransport.LocalAddr() {
+		return &NodeDetails{Name: c.config.NodeName, ID: c.config.NodeID}
+	}
+
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil || c.serf == nil {
+		return nil
+	}
+	ip := net.ParseIP(host)
+	port, _ := strconv.Atoi(portStr)
+	for _, m := range c.serf.Members() {
+		details, err := GetNodeDetails(m)
+		if err != nil {
+			continue
+		}
+		if details.Addr.Equal(ip) && (details.Port == 0 || details.Port == port) {
+			return details
+		}
+	}
+	return nil
+}
+
+// RemoveRaftPeer removes a peer from the Raft configuration.
+func (c *cerebrum) RemoveRaftPeer(addr string) error {
+	if _, err := net.ResolveTCPAddr("tcp", addr); err != nil {
+		return err
+	}
+
+	future := c.raft.RemovePeer(addr)
+	if err := future.Error(); err != nil {
+		c.logger.Warn("failed to remove raft peer", "peer", addr, "err", err)
+		return err
+	}
+	c.logger.Info("removed raft peer", "peer", addr)
+	c.audits.Audit(AuditPeerRemoved, addr, "removed raft peer by operator request")
+	return nil
+}
+
+// TransferLeadership is not supported by the vendored Raft library, which has
+// no way for a leader to step down in favour of another peer.
+func (c *cerebrum) TransferLeadership() error {
+	if c.raft.State() != raft.Leader {
+		return raft.ErrNotLeader
+	}
+	return ErrLeadershipTransfer
+}
+
+// ForceRaftPeers replaces the local peer set with the given addresses.
+func (c *cerebrum) ForceRaftPeers(addrs []string) error {
+	if len(addrs) == 0 {
+		return ErrNoPeers
+	}
+	for _, addr := range addrs {
+		if _, err := net.ResolveTCPAddr("tcp", addr); err != nil {
+			return err
+		}
+	}
+
+	future := c.raft.SetPeers(addrs)
+	if err := future.Error(); err != nil {
+		c.logger.Warn("failed to force raft peers", "peers", addrs, "err", err)
+		return err
+	}
+	c.logger.Warn("forced raft peers", "peers", addrs)
+	c.audits.Audit(AuditOperator, "raft", "forced raft peers %v", addrs)
+	return nil
+}
+
+// CompactRaftStore compacts the Raft store by operator request.
+func (c *cerebrum) CompactRaftStore() (*RaftStoreCompaction, error) {
+	result, err := c.compactRaftStore()
+	if err != nil {
+		return nil, err
+	}
+	c.audits.Audit(AuditOperator, "raft", "compacted raft store from %d to %d bytes", result.SizeBefore, result.SizeAfter)
+	return result, nil
+}
+
+// compactRaftStore compacts a bolt Raft store. Other stores return
+// ErrCompactionUnsupported.
+func (c *cerebrum) compactRaftStore() (*RaftStoreCompaction, error) {
+	compactor, ok := c.raftStore.(raftStoreCompactor)
+	if !ok {
+		return nil, ErrCompactionUnsupported
+	}
+
+	start := time.Now()
+	before, after, err := compactor.Compact()
+	if err != nil {
+		c.logger.Warn("failed to compact raft store", "err", err)
+		return nil, err
+	}
+	result := &RaftStoreCompaction{SizeBefore: before, SizeAfter: after, Duration: time.Since(start)}
+	c.telemetry.MeasureSince([]string{"raft", "store", "compact"}, start)
+	c.logger.Info("compacted raft store", "before", before, "after", after, "duration", result.Duration)
+	return result, nil
+}
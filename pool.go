@@ -2,9 +2,11 @@ package cerebrum
 
 import (
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"strconv"
 	"sync"
 	"time"
 
@@ -12,11 +14,11 @@ import (
 	"github.com/hashicorp/yamux"
 )
 
+// errPingTimeout is returned by health checks which are not answered in time.
+var errPingTimeout = errors.New("ping timed out")
+
 // Conn is a pooled connection to a Cerebrum server
 type Conn struct {
-	// refCount    int32
-	// shouldClose int32
-
 	addr     string
 	session  *yamux.Session
 	lastUsed time.Time
@@ -33,35 +35,35 @@ func (c *Conn) Close() error {
 	return c.session.Close()
 }
 
-// getClient is used to get a cached or new client
-func (c *Conn) getClient() (net.Conn, error) {
-
-	// Open a new session
-	stream, err := c.session.Open()
-	if err != nil {
-		return nil, err
-	}
-	return stream, nil
-}
-
+// dial opens a stream of the given type.
 func (c *Conn) dial(t yamuxer.StreamType) (net.Conn, error) {
-	stream, err := c.getClient()
+	stream, err := c.session.Open()
 	if err != nil {
 		return nil, err
 	}
 
 	if _, err = stream.Write([]byte{byte(t)}); err != nil {
+		stream.Close()
 		return nil, err
 	}
 	return stream, nil
 }
 
-func (c *Conn) dialRaft() (net.Conn, error) {
-	return c.dial(connRaft)
-}
-
-func (c *Conn) dialForwarding() (net.Conn, error) {
-	return c.dial(connForward)
+// ping checks that the server answers on the session within the timeout.
+func (c *Conn) ping(timeout time.Duration) error {
+	// Ping only returns once the session is closed if the server is gone
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := c.session.Ping()
+		errCh <- err
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-time.After(timeout):
+		return errPingTimeout
+	}
 }
 
 // ConnPool is used to maintain a connection pool to other
@@ -78,32 +80,70 @@ type ConnPool struct {
 	// The maximum time to keep a connection open
 	maxTime time.Duration
 
-	// Pool maps an address to a open connection
-	pool map[string]*Conn
+	// Pool maps an address to its open sessions
+	pool map[string][]*Conn
+
+	// dialing counts the sessions being dialed by address
+	dialing map[string]int
+
+	// sessions is the number of sessions kept per address
+	sessions int
+
+	// streams bounds the open streams of all sessions. It is nil if the
+	// streams are unbounded.
+	streams chan struct{}
+
+	// healthInterval is how often sessions are pinged
+	healthInterval time.Duration
 
 	// TLS config
 	config *tls.Config
 
+	// serverName returns the name the server at an address must present
+	serverName func(addr string) string
+
+	// network dials the servers
+	network Network
+
+	// telemetry receives the metrics of the pool
+	telemetry *Telemetry
+
+	stats poolStats
+
 	// Used to indicate the pool is shutdown
 	shutdown   bool
 	shutdownCh chan struct{}
 }
 
+// poolStats counts the events of the pool.
+type poolStats struct {
+	dials          uint64
+	dialFailures   uint64
+	evicted        uint64
+	reaped         uint64
+	healthFailures uint64
+}
+
 // NewPool is used to make a new connection pool
-// Maintain at most one connection per host, for up to maxTime.
+// Maintain one session per host by default, for up to maxTime.
 // Set maxTime to 0 to disable reaping.
 // If TLS settings are provided outgoing connections use TLS.
 func NewPool(logOutput io.Writer, maxTime time.Duration, config *tls.Config) *ConnPool {
 	pool := &ConnPool{
-		logOutput:  logOutput,
-		maxTime:    maxTime,
-		pool:       make(map[string]*Conn),
-		config:     config,
-		shutdownCh: make(chan struct{}),
+		logOutput:      logOutput,
+		maxTime:        maxTime,
+		pool:           make(map[string][]*Conn),
+		dialing:        make(map[string]int),
+		sessions:       DefaultPoolSessions,
+		healthInterval: DefaultPoolHealthInterval,
+		config:         config,
+		network:        TCPNetwork{},
+		shutdownCh:     make(chan struct{}),
 	}
 	if maxTime > 0 {
 		go pool.reap()
 	}
+	go pool.checkHealth()
 	return pool
 }
 
@@ -112,10 +152,12 @@ func (p *ConnPool) Shutdown() error {
 	p.Lock()
 	defer p.Unlock()
 
-	for _, conn := range p.pool {
-		conn.Close()
+	for _, conns := range p.pool {
+		for _, conn := range conns {
+			conn.Close()
+		}
 	}
-	p.pool = make(map[string]*Conn)
+	p.pool = make(map[string][]*Conn)
 
 	if p.shutdown {
 		return nil
@@ -125,43 +167,207 @@ func (p *ConnPool) Shutdown() error {
 	return nil
 }
 
-// Acquire is used to get a connection that is
-// pooled or to return a new connection
-func (p *ConnPool) acquire(addr string, timeout time.Duration) (*Conn, error) {
-	// Check to see if there's a pooled connection available. This is up
-	// here since it should the the vastly more common case than the rest
-	// of the code here.
+// SetTLSConfig replaces the TLS configuration used for new connections.
+// Pooled connections keep the configuration they were dialed with.
+func (p *ConnPool) SetTLSConfig(config *tls.Config) {
 	p.Lock()
 	defer p.Unlock()
+	p.config = config
+}
+
+// SetServerName sets the function returning the certificate name expected
+// from the server at an address.
+func (p *ConnPool) SetServerName(fn func(addr string) string) {
+	p.Lock()
+	defer p.Unlock()
+	p.serverName = fn
+}
+
+// SetNetwork sets the Network servers are dialed on.
+func (p *ConnPool) SetNetwork(n Network) {
+	p.Lock()
+	defer p.Unlock()
+	p.network = n
+}
 
-	c := p.pool[addr]
-	if c != nil {
+// SetTelemetry sets the Telemetry the metrics of the pool are emitted to.
+func (p *ConnPool) SetTelemetry(t *Telemetry) {
+	p.Lock()
+	defer p.Unlock()
+	p.telemetry = t
+}
+
+// SetSessions sets the number of sessions kept per server. Streams are
+// opened on the session with the fewest streams.
+func (p *ConnPool) SetSessions(n int) {
+	p.Lock()
+	defer p.Unlock()
+	if n < 1 {
+		n = 1
+	}
+	p.sessions = n
+}
+
+// SetMaxStreams bounds the open streams of all sessions. Dials wait up to
+// their timeout for a stream to be closed. It must be set before the pool is
+// used; 0 removes the bound.
+func (p *ConnPool) SetMaxStreams(n int) {
+	p.Lock()
+	defer p.Unlock()
+	p.streams = nil
+	if n > 0 {
+		p.streams = make(chan struct{}, n)
+	}
+}
+
+// SetHealthInterval sets how often the sessions are pinged. Sessions which
+// do not answer within the interval are closed. Zero sets
+// DefaultPoolHealthInterval.
+func (p *ConnPool) SetHealthInterval(d time.Duration) {
+	p.Lock()
+	defer p.Unlock()
+	if d <= 0 {
+		d = DefaultPoolHealthInterval
+	}
+	p.healthInterval = d
+}
+
+// Stats returns the number of hosts, sessions and streams of the pool and
+// the counts of its dials, dial failures, evicted and reaped sessions and
+// failed health checks.
+func (p *ConnPool) Stats() map[string]string {
+	p.Lock()
+	defer p.Unlock()
+
+	sessions, streams := 0, 0
+	for _, conns := range p.pool {
+		for _, conn := range conns {
+			sessions++
+			streams += conn.session.NumStreams()
+		}
+	}
+	return map[string]string{
+		"hosts":           strconv.Itoa(len(p.pool)),
+		"sessions":        strconv.Itoa(sessions),
+		"streams":         strconv.Itoa(streams),
+		"dials":           strconv.FormatUint(p.stats.dials, 10),
+		"dial_failures":   strconv.FormatUint(p.stats.dialFailures, 10),
+		"evicted":         strconv.FormatUint(p.stats.evicted, 10),
+		"reaped":          strconv.FormatUint(p.stats.reaped, 10),
+		"health_failures": strconv.FormatUint(p.stats.healthFailures, 10),
+	}
+}
+
+// Acquire is used to get a connection that is
+// pooled or to return a new connection. New sessions are dialed without
+// holding the lock, so a slow server does not hold up the others.
+func (p *ConnPool) acquire(addr string, timeout time.Duration) (*Conn, error) {
+	p.Lock()
+	if p.shutdown {
+		p.Unlock()
+		return nil, ErrPoolShutdown
+	}
+	conns := p.liveConnsLocked(addr)
+	if len(conns) > 0 && len(conns)+p.dialing[addr] >= p.sessions {
+		c := leastLoaded(conns)
 		c.markForUse()
 		p.Unlock()
 		return c, nil
 	}
+	p.dialing[addr]++
+	p.stats.dials++
+	p.Unlock()
 
-	// Create new connection if it doesn't exist
 	c, err := p.getNewConn(addr, timeout)
+
+	p.Lock()
+	defer p.Unlock()
+	if p.dialing[addr]--; p.dialing[addr] == 0 {
+		delete(p.dialing, addr)
+	}
 	if err != nil {
+		p.stats.dialFailures++
+		p.telemetry.IncrCounter([]string{"pool", "dial_failures"}, 1)
 		return nil, err
 	}
-	p.pool[addr] = c
+	if p.shutdown {
+		c.Close()
+		return nil, ErrPoolShutdown
+	}
 
+	// Concurrent dials may have filled the pool in the meantime
+	if conns = p.liveConnsLocked(addr); len(conns) >= p.sessions {
+		c.Close()
+		c = leastLoaded(conns)
+		c.markForUse()
+		return c, nil
+	}
+	p.pool[addr] = append(conns, c)
+	p.setSizeGauge()
 	return c, nil
 }
 
+// liveConnsLocked drops the closed sessions of the address and returns the
+// others. The lock must be held.
+func (p *ConnPool) liveConnsLocked(addr string) []*Conn {
+	conns := p.pool[addr]
+	live := conns[:0]
+	for _, c := range conns {
+		if !c.session.IsClosed() {
+			live = append(live, c)
+		}
+	}
+	if len(live) == 0 {
+		delete(p.pool, addr)
+	} else if len(live) < len(conns) {
+		p.pool[addr] = live
+	}
+	if len(live) < len(conns) {
+		p.setSizeGauge()
+	}
+	return live
+}
+
+// leastLoaded returns the session with the fewest streams.
+func leastLoaded(conns []*Conn) *Conn {
+	best := conns[0]
+	for _, c := range conns[1:] {
+		if c.session.NumStreams() < best.session.NumStreams() {
+			best = c
+		}
+	}
+	return best
+}
+
 // getNewConn is used to return a new connection
 func (p *ConnPool) getNewConn(addr string, timeout time.Duration) (*Conn, error) {
+	p.Lock()
+	config, serverName, network := p.config, p.serverName, p.network
+	p.Unlock()
+
 	// Try to dial the conn
-	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", addr, p.config)
+	if serverName != nil {
+		config = config.Clone()
+		config.ServerName = serverName(addr)
+	}
+	raw, err := network.Dial(addr, timeout)
 	if err != nil {
 		return nil, err
 	}
+	conn := tls.Client(raw, config)
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+	if err = conn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
 
-	// Setup the logger
+	// Setup the logger. The pool checks the health of its sessions itself.
 	conf := yamux.DefaultConfig()
 	conf.LogOutput = p.logOutput
+	conf.EnableKeepAlive = false
 
 	// Create a multiplexed session
 	session, err := yamux.Client(conn, conf)
@@ -180,22 +386,38 @@ func (p *ConnPool) getNewConn(addr string, timeout time.Duration) (*Conn, error)
 	return c, nil
 }
 
-// clearConn is used to clear any cached connection, potentially in response to an error
+// clearConn is used to clear any cached connection in response to an error.
+// A session which failed is closed, which fails its other streams.
 func (p *ConnPool) clearConn(conn *Conn) {
-	// Ensure returned streams are closed
-	// atomic.StoreInt32(&conn.shouldClose, 1)
-
-	// Clear from the cache
 	p.Lock()
-	if c, ok := p.pool[conn.addr]; ok && c == conn {
-		delete(p.pool, conn.addr)
+	conns := p.pool[conn.addr]
+	for i, c := range conns {
+		if c == conn {
+			conns = append(conns[:i:i], conns[i+1:]...)
+			if len(conns) == 0 {
+				delete(p.pool, conn.addr)
+			} else {
+				p.pool[conn.addr] = conns
+			}
+			p.stats.evicted++
+			p.telemetry.IncrCounter([]string{"pool", "evicted"}, 1)
+			p.setSizeGauge()
+			break
+		}
 	}
+	p.Unlock()
 
-	// Close down immediately if idle
-	if conn.session.NumStreams() == 0 {
-		conn.Close()
+	conn.Close()
+}
+
+// setSizeGauge reports the number of pooled sessions. The lock must be
+// held.
+func (p *ConnPool) setSizeGauge() {
+	n := 0
+	for _, conns := range p.pool {
+		n += len(conns)
 	}
-	p.Unlock()
+	p.telemetry.SetGauge([]string{"pool", "conns"}, float32(n))
 }
 
 // getClient is used to get a usable client for an address
@@ -207,26 +429,111 @@ func (p *ConnPool) getClient(addr string, timeout time.Duration) (*Conn, error)
 	return conn, nil
 }
 
-func (p *ConnPool) dialRaft(addr string, timeout time.Duration) (net.Conn, error) {
-	// Get a usable client
-	conn, err := p.getClient(addr, timeout)
+// dial opens a stream of the given type to the server at the address. A
+// session which fails to open the stream is evicted, so the next dial
+// starts a new one.
+func (p *ConnPool) dial(addr string, t yamuxer.StreamType, timeout time.Duration) (net.Conn, error) {
+	release, err := p.reserveStream(timeout)
 	if err != nil {
-		return nil, fmt.Errorf("rpc error: %v", err)
+		return nil, err
 	}
 
-	// Return raft stream
-	return conn.dialRaft()
-}
-
-func (p *ConnPool) dialForwarding(addr string, timeout time.Duration) (net.Conn, error) {
 	// Get a usable client
 	conn, err := p.getClient(addr, timeout)
-	if err != nil {
-		return nil, fmt.Errorf("rpc error: %v", err)
+	if err == nil {
+		var stream net.Conn
+		if stream, err = conn.dial(t); err == nil {
+			if release == nil {
+				return stream, nil
+			}
+			return &pooledStream{Conn: stream, release: release}, nil
+		}
+		p.clearConn(conn)
+	} else {
+		err = fmt.Errorf("rpc error: %v", err)
+	}
+	if release != nil {
+		release()
+	}
+	return nil, err
+}
+
+// reserveStream waits up to the timeout for a stream to be available and
+// returns the function releasing it, or nil if the streams are unbounded.
+func (p *ConnPool) reserveStream(timeout time.Duration) (func(), error) {
+	p.Lock()
+	streams, telemetry := p.streams, p.telemetry
+	p.Unlock()
+	if streams == nil {
+		return nil, nil
 	}
 
-	// Return forwarding raft stream
-	return conn.dialForwarding()
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case streams <- struct{}{}:
+		return func() { <-streams }, nil
+	case <-expired:
+		telemetry.IncrCounter([]string{"pool", "exhausted"}, 1)
+		return nil, ErrTooManyStreams
+	case <-p.shutdownCh:
+		return nil, ErrPoolShutdown
+	}
+}
+
+// pooledStream releases its reservation when it is closed.
+type pooledStream struct {
+	net.Conn
+	release func()
+	once    sync.Once
+}
+
+func (s *pooledStream) Close() error {
+	s.once.Do(s.release)
+	return s.Conn.Close()
+}
+
+// checkHealth pings the sessions periodically and closes those which do
+// not answer, so they are not handed out any more.
+func (p *ConnPool) checkHealth() {
+	for {
+		p.Lock()
+		interval := p.healthInterval
+		p.Unlock()
+
+		select {
+		case <-p.shutdownCh:
+			return
+		case <-time.After(interval):
+		}
+
+		p.Lock()
+		var conns []*Conn
+		for _, cs := range p.pool {
+			conns = append(conns, cs...)
+		}
+		p.Unlock()
+
+		var wg sync.WaitGroup
+		for _, conn := range conns {
+			wg.Add(1)
+			go func(conn *Conn) {
+				defer wg.Done()
+				if err := conn.ping(interval); err != nil {
+					p.Lock()
+					p.stats.healthFailures++
+					p.telemetry.IncrCounter([]string{"pool", "health_failures"}, 1)
+					p.Unlock()
+					p.clearConn(conn)
+				}
+			}(conn)
+		}
+		wg.Wait()
+	}
 }
 
 // Reap is used to close conns open over maxTime
@@ -241,27 +548,34 @@ func (p *ConnPool) reap() {
 
 		// Reap all old conns
 		p.Lock()
-		var removed []string
+		reaped := 0
 		now := time.Now()
-		for host, conn := range p.pool {
-			// Skip recently used connections
-			if now.Sub(conn.lastUsed) < p.maxTime {
-				continue
+		for host, conns := range p.pool {
+			live := conns[:0]
+			for _, conn := range conns {
+				// Skip recently used connections and those with active
+				// streams
+				if now.Sub(conn.lastUsed) < p.maxTime || conn.session.NumStreams() > 0 {
+					live = append(live, conn)
+					continue
+				}
+
+				// Close the conn
+				conn.Close()
+				reaped++
 			}
 
-			// Skip connections with active streams
-			if conn.session.NumStreams() > 0 {
-				continue
-			}
-
-			// Close the conn
-			conn.Close()
-
 			// Remove from pool
-			removed = append(removed, host)
+			if len(live) == 0 {
+				delete(p.pool, host)
+			} else {
+				p.pool[host] = live
+			}
 		}
-		for _, host := range removed {
-			delete(p.pool, host)
+		if reaped > 0 {
+			p.stats.reaped += uint64(reaped)
+			p.telemetry.IncrCounter([]string{"pool", "reaped"}, float32(reaped))
+			p.setSizeGauge()
 		}
 		p.Unlock()
 	}
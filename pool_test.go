@@ -0,0 +1,186 @@
+package cerebrum
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/yamux"
+	"github.com/stretchr/testify/assert"
+)
+
+// testServer accepts pooled sessions and echoes their streams.
+type testServer struct {
+	listener net.Listener
+	lock     sync.Mutex
+	conns    []net.Conn
+}
+
+func newTestServer(t *testing.T) (*testServer, *tls.Config) {
+	cert, certPEM, keyPEM := testCert(t, "server")
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	assert.Nil(t, err)
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{pair}})
+	assert.Nil(t, err)
+
+	s := &testServer{listener: l}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			s.lock.Lock()
+			s.conns = append(s.conns, conn)
+			s.lock.Unlock()
+			session, _ := yamux.Server(conn, nil)
+			go func() {
+				for {
+					stream, err := session.Accept()
+					if err != nil {
+						return
+					}
+					go io.Copy(stream, stream)
+				}
+			}()
+		}
+	}()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	return s, &tls.Config{RootCAs: roots, ServerName: "server"}
+}
+
+// kill closes the accepted connections.
+func (s *testServer) kill() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+	s.conns = nil
+}
+
+func TestPool_Sessions(t *testing.T) {
+	server, config := newTestServer(t)
+	defer server.listener.Close()
+	pool := NewPool(nil, 0, config)
+	defer pool.Shutdown()
+	pool.SetSessions(2)
+	addr := server.listener.Addr().String()
+
+	// Streams are spread over the sessions
+	for i := 0; i < 4; i++ {
+		stream, err := pool.dial(addr, connForward, time.Second)
+		if !assert.Nil(t, err) {
+			return
+		}
+		defer stream.Close()
+	}
+	stats := pool.Stats()
+	assert.Equal(t, "1", stats["hosts"])
+	assert.Equal(t, "2", stats["sessions"])
+	assert.Equal(t, "4", stats["streams"])
+	assert.Equal(t, "2", stats["dials"])
+
+	// Dead sessions are not handed out
+	server.kill()
+	time.Sleep(50 * time.Millisecond)
+	stream, err := pool.dial(addr, connForward, time.Second)
+	if assert.Nil(t, err) {
+		stream.Close()
+	}
+	assert.Equal(t, "3", pool.Stats()["dials"])
+}
+
+func TestPool_MaxStreams(t *testing.T) {
+	server, config := newTestServer(t)
+	defer server.listener.Close()
+	pool := NewPool(nil, 0, config)
+	defer pool.Shutdown()
+	pool.SetMaxStreams(1)
+	addr := server.listener.Addr().String()
+
+	stream, err := pool.dial(addr, connForward, time.Second)
+	if !assert.Nil(t, err) {
+		return
+	}
+	_, err = pool.dial(addr, connForward, 20*time.Millisecond)
+	assert.Equal(t, ErrTooManyStreams, err)
+
+	// Closing a stream lets the next dial through
+	time.AfterFunc(20*time.Millisecond, func() { stream.Close() })
+	stream, err = pool.dial(addr, connForward, time.Second)
+	if assert.Nil(t, err) {
+		stream.Close()
+	}
+}
+
+// stallNetwork dials connections whose reads hang once stalled, like a
+// server which stopped answering.
+type stallNetwork struct {
+	TCPNetwork
+	stalled chan struct{}
+}
+
+func (n *stallNetwork) Dial(addr string, timeout time.Duration) (net.Conn, error) {
+	conn, err := n.TCPNetwork.Dial(addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &stallConn{Conn: conn, stalled: n.stalled, closed: make(chan struct{})}, nil
+}
+
+type stallConn struct {
+	net.Conn
+	stalled chan struct{}
+	closed  chan struct{}
+	once    sync.Once
+}
+
+func (c *stallConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	select {
+	case <-c.stalled:
+		<-c.closed
+		return 0, io.EOF
+	default:
+	}
+	return n, err
+}
+
+func (c *stallConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
+
+func TestPool_HealthCheck(t *testing.T) {
+	server, config := newTestServer(t)
+	defer server.listener.Close()
+	pool := NewPool(nil, 0, config)
+	defer pool.Shutdown()
+	network := &stallNetwork{stalled: make(chan struct{})}
+	pool.SetNetwork(network)
+	pool.SetHealthInterval(20 * time.Millisecond)
+	addr := server.listener.Addr().String()
+
+	stream, err := pool.dial(addr, connForward, time.Second)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer stream.Close()
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, "1", pool.Stats()["sessions"])
+
+	// Sessions which stop answering pings are evicted
+	close(network.stalled)
+	time.Sleep(100 * time.Millisecond)
+	stats := pool.Stats()
+	assert.Equal(t, "0", stats["sessions"])
+	assert.Equal(t, "1", stats["evicted"])
+	assert.Equal(t, "1", stats["health_failures"])
+}
@@ -0,0 +1,117 @@
+package cerebrum
+
+import (
+	"path/filepath"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// raftStoreMetricsInterval is how often the gauges of the Raft store are
+// emitted.
+const raftStoreMetricsInterval = 10 * time.Second
+
+// RaftStore is the log and stable store of Raft.
+type RaftStore interface {
+	raft.LogStore
+	raft.StableStore
+	Close() error
+}
+
+// RaftStoreBackend opens the RaftStore of a node in its Raft directory,
+// DataPath/raft.
+type RaftStoreBackend interface {
+	Open(dir string) (RaftStore, error)
+}
+
+// raftStoreBackends are the backends which can be named by raft_store in
+// configuration files.
+var raftStoreBackends = map[string]RaftStoreBackend{
+	"bolt":  BoltRaftStore{},
+	"inmem": InmemRaftStore{},
+}
+
+// BoltRaftStore keeps the Raft log and stable store in raft.db, in the
+// format of raft-boltdb. It is the default backend and the only one which
+// can be compacted.
+type BoltRaftStore struct{}
+
+func (BoltRaftStore) Open(dir string) (RaftStore, error) {
+	store, err := openBoltStore(filepath.Join(dir, "raft.db"))
+	if err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// InmemRaftStore keeps the Raft log and stable store in memory, for tests
+// and ephemeral clusters. They are lost when the node stops, so a restarted
+// node must be removed from the cluster and join again.
+type InmemRaftStore struct{}
+
+func (InmemRaftStore) Open(dir string) (RaftStore, error) {
+	return &inmemRaftStore{raft.NewInmemStore()}, nil
+}
+
+type inmemRaftStore struct {
+	*raft.InmemStore
+}
+
+func (s *inmemRaftStore) Close() error {
+	return nil
+}
+
+// raftStoreCompactor is implemented by stores which can be compacted.
+type raftStoreCompactor interface {
+	Compact() (before, after int64, err error)
+	stats() (boltStats, error)
+}
+
+// monitorRaftStore emits the gauges of the Raft store and compacts it every
+// RaftCompactInterval until the node stops. Failed compactions are logged
+// and tried again at the next interval.
+func (c *cerebrum) monitorRaftStore() {
+	metricsTicker := time.NewTicker(raftStoreMetricsInterval)
+	defer metricsTicker.Stop()
+
+	var compactCh <-chan time.Time
+	if c.config.RaftCompactInterval > 0 {
+		compactTicker := time.NewTicker(c.config.RaftCompactInterval)
+		defer compactTicker.Stop()
+		compactCh = compactTicker.C
+	}
+
+	for {
+		select {
+		case <-c.context.Done():
+			return
+		case <-metricsTicker.C:
+			c.emitRaftStoreMetrics()
+		case <-compactCh:
+			c.compactRaftStore()
+		}
+	}
+}
+
+// emitRaftStoreMetrics emits the range of the stored logs and, for bolt,
+// the size and free pages of the file.
+func (c *cerebrum) emitRaftStoreMetrics() {
+	if first, err := c.raftStore.FirstIndex(); err == nil {
+		c.telemetry.SetGauge([]string{"raft", "store", "first_index"}, float32(first))
+	}
+	if last, err := c.raftStore.LastIndex(); err == nil {
+		c.telemetry.SetGauge([]string{"raft", "store", "last_index"}, float32(last))
+	}
+	compactor, ok := c.raftStore.(raftStoreCompactor)
+	if !ok {
+		return
+	}
+	stats, err := compactor.stats()
+	if err != nil {
+		c.logger.Warn("Failed to read raft store stats", "err", err)
+		return
+	}
+	c.telemetry.SetGauge([]string{"raft", "store", "size"}, float32(stats.Size))
+	c.telemetry.SetGauge([]string{"raft", "store", "free_pages"}, float32(stats.FreePages))
+	c.telemetry.SetGauge([]string{"raft", "store", "pending_pages"}, float32(stats.PendingPages))
+}
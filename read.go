@@ -0,0 +1,205 @@
+package cerebrum
+
+import (
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+const (
+	// defaultQueryWait is used for blocking reads without a MaxWait.
+	defaultQueryWait = 5 * time.Minute
+
+	// maxQueryWait is the longest a blocking read may wait.
+	maxQueryWait = 10 * time.Minute
+)
+
+// ReadMode is the consistency of a read.
+type ReadMode uint8
+
+const (
+	// ReadDefault reads the local state but fails if there is no known
+	// leader.
+	ReadDefault ReadMode = iota
+
+	// ReadStale reads the local state, even without a leader. The result may
+	// be arbitrarily stale.
+	ReadStale
+
+	// ReadConsistent verifies leadership with a quorum before reading. It
+	// must be served by the leader.
+	ReadConsistent
+)
+
+// QueryOptions control the consistency and blocking of a read.
+type QueryOptions struct {
+	Mode ReadMode
+
+	// MinIndex blocks the read until the state index is greater than it or
+	// MaxWait expires. Zero disables blocking.
+	MinIndex uint64
+	MaxWait  time.Duration
+
+	// Token is the ACL token the read is authorized with.
+	Token string
+}
+
+// QueryMeta describes the state a read was served from.
+type QueryMeta struct {
+	Index       uint64
+	KnownLeader bool
+	LastContact time.Duration
+}
+
+// Reader reads the replicated state.
+type Reader interface {
+
+	// Leader returns the Raft address of the leader or an empty string.
+	Leader() string
+
+	// CatalogNodes lists the registered nodes.
+	CatalogNodes(q *QueryOptions) ([]*NodeEntry, *QueryMeta, error)
+
+	// KVRead returns the entry for a key, or all entries under a prefix if
+	// recurse is set.
+	KVRead(key string, recurse bool, q *QueryOptions) ([]*KVEntry, *QueryMeta, error)
+
+	// AuditLog returns the retained audit events, oldest first. Only events
+	// after MinIndex are returned, so blocking reads follow the log.
+	AuditLog(q *QueryOptions) ([]*AuditEvent, *QueryMeta, error)
+}
+
+func (c *cerebrum) Leader() string {
+	return c.raft.Leader()
+}
+
+func (c *cerebrum) CatalogNodes(q *QueryOptions) (nodes []*NodeEntry, meta *QueryMeta, err error) {
+	authz, err := c.resolveQuery(q)
+	if err != nil {
+		return
+	}
+	if !authz.CatalogRead() {
+		return nil, nil, ErrPermissionDenied
+	}
+	meta, err = c.blockingRead(q, func() {
+		nodes = c.state.Nodes()
+	})
+	return
+}
+
+// KVRead leaves out the entries under the prefix which the token may not
+// read.
+func (c *cerebrum) KVRead(key string, recurse bool, q *QueryOptions) (entries []*KVEntry, meta *QueryMeta, err error) {
+	authz, err := c.resolveQuery(q)
+	if err != nil {
+		return
+	}
+	if !recurse && !authz.KVRead(key) {
+		return nil, nil, ErrPermissionDenied
+	}
+	meta, err = c.blockingRead(q, func() {
+		if !recurse {
+			if entry := c.state.KVGet(key); entry != nil {
+				entries = []*KVEntry{entry}
+			}
+			return
+		}
+		for _, entry := range c.state.KVList(key) {
+			if authz.KVRead(entry.Key) {
+				entries = append(entries, entry)
+			}
+		}
+	})
+	return
+}
+
+// AuditLog requires operator read access.
+func (c *cerebrum) AuditLog(q *QueryOptions) (events []*AuditEvent, meta *QueryMeta, err error) {
+	authz, err := c.resolveQuery(q)
+	if err != nil {
+		return
+	}
+	if !authz.OperatorRead() {
+		return nil, nil, ErrPermissionDenied
+	}
+	meta, err = c.blockingRead(q, func() {
+		var minIndex uint64
+		if q != nil {
+			minIndex = q.MinIndex
+		}
+		events = c.state.AuditEvents(minIndex)
+	})
+	return
+}
+
+// resolveQuery resolves the token of the query.
+func (c *cerebrum) resolveQuery(q *QueryOptions) (Authorizer, error) {
+	if q == nil {
+		return c.acl.ResolveToken("")
+	}
+	return c.acl.ResolveToken(q.Token)
+}
+
+// blockingRead checks the read mode, waits for the state to pass MinIndex and
+// then runs the read.
+func (c *cerebrum) blockingRead(q *QueryOptions, read func()) (*QueryMeta, error) {
+	if q == nil {
+		q = &QueryOptions{}
+	}
+
+	switch q.Mode {
+	case ReadDefault:
+		if c.raft.Leader() == "" {
+			return nil, ErrNoLeader
+		}
+	case ReadConsistent:
+		if c.raft.State() != raft.Leader {
+			return nil, raft.ErrNotLeader
+		}
+		if err := c.raft.VerifyLeader().Error(); err != nil {
+			return nil, err
+		}
+		// A new leader may not have applied the entries committed by its
+		// predecessors yet
+		if !c.isReadyForConsistentReads() {
+			return nil, ErrNotReadyForConsistentReads
+		}
+	}
+
+	if q.MinIndex > 0 {
+		wait := q.MaxWait
+		if wait <= 0 {
+			wait = defaultQueryWait
+		} else if wait > maxQueryWait {
+			wait = maxQueryWait
+		}
+		timeout := time.After(wait)
+
+	WAIT:
+		for {
+			watch := c.state.Watch()
+			if c.state.Index() > q.MinIndex {
+				break
+			}
+			select {
+			case <-watch:
+			case <-timeout:
+				break WAIT
+			case <-c.context.Done():
+				break WAIT
+			}
+		}
+	}
+
+	meta := &QueryMeta{
+		Index:       c.state.Index(),
+		KnownLeader: c.raft.Leader() != "",
+	}
+	if c.raft.State() != raft.Leader {
+		if last := c.raft.LastContact(); !last.IsZero() {
+			meta.LastContact = time.Now().Sub(last)
+		}
+	}
+	read()
+	return meta, nil
+}
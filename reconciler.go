@@ -12,15 +12,20 @@ const (
 type Reconciler struct {
 	ReconcileCh chan serf.Member
 	IsLeader    func() bool
+	Telemetry   *Telemetry
 }
 
 // Reconcile is used to reconcile Serf events with the strongly
-// consistent store if we are the current leader
+// consistent store if we are the current leader. Members are dropped if the
+// queue is full; the leader reconciles all members every ReconcileInterval,
+// which catches up with them.
 func (r *Reconciler) Reconcile(m serf.Member) {
 	if r.IsLeader() {
 		select {
 		case r.ReconcileCh <- m:
 		default:
+			r.Telemetry.IncrCounter([]string{"reconcile", "dropped"}, 1)
 		}
+		r.Telemetry.SetGauge([]string{"reconcile", "queue"}, float32(len(r.ReconcileCh)))
 	}
 }
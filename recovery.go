@@ -0,0 +1,106 @@
+package cerebrum
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/hashicorp/raft"
+	log "github.com/mgutz/logxi/v1"
+)
+
+const (
+	// PeersRecoveryFile is the file an operator places in the Raft state
+	// directory to force a new peer set when quorum has been lost.
+	PeersRecoveryFile = "peers.json"
+
+	// peersAppliedSuffix is appended to the recovery file once it has been
+	// applied so it is not applied again on the next start.
+	peersAppliedSuffix = ".applied"
+)
+
+// readPeersFile reads and validates a peers.json recovery file. The file must
+// contain a JSON array of unique "host:port" Raft addresses.
+func readPeersFile(path string) ([]string, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var peers []string
+	if err = json.Unmarshal(buf, &peers); err != nil {
+		return nil, fmt.Errorf("invalid peers file %s: %v", path, err)
+	}
+	if len(peers) == 0 {
+		return nil, fmt.Errorf("invalid peers file %s: %v", path, ErrNoPeers)
+	}
+
+	seen := make(map[string]bool, len(peers))
+	for _, peer := range peers {
+		if _, err = net.ResolveTCPAddr("tcp", peer); err != nil {
+			return nil, fmt.Errorf("invalid peer '%s' in %s: %v", peer, path, err)
+		}
+		if seen[peer] {
+			return nil, fmt.Errorf("duplicate peer '%s' in %s", peer, path)
+		}
+		seen[peer] = true
+	}
+	return peers, nil
+}
+
+// recoverPeers checks the Raft state directory for a peers.json recovery file.
+// If one exists, it is validated, written to the peer store and renamed so it
+// is only applied once. It returns true if a recovery was performed.
+func recoverPeers(dir string, local string, store raft.PeerStore, logger log.Logger) (bool, error) {
+	path := filepath.Join(dir, PeersRecoveryFile)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	peers, err := readPeersFile(path)
+	if err != nil {
+		return false, err
+	}
+	if !raft.PeerContained(peers, local) {
+		logger.Warn("recovered peers do not include the local node", "local", local, "peers", peers)
+	}
+
+	if err = store.SetPeers(peers); err != nil {
+		return false, err
+	}
+	if err = os.Rename(path, path+peersAppliedSuffix); err != nil {
+		return false, err
+	}
+	logger.Warn("recovered raft peers from file", "file", path, "peers", peers)
+	return true, nil
+}
+
+// migratePeers moves the peer store of older versions, which raft.JSONPeers
+// kept at peers.json in the Raft state directory, into the peer store
+// directory. It is only moved while the new peer store does not exist, so it
+// is not mistaken for a recovery file. It returns true if it was moved.
+func migratePeers(dir, peersDir string, logger log.Logger) (bool, error) {
+	legacy := filepath.Join(dir, PeersRecoveryFile)
+	if _, err := os.Stat(legacy); os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	path := filepath.Join(peersDir, PeersRecoveryFile)
+	if _, err := os.Stat(path); err == nil {
+		return false, nil
+	} else if !os.IsNotExist(err) {
+		return false, err
+	}
+
+	if err := os.Rename(legacy, path); err != nil {
+		return false, err
+	}
+	logger.Info("migrated raft peer store", "from", legacy, "to", path)
+	return true, nil
+}
@@ -0,0 +1,104 @@
+package cerebrum
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/raft"
+	log "github.com/mgutz/logxi/v1"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecoverPeers_NoFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cerebrum")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	store := &raft.StaticPeers{StaticPeers: []string{"127.0.0.1:9000"}}
+	recovered, err := recoverPeers(dir, "127.0.0.1:9000", store, &log.NullLogger{})
+	assert.Nil(t, err)
+	assert.False(t, recovered)
+
+	peers, _ := store.Peers()
+	assert.Equal(t, []string{"127.0.0.1:9000"}, peers)
+}
+
+func TestRecoverPeers_Apply(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cerebrum")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, PeersRecoveryFile)
+	err = ioutil.WriteFile(path, []byte(`["127.0.0.1:9000", "127.0.0.2:9000"]`), 0644)
+	assert.Nil(t, err)
+
+	store := &raft.StaticPeers{StaticPeers: []string{"127.0.0.1:9000", "127.0.0.3:9000"}}
+	recovered, err := recoverPeers(dir, "127.0.0.1:9000", store, &log.NullLogger{})
+	assert.Nil(t, err)
+	assert.True(t, recovered)
+
+	peers, _ := store.Peers()
+	assert.Equal(t, []string{"127.0.0.1:9000", "127.0.0.2:9000"}, peers)
+
+	// The recovery file is renamed so it is not applied twice
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(path + peersAppliedSuffix)
+	assert.Nil(t, err)
+}
+
+func TestRecoverPeers_Invalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cerebrum")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, PeersRecoveryFile)
+	for _, contents := range []string{`{}`, `[]`, `["not-an-address"]`, `["127.0.0.1:9000", "127.0.0.1:9000"]`} {
+		err = ioutil.WriteFile(path, []byte(contents), 0644)
+		assert.Nil(t, err)
+
+		store := &raft.StaticPeers{}
+		recovered, err := recoverPeers(dir, "127.0.0.1:9000", store, &log.NullLogger{})
+		assert.NotNil(t, err, contents)
+		assert.False(t, recovered)
+
+		// Invalid files are left in place for the operator to fix
+		_, err = os.Stat(path)
+		assert.Nil(t, err)
+	}
+}
+
+func TestMigratePeers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cerebrum")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	peersDir := filepath.Join(dir, "peers")
+	assert.Nil(t, os.MkdirAll(peersDir, 0755))
+
+	// Nothing to migrate
+	migrated, err := migratePeers(dir, peersDir, &log.NullLogger{})
+	assert.Nil(t, err)
+	assert.False(t, migrated)
+
+	// The peer store of older versions is moved, even if it is empty
+	legacy := filepath.Join(dir, PeersRecoveryFile)
+	assert.Nil(t, ioutil.WriteFile(legacy, []byte(`null`), 0644))
+	migrated, err = migratePeers(dir, peersDir, &log.NullLogger{})
+	assert.Nil(t, err)
+	assert.True(t, migrated)
+	_, err = os.Stat(legacy)
+	assert.True(t, os.IsNotExist(err))
+	recovered, err := recoverPeers(dir, "127.0.0.1:9000", &raft.StaticPeers{}, &log.NullLogger{})
+	assert.Nil(t, err)
+	assert.False(t, recovered)
+
+	// Once the new store exists, peers.json is a recovery file
+	assert.Nil(t, ioutil.WriteFile(legacy, []byte(`["127.0.0.1:9000"]`), 0644))
+	migrated, err = migratePeers(dir, peersDir, &log.NullLogger{})
+	assert.Nil(t, err)
+	assert.False(t, migrated)
+	_, err = os.Stat(legacy)
+	assert.Nil(t, err)
+}
@@ -0,0 +1,162 @@
+package cerebrum
+
+import (
+	"crypto/tls"
+	"net"
+	"reflect"
+	"strings"
+	"time"
+
+	log "github.com/mgutz/logxi/v1"
+)
+
+// reservedTags are the Serf tags set by Cerebrum.
+var reservedTags = []string{"id", "role", "dc", "port"}
+
+// ReloadError lists the fields which cannot change without a restart.
+type ReloadError struct {
+	Fields []string
+}
+
+func (e *ReloadError) Error() string {
+	return "restart required to change: " + strings.Join(e.Fields, ", ")
+}
+
+// Reload applies the TLSConfig, ReconcileInterval, Tags and log levels of the
+// new configuration. Services, the FSM and the handlers are not reloaded.
+func (c *cerebrum) Reload(nc *Config) error {
+	c.reloadLock.Lock()
+	defer c.reloadLock.Unlock()
+
+	if nc.LogOutput == nil {
+		nc.LogOutput = c.config.LogOutput
+	}
+	if nc.Logger == nil {
+		nc.Logger = c.config.Logger
+	}
+	if err := nc.Validate(); err != nil {
+		return err
+	}
+	if fields := restartFields(c.config, nc); len(fields) > 0 {
+		return &ReloadError{fields}
+	}
+
+	if !reflect.DeepEqual(c.config.Tags, nc.Tags) {
+		if err := c.serf.SetTags(c.serfTags(nc.Tags)); err != nil {
+			return err
+		}
+		c.logger.Info("Reloaded tags", "tags", nc.Tags)
+	}
+
+	c.configLock.Lock()
+	c.config.TLSConfig = nc.TLSConfig
+	c.config.ReconcileInterval = nc.ReconcileInterval
+	c.config.Tags = nc.Tags
+	c.config.LogLevel = nc.LogLevel
+	c.config.LogLevels = nc.LogLevels
+	c.configLock.Unlock()
+
+	c.pool.SetTLSConfig(nc.TLSConfig)
+	c.logging.SetLevels(nc.LogLevel, nc.LogLevels)
+	c.logger.Info("Reloaded configuration")
+	return nil
+}
+
+// restartFields returns the names of the fields which differ but cannot be
+// reloaded.
+func restartFields(old, nc *Config) []string {
+	var fields []string
+	check := func(name string, a, b interface{}) {
+		if !reflect.DeepEqual(a, b) {
+			fields = append(fields, name)
+		}
+	}
+
+	check("Bootstrap", old.Bootstrap, nc.Bootstrap)
+	check("NodeID", old.NodeID, nc.NodeID)
+	check("NodeName", old.NodeName, nc.NodeName)
+	check("DataCenter", old.DataCenter, nc.DataCenter)
+	check("DataPath", old.DataPath, nc.DataPath)
+	check("GossipBindAddr", old.GossipBindAddr, nc.GossipBindAddr)
+	check("GossipBindPort", old.GossipBindPort, nc.GossipBindPort)
+	check("GossipAdvertiseAddr", old.GossipAdvertiseAddr, nc.GossipAdvertiseAddr)
+	check("GossipAdvertisePort", old.GossipAdvertisePort, nc.GossipAdvertisePort)
+	check("RaftBindAddr", old.RaftBindAddr, nc.RaftBindAddr)
+	check("AdminBindAddr", old.AdminBindAddr, nc.AdminBindAddr)
+	check("HTTPBindAddr", old.HTTPBindAddr, nc.HTTPBindAddr)
+	check("HealthBindAddr", old.HealthBindAddr, nc.HealthBindAddr)
+	check("HealthMaxIndexLag", old.HealthMaxIndexLag, nc.HealthMaxIndexLag)
+	check("HealthMaxLastContact", old.HealthMaxLastContact, nc.HealthMaxLastContact)
+	check("SnapshotsRetained", old.SnapshotsRetained, nc.SnapshotsRetained)
+	check("LogCacheSize", old.LogCacheSize, nc.LogCacheSize)
+	check("ConnectionDeadline", old.ConnectionDeadline, nc.ConnectionDeadline)
+	check("EnqueueTimeout", old.EnqueueTimeout, nc.EnqueueTimeout)
+	check("ForwardTimeout", old.ForwardTimeout, nc.ForwardTimeout)
+	check("ForwardBackoff", old.ForwardBackoff, nc.ForwardBackoff)
+	check("EncryptKey", old.EncryptKey, nc.EncryptKey)
+	check("ACLDefaultPolicy", old.ACLDefaultPolicy, nc.ACLDefaultPolicy)
+	check("ACLMasterToken", old.ACLMasterToken, nc.ACLMasterToken)
+	check("StatsdAddr", old.StatsdAddr, nc.StatsdAddr)
+	check("StatsiteAddr", old.StatsiteAddr, nc.StatsiteAddr)
+	check("PrometheusMetrics", old.PrometheusMetrics, nc.PrometheusMetrics)
+	check("DisableHostname", old.DisableHostname, nc.DisableHostname)
+	check("GlobalMetrics", old.GlobalMetrics, nc.GlobalMetrics)
+	check("MetricSinks", old.MetricSinks, nc.MetricSinks)
+	check("TraceFile", old.TraceFile, nc.TraceFile)
+	check("TraceExporter", old.TraceExporter, nc.TraceExporter)
+	check("Logger", old.Logger, nc.Logger)
+	check("Network", old.Network, nc.Network)
+	check("RaftStore", old.RaftStore, nc.RaftStore)
+	check("RaftCompactInterval", old.RaftCompactInterval, nc.RaftCompactInterval)
+	check("PoolSessions", old.PoolSessions, nc.PoolSessions)
+	check("PoolMaxStreams", old.PoolMaxStreams, nc.PoolMaxStreams)
+	check("PoolHealthInterval", old.PoolHealthInterval, nc.PoolHealthInterval)
+
+	// Raft modifies the logger and single node settings of its config
+	if old.RaftConfig != nil && nc.RaftConfig != nil {
+		o, n := *old.RaftConfig, *nc.RaftConfig
+		o.LogOutput, n.LogOutput = nil, nil
+		o.EnableSingleNode, n.EnableSingleNode = false, false
+		check("RaftConfig", o, n)
+	}
+	return fields
+}
+
+// serfTags merges the user tags with the reserved tags.
+func (c *cerebrum) serfTags(user map[string]string) map[string]string {
+	tags := make(map[string]string, len(user)+len(reservedTags))
+	for k, v := range user {
+		tags[k] = v
+	}
+	tags["id"] = c.config.NodeID
+	tags["role"] = "cerebrum-server"
+	tags["dc"] = c.config.DataCenter
+	if _, port, err := net.SplitHostPort(c.config.RaftBindAddr); err == nil {
+		tags["port"] = port
+	}
+	return tags
+}
+
+// serverTLSConfig returns the current TLS configuration for an incoming
+// connection, identifying the peer's certificate.
+func (c *cerebrum) serverTLSConfig(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	c.configLock.RLock()
+	config := c.config.TLSConfig.Clone()
+	c.configLock.RUnlock()
+
+	config.VerifyConnection = c.verifyPeer(hello.Conn)
+	return config, nil
+}
+
+// reconcileInterval returns the current ReconcileInterval.
+func (c *cerebrum) reconcileInterval() time.Duration {
+	c.configLock.RLock()
+	defer c.configLock.RUnlock()
+	return c.config.ReconcileInterval
+}
+
+// newLogger returns the logger of a component, whose level follows LogLevel
+// and LogLevels.
+func (c *cerebrum) newLogger(name string) log.Logger {
+	return c.logging.Named(name)
+}
@@ -0,0 +1,37 @@
+package cerebrum
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReload_RestartFields(t *testing.T) {
+	old := DefaultConfig()
+	old.RaftConfig.LogOutput = ioutil.Discard
+	old.RaftConfig.EnableSingleNode = true
+
+	nc := DefaultConfig()
+	nc.ReconcileInterval = time.Second
+	nc.LogLevel = "debug"
+	nc.Tags = map[string]string{"zone": "a"}
+	assert.Empty(t, restartFields(old, nc))
+
+	nc.NodeID = "other"
+	nc.RaftBindAddr = "127.0.0.1:9300"
+	nc.RaftConfig = raft.DefaultConfig()
+	nc.RaftConfig.ElectionTimeout = time.Minute
+	assert.Equal(t, []string{"NodeID", "RaftBindAddr", "RaftConfig"}, restartFields(old, nc))
+
+	err := &ReloadError{restartFields(old, nc)}
+	assert.Equal(t, "restart required to change: NodeID, RaftBindAddr, RaftConfig", err.Error())
+}
+
+func TestReload_SerfTags(t *testing.T) {
+	c := &cerebrum{config: &Config{NodeID: "n1", DataCenter: "dc1", RaftBindAddr: "127.0.0.1:8300"}}
+	tags := c.serfTags(map[string]string{"zone": "a"})
+	assert.Equal(t, map[string]string{"zone": "a", "id": "n1", "role": "cerebrum-server", "dc": "dc1", "port": "8300"}, tags)
+}
@@ -0,0 +1,423 @@
+package cerebrum
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-msgpack/codec"
+	"github.com/hashicorp/raft"
+	log "github.com/mgutz/logxi/v1"
+	"golang.org/x/net/context"
+)
+
+// Defaults of the RPC client.
+const (
+	DefaultRPCTimeout = 10 * time.Second
+	DefaultRPCBackoff = 50 * time.Millisecond
+)
+
+// RPCHandler serves the calls of a method. It decodes the request with
+// call.Decode and returns the response, or sends a stream of responses with
+// call.Send and returns nil. The context expires with the deadline of the
+// caller.
+type RPCHandler func(ctx context.Context, call *RPCCall) (interface{}, error)
+
+// RPCCall is a call received by an RPCHandler.
+type RPCCall struct {
+	// Method is the name of the called method.
+	Method string
+
+	// Peer is the verified identity of the caller.
+	Peer Identity
+
+	dec *codec.Decoder
+	enc *codec.Encoder
+}
+
+// Decode decodes the request into v. The request is skipped if v is nil.
+func (c *RPCCall) Decode(v interface{}) error {
+	if v == nil {
+		var discard interface{}
+		v = &discard
+	}
+	return c.dec.Decode(v)
+}
+
+// Send streams a response to the caller ahead of the one returned by the
+// handler.
+func (c *RPCCall) Send(v interface{}) error {
+	return writeRPCFrame(c.enc, &rpcResponseHeader{Body: true}, v)
+}
+
+// rpcRequestHeader precedes the request of each call. Every call is made on
+// its own stream.
+type rpcRequestHeader struct {
+	Method string
+
+	// Deadline is the deadline of the caller in Unix nanoseconds, or zero.
+	Deadline int64
+
+	Span SpanContext
+}
+
+// rpcResponseHeader precedes each response. The handler's result is sent
+// with End set; responses sent before it are streamed.
+type rpcResponseHeader struct {
+	Error string
+
+	// Leader is the address of the leader known to a node which refused a
+	// call for the leader.
+	Leader string
+
+	Body bool
+	End  bool
+}
+
+// rpcErrors are the errors which are returned as themselves by callers.
+var rpcErrors = []error{
+	ErrNoLeader, ErrPermissionDenied, ErrACLNotFound, ErrUnknownRPCMethod, ErrRPCMethodRegistered,
+	ErrNotForwardable, ErrStaleSequence, raft.ErrNotLeader, raft.ErrLeadershipLost,
+	raft.ErrEnqueueTimeout, context.DeadlineExceeded, context.Canceled,
+}
+
+// rpcError returns the error of a response.
+func rpcError(msg string) error {
+	for _, err := range rpcErrors {
+		if err.Error() == msg {
+			return err
+		}
+	}
+	return errors.New(msg)
+}
+
+// rpcMethod is a registered method.
+type rpcMethod struct {
+	handler RPCHandler
+	leader  bool
+}
+
+// RPC serves the methods registered on a node over RPC streams and calls
+// the methods of other nodes through the connection pool. Requests and
+// responses are encoded with msgpack.
+type RPC struct {
+	raft       RaftApplier
+	dialer     Dialer
+	identities *identities
+	tracer     *Tracer
+	telemetry  *Telemetry
+	logger     log.Logger
+
+	// Timeout bounds calls whose context has no deadline. It defaults to
+	// DefaultRPCTimeout.
+	Timeout time.Duration
+
+	// Backoff is how long calls for the leader wait before trying again
+	// during an election. It defaults to DefaultRPCBackoff.
+	Backoff time.Duration
+
+	lock    sync.RWMutex
+	methods map[string]rpcMethod
+}
+
+// NewRPC creates the RPC server and client of a node.
+func NewRPC(r RaftApplier, d Dialer, ids *identities, t *Tracer, m *Telemetry, l log.Logger) *RPC {
+	return &RPC{
+		raft:       r,
+		dialer:     d,
+		identities: ids,
+		tracer:     t,
+		telemetry:  m,
+		logger:     l,
+		Timeout:    DefaultRPCTimeout,
+		Backoff:    DefaultRPCBackoff,
+		methods:    make(map[string]rpcMethod),
+	}
+}
+
+// Register serves a method on the node.
+func (r *RPC) Register(method string, h RPCHandler) error {
+	return r.register(method, rpcMethod{h, false})
+}
+
+// RegisterLeader serves a method on the leader. Other nodes refuse its calls
+// with raft.ErrNotLeader, which CallLeader retries on the leader.
+func (r *RPC) RegisterLeader(method string, h RPCHandler) error {
+	return r.register(method, rpcMethod{h, true})
+}
+
+func (r *RPC) register(name string, m rpcMethod) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if _, ok := r.methods[name]; ok {
+		return ErrRPCMethodRegistered
+	}
+	r.methods[name] = m
+	return nil
+}
+
+// Handle serves a call received on an RPC stream.
+func (r *RPC) Handle(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	var handle codec.MsgpackHandle
+	call := &RPCCall{
+		dec: codec.NewDecoder(conn, &handle),
+		enc: codec.NewEncoder(conn, &handle),
+	}
+
+	var req rpcRequestHeader
+	if err := call.dec.Decode(&req); err != nil {
+		r.logger.Warn("Failed to decode RPC request", "err", err)
+		return
+	}
+	call.Method = req.Method
+	call.Peer, _ = r.identities.get(conn.RemoteAddr())
+	if req.Deadline != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, time.Unix(0, req.Deadline))
+		defer cancel()
+		conn.SetDeadline(time.Unix(0, req.Deadline))
+	}
+
+	span := r.tracer.continueSpan(req.Span, "rpc:"+req.Method)
+	span.SetAttribute("peer", conn.RemoteAddr().String())
+	ctx = ContextWithSpan(ctx, span.Context())
+	defer r.telemetry.MeasureSince([]string{"rpc", "serve"}, time.Now())
+
+	resp := &rpcResponseHeader{End: true}
+	body, err := r.serve(ctx, call)
+	if err != nil {
+		r.telemetry.IncrCounter([]string{"rpc", "serve", "errors"}, 1)
+		resp.Error = err.Error()
+		if err == raft.ErrNotLeader {
+			resp.Leader = r.raft.Leader()
+		}
+	}
+	span.Finish(err)
+	resp.Body = body != nil
+	if err = writeRPCFrame(call.enc, resp, body); err != nil {
+		r.logger.Warn("Failed to send RPC response", "method", req.Method, "err", err)
+	}
+}
+
+func (r *RPC) serve(ctx context.Context, call *RPCCall) (interface{}, error) {
+	r.lock.RLock()
+	m, ok := r.methods[call.Method]
+	r.lock.RUnlock()
+	if !ok {
+		return nil, ErrUnknownRPCMethod
+	}
+	if m.leader && r.raft.State() != raft.Leader {
+		return nil, raft.ErrNotLeader
+	}
+	return m.handler(ctx, call)
+}
+
+// Call calls a method on the node at the Raft address and decodes the
+// response into resp, which may be nil. Streamed responses are decoded into
+// resp in turn.
+func (r *RPC) Call(ctx context.Context, addr, method string, req, resp interface{}) error {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+	_, _, err := r.call(ctx, addr, method, req, resp)
+	return err
+}
+
+// CallLeader calls a method on the leader. Calls are retried while there is
+// no leader, a node refuses the call as it is not the leader or the request
+// could not be sent, until the context expires.
+func (r *RPC) CallLeader(ctx context.Context, method string, req, resp interface{}) error {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	var hint string
+	for {
+		addr := hint
+		if addr == "" {
+			addr = r.raft.Leader()
+		}
+
+		var err error
+		sent := false
+		hint = ""
+		if addr == "" {
+			err = ErrNoLeader
+		} else if sent, hint, err = r.call(ctx, addr, method, req, resp); sent && !isLeaderError(err) {
+			return err
+		}
+
+		r.telemetry.IncrCounter([]string{"rpc", "leader_retries"}, 1)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(r.Backoff):
+		}
+	}
+}
+
+// isLeaderError reports whether a call may succeed on the next leader.
+func isLeaderError(err error) bool {
+	return err == ErrNoLeader || err == raft.ErrNotLeader || err == raft.ErrLeadershipLost
+}
+
+// call makes a call. It reports whether the request was sent, and returns
+// the leader hint of a refused call.
+func (r *RPC) call(ctx context.Context, addr, method string, req, resp interface{}) (bool, string, error) {
+	s, err := r.Stream(ctx, addr, method, req)
+	if err != nil {
+		return false, "", err
+	}
+	defer s.Close()
+	for {
+		if err = s.Recv(resp); err == io.EOF {
+			return true, "", nil
+		} else if err != nil {
+			return true, s.leader, err
+		}
+	}
+}
+
+// Stream calls a method on the node at the Raft address and returns its
+// stream of responses. The stream must be closed.
+func (r *RPC) Stream(ctx context.Context, addr, method string, req interface{}) (*RPCStream, error) {
+	span, ctx := r.tracer.StartSpan(ctx, "rpc:"+method)
+	span.SetAttribute("addr", addr)
+	s, err := r.stream(ctx, addr, method, req)
+	if err != nil {
+		r.telemetry.IncrCounter([]string{"rpc", "call", "errors"}, 1)
+		span.Finish(err)
+		return nil, err
+	}
+	s.span = span
+	return s, nil
+}
+
+func (r *RPC) stream(ctx context.Context, addr, method string, req interface{}) (*RPCStream, error) {
+	timeout := r.Timeout
+	deadline, ok := ctx.Deadline()
+	if ok {
+		timeout = deadline.Sub(time.Now())
+		if timeout <= 0 {
+			return nil, context.DeadlineExceeded
+		}
+	}
+	conn, err := r.dialer.Dial(connRPC, addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	header := rpcRequestHeader{Method: method}
+	header.Span, _ = SpanFromContext(ctx)
+	if ok {
+		header.Deadline = deadline.UnixNano()
+		conn.SetDeadline(deadline)
+	}
+	var handle codec.MsgpackHandle
+	enc := codec.NewEncoder(conn, &handle)
+	if err = enc.Encode(&header); err == nil {
+		err = enc.Encode(req)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// Cancelling the context aborts the call
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	return &RPCStream{conn: conn, dec: codec.NewDecoder(conn, &handle), ctx: ctx, done: done}, nil
+}
+
+func (r *RPC) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok || r.Timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, r.Timeout)
+}
+
+// RPCStream receives the responses of a call.
+type RPCStream struct {
+	conn   net.Conn
+	dec    *codec.Decoder
+	ctx    context.Context
+	span   *Span
+	leader string
+	err    error
+	done   chan struct{}
+	once   sync.Once
+}
+
+// Recv decodes the next response into v, which may be nil. It returns
+// io.EOF after the last response, or the error of the call.
+func (s *RPCStream) Recv(v interface{}) error {
+	if s.err != nil {
+		return s.err
+	}
+
+	var header rpcResponseHeader
+	err := s.dec.Decode(&header)
+	if err == nil && header.Body {
+		if v == nil {
+			var discard interface{}
+			v = &discard
+		}
+		err = s.dec.Decode(v)
+	}
+	if err != nil {
+		// The connection is closed when the context expires, or its
+		// deadline passes first
+		if deadline, ok := s.ctx.Deadline(); ok && !time.Now().Before(deadline) {
+			err = context.DeadlineExceeded
+		} else if s.ctx.Err() != nil {
+			err = s.ctx.Err()
+		}
+		s.err = err
+		return err
+	}
+
+	if header.End {
+		s.leader = header.Leader
+		if header.Error != "" {
+			s.err = rpcError(header.Error)
+			return s.err
+		}
+		s.err = io.EOF
+		if header.Body {
+			return nil
+		}
+		return io.EOF
+	}
+	return nil
+}
+
+// Close ends the call.
+func (s *RPCStream) Close() error {
+	s.once.Do(func() {
+		close(s.done)
+		if s.err == io.EOF {
+			s.span.Finish(nil)
+		} else {
+			s.span.Finish(s.err)
+		}
+	})
+	return s.conn.Close()
+}
+
+// writeRPCFrame writes a response header and, if it has one, its body.
+func writeRPCFrame(enc *codec.Encoder, header *rpcResponseHeader, body interface{}) error {
+	if err := enc.Encode(header); err != nil {
+		return err
+	}
+	if header.Body {
+		return enc.Encode(body)
+	}
+	return nil
+}
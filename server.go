@@ -1,16 +1,16 @@
 package cerebrum
 
 import (
+	"crypto/tls"
 	"net"
 	"os"
 	"path/filepath"
+	"sync"
 	"time"
 
 	"github.com/blacklabeldata/grim"
 	"github.com/blacklabeldata/serfer"
-	"github.com/blacklabeldata/yamuxer"
 	"github.com/hashicorp/raft"
-	raftboltdb "github.com/hashicorp/raft-boltdb"
 	"github.com/hashicorp/serf/serf"
 	log "github.com/mgutz/logxi/v1"
 	"golang.org/x/net/context"
@@ -28,6 +28,7 @@ const (
 const (
 	SerfSnapshotDir   = "serf/local.snapshot"
 	RaftStateDir      = "raft/"
+	RaftPeersDir      = "raft/peers/"
 	tmpStatePath      = "tmp/"
 	SnapshotsRetained = 2
 
@@ -42,7 +43,20 @@ func New(c *Config) (cer Cerebrum, err error) {
 	if c.LogOutput == nil {
 		c.LogOutput = log.NewConcurrentWriter(os.Stderr)
 	}
-	logger := log.NewLogger(c.LogOutput, "kappa")
+	logging := newLogging(c)
+	logger := logging.Named("cerebrum")
+
+	// Validate the configuration
+	if err = c.Validate(); err != nil {
+		logger.Error("Invalid configuration", "err", err)
+		return
+	}
+
+	// The HTTP service is added to a copy so the caller's Config is unchanged
+	services := append([]Service{}, c.Services...)
+	if c.HTTPBindAddr != "" {
+		services = append(services, NewHTTPService(c.HTTPBindAddr))
+	}
 
 	// Create data directory
 	if err = os.MkdirAll(c.DataPath, 0755); err != nil {
@@ -50,33 +64,73 @@ func New(c *Config) (cer Cerebrum, err error) {
 		return
 	}
 
+	// Setup the metrics sinks
+	telemetry, err := setupTelemetry(c)
+	if err != nil {
+		logger.Error("Failed to setup telemetry", "err", err)
+		return
+	}
+	tracer, traceFile, err := setupTracing(c)
+	if err != nil {
+		telemetry.Shutdown()
+		logger.Error("Failed to setup tracing", "err", err)
+		return
+	}
+
 	// Setup reconciler
 	serfEventCh := make(chan serf.Event, 256)
 	reconcilerCh := make(chan serf.Member, 32)
 
+	// Create the FSM
+	fsm := newFSM(filepath.Join(c.DataPath, tmpStatePath), c.FSM, c.LogOutput)
+	fsm.logger = logging.Named("fsm")
+	fsm.tracer = tracer
+	fsm.telemetry = telemetry
+
 	ctx, cancel := context.WithCancel(context.Background())
+	pool := NewPool(logging.Writer("yamux"), 5*time.Minute, c.TLSConfig)
 	cereb := &cerebrum{
 		config:      c,
+		services:    services,
 		logger:      logger,
-		dialer:      NewDialer(NewPool(c.LogOutput, 5*time.Minute, c.TLSConfig)),
+		logging:     logging,
+		fsm:         fsm,
+		state:       fsm.state,
+		acl:         &aclResolver{fsm.state, c.ACLMasterToken, c.ACLDefaultPolicy},
+		pool:        pool,
+		identities:  newIdentities(),
+		streamStats: newStreamStats(),
+		telemetry:   telemetry,
+		tracer:      tracer,
+		traceFile:   traceFile,
+		dialer:      NewDialer(pool),
 		serfEventCh: serfEventCh,
 		reconcileCh: reconcilerCh,
 		grim:        grim.ReaperWithContext(ctx),
 		context:     ctx,
 		cancel:      cancel,
+		doneCh:      make(chan struct{}),
 	}
-
-	// Create serf server
+	cereb.audits = newAuditQueue(cereb, auditQueueSize, telemetry, logging.Named("audit"))
+	pool.SetServerName(cereb.peerServerName)
+	pool.SetNetwork(cereb.network())
+	pool.SetTelemetry(telemetry)
+	pool.SetSessions(c.PoolSessions)
+	pool.SetMaxStreams(c.PoolMaxStreams)
+	pool.SetHealthInterval(c.PoolHealthInterval)
+
+	// Create raft server
 	err = cereb.setupRaft()
 	if err != nil {
-		err = logger.Error("Failed to start serf: %v", err)
+		cereb.release()
+		err = logger.Error("Failed to start raft", "err", err)
 		return nil, err
 	}
 
 	isLeader := func() bool { return cereb.raft.State() == raft.Leader }
-	reconciler := &Reconciler{reconcilerCh, isLeader}
+	reconciler := &Reconciler{reconcilerCh, isLeader, telemetry}
 	cereb.serfer = serfer.NewSerfer(serfEventCh, serfer.SerfEventHandler{
-		Logger:              log.NewLogger(c.LogOutput, CerebrumEventPrefix),
+		Logger:              cereb.newLogger("serf"),
 		ServicePrefix:       CerebrumEventPrefix,
 		ReconcileOnJoin:     true,
 		ReconcileOnLeave:    true,
@@ -101,7 +155,8 @@ func New(c *Config) (cer Cerebrum, err error) {
 	// Create serf server
 	cereb.serf, err = cereb.setupSerf()
 	if err != nil {
-		err = logger.Error("Failed to start serf: %v", err)
+		cereb.release()
+		err = logger.Error("Failed to start serf", "err", err)
 		return nil, err
 	}
 
@@ -110,12 +165,30 @@ func New(c *Config) (cer Cerebrum, err error) {
 }
 
 type Cerebrum interface {
+	Operator
+	Agent
+	Reader
+
 	Start() error
 	Stop()
+
+	// Reload applies a new configuration to the running node. It fails
+	// without changing anything if a field requiring a restart differs.
+	Reload(*Config) error
+
+	// Health reports the liveness and readiness of the node.
+	Health() *HealthStatus
+
+	// Done is closed once the node has stopped.
+	Done() <-chan struct{}
 }
 
 type cerebrum struct {
 	config *Config
+
+	// services are the services of the config and the HTTP service
+	services []Service
+
 	logger log.Logger
 
 	// pool        *ConnPool
@@ -125,31 +198,94 @@ type cerebrum struct {
 	serf        *serf.Serf
 	serfer      serfer.Serfer
 
+	// readyForConsistentReads is set once a new leader has applied a
+	// barrier, so its FSM includes every committed entry
+	readyForConsistentReads int32
+
 	// The raft instance is used among Consul nodes within the
 	// DC to protect operations that require strong consistency
 	raft          *raft.Raft
 	raftPeers     raft.PeerStore
 	raftLayer     *RaftLayer
-	raftStore     *raftboltdb.BoltStore
+	raftStore     RaftStore
+	raftSnapshots raft.SnapshotStore
 	raftTransport *raft.NetworkTransport
 	reconcileCh   chan serf.Member
 	// listener      *net.TCPListener
-	muxer yamuxer.Yamuxer
-	fsm   raft.FSM
+	muxer      *muxer
+	dispatcher *authDispatcher
+	fsm        *fsm
+	state      *stateStore
+
+	adminListener  net.Listener
+	healthListener net.Listener
 
 	applier   Applier
+	audits    *auditQueue
 	forwarder Forwarder
+	rpc       *RPC
+	acl       ACLResolver
+
+	// configLock protects the fields of config changed by Reload.
+	configLock sync.RWMutex
+	reloadLock sync.Mutex
+	pool       *ConnPool
+	logging    *logging
+
+	// identities of the peers connected to the muxer
+	identities  *identities
+	streamStats *streamStats
+	telemetry   *Telemetry
+	tracer      *Tracer
+	traceFile   *FileExporter
 
 	// t       tomb.Tomb
 	grim    grim.GrimReaper
 	context context.Context
 	cancel  context.CancelFunc
+
+	// stopLock also protects the progress of Start reported by Health
+	stopLock        sync.Mutex
+	stopped         bool
+	joined          bool
+	servicesStarted int
+	doneCh          chan struct{}
 }
 
 func (c *cerebrum) Start() error {
 
+	// Start accepting Raft and forwarding streams
+	c.muxer.Start()
+
+	// Start the health listener first so liveness can be probed while
+	// joining
+	if c.config.HealthBindAddr != "" {
+		l, err := net.Listen("tcp", c.config.HealthBindAddr)
+		if err != nil {
+			c.logger.Error("Failed to start health listener", "err", err)
+			return err
+		}
+		c.healthListener = l
+		logger := c.newLogger("health")
+		go serveHealth(c.context, l, &healthHandler{c.Health, logger}, logger)
+	}
+
+	// Start the local admin listener
+	if c.config.AdminBindAddr != "" {
+		l, err := net.Listen("tcp", c.config.AdminBindAddr)
+		if err != nil {
+			c.logger.Error("Failed to start admin listener", "err", err)
+			return err
+		}
+		c.adminListener = l
+		handler := NewAdminHandler(c, c, c.acl, c.newLogger("admin"))
+		go handler.Serve(c.context, l)
+	}
+
 	// Start monitoring raft cluster
 	go c.monitorLeadership()
+	go c.monitorRaftStore()
+	go c.audits.run(c.context)
 
 	// Start serf handler
 	c.serfer.Start()
@@ -163,23 +299,55 @@ func (c *cerebrum) Start() error {
 		return err
 	}
 	c.logger.Info("Joined cluster", "nodes", n)
+	c.stopLock.Lock()
+	c.joined = n > 0 || len(c.config.ExistingNodes) == 0
+	c.stopLock.Unlock()
 
 	// Start services
 	ctx := Context{
 		Context: c.context,
 		Serf:    c.serf,
 		Raft:    c.raft,
+
+		Agent:     c,
+		Operator:  c,
+		Reader:    c,
+		Telemetry: c.telemetry,
+		Logger:    c.newLogger,
+
+		Dialer:         c.dialer,
+		RegisterStream: c.dispatcher.RegisterService,
+		RPC:            c.rpc,
 	}
-	for _, svc := range c.config.Services {
-		svc.Start(&ctx)
+	for _, svc := range c.services {
+		if err := svc.Start(&ctx); err != nil {
+			c.logger.Error("Failed to start service", "service", svc.Name(), "err", err)
+			return err
+		}
+		c.stopLock.Lock()
+		c.servicesStarted++
+		c.stopLock.Unlock()
 	}
 
 	return nil
 }
 
 func (c *cerebrum) Stop() {
+	c.stopLock.Lock()
+	defer c.stopLock.Unlock()
+	if c.stopped {
+		return
+	}
+	c.stopped = true
+
 	c.cancel()
-	for _, svc := range c.config.Services {
+	if c.adminListener != nil {
+		c.adminListener.Close()
+	}
+	if c.healthListener != nil {
+		c.healthListener.Close()
+	}
+	for _, svc := range c.services {
 		svc.Stop()
 	}
 
@@ -194,9 +362,37 @@ func (c *cerebrum) Stop() {
 		c.logger.Warn("error: stopping Serfer handlers", err.Error())
 	}
 
+	c.release()
+	close(c.doneCh)
+}
+
+// release shuts down Raft and releases the listener, connections, metrics
+// sinks and trace file of the node. New releases what it has set up if it
+// fails.
+func (c *cerebrum) release() {
+	c.cancel()
+	if c.raft != nil {
+		if err := c.raft.Shutdown().Error(); err != nil {
+			c.logger.Warn("error: stopping Raft", "err", err)
+		}
+	}
+	if c.raftStore != nil {
+		c.raftStore.Close()
+	}
+
 	// c.listener.Close()
-	c.muxer.Stop()
+	if c.muxer != nil {
+		c.muxer.Stop()
+	}
 	c.dialer.Shutdown()
+	c.telemetry.Shutdown()
+	if c.traceFile != nil {
+		c.traceFile.Close()
+	}
+}
+
+func (c *cerebrum) Done() <-chan struct{} {
+	return c.doneCh
 }
 
 func (c *cerebrum) setupSerf() (*serf.Serf, error) {
@@ -217,25 +413,41 @@ func (c *cerebrum) setupSerf() (*serf.Serf, error) {
 		"AdvertiseAddr", conf.MemberlistConfig.AdvertiseAddr,
 		"AdvertisePort", conf.MemberlistConfig.AdvertisePort)
 
-	conf.Tags["id"] = c.config.NodeID
-	conf.Tags["role"] = "cerebrum-server"
-	conf.Tags["dc"] = c.config.DataCenter
-	// conf.Tags["port"] = fmt.Sprintf("%d", port)
+	conf.Tags = c.serfTags(c.config.Tags)
 
-	conf.MemberlistConfig.LogOutput = c.config.LogOutput
-	conf.LogOutput = c.config.LogOutput
+	conf.MemberlistConfig.LogOutput = c.logging.Writer("memberlist")
+	conf.LogOutput = c.logging.Writer("serf")
 	conf.EventCh = c.serfEventCh
 	conf.SnapshotPath = filepath.Join(c.config.DataPath, SerfSnapshotDir)
 	conf.ProtocolVersion = conf.ProtocolVersion
 	conf.RejoinAfterLeave = true
 	conf.EnableNameConflictResolution = false
 	conf.Merge = &mergeDelegate{c.logger}
-	if err := os.MkdirAll(conf.SnapshotPath, 0755); err != nil {
+	if err := os.MkdirAll(filepath.Dir(conf.SnapshotPath), 0755); err != nil {
+		return nil, err
+	}
+	if err := c.setupKeyring(conf); err != nil {
 		return nil, err
 	}
 	return serf.Create(conf)
 }
 
+// network returns the configured Network or TCP.
+func (c *cerebrum) network() Network {
+	if c.config.Network != nil {
+		return c.config.Network
+	}
+	return TCPNetwork{}
+}
+
+// raftStoreBackend returns the configured RaftStoreBackend or bolt.
+func (c *cerebrum) raftStoreBackend() RaftStoreBackend {
+	if c.config.RaftStore != nil {
+		return c.config.RaftStore
+	}
+	return BoltRaftStore{}
+}
+
 // setupRaft is used to setup and initialize Raft
 func (c *cerebrum) setupRaft() error {
 
@@ -255,12 +467,19 @@ func (c *cerebrum) setupRaft() error {
 
 	// Create the base raft path
 	path := filepath.Join(c.config.DataPath, RaftStateDir)
-	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return err
+	}
+
+	// Create the peer store path. The peer store is kept apart from the
+	// state path so that a peers.json recovery file can be told apart.
+	peersPath := filepath.Join(c.config.DataPath, RaftPeersDir)
+	if err := os.MkdirAll(peersPath, 0755); err != nil {
 		return err
 	}
 
 	// Create the backend raft store for logs and stable storage
-	store, err := raftboltdb.NewBoltStore(filepath.Join(path, "raft.db"))
+	store, err := c.raftStoreBackend().Open(path)
 	if err != nil {
 		return err
 	}
@@ -269,55 +488,64 @@ func (c *cerebrum) setupRaft() error {
 	// Wrap the store in a LogCache to improve performance
 	cacheStore, err := raft.NewLogCache(c.config.LogCacheSize, store)
 	if err != nil {
-		store.Close()
 		return err
 	}
 
 	// Create the snapshot store
-	snapshots, err := raft.NewFileSnapshotStore(path, c.config.SnapshotsRetained, c.config.LogOutput)
-	if err != nil {
-		store.Close()
-		return err
-	}
-
-	// Try to bind
-	addr, err := net.ResolveTCPAddr("tcp", c.config.RaftBindAddr)
+	snapshots, err := raft.NewFileSnapshotStore(path, c.config.SnapshotsRetained, c.logging.Writer("snapshot"))
 	if err != nil {
 		return err
 	}
+	c.raftSnapshots = snapshots
 
-	// Start TCP listener
-	listener, err := net.ListenTCP("tcp", addr)
+	// Start the listener
+	listener, err := c.network().Listen(c.config.RaftBindAddr)
 	if err != nil {
 		return err
 	}
 
 	// Create connection layer and transport
 	layer := NewRaftLayer(c.dialer, listener.Addr(), c.config.TLSConfig)
-	c.raftTransport = raft.NewNetworkTransport(layer, 3, 10*time.Second, c.config.LogOutput)
+	c.raftTransport = raft.NewNetworkTransport(layer, 3, 10*time.Second, c.logging.Writer("raft"))
 
 	// Create TLS connection dispatcher
-	dispatcher := yamuxer.NewDispatcher(log.NewLogger(c.config.LogOutput, "dispatcher"), nil)
+	dispatcher := &authDispatcher{
+		authorize:  c.config.AuthorizeStream,
+		identities: c.identities,
+		stats:      c.streamStats,
+		logger:     c.newLogger("streams"),
+	}
+	if dispatcher.authorize == nil {
+		dispatcher.authorize = dispatcher.authorizeRoles
+	}
+	c.dispatcher = dispatcher
 	dispatcher.Register(connRaft, layer)
-	dispatcher.Register(connForward, &ForwardingHandler{c.applier, log.NewLogger(c.config.LogOutput, "forwarder")})
+	dispatcher.Register(connAdmin, NewAdminHandler(c, c, c.acl, c.newLogger("admin")))
 
 	// Create TLS connection muxer
-	c.muxer = yamuxer.New(c.context, &yamuxer.Config{
-		Listener:   listener,
-		TLSConfig:  c.config.TLSConfig,
-		Deadline:   c.config.ConnectionDeadline,
-		LogOutput:  c.config.LogOutput,
-		Dispatcher: dispatcher,
-	})
+	c.muxer = newMuxer(c.context, listener, &tls.Config{GetConfigForClient: c.serverTLSConfig},
+		dispatcher, c.identities.remove, c.config.ConnectionDeadline, c.logging.Writer("yamux"), c.newLogger("muxer"))
 
 	// Setup the peer store
-	c.raftPeers = raft.NewJSONPeers(path, c.raftTransport)
+	c.raftPeers = raft.NewJSONPeers(peersPath, c.raftTransport)
+
+	// Move the peer store of older versions out of the way of the recovery
+	// file
+	if _, err := migratePeers(path, peersPath, c.logger); err != nil {
+		c.logger.Error("failed to migrate raft peers", "err", err)
+		return err
+	}
+
+	// Apply a peers.json recovery file if an operator has provided one
+	if _, err := recoverPeers(path, c.raftTransport.LocalAddr(), c.raftPeers, c.logger); err != nil {
+		c.logger.Error("failed to recover raft peers", "err", err)
+		return err
+	}
 
 	// Ensure local host is always included if we are in bootstrap mode
 	if c.config.Bootstrap {
 		peers, err := c.raftPeers.Peers()
 		if err != nil {
-			store.Close()
 			return err
 		}
 		if !raft.PeerContained(peers, c.raftTransport.LocalAddr()) {
@@ -326,20 +554,23 @@ func (c *cerebrum) setupRaft() error {
 	}
 
 	// Make sure we set the LogOutput
-	c.config.RaftConfig.LogOutput = c.config.LogOutput
+	c.config.RaftConfig.LogOutput = c.logging.Writer("raft")
 
 	// Setup the Raft store
 	c.raft, err = raft.NewRaft(c.config.RaftConfig, c.fsm, cacheStore, store,
 		snapshots, c.raftPeers, c.raftTransport)
 	if err != nil {
-		store.Close()
 		c.raftTransport.Close()
 		return err
 	}
+	c.logging.setTerm(c.fsm.appliedTerm)
 
 	// Setup forwarding and applier
-	c.forwarder = NewForwarder(c.raft, c.dialer, log.NewLogger(c.config.LogOutput, "forwarder"))
-	c.applier = NewApplier(c.raft, c.forwarder, log.NewLogger(c.config.LogOutput, "applier"), c.config.EnqueueTimeout)
+	c.forwarder = NewForwarder(c.raft, c.dialer, c.telemetry, c.newLogger("forwarder"), c.config.ForwardTimeout, c.config.ForwardBackoff)
+	c.applier = NewApplier(c.raft, c.forwarder, c.acl, c.config.ACLMasterToken, c.audits, c.tracer, c.telemetry, c.newLogger("applier"), c.config.EnqueueTimeout)
+	dispatcher.Register(connForward, &ForwardingHandler{c.applier, c.tracer, c.newLogger("forwarder")})
+	c.rpc = NewRPC(c.raft, c.dialer, c.identities, c.tracer, c.telemetry, c.newLogger("rpc"))
+	dispatcher.Register(connRPC, c.rpc)
 
 	// // Start monitoring leadership
 	// c.t.Go(func() error {
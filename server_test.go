@@ -0,0 +1,42 @@
+package cerebrum
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNew_Release(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cerebrum-new")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	// The Raft address is taken, so New fails after opening the Raft store
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer l.Close()
+
+	c := DefaultConfig()
+	c.NodeID = "n1"
+	c.DataPath = dir
+	c.TLSConfig = mutualTLSConfig()
+	c.RaftBindAddr = l.Addr().String()
+	c.HTTPBindAddr = "127.0.0.1:0"
+	c.StatsdAddr = "127.0.0.1:8125"
+	c.LogOutput = ioutil.Discard
+	_, err = New(c)
+	assert.NotNil(t, err)
+
+	// The HTTP service is not added to the config
+	assert.Nil(t, c.Services)
+
+	// The Raft store was closed, so it can be opened again
+	store, err := BoltRaftStore{}.Open(filepath.Join(dir, RaftStateDir))
+	if assert.Nil(t, err) {
+		store.Close()
+	}
+}
@@ -3,6 +3,7 @@ package cerebrum
 import (
 	"github.com/hashicorp/raft"
 	"github.com/hashicorp/serf/serf"
+	log "github.com/mgutz/logxi/v1"
 	"golang.org/x/net/context"
 )
 
@@ -16,4 +17,26 @@ type Context struct {
 	Context context.Context
 	Serf    *serf.Serf
 	Raft    *raft.Raft
+
+	Agent    Agent
+	Operator Operator
+	Reader   Reader
+
+	// Telemetry holds the metrics sinks of the node.
+	Telemetry *Telemetry
+
+	// Logger returns the logger of a component, e.g. the name of the
+	// service. Its level follows LogLevel and LogLevels.
+	Logger func(name string) log.Logger
+
+	// Dialer opens streams to the Raft address of other nodes over the
+	// pooled TLS sessions of the node.
+	Dialer Dialer
+
+	// RegisterStream serves a stream type of the service on the Raft port.
+	RegisterStream func(StreamHandler) error
+
+	// RPC registers the methods of the service and calls those of other
+	// nodes.
+	RPC *RPC
 }
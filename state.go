@@ -0,0 +1,463 @@
+package cerebrum
+
+import (
+	"encoding/json"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DedupWindow is how long the FSM remembers the last request of a client.
+// Retries of a request arriving later are applied again.
+const DedupWindow = 10 * time.Minute
+
+// NodeEntry is the replicated status of a cluster node.
+type NodeEntry struct {
+	ID          string
+	Name        string
+	DataCenter  string
+	Status      NodeStatus
+	Addr        string
+	Port        int
+	ModifyIndex uint64
+}
+
+// KVEntry is a replicated key/value pair.
+type KVEntry struct {
+	Key         string
+	Value       []byte
+	CreateIndex uint64
+	ModifyIndex uint64
+}
+
+// clientEntry is the last request of a client applied by the FSM.
+type clientEntry struct {
+	Client string
+	Seq    uint64
+
+	// Time is the leader's clock at the apply in Unix nanoseconds
+	Time int64
+
+	// Error is the error of the apply, if any
+	Error string `json:",omitempty"`
+
+	// Response is the encoded response of the user FSM and ResponseType its
+	// type, one of the responseX constants
+	Response     []byte `json:",omitempty"`
+	ResponseType string `json:",omitempty"`
+}
+
+// Types of the responses kept in a clientEntry. Responses which are neither
+// bytes nor strings cannot be kept and their duplicates get a
+// DuplicateResponse instead.
+const (
+	responseBytes  = "bytes"
+	responseString = "string"
+	responseOther  = "other"
+)
+
+// stateStore holds the replicated cerebrum state. It is only modified by the
+// FSM and can be read concurrently.
+type stateStore struct {
+	l     sync.RWMutex
+	index uint64
+	nodes map[string]*NodeEntry
+	kvs   map[string]*KVEntry
+	acls  map[string]*ACLToken
+
+	// audit holds the last AuditLogSize events, oldest first
+	audit []*AuditEvent
+
+	// clients holds the last request of each client. Requests older than
+	// DedupWindow are dropped from time to time; clientsExpired is the time
+	// of the last sweep.
+	clients        map[string]*clientEntry
+	clientsExpired int64
+
+	// pending holds the chunks of a restore until its last chunk
+	pending *pendingRestore
+
+	// watchCh is closed and replaced on every change
+	watchCh chan struct{}
+}
+
+// stateSnapshot is the serialized form of the stateStore.
+type stateSnapshot struct {
+	Index   uint64
+	Nodes   []*NodeEntry
+	KVs     []*KVEntry
+	ACLs    []*ACLToken     `json:",omitempty"`
+	Audit   []*AuditEvent   `json:",omitempty"`
+	Clients []*clientEntry  `json:",omitempty"`
+	Pending *pendingRestore `json:",omitempty"`
+}
+
+// pendingRestore is a chunked restore which has not received its last chunk.
+type pendingRestore struct {
+	ID   string
+	Data []byte
+}
+
+func newStateStore() *stateStore {
+	return &stateStore{
+		nodes:   make(map[string]*NodeEntry),
+		kvs:     make(map[string]*KVEntry),
+		acls:    make(map[string]*ACLToken),
+		clients: make(map[string]*clientEntry),
+		watchCh: make(chan struct{}),
+	}
+}
+
+// Watch returns a channel which is closed on the next change.
+func (s *stateStore) Watch() <-chan struct{} {
+	s.l.RLock()
+	defer s.l.RUnlock()
+	return s.watchCh
+}
+
+// notify wakes up all watchers. The write lock must be held.
+func (s *stateStore) notify() {
+	close(s.watchCh)
+	s.watchCh = make(chan struct{})
+}
+
+// Index returns the Raft index of the last change.
+func (s *stateStore) Index() uint64 {
+	s.l.RLock()
+	defer s.l.RUnlock()
+	return s.index
+}
+
+// setIndex records a change at the given index.
+func (s *stateStore) setIndex(index uint64) {
+	s.l.Lock()
+	s.index = index
+	s.notify()
+	s.l.Unlock()
+}
+
+// Nodes returns all known nodes sorted by name.
+func (s *stateStore) Nodes() []*NodeEntry {
+	s.l.RLock()
+	defer s.l.RUnlock()
+	return s.nodeList()
+}
+
+// KVGet returns the entry for the key or nil if it does not exist.
+func (s *stateStore) KVGet(key string) *KVEntry {
+	s.l.RLock()
+	defer s.l.RUnlock()
+
+	if e, ok := s.kvs[key]; ok {
+		entry := *e
+		return &entry
+	}
+	return nil
+}
+
+// KVList returns all entries with the given prefix sorted by key.
+func (s *stateStore) KVList(prefix string) []*KVEntry {
+	s.l.RLock()
+	defer s.l.RUnlock()
+	return s.kvList(prefix)
+}
+
+// ACLGet returns the token with the ID or nil if it does not exist.
+func (s *stateStore) ACLGet(id string) *ACLToken {
+	s.l.RLock()
+	defer s.l.RUnlock()
+
+	if a, ok := s.acls[id]; ok {
+		acl := *a
+		return &acl
+	}
+	return nil
+}
+
+// ACLList returns all tokens sorted by ID.
+func (s *stateStore) ACLList() []*ACLToken {
+	s.l.RLock()
+	defer s.l.RUnlock()
+	return s.aclList()
+}
+
+// AuditEvents returns the retained audit events with an index greater than
+// minIndex, oldest first.
+func (s *stateStore) AuditEvents(minIndex uint64) []*AuditEvent {
+	s.l.RLock()
+	defer s.l.RUnlock()
+	return s.auditList(minIndex)
+}
+
+// nodeList copies the nodes. The lock must be held.
+func (s *stateStore) nodeList() []*NodeEntry {
+	nodes := make([]*NodeEntry, 0, len(s.nodes))
+	for _, n := range s.nodes {
+		node := *n
+		nodes = append(nodes, &node)
+	}
+	sort.Sort(nodesByName(nodes))
+	return nodes
+}
+
+// kvList copies the entries with the given prefix. The lock must be held.
+func (s *stateStore) kvList(prefix string) []*KVEntry {
+	entries := make([]*KVEntry, 0)
+	for key, e := range s.kvs {
+		if strings.HasPrefix(key, prefix) {
+			entry := *e
+			entries = append(entries, &entry)
+		}
+	}
+	sort.Sort(kvsByKey(entries))
+	return entries
+}
+
+// aclList copies the tokens. The lock must be held.
+func (s *stateStore) aclList() []*ACLToken {
+	acls := make([]*ACLToken, 0, len(s.acls))
+	for _, a := range s.acls {
+		acl := *a
+		acls = append(acls, &acl)
+	}
+	sort.Sort(aclsByID(acls))
+	return acls
+}
+
+// auditList copies the audit events after minIndex. The lock must be held.
+func (s *stateStore) auditList(minIndex uint64) []*AuditEvent {
+	events := make([]*AuditEvent, 0)
+	for _, e := range s.audit {
+		if e.Index > minIndex {
+			event := *e
+			events = append(events, &event)
+		}
+	}
+	return events
+}
+
+// clientList copies the last requests of the clients. The lock must be held.
+func (s *stateStore) clientList() []*clientEntry {
+	clients := make([]*clientEntry, 0, len(s.clients))
+	for _, c := range s.clients {
+		client := *c
+		clients = append(clients, &client)
+	}
+	sort.Sort(clientsByID(clients))
+	return clients
+}
+
+// setNode updates the status of a node. Reaped nodes are removed.
+func (s *stateStore) setNode(index uint64, node *NodeEntry) {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	s.index = index
+	defer s.notify()
+	if node.Status == StatusReaped {
+		delete(s.nodes, node.Name)
+		return
+	}
+	node.ModifyIndex = index
+	s.nodes[node.Name] = node
+}
+
+// kvSet creates or updates a key.
+func (s *stateStore) kvSet(index uint64, key string, value []byte) {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	s.index = index
+	defer s.notify()
+	entry := &KVEntry{Key: key, Value: value, CreateIndex: index, ModifyIndex: index}
+	if e, ok := s.kvs[key]; ok {
+		entry.CreateIndex = e.CreateIndex
+	}
+	s.kvs[key] = entry
+}
+
+// kvDelete removes a key.
+func (s *stateStore) kvDelete(index uint64, key string) {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	s.index = index
+	delete(s.kvs, key)
+	s.notify()
+}
+
+// aclSet creates or updates a token.
+func (s *stateStore) aclSet(index uint64, acl *ACLToken) {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	s.index = index
+	defer s.notify()
+	acl.CreateIndex, acl.ModifyIndex = index, index
+	if a, ok := s.acls[acl.ID]; ok {
+		acl.CreateIndex = a.CreateIndex
+	}
+	s.acls[acl.ID] = acl
+}
+
+// aclDelete removes a token.
+func (s *stateStore) aclDelete(index uint64, id string) {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	s.index = index
+	delete(s.acls, id)
+	s.notify()
+}
+
+// auditAppend records an audit event, dropping the oldest event once
+// AuditLogSize are retained.
+func (s *stateStore) auditAppend(index uint64, e *AuditEvent) {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	s.index = index
+	e.Index = index
+	if len(s.audit) >= AuditLogSize {
+		s.audit = append(s.audit[:0:0], s.audit[len(s.audit)-AuditLogSize+1:]...)
+	}
+	s.audit = append(s.audit, e)
+	s.notify()
+}
+
+// clientRequest returns the last request of the client applied within
+// DedupWindow of the time, or nil.
+func (s *stateStore) clientRequest(client string, at int64) *clientEntry {
+	s.l.RLock()
+	defer s.l.RUnlock()
+
+	e := s.clients[client]
+	if e == nil || at-e.Time >= int64(DedupWindow) {
+		return nil
+	}
+	return e
+}
+
+// setClientRequest records the last request of a client. Once per tenth of
+// DedupWindow, the requests which expired by its time are dropped.
+func (s *stateStore) setClientRequest(e *clientEntry) {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	if e.Time-s.clientsExpired >= int64(DedupWindow/10) {
+		for id, c := range s.clients {
+			if e.Time-c.Time >= int64(DedupWindow) {
+				delete(s.clients, id)
+			}
+		}
+		s.clientsExpired = e.Time
+	}
+	s.clients[e.Client] = e
+}
+
+// restoreChunk appends a chunk to the restore with the ID, which a chunk at
+// offset zero starts. The snapshot is returned with the last chunk.
+func (s *stateStore) restoreChunk(id string, offset uint64, data []byte, last bool) ([]byte, error) {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	if offset == 0 {
+		s.pending = &pendingRestore{ID: id}
+	}
+	p := s.pending
+	if p == nil || p.ID != id || uint64(len(p.Data)) != offset {
+		return nil, ErrRestoreInterrupted
+	}
+	p.Data = append(p.Data, data...)
+	if !last {
+		return nil, nil
+	}
+	s.pending = nil
+	return p.Data, nil
+}
+
+// snapshot creates a point-in-time copy of the state.
+func (s *stateStore) snapshot() *stateSnapshot {
+	s.l.RLock()
+	defer s.l.RUnlock()
+
+	return &stateSnapshot{
+		Index:   s.index,
+		Nodes:   s.nodeList(),
+		KVs:     s.kvList(""),
+		ACLs:    s.aclList(),
+		Audit:   s.auditList(0),
+		Clients: s.clientList(),
+		Pending: s.pendingCopy(),
+	}
+}
+
+// pendingCopy returns the chunks of the pending restore received so far.
+func (s *stateStore) pendingCopy() *pendingRestore {
+	if s.pending == nil {
+		return nil
+	}
+	return &pendingRestore{ID: s.pending.ID, Data: s.pending.Data[:len(s.pending.Data):len(s.pending.Data)]}
+}
+
+// restore replaces the state with the snapshot.
+func (s *stateStore) restore(snap *stateSnapshot) {
+	nodes := make(map[string]*NodeEntry, len(snap.Nodes))
+	for _, n := range snap.Nodes {
+		nodes[n.Name] = n
+	}
+	kvs := make(map[string]*KVEntry, len(snap.KVs))
+	for _, e := range snap.KVs {
+		kvs[e.Key] = e
+	}
+	acls := make(map[string]*ACLToken, len(snap.ACLs))
+	for _, a := range snap.ACLs {
+		acls[a.ID] = a
+	}
+	clients := make(map[string]*clientEntry, len(snap.Clients))
+	for _, c := range snap.Clients {
+		clients[c.Client] = c
+	}
+
+	s.l.Lock()
+	s.index = snap.Index
+	s.nodes = nodes
+	s.kvs = kvs
+	s.acls = acls
+	s.audit = snap.Audit
+	s.clients = clients
+	s.pending = snap.Pending
+	s.notify()
+	s.l.Unlock()
+}
+
+// writeTo serializes the snapshot.
+func (snap *stateSnapshot) writeTo(w io.Writer) error {
+	return json.NewEncoder(w).Encode(snap)
+}
+
+type nodesByName []*NodeEntry
+
+func (n nodesByName) Len() int           { return len(n) }
+func (n nodesByName) Less(i, j int) bool { return n[i].Name < n[j].Name }
+func (n nodesByName) Swap(i, j int)      { n[i], n[j] = n[j], n[i] }
+
+type kvsByKey []*KVEntry
+
+func (k kvsByKey) Len() int           { return len(k) }
+func (k kvsByKey) Less(i, j int) bool { return k[i].Key < k[j].Key }
+func (k kvsByKey) Swap(i, j int)      { k[i], k[j] = k[j], k[i] }
+
+type aclsByID []*ACLToken
+
+func (a aclsByID) Len() int           { return len(a) }
+func (a aclsByID) Less(i, j int) bool { return a[i].ID < a[j].ID }
+func (a aclsByID) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+
+type clientsByID []*clientEntry
+
+func (c clientsByID) Len() int           { return len(c) }
+func (c clientsByID) Less(i, j int) bool { return c[i].Client < c[j].Client }
+func (c clientsByID) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
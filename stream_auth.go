@@ -0,0 +1,276 @@
+package cerebrum
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/blacklabeldata/grim"
+	"github.com/blacklabeldata/yamuxer"
+	log "github.com/mgutz/logxi/v1"
+	"golang.org/x/net/context"
+)
+
+// Stream types opened on the Raft port.
+const (
+	StreamForward yamuxer.StreamType = connForward
+	StreamRaft    yamuxer.StreamType = connRaft
+	StreamAdmin   yamuxer.StreamType = connAdmin
+	StreamRPC     yamuxer.StreamType = connRPC
+
+	// StreamServiceMin is the first stream type services may register.
+	// Lower types are reserved for Cerebrum.
+	StreamServiceMin yamuxer.StreamType = 0x10
+)
+
+// StreamHandler serves a stream type of a service on the Raft port. The
+// streams share the TLS sessions and the identities of the peers with the
+// streams of Cerebrum.
+type StreamHandler struct {
+	// Type is the stream type. It must be at least StreamServiceMin.
+	Type yamuxer.StreamType
+
+	// Name names the type in logs and stream stats.
+	Name string
+
+	// Roles may open the streams unless Config.AuthorizeStream is set. Only
+	// servers may if it is empty.
+	Roles []string
+
+	// Handler handles the authorized streams.
+	Handler yamuxer.Handler
+}
+
+// StreamAuthorizer decides whether a peer with the verified identity may open
+// a stream of the type. A rejected stream is closed.
+type StreamAuthorizer func(t yamuxer.StreamType, id Identity) error
+
+// streamRoles are the roles allowed to open each stream type by default.
+var streamRoles = map[yamuxer.StreamType][]string{
+	StreamRaft:    {RoleServer},
+	StreamAdmin:   {RoleServer},
+	StreamForward: {RoleServer, RoleClient},
+	StreamRPC:     {RoleServer},
+}
+
+// AuthorizeStreamRoles is the default StreamAuthorizer. Only servers may open
+// Raft and admin streams; clients may only open forwarding streams.
+func AuthorizeStreamRoles(t yamuxer.StreamType, id Identity) error {
+	for _, role := range streamRoles[t] {
+		if id.Role == role {
+			return nil
+		}
+	}
+	return fmt.Errorf("role %q may not open %s streams", id.Role, streamName(t))
+}
+
+// streamName returns a readable name for a stream type.
+func streamName(t yamuxer.StreamType) string {
+	switch t {
+	case StreamForward:
+		return "forward"
+	case StreamRaft:
+		return "raft"
+	case StreamAdmin:
+		return "admin"
+	case StreamRPC:
+		return "rpc"
+	}
+	return "type-" + strconv.Itoa(int(t))
+}
+
+// streamStats counts the accepted and rejected streams by type.
+type streamStats struct {
+	l        sync.Mutex
+	accepted map[yamuxer.StreamType]uint64
+	rejected map[yamuxer.StreamType]uint64
+	names    map[yamuxer.StreamType]string
+}
+
+func newStreamStats() *streamStats {
+	return &streamStats{
+		accepted: make(map[yamuxer.StreamType]uint64),
+		rejected: make(map[yamuxer.StreamType]uint64),
+		names:    make(map[yamuxer.StreamType]string),
+	}
+}
+
+// setName names a stream type registered by a service.
+func (s *streamStats) setName(t yamuxer.StreamType, name string) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	s.names[t] = name
+}
+
+// name returns the name of a stream type.
+func (s *streamStats) name(t yamuxer.StreamType) string {
+	s.l.Lock()
+	defer s.l.Unlock()
+	return s.nameLocked(t)
+}
+
+func (s *streamStats) nameLocked(t yamuxer.StreamType) string {
+	if name, ok := s.names[t]; ok {
+		return name
+	}
+	return streamName(t)
+}
+
+func (s *streamStats) count(t yamuxer.StreamType, accepted bool) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	if accepted {
+		s.accepted[t]++
+	} else {
+		s.rejected[t]++
+	}
+}
+
+// Stats returns the counts keyed by <type>_accepted and <type>_rejected.
+func (s *streamStats) Stats() map[string]string {
+	s.l.Lock()
+	defer s.l.Unlock()
+	stats := make(map[string]string)
+	for t, n := range s.accepted {
+		stats[s.nameLocked(t)+"_accepted"] = strconv.FormatUint(n, 10)
+	}
+	for t, n := range s.rejected {
+		stats[s.nameLocked(t)+"_rejected"] = strconv.FormatUint(n, 10)
+	}
+	return stats
+}
+
+// authDispatcher dispatches streams by type and authorizes them before
+// they are handled. Handlers may be registered while it dispatches.
+type authDispatcher struct {
+	authorize  StreamAuthorizer
+	identities *identities
+	stats      *streamStats
+	logger     log.Logger
+
+	lock     sync.RWMutex
+	handlers map[yamuxer.StreamType]yamuxer.Handler
+	roles    map[yamuxer.StreamType][]string
+}
+
+func (d *authDispatcher) Register(t yamuxer.StreamType, h yamuxer.Handler) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.registerLocked(t, h)
+}
+
+func (d *authDispatcher) registerLocked(t yamuxer.StreamType, h yamuxer.Handler) {
+	if d.handlers == nil {
+		d.handlers = make(map[yamuxer.StreamType]yamuxer.Handler)
+	}
+	d.handlers[t] = &streamGuard{t, h, d}
+}
+
+// RegisterService registers the stream type of a service. Reserved and
+// registered types are refused.
+func (d *authDispatcher) RegisterService(h StreamHandler) error {
+	if h.Type < StreamServiceMin {
+		return ErrStreamTypeReserved
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if _, ok := d.handlers[h.Type]; ok {
+		return ErrStreamTypeRegistered
+	}
+
+	roles := h.Roles
+	if len(roles) == 0 {
+		roles = []string{RoleServer}
+	}
+	if d.roles == nil {
+		d.roles = make(map[yamuxer.StreamType][]string)
+	}
+	d.roles[h.Type] = roles
+	if h.Name != "" {
+		d.stats.setName(h.Type, h.Name)
+	}
+	d.registerLocked(h.Type, h.Handler)
+	return nil
+}
+
+// Dispatch reads the type of the stream and passes it to its handler.
+// Streams of unknown types are closed.
+func (d *authDispatcher) Dispatch(g grim.GrimReaper, conn net.Conn) {
+	buf := make([]byte, 1)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		d.logger.Warn("Failed to read stream type", "remote", conn.RemoteAddr().String(), "err", err)
+		conn.Close()
+		return
+	}
+
+	t := yamuxer.StreamType(buf[0])
+	d.lock.RLock()
+	handler, ok := d.handlers[t]
+	d.lock.RUnlock()
+	if !ok {
+		d.logger.Warn("Closing stream of unknown type", "type", int(t), "remote", conn.RemoteAddr().String())
+		conn.Close()
+		return
+	}
+	g.SpawnFunc(func(ctx context.Context) {
+		handler.Handle(ctx, conn)
+	})
+}
+
+// authorizeRoles is the default StreamAuthorizer of the node. The streams
+// of services may be opened by the roles they were registered with.
+func (d *authDispatcher) authorizeRoles(t yamuxer.StreamType, id Identity) error {
+	d.lock.RLock()
+	roles, ok := d.roles[t]
+	d.lock.RUnlock()
+	if !ok {
+		return AuthorizeStreamRoles(t, id)
+	}
+	for _, role := range roles {
+		if id.Role == role {
+			return nil
+		}
+	}
+	return fmt.Errorf("role %q may not open %s streams", id.Role, d.stats.name(t))
+}
+
+func (d *authDispatcher) RegisterFunc(t yamuxer.StreamType, h yamuxer.HandlerFunc) {
+	d.Register(t, handlerFunc(h))
+}
+
+// handlerFunc adapts a yamuxer.HandlerFunc to the Handler interface.
+type handlerFunc yamuxer.HandlerFunc
+
+func (f handlerFunc) Handle(ctx context.Context, conn net.Conn) {
+	f(ctx, conn)
+}
+
+// streamGuard passes streams from authorized peers to the handler.
+type streamGuard struct {
+	streamType yamuxer.StreamType
+	handler    yamuxer.Handler
+	dispatcher *authDispatcher
+}
+
+func (g *streamGuard) Handle(ctx context.Context, conn net.Conn) {
+	d := g.dispatcher
+	remote := conn.RemoteAddr().String()
+
+	id, ok := d.identities.get(conn.RemoteAddr())
+	var err error
+	if !ok {
+		err = ErrNoPeerCertificate
+	} else {
+		err = d.authorize(g.streamType, id)
+	}
+	if err != nil {
+		d.stats.count(g.streamType, false)
+		d.logger.Warn("Rejected stream", "type", d.stats.name(g.streamType), "remote", remote, "role", id.Role, "err", err.Error())
+		conn.Close()
+		return
+	}
+	d.stats.count(g.streamType, true)
+	g.handler.Handle(ctx, conn)
+}
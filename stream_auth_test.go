@@ -0,0 +1,115 @@
+package cerebrum
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/blacklabeldata/grim"
+	"github.com/blacklabeldata/yamuxer"
+	log "github.com/mgutz/logxi/v1"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestStreamAuth_Roles(t *testing.T) {
+	server := Identity{RoleServer, "dc1"}
+	client := Identity{RoleClient, "dc1"}
+
+	assert.Nil(t, AuthorizeStreamRoles(StreamRaft, server))
+	assert.NotNil(t, AuthorizeStreamRoles(StreamRaft, client))
+	assert.NotNil(t, AuthorizeStreamRoles(StreamAdmin, client))
+	assert.Nil(t, AuthorizeStreamRoles(StreamForward, client))
+	assert.NotNil(t, AuthorizeStreamRoles(yamuxer.StreamType(0x7f), server))
+}
+
+func TestStreamAuth_Guard(t *testing.T) {
+	ids := newIdentities()
+	handled := make(chan net.Conn, 1)
+	d := &authDispatcher{
+		authorize:  AuthorizeStreamRoles,
+		identities: ids,
+		stats:      newStreamStats(),
+		logger:     &log.NullLogger{},
+	}
+	guard := &streamGuard{StreamRaft, &funcHandler{handled}, d}
+
+	// Streams from unknown peers are closed
+	client, server := net.Pipe()
+	guard.Handle(context.Background(), server)
+	_, err := client.Write([]byte{0})
+	assert.NotNil(t, err)
+	assert.Len(t, handled, 0)
+
+	// Streams from clients are closed
+	ids.add(server, Identity{RoleClient, "dc1"})
+	guard.Handle(context.Background(), server)
+	assert.Len(t, handled, 0)
+
+	// Streams from servers are passed on
+	client, server = net.Pipe()
+	ids.add(server, Identity{RoleServer, "dc1"})
+	guard.Handle(context.Background(), server)
+	assert.Len(t, handled, 1)
+	client.Close()
+
+	assert.Equal(t, map[string]string{"raft_accepted": "1", "raft_rejected": "2"}, d.stats.Stats())
+}
+
+func TestStreamAuth_Custom(t *testing.T) {
+	ids := newIdentities()
+	handled := make(chan net.Conn, 1)
+	d := &authDispatcher{
+		authorize: func(t yamuxer.StreamType, id Identity) error {
+			return errors.New("denied")
+		},
+		identities: ids,
+		stats:      newStreamStats(),
+		logger:     &log.NullLogger{},
+	}
+	guard := &streamGuard{StreamForward, &funcHandler{handled}, d}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	ids.add(server, Identity{RoleServer, "dc1"})
+	guard.Handle(context.Background(), server)
+	assert.Len(t, handled, 0)
+	assert.Equal(t, "1", d.stats.Stats()["forward_rejected"])
+}
+
+type funcHandler struct {
+	handled chan net.Conn
+}
+
+func (h *funcHandler) Handle(ctx context.Context, conn net.Conn) {
+	h.handled <- conn
+}
+
+func TestStreamAuth_Service(t *testing.T) {
+	ids := newIdentities()
+	handled := make(chan net.Conn, 1)
+	d := &authDispatcher{
+		identities: ids,
+		stats:      newStreamStats(),
+		logger:     &log.NullLogger{},
+	}
+	d.authorize = d.authorizeRoles
+	svc := yamuxer.StreamType(0x20)
+	assert.Nil(t, d.RegisterService(StreamHandler{Type: svc, Name: "svc", Roles: []string{RoleClient}, Handler: &funcHandler{handled}}))
+
+	// Services authorize their own roles
+	assert.Nil(t, d.authorize(svc, Identity{RoleClient, "dc1"}))
+	assert.NotNil(t, d.authorize(svc, Identity{RoleServer, "dc1"}))
+	assert.Nil(t, d.authorize(StreamRaft, Identity{RoleServer, "dc1"}))
+
+	// Streams are dispatched by their first byte
+	client, server := net.Pipe()
+	defer client.Close()
+	ids.add(server, Identity{RoleClient, "dc1"})
+	go client.Write([]byte{byte(svc)})
+	g := grim.ReaperWithContext(context.Background())
+	d.Dispatch(g, server)
+	g.Wait()
+	assert.Len(t, handled, 1)
+	assert.Equal(t, map[string]string{"svc_accepted": "1"}, d.stats.Stats())
+}
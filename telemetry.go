@@ -0,0 +1,331 @@
+package cerebrum
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/armon/go-metrics"
+)
+
+// Every node emits its metrics through its own go-metrics instance. Raft and
+// Serf use the global instance, which a node only replaces if
+// Config.GlobalMetrics is set. Every key is prefixed with MetricsServiceName.
+const (
+	MetricsServiceName = "cerebrum"
+
+	// The in-memory sink aggregates metrics per interval and keeps the
+	// intervals for the retention period.
+	MetricsInterval = 10 * time.Second
+	MetricsRetain   = time.Minute
+)
+
+// Telemetry emits the metrics of a node and holds the sinks which can be read
+// back, e.g. by the HTTP API. A nil Telemetry discards the metrics.
+type Telemetry struct {
+	Inmem *metrics.InmemSink
+
+	// Prometheus is nil unless Config.PrometheusMetrics is set.
+	Prometheus *PrometheusSink
+
+	metrics *metrics.Metrics
+
+	// remote are the statsd and statsite sinks, which are shut down with the
+	// node
+	remote []*remoteSink
+}
+
+// remoteSink discards the metrics once its sink is shut down. The global
+// instance and goroutines still running after Stop may emit to it, which
+// would panic on the closed queue of the sink.
+type remoteSink struct {
+	l      sync.RWMutex
+	closed bool
+	sink   interface {
+		metrics.MetricSink
+		Shutdown()
+	}
+}
+
+func (r *remoteSink) SetGauge(key []string, val float32) {
+	r.l.RLock()
+	if !r.closed {
+		r.sink.SetGauge(key, val)
+	}
+	r.l.RUnlock()
+}
+
+func (r *remoteSink) EmitKey(key []string, val float32) {
+	r.l.RLock()
+	if !r.closed {
+		r.sink.EmitKey(key, val)
+	}
+	r.l.RUnlock()
+}
+
+func (r *remoteSink) IncrCounter(key []string, val float32) {
+	r.l.RLock()
+	if !r.closed {
+		r.sink.IncrCounter(key, val)
+	}
+	r.l.RUnlock()
+}
+
+func (r *remoteSink) AddSample(key []string, val float32) {
+	r.l.RLock()
+	if !r.closed {
+		r.sink.AddSample(key, val)
+	}
+	r.l.RUnlock()
+}
+
+func (r *remoteSink) Shutdown() {
+	r.l.Lock()
+	if !r.closed {
+		r.closed = true
+		r.sink.Shutdown()
+	}
+	r.l.Unlock()
+}
+
+// setupTelemetry creates the configured sinks and the metrics instance of the
+// node. The sinks are also installed as the global metrics instance if
+// Config.GlobalMetrics is set.
+func setupTelemetry(c *Config) (*Telemetry, error) {
+	t := &Telemetry{Inmem: metrics.NewInmemSink(MetricsInterval, MetricsRetain)}
+	sinks := metrics.FanoutSink{t.Inmem}
+
+	if c.StatsdAddr != "" {
+		sink, err := metrics.NewStatsdSink(c.StatsdAddr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to start statsd sink: %v", err)
+		}
+		t.remote = append(t.remote, &remoteSink{sink: sink})
+	}
+	if c.StatsiteAddr != "" {
+		sink, err := metrics.NewStatsiteSink(c.StatsiteAddr)
+		if err != nil {
+			t.Shutdown()
+			return nil, fmt.Errorf("failed to start statsite sink: %v", err)
+		}
+		t.remote = append(t.remote, &remoteSink{sink: sink})
+	}
+	for _, sink := range t.remote {
+		sinks = append(sinks, sink)
+	}
+	if c.PrometheusMetrics {
+		t.Prometheus = NewPrometheusSink()
+		sinks = append(sinks, t.Prometheus)
+	}
+	sinks = append(sinks, c.MetricSinks...)
+
+	conf := metrics.DefaultConfig(MetricsServiceName)
+	conf.HostName = c.NodeName
+	conf.EnableHostname = !c.DisableHostname
+	if c.GlobalMetrics {
+		if _, err := metrics.NewGlobal(conf, sinks); err != nil {
+			t.Shutdown()
+			return nil, err
+		}
+	}
+
+	// The runtime metrics of the process are only collected by the global
+	// instance, whose collector is never stopped
+	conf.EnableRuntimeMetrics = false
+	m, err := metrics.New(conf, sinks)
+	if err != nil {
+		t.Shutdown()
+		return nil, err
+	}
+	t.metrics = m
+	return t, nil
+}
+
+// Shutdown stops the statsd and statsite sinks. Metrics emitted afterwards
+// are only kept in memory.
+func (t *Telemetry) Shutdown() {
+	if t == nil {
+		return
+	}
+	for _, sink := range t.remote {
+		sink.Shutdown()
+	}
+}
+
+// IncrCounter, SetGauge and MeasureSince emit through the metrics instance of
+// the node.
+func (t *Telemetry) IncrCounter(key []string, val float32) {
+	if t != nil {
+		t.metrics.IncrCounter(key, val)
+	}
+}
+
+func (t *Telemetry) SetGauge(key []string, val float32) {
+	if t != nil {
+		t.metrics.SetGauge(key, val)
+	}
+}
+
+func (t *Telemetry) MeasureSince(key []string, start time.Time) {
+	if t != nil {
+		t.metrics.MeasureSince(key, start)
+	}
+}
+
+// PrometheusSink is a metrics.MetricSink which keeps the totals of counters
+// and samples and writes them in the Prometheus text format. Samples are
+// written as summaries without quantiles.
+type PrometheusSink struct {
+	lock     sync.Mutex
+	gauges   map[string]float64
+	counters map[string]float64
+	samples  map[string]*prometheusSummary
+}
+
+type prometheusSummary struct {
+	count uint64
+	sum   float64
+}
+
+// NewPrometheusSink creates an empty PrometheusSink.
+func NewPrometheusSink() *PrometheusSink {
+	return &PrometheusSink{
+		gauges:   make(map[string]float64),
+		counters: make(map[string]float64),
+		samples:  make(map[string]*prometheusSummary),
+	}
+}
+
+func (p *PrometheusSink) SetGauge(key []string, val float32) {
+	p.lock.Lock()
+	p.gauges[prometheusName(key)] = float64(val)
+	p.lock.Unlock()
+}
+
+// EmitKey is ignored since Prometheus has no type for individual values.
+func (p *PrometheusSink) EmitKey(key []string, val float32) {}
+
+func (p *PrometheusSink) IncrCounter(key []string, val float32) {
+	p.lock.Lock()
+	p.counters[prometheusName(key)] += float64(val)
+	p.lock.Unlock()
+}
+
+func (p *PrometheusSink) AddSample(key []string, val float32) {
+	p.lock.Lock()
+	name := prometheusName(key)
+	s, ok := p.samples[name]
+	if !ok {
+		s = &prometheusSummary{}
+		p.samples[name] = s
+	}
+	s.count++
+	s.sum += float64(val)
+	p.lock.Unlock()
+}
+
+// WriteTo writes the metrics in the Prometheus text format, sorted by name.
+func (p *PrometheusSink) WriteTo(w io.Writer) (int64, error) {
+	p.lock.Lock()
+	var lines []string
+	for name, v := range p.gauges {
+		lines = append(lines, fmt.Sprintf("# TYPE %s gauge\n%s %s\n", name, name, formatFloat(v)))
+	}
+	for name, v := range p.counters {
+		lines = append(lines, fmt.Sprintf("# TYPE %s counter\n%s %s\n", name, name, formatFloat(v)))
+	}
+	for name, s := range p.samples {
+		lines = append(lines, fmt.Sprintf("# TYPE %s summary\n%s_sum %s\n%s_count %d\n",
+			name, name, formatFloat(s.sum), name, s.count))
+	}
+	p.lock.Unlock()
+
+	sort.Strings(lines)
+	n, err := io.WriteString(w, strings.Join(lines, ""))
+	return int64(n), err
+}
+
+// prometheusName joins a metric key into a valid Prometheus metric name.
+func prometheusName(key []string) string {
+	name := []byte(strings.Join(key, "_"))
+	for i, b := range name {
+		switch {
+		case b >= 'a' && b <= 'z', b >= 'A' && b <= 'Z', b == '_', b == ':':
+		case b >= '0' && b <= '9' && i > 0:
+		default:
+			name[i] = '_'
+		}
+	}
+	return string(name)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return fmt.Sprintf("%g", v)
+}
+
+// MetricsSummary is the last interval of the in-memory sink.
+type MetricsSummary struct {
+	Timestamp string
+	Gauges    map[string]float32
+	Counters  map[string]SampleSummary
+	Samples   map[string]SampleSummary
+}
+
+// SampleSummary aggregates the values of a counter or sample.
+type SampleSummary struct {
+	Count int
+	Sum   float64
+	Min   float64
+	Max   float64
+	Mean  float64
+}
+
+// Summary returns the most recent interval of the in-memory sink.
+func (t *Telemetry) Summary() *MetricsSummary {
+	summary := &MetricsSummary{
+		Gauges:   make(map[string]float32),
+		Counters: make(map[string]SampleSummary),
+		Samples:  make(map[string]SampleSummary),
+	}
+	data := t.Inmem.Data()
+	if len(data) == 0 {
+		return summary
+	}
+
+	intv := data[len(data)-1]
+	intv.RLock()
+	defer intv.RUnlock()
+	summary.Timestamp = intv.Interval.Round(time.Second).UTC().String()
+	for name, v := range intv.Gauges {
+		summary.Gauges[name] = v
+	}
+	for name, s := range intv.Counters {
+		summary.Counters[name] = sampleSummary(s)
+	}
+	for name, s := range intv.Samples {
+		summary.Samples[name] = sampleSummary(s)
+	}
+	return summary
+}
+
+func sampleSummary(s *metrics.AggregateSample) SampleSummary {
+	return SampleSummary{
+		Count: s.Count,
+		Sum:   s.Sum,
+		Min:   s.Min,
+		Max:   s.Max,
+		Mean:  s.Mean(),
+	}
+}
@@ -0,0 +1,99 @@
+package cerebrum
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/hashicorp/serf/serf"
+	log "github.com/mgutz/logxi/v1"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTelemetry_PrometheusSink(t *testing.T) {
+	sink := NewPrometheusSink()
+	sink.IncrCounter([]string{"cerebrum", "forward", "dials"}, 1)
+	sink.IncrCounter([]string{"cerebrum", "forward", "dials"}, 2)
+	sink.SetGauge([]string{"cerebrum", "n1", "pool", "conns"}, 4)
+	sink.AddSample([]string{"cerebrum", "fsm", "apply", "KVSet"}, 1.5)
+	sink.AddSample([]string{"cerebrum", "fsm", "apply", "KVSet"}, 0.5)
+
+	var buf bytes.Buffer
+	_, err := sink.WriteTo(&buf)
+	assert.Nil(t, err)
+	assert.Equal(t, `# TYPE cerebrum_forward_dials counter
+cerebrum_forward_dials 3
+# TYPE cerebrum_fsm_apply_KVSet summary
+cerebrum_fsm_apply_KVSet_sum 2
+cerebrum_fsm_apply_KVSet_count 2
+# TYPE cerebrum_n1_pool_conns gauge
+cerebrum_n1_pool_conns 4
+`, buf.String())
+}
+
+func TestTelemetry_Reconciler(t *testing.T) {
+	telemetry, err := setupTelemetry(&Config{NodeName: "n1", DisableHostname: true})
+	assert.Nil(t, err)
+
+	r := &Reconciler{make(chan serf.Member, 1), func() bool { return true }, telemetry}
+	r.Reconcile(serf.Member{Name: "a"})
+	r.Reconcile(serf.Member{Name: "b"})
+
+	summary := telemetry.Summary()
+	assert.Equal(t, float32(1), summary.Gauges["cerebrum.reconcile.queue"])
+	assert.Equal(t, 1, summary.Counters["cerebrum.reconcile.dropped"].Count)
+}
+
+func TestTelemetry_MetricSinks(t *testing.T) {
+	inmem := metrics.NewInmemSink(time.Second, time.Minute)
+	telemetry, err := setupTelemetry(&Config{NodeName: "n1", MetricSinks: []metrics.MetricSink{inmem}})
+	assert.Nil(t, err)
+
+	applier := &MockRaftApplier{leader: ""}
+	applier.On("Leader").Return(ErrNoLeader)
+	fwdr := &forwarder{
+		raft:      applier,
+		telemetry: telemetry,
+		logger:    &log.NullLogger{},
+		backoff:   time.Hour,
+	}
+	assert.Equal(t, ErrNoLeader, fwdr.Forward(expiredContext(), nil))
+
+	data := inmem.Data()
+	if assert.Len(t, data, 1) {
+		assert.Equal(t, 1, data[0].Counters["cerebrum.forward.no_leader"].Count)
+	}
+}
+
+func TestTelemetry_PerNode(t *testing.T) {
+	a, err := setupTelemetry(&Config{NodeName: "a", DisableHostname: true})
+	assert.Nil(t, err)
+	b, err := setupTelemetry(&Config{NodeName: "b", DisableHostname: true})
+	assert.Nil(t, err)
+
+	// Each node only receives its own metrics
+	a.IncrCounter([]string{"forward", "dials"}, 1)
+	b.IncrCounter([]string{"forward", "dials"}, 1)
+	b.IncrCounter([]string{"forward", "dials"}, 1)
+	assert.Equal(t, 1, a.Summary().Counters["cerebrum.forward.dials"].Count)
+	assert.Equal(t, 2, b.Summary().Counters["cerebrum.forward.dials"].Count)
+
+	// A nil Telemetry discards metrics
+	var none *Telemetry
+	none.IncrCounter([]string{"forward", "dials"}, 1)
+}
+
+func TestTelemetry_Shutdown(t *testing.T) {
+	telemetry, err := setupTelemetry(&Config{NodeName: "n1", DisableHostname: true, StatsdAddr: "127.0.0.1:8125", StatsiteAddr: "127.0.0.1:8126"})
+	assert.Nil(t, err)
+	assert.Len(t, telemetry.remote, 2)
+
+	// Metrics emitted after the sinks are shut down are dropped
+	telemetry.Shutdown()
+	telemetry.Shutdown()
+	telemetry.IncrCounter([]string{"forward", "dials"}, 1)
+	telemetry.SetGauge([]string{"pool", "conns"}, 1)
+	telemetry.MeasureSince([]string{"fsm", "apply"}, time.Now())
+	assert.Equal(t, 1, telemetry.Summary().Counters["cerebrum.forward.dials"].Count)
+}
@@ -0,0 +1,254 @@
+package cerebrum
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// SpanExporter receives the finished spans of a node.
+type SpanExporter interface {
+	ExportSpan(*Span)
+}
+
+// SpanContext identifies a span across nodes. The IDs are hex encoded and
+// compatible with the W3C traceparent header.
+type SpanContext struct {
+	TraceID string
+	SpanID  string
+}
+
+// Valid reports whether the SpanContext belongs to a trace.
+func (s SpanContext) Valid() bool {
+	return s.TraceID != "" && s.SpanID != ""
+}
+
+// Span is a timed operation of a trace. ParentID is empty for the root span.
+type Span struct {
+	TraceID    string
+	SpanID     string
+	ParentID   string `json:",omitempty"`
+	Name       string
+	Node       string
+	Start      time.Time
+	End        time.Time
+	Attributes map[string]string `json:",omitempty"`
+	Error      string            `json:",omitempty"`
+
+	exporter SpanExporter
+}
+
+// Context returns the SpanContext of the span. It is empty for a nil span.
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return SpanContext{s.TraceID, s.SpanID}
+}
+
+// SetAttribute annotates the span.
+func (s *Span) SetAttribute(key, value string) {
+	if s == nil {
+		return
+	}
+	if s.Attributes == nil {
+		s.Attributes = make(map[string]string)
+	}
+	s.Attributes[key] = value
+}
+
+// Finish ends the span with the result of the operation and exports it.
+func (s *Span) Finish(err error) {
+	if s == nil {
+		return
+	}
+	s.End = time.Now().UTC()
+	if err != nil {
+		s.Error = err.Error()
+	}
+	if s.exporter != nil {
+		s.exporter.ExportSpan(s)
+	}
+}
+
+type spanContextKey struct{}
+
+// ContextWithSpan returns a context whose spans continue the trace of sc.
+func ContextWithSpan(ctx context.Context, sc SpanContext) context.Context {
+	if !sc.Valid() {
+		return ctx
+	}
+	return context.WithValue(ctx, spanContextKey{}, sc)
+}
+
+// SpanFromContext returns the span carried by the context.
+func SpanFromContext(ctx context.Context) (SpanContext, bool) {
+	sc, ok := ctx.Value(spanContextKey{}).(SpanContext)
+	return sc, ok
+}
+
+// Tracer starts the spans of a node. Without an exporter it only continues
+// the traces of its callers, so that nodes which do not export spans still
+// propagate the trace. A nil Tracer does nothing.
+type Tracer struct {
+	node     string
+	exporter SpanExporter
+}
+
+// NewTracer creates a Tracer which exports spans to the exporter, if any.
+func NewTracer(node string, exporter SpanExporter) *Tracer {
+	return &Tracer{node, exporter}
+}
+
+// StartSpan starts a child of the span in the context, or a new trace. It
+// returns a nil span and the context unchanged when there is nothing to
+// trace.
+func (t *Tracer) StartSpan(ctx context.Context, name string) (*Span, context.Context) {
+	parent, _ := SpanFromContext(ctx)
+	span := t.continueSpan(parent, name)
+	if span == nil {
+		return nil, ctx
+	}
+	return span, ContextWithSpan(ctx, span.Context())
+}
+
+// continueSpan starts a child of parent, or a new trace if parent is empty.
+func (t *Tracer) continueSpan(parent SpanContext, name string) *Span {
+	if t == nil || (t.exporter == nil && !parent.Valid()) {
+		return nil
+	}
+	span := &Span{
+		TraceID:  parent.TraceID,
+		SpanID:   randomID(8),
+		ParentID: parent.SpanID,
+		Name:     name,
+		Node:     t.node,
+		Start:    time.Now().UTC(),
+		exporter: t.exporter,
+	}
+	if !parent.Valid() {
+		span.TraceID, span.ParentID = randomID(16), ""
+	}
+	return span
+}
+
+func randomID(n int) string {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		panic(fmt.Errorf("failed to read random bytes: %v", err))
+	}
+	return hex.EncodeToString(buf)
+}
+
+// parseTraceparent reads a W3C traceparent header,
+// e.g. 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01.
+func parseTraceparent(header string) (SpanContext, bool) {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) != 4 || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return SpanContext{}, false
+	}
+	for _, id := range parts[1:3] {
+		if _, err := hex.DecodeString(id); err != nil || strings.Trim(id, "0") == "" {
+			return SpanContext{}, false
+		}
+	}
+	return SpanContext{strings.ToLower(parts[1]), strings.ToLower(parts[2])}, true
+}
+
+// InmemExporter keeps the exported spans in memory.
+type InmemExporter struct {
+	lock  sync.Mutex
+	spans []*Span
+}
+
+func (e *InmemExporter) ExportSpan(s *Span) {
+	e.lock.Lock()
+	e.spans = append(e.spans, s)
+	e.lock.Unlock()
+}
+
+// Spans returns the exported spans in the order they finished.
+func (e *InmemExporter) Spans() []*Span {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return append([]*Span(nil), e.spans...)
+}
+
+// Reset drops the exported spans.
+func (e *InmemExporter) Reset() {
+	e.lock.Lock()
+	e.spans = nil
+	e.lock.Unlock()
+}
+
+// FileExporter appends the spans to a file as JSON, one per line.
+type FileExporter struct {
+	lock sync.Mutex
+	file *os.File
+	enc  *json.Encoder
+}
+
+// NewFileExporter opens or creates the file.
+func NewFileExporter(path string) (*FileExporter, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileExporter{file: file, enc: json.NewEncoder(file)}, nil
+}
+
+// ExportSpan writes the span. Write errors are dropped since tracing must not
+// fail the traced operation.
+func (e *FileExporter) ExportSpan(s *Span) {
+	e.lock.Lock()
+	e.enc.Encode(s)
+	e.lock.Unlock()
+}
+
+// Close closes the file.
+func (e *FileExporter) Close() error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.file.Close()
+}
+
+// spanExporters exports spans to several exporters.
+type spanExporters []SpanExporter
+
+func (s spanExporters) ExportSpan(span *Span) {
+	for _, e := range s {
+		e.ExportSpan(span)
+	}
+}
+
+// setupTracing creates the Tracer of the node from Config.TraceFile and
+// Config.TraceExporter. The file exporter is returned so it can be closed.
+func setupTracing(c *Config) (*Tracer, *FileExporter, error) {
+	var exporters spanExporters
+	var file *FileExporter
+	if c.TraceFile != "" {
+		var err error
+		if file, err = NewFileExporter(c.TraceFile); err != nil {
+			return nil, nil, fmt.Errorf("failed to open trace file: %v", err)
+		}
+		exporters = append(exporters, file)
+	}
+	if c.TraceExporter != nil {
+		exporters = append(exporters, c.TraceExporter)
+	}
+
+	switch len(exporters) {
+	case 0:
+		return NewTracer(c.NodeName, nil), nil, nil
+	case 1:
+		return NewTracer(c.NodeName, exporters[0]), file, nil
+	}
+	return NewTracer(c.NodeName, exporters), file, nil
+}
@@ -0,0 +1,159 @@
+package cerebrum
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	log "github.com/mgutz/logxi/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"golang.org/x/net/context"
+)
+
+func TestTracing_Spans(t *testing.T) {
+	exporter := &InmemExporter{}
+	tracer := NewTracer("n1", exporter)
+
+	root, ctx := tracer.StartSpan(context.Background(), "root")
+	child, _ := tracer.StartSpan(ctx, "child")
+	child.SetAttribute("key", "value")
+	child.Finish(ErrNoLeader)
+	root.Finish(nil)
+
+	spans := exporter.Spans()
+	if assert.Len(t, spans, 2) {
+		assert.Equal(t, "child", spans[0].Name)
+		assert.Equal(t, root.TraceID, spans[0].TraceID)
+		assert.Equal(t, root.SpanID, spans[0].ParentID)
+		assert.Equal(t, ErrNoLeader.Error(), spans[0].Error)
+		assert.Equal(t, "value", spans[0].Attributes["key"])
+		assert.Equal(t, "root", spans[1].Name)
+		assert.Equal(t, "", spans[1].ParentID)
+		assert.Equal(t, "n1", spans[1].Node)
+	}
+	exporter.Reset()
+	assert.Len(t, exporter.Spans(), 0)
+
+	// Without an exporter only the traces of callers are continued
+	quiet := NewTracer("n2", nil)
+	span, _ := quiet.StartSpan(context.Background(), "root")
+	assert.Nil(t, span)
+	span, _ = quiet.StartSpan(ctx, "child")
+	if assert.NotNil(t, span) {
+		assert.Equal(t, root.TraceID, span.TraceID)
+	}
+
+	var none *Tracer
+	span, _ = none.StartSpan(ctx, "child")
+	assert.Nil(t, span)
+	span.Finish(nil)
+}
+
+func TestTracing_Traceparent(t *testing.T) {
+	sc, ok := parseTraceparent("00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01")
+	assert.True(t, ok)
+	assert.Equal(t, SpanContext{"4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7"}, sc)
+
+	for _, header := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-xxf067aa0ba902b7-01",
+	} {
+		_, ok = parseTraceparent(header)
+		assert.False(t, ok, header)
+	}
+}
+
+func TestTracing_Forward(t *testing.T) {
+	tuple, err := newKVSet("key", []byte("value"))
+	assert.Nil(t, err)
+
+	exporter := &InmemExporter{}
+	raftApplier := &MockRaftApplier{state: raft.Follower}
+	raftApplier.On("State").Return(raft.Follower)
+	fwdr := &MockForwarder{}
+	fwdr.On("Forward", mock.Anything).Return()
+	applier := NewApplier(raftApplier, fwdr, &aclResolver{}, "", nil, NewTracer("n1", exporter), nil, &log.NullLogger{}, time.Second)
+
+	ctx := ContextWithSpan(context.Background(), SpanContext{"4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7"})
+	assert.Nil(t, applier.ApplyContext(ctx, tuple))
+
+	spans := exporter.Spans()
+	if !assert.Len(t, spans, 1) {
+		return
+	}
+	assert.Equal(t, "apply", spans[0].Name)
+	assert.Equal(t, "00f067aa0ba902b7", spans[0].ParentID)
+	assert.Equal(t, "follower", spans[0].Attributes["role"])
+
+	// The forwarding frame carries the span of the follower
+	envelope, err := decodeTuple(fwdr.Calls[0].Arguments.Get(0).([]byte))
+	assert.Nil(t, err)
+	msg, err := decodeForward(envelope)
+	assert.Nil(t, err)
+	assert.Equal(t, spans[0].Context(), msg.span)
+}
+
+func TestTracing_LeaderAndFSM(t *testing.T) {
+	tuple, err := newKVSet("key", []byte("value"))
+	assert.Nil(t, err)
+
+	exporter := &InmemExporter{}
+	future := &MockApplyFuture{}
+	future.On("Error").Return(nil)
+	future.On("Response").Return()
+	raftApplier := &MockRaftApplier{state: raft.Leader, future: future}
+	raftApplier.On("State").Return(raft.Leader)
+	raftApplier.On("Apply", mock.Anything, time.Second).Return(future)
+	applier := NewApplier(raftApplier, &MockForwarder{}, &aclResolver{}, "", nil, NewTracer("n1", exporter), nil, &log.NullLogger{}, time.Second)
+	assert.Nil(t, applier.Apply(tuple))
+
+	// The Raft log entry carries the span of the leader's apply
+	data := raftApplier.Calls[1].Arguments.Get(0).([]byte)
+	f := newFSM("", nil, ioutil.Discard)
+	f.tracer = NewTracer("n2", exporter)
+	assert.Nil(t, f.Apply(&raft.Log{Index: 1, Data: data}))
+	assert.Equal(t, []byte("value"), f.state.KVGet("key").Value)
+
+	spans := exporter.Spans()
+	if assert.Len(t, spans, 2) {
+		assert.Equal(t, "apply", spans[0].Name)
+		assert.Equal(t, "", spans[0].ParentID)
+		assert.Equal(t, "fsm.apply", spans[1].Name)
+		assert.Equal(t, "n2", spans[1].Node)
+		assert.Equal(t, spans[0].TraceID, spans[1].TraceID)
+		assert.Equal(t, spans[0].SpanID, spans[1].ParentID)
+		assert.Equal(t, "1", spans[1].Attributes["index"])
+	}
+}
+
+func TestTracing_FileExporter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cerebrum")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "trace.json")
+	tracer, file, err := setupTracing(&Config{NodeName: "n1", TraceFile: path})
+	assert.Nil(t, err)
+	span, _ := tracer.StartSpan(context.Background(), "apply")
+	span.Finish(nil)
+	assert.Nil(t, file.Close())
+
+	f, err := os.Open(path)
+	assert.Nil(t, err)
+	defer f.Close()
+	var exported Span
+	scanner := bufio.NewScanner(f)
+	assert.True(t, scanner.Scan())
+	assert.Nil(t, json.Unmarshal(scanner.Bytes(), &exported))
+	assert.Equal(t, span.TraceID, exported.TraceID)
+	assert.Equal(t, "apply", exported.Name)
+	assert.False(t, scanner.Scan())
+}
@@ -0,0 +1,190 @@
+package cerebrum
+
+import (
+	"bytes"
+	"errors"
+	"math"
+
+	"github.com/blacklabeldata/namedtuple"
+	"github.com/blacklabeldata/xbinary"
+)
+
+// ErrFieldNotSet is returned when reading an optional field which was not
+// written to the tuple.
+var ErrFieldNotSet = errors.New("Field not set")
+
+// ErrInvalidFieldType is returned when the encoded field does not have the
+// expected type.
+var ErrInvalidFieldType = errors.New("Invalid field type")
+
+// encodeTuple encodes the tuple along with its protocol header so that it can
+// be read back with a namedtuple.Decoder.
+func encodeTuple(t namedtuple.Tuple) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := namedtuple.NewEncoder(&buf).Encode(t); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeTuple decodes a single tuple from an encoded buffer.
+func decodeTuple(buf []byte) (namedtuple.Tuple, error) {
+	dec := namedtuple.NewDecoderSize(namedtuple.DefaultRegistry, uint64(len(buf)), bytes.NewReader(buf))
+	return dec.Decode()
+}
+
+// fieldOffset returns the offset of the field's type code in the tuple
+// payload.
+func fieldOffset(t namedtuple.Tuple, field string) (int, error) {
+	offset, err := t.Offset(field)
+	if err != nil {
+		return 0, err
+	}
+	if uint64(offset) == math.MaxUint64 {
+		return 0, ErrFieldNotSet
+	}
+
+	// Every field has a type code followed by at least one byte
+	if offset < 0 || offset+1 >= len(t.Payload()) {
+		return 0, xbinary.ErrOutOfRange
+	}
+	return offset, nil
+}
+
+// readLength reads a length prefixed value starting at the type code. The
+// code is one of four consecutive type codes for 8, 16, 32 and 64 bit lengths.
+func readLength(buf []byte, pos int, base namedtuple.TypeCode) (start, size int, err error) {
+	switch buf[pos] {
+	case byte(base.OpCode):
+		var l uint8
+		l, err = xbinary.LittleEndian.Uint8(buf, pos+1)
+		start, size = pos+2, int(l)
+	case byte(base.OpCode + 1):
+		var l uint16
+		l, err = xbinary.LittleEndian.Uint16(buf, pos+1)
+		start, size = pos+3, int(l)
+	case byte(base.OpCode + 2):
+		var l uint32
+		l, err = xbinary.LittleEndian.Uint32(buf, pos+1)
+		start, size = pos+5, int(l)
+	case byte(base.OpCode + 3):
+		var l uint64
+		l, err = xbinary.LittleEndian.Uint64(buf, pos+1)
+		start, size = pos+9, int(l)
+	default:
+		return 0, 0, ErrInvalidFieldType
+	}
+	if err == nil && start+size > len(buf) {
+		err = xbinary.ErrOutOfRange
+	}
+	return
+}
+
+// tupleString reads a StringField.
+func tupleString(t namedtuple.Tuple, field string) (string, error) {
+	pos, err := fieldOffset(t, field)
+	if err != nil {
+		return "", err
+	}
+	buf := t.Payload()
+	start, size, err := readLength(buf, pos, namedtuple.String8Code)
+	if err != nil {
+		return "", err
+	}
+	return string(buf[start : start+size]), nil
+}
+
+// tupleBytes reads a Uint8ArrayField. The returned slice is a copy.
+func tupleBytes(t namedtuple.Tuple, field string) ([]byte, error) {
+	pos, err := fieldOffset(t, field)
+	if err != nil {
+		return nil, err
+	}
+	buf := t.Payload()
+	start, size, err := readLength(buf, pos, namedtuple.UnsignedByteArray8Code)
+	if err != nil {
+		return nil, err
+	}
+	value := make([]byte, size)
+	copy(value, buf[start:start+size])
+	return value, nil
+}
+
+// tupleUint8 reads a Uint8Field.
+func tupleUint8(t namedtuple.Tuple, field string) (uint8, error) {
+	pos, err := fieldOffset(t, field)
+	if err != nil {
+		return 0, err
+	}
+	buf := t.Payload()
+	if buf[pos] != byte(namedtuple.UnsignedInt8Code.OpCode) {
+		return 0, ErrInvalidFieldType
+	}
+	return xbinary.LittleEndian.Uint8(buf, pos+1)
+}
+
+// tupleInt32 reads an Int32Field, which may have been encoded in fewer bytes.
+func tupleInt32(t namedtuple.Tuple, field string) (int32, error) {
+	pos, err := fieldOffset(t, field)
+	if err != nil {
+		return 0, err
+	}
+	buf := t.Payload()
+	switch buf[pos] {
+	case byte(namedtuple.Int8Code.OpCode):
+		v, err := xbinary.LittleEndian.Uint8(buf, pos+1)
+		return int32(v), err
+	case byte(namedtuple.Int16Code.OpCode):
+		v, err := xbinary.LittleEndian.Uint16(buf, pos+1)
+		return int32(v), err
+	case byte(namedtuple.Int32Code.OpCode):
+		return xbinary.LittleEndian.Int32(buf, pos+1)
+	}
+	return 0, ErrInvalidFieldType
+}
+
+// tupleUint64 reads a Uint64Field, which may have been encoded in fewer bytes.
+func tupleUint64(t namedtuple.Tuple, field string) (uint64, error) {
+	pos, err := fieldOffset(t, field)
+	if err != nil {
+		return 0, err
+	}
+	buf := t.Payload()
+	switch buf[pos] {
+	case byte(namedtuple.UnsignedLong8Code.OpCode):
+		v, err := xbinary.LittleEndian.Uint8(buf, pos+1)
+		return uint64(v), err
+	case byte(namedtuple.UnsignedLong16Code.OpCode):
+		v, err := xbinary.LittleEndian.Uint16(buf, pos+1)
+		return uint64(v), err
+	case byte(namedtuple.UnsignedLong32Code.OpCode):
+		v, err := xbinary.LittleEndian.Uint32(buf, pos+1)
+		return uint64(v), err
+	case byte(namedtuple.UnsignedLong64Code.OpCode):
+		return xbinary.LittleEndian.Uint64(buf, pos+1)
+	}
+	return 0, ErrInvalidFieldType
+}
+
+// tupleInt64 reads an Int64Field, which may have been encoded in fewer bytes.
+func tupleInt64(t namedtuple.Tuple, field string) (int64, error) {
+	pos, err := fieldOffset(t, field)
+	if err != nil {
+		return 0, err
+	}
+	buf := t.Payload()
+	switch buf[pos] {
+	case byte(namedtuple.Long8Code.OpCode):
+		v, err := xbinary.LittleEndian.Uint8(buf, pos+1)
+		return int64(v), err
+	case byte(namedtuple.Long16Code.OpCode):
+		v, err := xbinary.LittleEndian.Uint16(buf, pos+1)
+		return int64(v), err
+	case byte(namedtuple.Long32Code.OpCode):
+		v, err := xbinary.LittleEndian.Uint32(buf, pos+1)
+		return int64(v), err
+	case byte(namedtuple.Long64Code.OpCode):
+		return xbinary.LittleEndian.Int64(buf, pos+1)
+	}
+	return 0, ErrInvalidFieldType
+}
@@ -0,0 +1,67 @@
+package cerebrum
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/blacklabeldata/namedtuple"
+	"github.com/stretchr/testify/assert"
+)
+
+func roundTrip(t *testing.T, tuple namedtuple.Tuple) namedtuple.Tuple {
+	buf, err := encodeTuple(tuple)
+	assert.Nil(t, err)
+
+	decoded, err := decodeTuple(buf)
+	assert.Nil(t, err)
+	return decoded
+}
+
+func TestTuples_NodeStatus(t *testing.T) {
+	for _, port := range []int32{9, 9000, 90000} {
+		builder := namedtuple.NewBuilder(nodeStatus, make([]byte, 512))
+		builder.PutString("ID", "id")
+		builder.PutString("Name", "name")
+		builder.PutString("DataCenter", "dc1")
+		builder.PutUint8("Status", uint8(StatusFailed))
+		builder.PutString("Addr", "127.0.0.1")
+		builder.PutInt32("Port", port)
+		tuple, err := builder.Build()
+		assert.Nil(t, err)
+		tuple = roundTrip(t, tuple)
+
+		name, err := tupleString(tuple, "Name")
+		assert.Nil(t, err)
+		assert.Equal(t, "name", name)
+
+		status, err := tupleUint8(tuple, "Status")
+		assert.Nil(t, err)
+		assert.Equal(t, uint8(StatusFailed), status)
+
+		p, err := tupleInt32(tuple, "Port")
+		assert.Nil(t, err)
+		assert.Equal(t, port, p)
+
+		_, err = tupleString(tuple, "Unknown")
+		assert.Equal(t, namedtuple.ErrFieldDoesNotExist, err)
+
+		_, err = tupleString(tuple, "Port")
+		assert.Equal(t, ErrInvalidFieldType, err)
+	}
+}
+
+func TestTuples_Bytes(t *testing.T) {
+	for _, size := range []int{0, 10, 300, 70000} {
+		value := bytes.Repeat([]byte{0x2a}, size)
+		builder := namedtuple.NewBuilder(kvSet, make([]byte, size+64))
+		builder.PutString("Key", "key")
+		builder.PutUint8Array("Value", value)
+		tuple, err := builder.Build()
+		assert.Nil(t, err)
+		tuple = roundTrip(t, tuple)
+
+		v, err := tupleBytes(tuple, "Value")
+		assert.Nil(t, err)
+		assert.Equal(t, value, v)
+	}
+}
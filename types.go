@@ -3,7 +3,17 @@ package cerebrum
 import "github.com/blacklabeldata/namedtuple"
 
 var (
-	nodeStatus namedtuple.TupleType
+	nodeStatus   namedtuple.TupleType
+	kvSet        namedtuple.TupleType
+	kvDelete     namedtuple.TupleType
+	stateRestore namedtuple.TupleType
+	aclSet       namedtuple.TupleType
+	aclDelete    namedtuple.TupleType
+	forwardReq   namedtuple.TupleType
+	auditEvent   namedtuple.TupleType
+	tracedReq    namedtuple.TupleType
+	forwardAck   namedtuple.TupleType
+	onceReq      namedtuple.TupleType
 )
 
 type NodeStatus uint8
@@ -27,6 +37,98 @@ func init() {
 		namedtuple.Field{"Addr", true, namedtuple.StringField},
 		namedtuple.Field{"Port", true, namedtuple.Int32Field})
 	namedtuple.DefaultRegistry.Register(nodeStatus)
+
+	// Key/value types
+	kvSet = namedtuple.New("cerebrum", "KVSet")
+	kvSet.AddVersion(
+		namedtuple.Field{"Key", true, namedtuple.StringField},
+		namedtuple.Field{"Value", true, namedtuple.Uint8ArrayField})
+	namedtuple.DefaultRegistry.Register(kvSet)
+
+	kvDelete = namedtuple.New("cerebrum", "KVDelete")
+	kvDelete.AddVersion(
+		namedtuple.Field{"Key", true, namedtuple.StringField})
+	namedtuple.DefaultRegistry.Register(kvDelete)
+
+	// Snapshot restore type. The second version replicates a snapshot in
+	// chunks; the FSM collects the chunks of the restore ID and restores the
+	// snapshot with the last one.
+	stateRestore = namedtuple.New("cerebrum", "Restore")
+	stateRestore.AddVersion(
+		namedtuple.Field{"Data", true, namedtuple.Uint8ArrayField})
+	stateRestore.AddVersion(
+		namedtuple.Field{"ID", false, namedtuple.StringField},
+		namedtuple.Field{"Offset", false, namedtuple.Uint64Field},
+		namedtuple.Field{"Last", false, namedtuple.Uint8Field})
+	namedtuple.DefaultRegistry.Register(stateRestore)
+
+	// ACL types. The policy is encoded as JSON.
+	aclSet = namedtuple.New("cerebrum", "ACLSet")
+	aclSet.AddVersion(
+		namedtuple.Field{"ID", true, namedtuple.StringField},
+		namedtuple.Field{"Name", true, namedtuple.StringField},
+		namedtuple.Field{"Management", true, namedtuple.Uint8Field},
+		namedtuple.Field{"Policy", true, namedtuple.Uint8ArrayField})
+	namedtuple.DefaultRegistry.Register(aclSet)
+
+	aclDelete = namedtuple.New("cerebrum", "ACLDelete")
+	aclDelete.AddVersion(
+		namedtuple.Field{"ID", true, namedtuple.StringField})
+	namedtuple.DefaultRegistry.Register(aclDelete)
+
+	// Audit log event. Time is in Unix nanoseconds.
+	auditEvent = namedtuple.New("cerebrum", "AuditEvent")
+	auditEvent.AddVersion(
+		namedtuple.Field{"Time", true, namedtuple.Int64Field},
+		namedtuple.Field{"Kind", true, namedtuple.StringField},
+		namedtuple.Field{"Node", true, namedtuple.StringField},
+		namedtuple.Field{"Subject", true, namedtuple.StringField},
+		namedtuple.Field{"Message", true, namedtuple.StringField})
+	namedtuple.DefaultRegistry.Register(auditEvent)
+
+	// Forwarding envelope carrying the ACL token and the span of an encoded
+	// tuple. The token is empty for anonymous requests and the span IDs are
+	// empty for untraced requests. The ID and sequence number of the second
+	// version ask the leader to acknowledge the apply and to apply retries
+	// once.
+	forwardReq = namedtuple.New("cerebrum", "Forward")
+	forwardReq.AddVersion(
+		namedtuple.Field{"Token", true, namedtuple.StringField},
+		namedtuple.Field{"TraceID", true, namedtuple.StringField},
+		namedtuple.Field{"SpanID", true, namedtuple.StringField},
+		namedtuple.Field{"Data", true, namedtuple.Uint8ArrayField})
+	forwardReq.AddVersion(
+		namedtuple.Field{"ID", false, namedtuple.StringField},
+		namedtuple.Field{"Seq", false, namedtuple.Uint64Field})
+	namedtuple.DefaultRegistry.Register(forwardReq)
+
+	// Acknowledgement of a forward with an ID. The error is empty if the
+	// tuple was applied.
+	forwardAck = namedtuple.New("cerebrum", "ForwardAck")
+	forwardAck.AddVersion(
+		namedtuple.Field{"ID", true, namedtuple.StringField},
+		namedtuple.Field{"Error", true, namedtuple.StringField})
+	namedtuple.DefaultRegistry.Register(forwardAck)
+
+	// Raft log envelope carrying the client ID and sequence number of a
+	// request so the FSM applies its retries once. Time is the leader's
+	// clock in Unix nanoseconds.
+	onceReq = namedtuple.New("cerebrum", "Once")
+	onceReq.AddVersion(
+		namedtuple.Field{"ID", true, namedtuple.StringField},
+		namedtuple.Field{"Seq", true, namedtuple.Uint64Field},
+		namedtuple.Field{"Time", true, namedtuple.Int64Field},
+		namedtuple.Field{"Data", true, namedtuple.Uint8ArrayField})
+	namedtuple.DefaultRegistry.Register(onceReq)
+
+	// Raft log envelope carrying the span of an encoded tuple so the FSM
+	// continues the trace.
+	tracedReq = namedtuple.New("cerebrum", "Traced")
+	tracedReq.AddVersion(
+		namedtuple.Field{"TraceID", true, namedtuple.StringField},
+		namedtuple.Field{"SpanID", true, namedtuple.StringField},
+		namedtuple.Field{"Data", true, namedtuple.Uint8ArrayField})
+	namedtuple.DefaultRegistry.Register(tracedReq)
 }
 
 func (c *cerebrum) updateNodeStatus(details *NodeDetails, status NodeStatus) (err error) {
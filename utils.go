@@ -88,6 +88,9 @@ func GetNodeDetails(m serf.Member) (n *NodeDetails, err error) {
 	// All nodes which have this tag are bootstrapped
 	_, bootstrap := m.Tags["bootstrap"]
 
+	// The Raft port is advertised in the port tag
+	port, _ := strconv.Atoi(m.Tags["port"])
+
 	n = &NodeDetails{
 		Bootstrap:  bootstrap,
 		ID:         m.Tags["id"],
@@ -95,6 +98,7 @@ func GetNodeDetails(m serf.Member) (n *NodeDetails, err error) {
 		Role:       role,
 		DataCenter: dc,
 		Addr:       m.Addr,
+		Port:       port,
 		Services:   services,
 		Status:     m.Status,
 		Tags:       m.Tags,